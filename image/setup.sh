@@ -13,14 +13,26 @@ systemctl daemon-reload
 cat >/usr/local/bin/kutee-start <<EOF 
 #!/bin/bash
 set -e
-minikube start --container-runtime=containerd --docker-opt containerd=/var/run/containerd/containerd.sock
 
-find /kutee/ -name "*.tar" -exec minikube image load {} \;
+# The deployer binds the files in /kutee/ to the measured kernel command line
+expected_digest=\$(sed -n 's/.*kutee\.bundle_digest=\([0-9a-f]*\).*/\1/p' /proc/cmdline)
+if [ -n "\$expected_digest" ]; then
+  actual_digest=\$(cd /kutee && find . -maxdepth 1 -type f -printf '%P\n' | LC_ALL=C sort | xargs -r -d '\n' sha384sum | sha384sum | cut -d' ' -f1)
+  if [ "\$expected_digest" != "\$actual_digest" ]; then
+    echo "kutee bundle digest mismatch: expected \$expected_digest, got \$actual_digest"
+    exit 1
+  fi
+fi
+
+minikube start --container-runtime=containerd --docker-opt containerd=/var/run/containerd/containerd.sock
 
 minikube addons enable gvisor
 
+# Images are assembled from the layer blobs they share and loaded by the orchestrator
 cp /kutee/deployment.yaml /home/tdx/workload.yaml
-cd /home/tdx && kutee-orchestrator --listen-addr 0.0.0.0:8087
+# The sealing root only lives in TD memory, autosecrets change on every boot unless it's fetched
+# from a running instance with --root-source peer
+cd /home/tdx && kutee-orchestrator --listen-addr 0.0.0.0:8087 --images-dir /kutee --image-allowlist /kutee/manifest.json --root-source memory --sealing-identity tdx --tls ratls
 EOF
 chmod +x /usr/local/bin/kutee-start
 
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators when the request has none of their credentials
+	ErrNoCredentials      = errors.New("missing authentication")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+const (
+	MethodBasic  = "basic"
+	MethodBearer = "bearer"
+	MethodMTLS   = "mtls"
+)
+
+// Principal is who made a request
+type Principal struct {
+	Name string
+	// Method is how the principal authenticated
+	Method string
+	Roles  []Role
+	// Scopes, if not nil, limit the permissions of the roles to these
+	Scopes []Permission
+	// TokenID is the id of the token the principal authenticated with, if issued by Tokens
+	TokenID string
+}
+
+// Authenticator finds who made the request from its credentials, it returns ErrNoCredentials if
+// the request has none of the credentials it checks
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Chain tries its authenticators in order, the first that finds its credentials decides
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, authenticator := range c {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// Middleware refuses the requests the authenticator doesn't authenticate, and passes the
+// principal of the others to next in their context
+func Middleware(authenticator Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, err := authenticator.Authenticate(r)
+			if errors.Is(err, ErrNoCredentials) {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				http.Error(w, ErrInvalidCredentials.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFrom returns the principal Middleware authenticated, nil if there's none
+func PrincipalFrom(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// User is the name of the principal who made the request, empty if it isn't authenticated
+func User(r *http.Request) string {
+	if principal := PrincipalFrom(r.Context()); principal != nil {
+		return principal.Name
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Chain(t *testing.T) {
+	chain, err := New(DummyConfig, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+
+	withCert := func(name string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "https://localhost/", nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return r
+	}
+
+	for name, tc := range map[string]struct {
+		request   func() *http.Request
+		principal *Principal
+		err       error
+	}{
+		"none": {
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/", nil) },
+			err:     ErrNoCredentials,
+		},
+		"basic": {
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.SetBasicAuth("test", "test")
+				return r
+			},
+			principal: &Principal{Name: "test", Method: MethodBasic, Roles: []Role{RoleAdmin}},
+		},
+		"basic wrong password": {
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.SetBasicAuth("test", "wrong")
+				return r
+			},
+			err: ErrInvalidCredentials,
+		},
+		"bearer": {
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("Authorization", "Bearer test")
+				return r
+			},
+			principal: &Principal{Name: "test", Method: MethodBearer, Roles: []Role{RoleAdmin}},
+		},
+		"bearer wrong token": {
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("Authorization", "Bearer wrong")
+				return r
+			},
+			err: ErrInvalidCredentials,
+		},
+		"mtls": {
+			request:   func() *http.Request { return withCert("alice") },
+			principal: &Principal{Name: "alice", Method: MethodMTLS},
+		},
+		"mtls without a name": {
+			request: func() *http.Request { return withCert("") },
+			err:     ErrInvalidCredentials,
+		},
+	} {
+		principal, err := chain.Authenticate(tc.request())
+		require.ErrorIs(t, err, tc.err, name)
+		require.Equal(t, tc.principal, principal, name)
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	chain, err := New(DummyConfig, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+
+	handler := Middleware(chain)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(User(r)))
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r.SetBasicAuth("test", "wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r.SetBasicAuth("test", "test")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "test", w.Body.String())
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"net/http"
+
+	"kutee/passwords"
+)
+
+// Basic authenticates users by the passwords of their basic auth
+type Basic struct {
+	passwords *passwords.Verifier
+}
+
+// NewBasic authenticates the users with the PHC strings of their passwords, see passwords.NewVerifier
+func NewBasic(users map[string]string, hasher passwords.Hasher) (*Basic, error) {
+	verifier, err := passwords.NewVerifier(users, hasher)
+	if err != nil {
+		return nil, err
+	}
+	return &Basic{passwords: verifier}, nil
+}
+
+func (b *Basic) Authenticate(r *http.Request) (*Principal, error) {
+	u, p, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	if !b.passwords.Verify(u, p) {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: u, Method: MethodBasic}, nil
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Bearer authenticates users by the tokens in their Authorization: Bearer headers
+type Bearer struct {
+	// digests maps the users to the sha256 of their tokens
+	digests map[string][]byte
+}
+
+// NewBearer authenticates the users with the hex sha256 of their tokens, as TokenDigest returns
+// them. Tokens are random, so unlike passwords they need no salt nor slow hash.
+func NewBearer(tokens map[string]string) (*Bearer, error) {
+	digests := make(map[string][]byte, len(tokens))
+	for user, token := range tokens {
+		digest, err := hex.DecodeString(token)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("user %s: the token digest is not a hex sha256", user)
+		}
+		digests[user] = digest
+	}
+	return &Bearer{digests: digests}, nil
+}
+
+// TokenDigest is the hex sha256 of the token, as NewBearer takes it
+func TokenDigest(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// BearerToken returns the token of the request's Authorization header, if it has one
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+func (b *Bearer) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := BearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	// Every digest is compared, so that the time taken doesn't tell which users have tokens
+	digest := sha256.Sum256([]byte(token))
+	name := ""
+	for user, expected := range b.digests {
+		if subtle.ConstantTimeCompare(digest[:], expected) == 1 {
+			name = user
+		}
+	}
+	if name == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: name, Method: MethodBearer}, nil
+}
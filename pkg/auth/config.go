@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+
+	"kutee/passwords"
+)
+
+type Config struct {
+	// AuthenticatedUsers maps the users to the PHC strings of their passwords, legacy entries are still accepted
+	AuthenticatedUsers map[string]string
+	// PasswordHasher is the scheme new users are hashed with
+	PasswordHasher passwords.Hasher
+	// BearerTokens maps the users to the hex sha256 of their tokens
+	BearerTokens map[string]string
+	// Roles maps the users to their roles
+	Roles map[string][]Role
+	// DefaultRoles are the roles of the users Roles doesn't list
+	DefaultRoles []Role
+	// Tokens, if not nil, also authenticates the tokens it issued
+	Tokens *Tokens
+}
+
+var EmptyConfig Config = Config{
+	AuthenticatedUsers: make(map[string]string),
+	PasswordHasher:     passwords.DefaultHasher,
+	BearerTokens:       make(map[string]string),
+	Roles:              make(map[string][]Role),
+	DefaultRoles:       []Role{},
+}
+
+func (c Config) ParseJSONUsers(jsonConfig []byte) Config {
+	users := make(map[string]string)
+	if err := json.Unmarshal(jsonConfig, &users); err != nil {
+		panic(err)
+	}
+	c.AuthenticatedUsers = users
+	return c
+}
+
+func (c Config) ParseJSONTokens(jsonConfig []byte) Config {
+	tokens := make(map[string]string)
+	if err := json.Unmarshal(jsonConfig, &tokens); err != nil {
+		panic(err)
+	}
+	c.BearerTokens = tokens
+	return c
+}
+
+func (c Config) ParseJSONRoles(jsonConfig []byte) Config {
+	roles := make(map[string][]Role)
+	if err := json.Unmarshal(jsonConfig, &roles); err != nil {
+		panic(err)
+	}
+	c.Roles = roles
+	return c
+}
+
+// dummyHasher is cheap, for tests
+var dummyHasher = passwords.Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// DummyConfig authenticates test:test, and the bearer token "test", as an admin
+var DummyConfig Config = Config{
+	AuthenticatedUsers: map[string]string{
+		"test": mustHash(dummyHasher, "test"),
+	},
+	PasswordHasher: dummyHasher,
+	BearerTokens: map[string]string{
+		"test": TokenDigest("test"),
+	},
+	Roles: map[string][]Role{
+		"test": {RoleAdmin},
+	},
+}
+
+func mustHash(hasher passwords.Hasher, password string) string {
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// New authenticates the users of the config with basic auth, issued or static bearer tokens, or
+// the client certificates the TLS server verified, and gives them their roles
+func New(cfg Config, log *slog.Logger) (Authenticator, error) {
+	basic, err := NewBasic(cfg.AuthenticatedUsers, cfg.PasswordHasher)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the users: %w", err)
+	}
+	if legacy := passwords.LegacyUsers(cfg.AuthenticatedUsers); len(legacy) > 0 {
+		log.Warn("users have legacy password hashes, generate new entries with the cli's user command", "users", legacy)
+	}
+
+	bearer, err := NewBearer(cfg.BearerTokens)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the tokens: %w", err)
+	}
+	if err := CheckRoles(cfg.DefaultRoles); err != nil {
+		return nil, fmt.Errorf("default roles: %w", err)
+	}
+	for user, roles := range cfg.Roles {
+		if err := CheckRoles(roles); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user, err)
+		}
+	}
+
+	if len(cfg.DefaultRoles) == 0 {
+		if roleless := usersWithoutRoles(cfg); len(roleless) > 0 {
+			log.Warn("users have no roles, every request of theirs is refused", "users", roleless)
+		}
+	}
+
+	chain := Chain{basic}
+	if cfg.Tokens != nil {
+		chain = append(chain, cfg.Tokens)
+	}
+	chain = append(chain, bearer, MTLS{})
+
+	return &roleAssigner{
+		authenticator: chain,
+		roles:         cfg.Roles,
+		defaultRoles:  cfg.DefaultRoles,
+	}, nil
+}
+
+// usersWithoutRoles returns the users of the config Roles doesn't list, sorted
+func usersWithoutRoles(cfg Config) []string {
+	users := []string{}
+	for _, names := range []map[string]string{cfg.AuthenticatedUsers, cfg.BearerTokens} {
+		for user := range names {
+			if _, found := cfg.Roles[user]; !found && !slices.Contains(users, user) {
+				users = append(users, user)
+			}
+		}
+	}
+	sort.Strings(users)
+	return users
+}
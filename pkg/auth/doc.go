@@ -0,0 +1,4 @@
+// Package auth authenticates the requests to the APIs of the deployer and the orchestrator, with
+// basic auth, bearer tokens or client certificates, and passes the principal to the handlers in
+// the request context.
+package auth
@@ -0,0 +1,21 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// MTLS authenticates clients by the common name of their certificates. The certificates are
+// verified by the TLS server, whose tls.Config sets ClientAuth and ClientCAs; requests without a
+// verified certificate have no credentials.
+type MTLS struct{}
+
+func (MTLS) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: name, Method: MethodMTLS}, nil
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// Permission is what a route needs of its principals
+type Permission string
+
+const (
+	// PermissionRead lists and inspects deployments, workloads and pods
+	PermissionRead Permission = "read"
+	// PermissionUpload uploads images and bundles
+	PermissionUpload Permission = "upload"
+	// PermissionDeploy deploys uploaded bundles
+	PermissionDeploy Permission = "deploy"
+	// PermissionOperate starts, changes and stops workloads and deployments, and rotates their secrets
+	PermissionOperate Permission = "operate"
+	// PermissionAudit reads the audit log
+	PermissionAudit Permission = "audit"
+	// PermissionRevokeTokens revokes the tokens of any user
+	PermissionRevokeTokens Permission = "revoke_tokens"
+)
+
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleDeployer Role = "deployer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// RolePermissions are the permissions of each role
+var RolePermissions = map[Role][]Permission{
+	RoleViewer:   {PermissionRead},
+	RoleDeployer: {PermissionRead, PermissionUpload, PermissionDeploy},
+	RoleOperator: {PermissionRead, PermissionUpload, PermissionDeploy, PermissionOperate},
+	RoleAdmin:    {PermissionRead, PermissionUpload, PermissionDeploy, PermissionOperate, PermissionAudit, PermissionRevokeTokens},
+}
+
+// CheckRoles returns an error if a role is unknown
+func CheckRoles(roles []Role) error {
+	for _, role := range roles {
+		if _, found := RolePermissions[role]; !found {
+			return fmt.Errorf("unknown role %s", role)
+		}
+	}
+	return nil
+}
+
+// Can reports whether one of the principal's roles has the permission, and its scopes allow it
+func (p *Principal) Can(permission Permission) bool {
+	if p.Scopes != nil && !slices.Contains(p.Scopes, permission) {
+		return false
+	}
+	for _, role := range p.Roles {
+		if slices.Contains(RolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions are the permissions of the principal's roles, within its scopes
+func (p *Principal) Permissions() []Permission {
+	permissions := []Permission{}
+	for _, role := range []Role{RoleViewer, RoleDeployer, RoleOperator, RoleAdmin} {
+		for _, permission := range RolePermissions[role] {
+			if !slices.Contains(permissions, permission) && p.Can(permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions
+}
+
+// roleAssigner gives the principals authenticated their roles
+type roleAssigner struct {
+	authenticator Authenticator
+	roles         map[string][]Role
+	defaultRoles  []Role
+}
+
+func (a *roleAssigner) Authenticate(r *http.Request) (*Principal, error) {
+	principal, err := a.authenticator.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	roles, found := a.roles[principal.Name]
+	if !found {
+		roles = a.defaultRoles
+	}
+	principal.Roles = roles
+	return principal, nil
+}
+
+// Authorize refuses the requests whose principal, as Middleware passes it, doesn't have the permission
+func Authorize(log *slog.Logger, permission Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := PrincipalFrom(r.Context())
+			if principal == nil {
+				http.Error(w, ErrNoCredentials.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			log := log.With("user", principal.Name, "authMethod", principal.Method, "roles", principal.Roles, "permission", permission, "path", r.URL.Path)
+			if !principal.Can(permission) {
+				log.Warn("refused a request the user has no permission for")
+				http.Error(w, fmt.Sprintf("%s lacks the %s permission", principal.Name, permission), http.StatusForbidden)
+				return
+			}
+			log.Debug("authorized request")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
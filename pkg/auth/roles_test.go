@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Authorize(t *testing.T) {
+	cfg := DummyConfig
+	cfg.AuthenticatedUsers = map[string]string{
+		"ci":   mustHash(dummyHasher, "ci"),
+		"test": DummyConfig.AuthenticatedUsers["test"],
+		"anon": mustHash(dummyHasher, "anon"),
+	}
+	cfg.Roles = map[string][]Role{"ci": {RoleDeployer}, "test": {RoleAdmin}}
+	cfg.DefaultRoles = []Role{RoleViewer}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	authenticator, err := New(cfg, log)
+	require.NoError(t, err)
+
+	handler := func(permission Permission) http.Handler {
+		return Middleware(authenticator)(Authorize(log, permission)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	}
+	do := func(user string, permission Permission) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(user, user)
+		w := httptest.NewRecorder()
+		handler(permission).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// CI uploads images, but doesn't start workloads
+	require.Equal(t, http.StatusOK, do("ci", PermissionUpload))
+	require.Equal(t, http.StatusForbidden, do("ci", PermissionOperate))
+	require.Equal(t, http.StatusOK, do("test", PermissionAudit))
+	// Users without roles get the default ones
+	require.Equal(t, http.StatusOK, do("anon", PermissionRead))
+	require.Equal(t, http.StatusForbidden, do("anon", PermissionUpload))
+
+	cfg.Roles = map[string][]Role{"ci": {"superuser"}}
+	_, err = New(cfg, log)
+	require.Error(t, err)
+}
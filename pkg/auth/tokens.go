@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"kutee/statefile"
+)
+
+const MethodToken = "token"
+
+// MaxTokenTTL is the longest a token is valid for
+const MaxTokenTTL = 24 * time.Hour
+
+var (
+	ErrTokenExpired = errors.New("the token expired")
+	ErrTokenRevoked = errors.New("the token was revoked")
+)
+
+// TokenClaims are the claims of the tokens Tokens issues
+type TokenClaims struct {
+	ID      string `json:"jti"`
+	Subject string `json:"sub"`
+	// Scopes limit the permissions of the token to some of its subject's
+	Scopes    []Permission `json:"scope"`
+	IssuedAt  int64        `json:"iat"`
+	ExpiresAt int64        `json:"exp"`
+}
+
+// tokenHeader is the header of every token, the only one accepted
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Tokens issues bearer tokens as JWTs signed with HMAC-SHA256, and authenticates them
+type Tokens struct {
+	key         []byte
+	revocations *Revocations
+}
+
+// GenerateTokenKey returns a new random key to sign tokens with. It's meant to be kept in memory only,
+// so that the tokens it signs are only valid until the server restarts.
+func GenerateTokenKey() ([]byte, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func NewTokens(key []byte, revocations *Revocations) (*Tokens, error) {
+	if len(key) < sha256.Size {
+		return nil, fmt.Errorf("the token key is %d bytes, at least %d are needed", len(key), sha256.Size)
+	}
+	return &Tokens{key: key, revocations: revocations}, nil
+}
+
+// Issue returns a token for subject, limited to the scopes, which expires after ttl
+func (t *Tokens) Issue(subject string, scopes []Permission, ttl time.Duration) (string, TokenClaims, error) {
+	if ttl <= 0 || ttl > MaxTokenTTL {
+		return "", TokenClaims{}, fmt.Errorf("tokens are valid for up to %s", MaxTokenTTL)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", TokenClaims{}, err
+	}
+
+	now := time.Now()
+	claims := TokenClaims{
+		ID:        hex.EncodeToString(id),
+		Subject:   subject,
+		Scopes:    scopes,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", TokenClaims{}, err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(t.sign(signed)), claims, nil
+}
+
+func (t *Tokens) sign(signed string) []byte {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// Verify returns the claims of a token it issued, unless it expired or was revoked
+func (t *Tokens) Verify(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, ErrInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, t.sign(parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidCredentials
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, ErrTokenExpired)
+	}
+	if t.revocations != nil && t.revocations.Revoked(claims.ID) {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, ErrTokenRevoked)
+	}
+	return &claims, nil
+}
+
+// Authenticate authenticates the bearer tokens shaped like JWTs, others have no credentials for it
+func (t *Tokens) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := BearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	claims, err := t.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{Name: claims.Subject, Method: MethodToken, Scopes: claims.Scopes, TokenID: claims.ID}, nil
+}
+
+// Revoke revokes the token with the id
+func (t *Tokens) Revoke(id string) error {
+	if t.revocations == nil {
+		return errors.New("tokens can't be revoked")
+	}
+	return t.revocations.Revoke(id)
+}
+
+// Revocations are the ids of the tokens revoked, kept until the tokens would have expired
+type Revocations struct {
+	path string
+
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// OpenRevocations returns the revocations kept in the file at path, or only in memory if path is empty
+func OpenRevocations(path string) (*Revocations, error) {
+	r := &Revocations{path: path, revoked: make(map[string]time.Time)}
+	if path == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.revoked); err != nil {
+		return nil, fmt.Errorf("could not read the revoked tokens: %w", err)
+	}
+	return r, nil
+}
+
+// Revoke revokes the token with the id. Tokens are valid for MaxTokenTTL at most, the revocation is
+// forgotten after that.
+func (r *Revocations) Revoke(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for revoked, until := range r.revoked {
+		if now.After(until) {
+			delete(r.revoked, revoked)
+		}
+	}
+	r.revoked[id] = now.Add(MaxTokenTTL)
+
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(r.revoked)
+	if err != nil {
+		return err
+	}
+	return statefile.Write(r.path, data)
+}
+
+func (r *Revocations) Revoked(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, revoked := r.revoked[id]
+	return revoked
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Tokens(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	revocations, err := OpenRevocations(path)
+	require.NoError(t, err)
+	tokens, err := NewTokens(key, revocations)
+	require.NoError(t, err)
+
+	token, claims, err := tokens.Issue("ci", []Permission{PermissionUpload}, time.Hour)
+	require.NoError(t, err)
+	verified, err := tokens.Verify(token)
+	require.NoError(t, err)
+	require.Equal(t, claims, *verified)
+
+	_, _, err = tokens.Issue("ci", nil, MaxTokenTTL+time.Second)
+	require.Error(t, err)
+
+	// Tokens are only valid with their signature, and the key
+	parts := strings.Split(token, ".")
+	forged, err := json.Marshal(TokenClaims{ID: claims.ID, Subject: "admin", ExpiresAt: claims.ExpiresAt})
+	require.NoError(t, err)
+	_, err = tokens.Verify(parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2])
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	// such as the one a restarted server generates
+	otherKey, err := GenerateTokenKey()
+	require.NoError(t, err)
+	other, err := NewTokens(otherKey, nil)
+	require.NoError(t, err)
+	_, err = other.Verify(token)
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	expired, err := json.Marshal(TokenClaims{ID: "old", Subject: "ci", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	require.NoError(t, err)
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(expired)
+	_, err = tokens.Verify(signed + "." + base64.RawURLEncoding.EncodeToString(tokens.sign(signed)))
+	require.ErrorIs(t, err, ErrTokenExpired)
+
+	// Revocations are kept across restarts
+	require.NoError(t, tokens.Revoke(claims.ID))
+	revocations, err = OpenRevocations(path)
+	require.NoError(t, err)
+	tokens, err = NewTokens(key, revocations)
+	require.NoError(t, err)
+	_, err = tokens.Verify(token)
+	require.ErrorIs(t, err, ErrTokenRevoked)
+}
+
+func Test_Tokens_Scopes(t *testing.T) {
+	tokens, err := NewTokens([]byte(strings.Repeat("k", 32)), nil)
+	require.NoError(t, err)
+	cfg := DummyConfig
+	cfg.Tokens = tokens
+	authenticator, err := New(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+
+	token, claims, err := tokens.Issue("test", []Permission{PermissionUpload}, time.Hour)
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	principal, err := authenticator.Authenticate(r)
+	require.NoError(t, err)
+	require.Equal(t, "test", principal.Name)
+	require.Equal(t, MethodToken, principal.Method)
+	require.Equal(t, claims.ID, principal.TokenID)
+
+	// The token only has the permissions of its scopes, even though test is an admin
+	require.True(t, principal.Can(PermissionUpload))
+	require.False(t, principal.Can(PermissionOperate))
+	require.Equal(t, []Permission{PermissionUpload}, principal.Permissions())
+
+	// Static tokens are still authenticated
+	r.Header.Set("Authorization", "Bearer test")
+	principal, err = authenticator.Authenticate(r)
+	require.NoError(t, err)
+	require.Equal(t, MethodBearer, principal.Method)
+}
@@ -0,0 +1,343 @@
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"kutee/manifest"
+	"kutee/ociarchive"
+)
+
+// DeploymentFileName is the kubernetes manifest every bundle must contain
+const DeploymentFileName = "deployment.yaml"
+
+type Limits struct {
+	MaxFileSize  int64
+	MaxTotalSize int64
+	MaxFiles     int
+}
+
+// DefaultLimits keep bundles within what the orchestrator accepts
+var DefaultLimits = Limits{
+	MaxFileSize:  ociarchive.MaxSize,
+	MaxTotalSize: ociarchive.MaxSize,
+	MaxFiles:     1024, // layers are stored as separate files
+}
+
+// Error describes why a bundle was rejected. It's the client's fault, and is meant to be returned to them.
+type Error struct {
+	Reason     string   `json:"error"`
+	Missing    []string `json:"missing,omitempty"`
+	Extra      []string `json:"extra,omitempty"`
+	Mismatched []string `json:"mismatched,omitempty"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Reason
+	if len(e.Missing) > 0 {
+		msg += ", missing: " + strings.Join(e.Missing, ", ")
+	}
+	if len(e.Extra) > 0 {
+		msg += ", extra: " + strings.Join(e.Extra, ", ")
+	}
+	if len(e.Mismatched) > 0 {
+		msg += ", mismatched: " + strings.Join(e.Mismatched, ", ")
+	}
+	return msg
+}
+
+// validName matches the names of the files of a bundle. They are passed to the tools installing the
+// files into the image, so they are limited to characters with no meaning to them.
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ValidName tells whether name is allowed for a file of a bundle
+func ValidName(name string) bool {
+	return validName.MatchString(name) && name != "." && name != ".."
+}
+
+func rejectf(format string, args ...any) *Error {
+	return &Error{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Verified is a bundle that passed validation
+type Verified struct {
+	Manifest Manifest
+	// Publisher is the trusted key the bundle is signed with, nil if signatures are not required
+	Publisher ed25519.PublicKey
+}
+
+// Unpack extracts the gzipped tar archive at archivePath into dst and validates its contents.
+// The bundle must contain the deployment.yaml, a tarball for every image it references, and
+// the manifest pinning them, nothing else. See Validate.
+func Unpack(archivePath string, dst string, limits Limits, trustedKeys []ed25519.PublicKey) (*Verified, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files, err := Extract(f, dst, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	return Validate(dst, files, trustedKeys)
+}
+
+// Extract writes the regular files of a gzipped tar archive into dst.
+// The bundle is flat: only top-level regular files are accepted, anything that
+// could escape dst or does not fit the limits rejects the whole archive.
+func Extract(r io.Reader, dst string, limits Limits) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, rejectf("bundle is not gzip compressed: %v", err)
+	}
+	defer gz.Close()
+
+	if err := os.MkdirAll(dst, 0o700); err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	var totalSize int64
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, rejectf("invalid tar archive: %v", err)
+		}
+
+		name, err := entryName(hdr)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue // the archive root
+		}
+
+		if len(files) >= limits.MaxFiles {
+			return nil, rejectf("bundle contains more than %d files", limits.MaxFiles)
+		}
+		if hdr.Size > limits.MaxFileSize {
+			return nil, rejectf("%s is larger than %d bytes", name, limits.MaxFileSize)
+		}
+		totalSize += hdr.Size
+		if totalSize > limits.MaxTotalSize {
+			return nil, rejectf("bundle is larger than %d bytes", limits.MaxTotalSize)
+		}
+
+		if err := writeFile(filepath.Join(dst, name), tr, hdr.Size); err != nil {
+			if errors.Is(err, os.ErrExist) {
+				return nil, rejectf("%s is in the bundle more than once", name)
+			}
+			return nil, err
+		}
+		files = append(files, name)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// entryName returns the cleaned name of a top-level regular file, or an empty name for the archive root
+func entryName(hdr *tar.Header) (string, error) {
+	name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+	if hdr.Typeflag == tar.TypeDir && (name == "." || name == "") {
+		return "", nil
+	}
+
+	if path.IsAbs(hdr.Name) || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "\\") {
+		return "", rejectf("%s points outside of the bundle", hdr.Name)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+	case tar.TypeSymlink, tar.TypeLink:
+		return "", rejectf("%s is a link, links are not allowed", hdr.Name)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return "", rejectf("%s is a device file, device files are not allowed", hdr.Name)
+	case tar.TypeDir:
+		return "", rejectf("%s is a directory, bundles must be flat", hdr.Name)
+	default:
+		return "", rejectf("%s has unsupported type %q", hdr.Name, hdr.Typeflag)
+	}
+
+	if strings.Contains(name, "/") {
+		return "", rejectf("%s is nested, bundles must be flat", hdr.Name)
+	}
+	if !ValidName(name) {
+		return "", rejectf("%q has characters other than letters, digits, '.', '_' and '-'", hdr.Name)
+	}
+
+	return name, nil
+}
+
+func writeFile(dst string, r io.Reader, size int64) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.CopyN(f, r, size); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Validate checks that the extracted files are exactly the deployment.yaml, the archives of the images
+// it references, their layer blobs and the bundle manifest, and that the manifest pins all of them.
+// If trustedKeys are given, the manifest must be signed by one of them.
+func Validate(dir string, files []string, trustedKeys []ed25519.PublicKey) (*Verified, error) {
+	present := make(map[string]bool, len(files))
+	for _, f := range files {
+		if !ValidName(f) {
+			return nil, rejectf("%q has characters other than letters, digits, '.', '_' and '-'", f)
+		}
+		present[f] = true
+	}
+
+	required := []string{DeploymentFileName, ManifestFileName}
+	if len(trustedKeys) > 0 {
+		required = append(required, SignatureFileName)
+	}
+	if missing := missingFiles(present, required); len(missing) > 0 {
+		return nil, &Error{Reason: "bundle is incomplete", Missing: missing}
+	}
+
+	manifestData, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	verified := &Verified{}
+	if len(trustedKeys) > 0 {
+		signature, err := os.ReadFile(filepath.Join(dir, SignatureFileName))
+		if err != nil {
+			return nil, err
+		}
+		publisher, ok := verifySignature(manifestData, signature, trustedKeys)
+		if !ok {
+			return nil, rejectf("%s is not signed by a trusted publisher", ManifestFileName)
+		}
+		verified.Publisher = publisher
+	}
+
+	if err := json.Unmarshal(manifestData, &verified.Manifest); err != nil {
+		return nil, rejectf("invalid %s: %v", ManifestFileName, err)
+	}
+	if verified.Manifest.Version != FormatVersion {
+		return nil, rejectf("unsupported bundle format version %d", verified.Manifest.Version)
+	}
+
+	deployment, err := os.ReadFile(filepath.Join(dir, DeploymentFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := manifest.Images(deployment)
+	if err != nil {
+		return nil, rejectf("invalid %s: %v", DeploymentFileName, err)
+	}
+
+	if !slices.Equal(images, sortedCopy(verified.Manifest.Images)) {
+		return nil, rejectf("images listed in %s do not match %s", ManifestFileName, DeploymentFileName)
+	}
+
+	expected := map[string]bool{DeploymentFileName: true}
+	for _, image := range images {
+		archive := manifest.ArchiveName(image)
+		if !ValidName(archive) {
+			return nil, rejectf("image %q has characters other than letters, digits, '.', '_', '-', '/', ':' and '@'", image)
+		}
+		expected[archive] = true
+		if !present[archive] {
+			continue // reported as missing below
+		}
+
+		// The layers of the image are stored next to it, as blobs shared with the other images
+		layers, err := ociarchive.Layers(filepath.Join(dir, archive))
+		if err != nil {
+			return nil, rejectf("invalid image archive %s: %v", archive, err)
+		}
+		for _, layer := range layers {
+			expected[ociarchive.BlobName(layer)] = true
+		}
+	}
+
+	bundleErr := &Error{Reason: "bundle does not match " + DeploymentFileName}
+	for archive := range expected {
+		if !present[archive] {
+			bundleErr.Missing = append(bundleErr.Missing, archive)
+		}
+	}
+	for _, f := range files {
+		if !expected[f] && f != ManifestFileName && f != SignatureFileName {
+			bundleErr.Extra = append(bundleErr.Extra, f)
+		}
+	}
+	if len(bundleErr.Missing) > 0 || len(bundleErr.Extra) > 0 {
+		sort.Strings(bundleErr.Missing)
+		return nil, bundleErr
+	}
+
+	// Every file, and only those, must be pinned by the manifest
+	pinned := make(map[string]bool, len(verified.Manifest.Files))
+	for _, entry := range verified.Manifest.Files {
+		if !expected[entry.Name] || pinned[entry.Name] {
+			return nil, rejectf("%s lists unexpected file %s", ManifestFileName, entry.Name)
+		}
+		pinned[entry.Name] = true
+
+		actual, err := hashFile(dir, entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		if digest, ok := ociarchive.ParseBlobName(entry.Name); ok && digest != "sha256:"+actual.SHA256 {
+			bundleErr.Mismatched = append(bundleErr.Mismatched, entry.Name)
+		} else if actual != entry {
+			bundleErr.Mismatched = append(bundleErr.Mismatched, entry.Name)
+		}
+	}
+	for archive := range expected {
+		if !pinned[archive] {
+			return nil, rejectf("%s is not listed in %s", archive, ManifestFileName)
+		}
+	}
+	if len(bundleErr.Mismatched) > 0 {
+		bundleErr.Reason = "bundle does not match " + ManifestFileName
+		return nil, bundleErr
+	}
+
+	return verified, nil
+}
+
+func missingFiles(present map[string]bool, required []string) []string {
+	missing := []string{}
+	for _, f := range required {
+		if !present[f] {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+func sortedCopy(s []string) []string {
+	c := append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
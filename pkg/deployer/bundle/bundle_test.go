@@ -0,0 +1,295 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kutee/ociarchive"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testDeployment = `apiVersion: v1
+kind: Pod
+spec:
+  initContainers:
+  - name: init
+    image: init:1.0
+  containers:
+  - name: app
+    image: docker.io/library/app:latest
+---
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: docker.io/library/app:latest
+`
+
+// testImageArchive builds an image archive whose layers are stored as blobs next to it
+func testImageArchive(t *testing.T, name string, layers ...string) []byte {
+	t.Helper()
+
+	descriptors := []map[string]string{}
+	for _, layer := range layers {
+		descriptors = append(descriptors, map[string]string{"digest": "sha256:" + sha256Hex(layer)})
+	}
+	config := `{"name":"` + name + `"}`
+	manifest, err := json.Marshal(map[string]any{
+		"config": map[string]string{"digest": "sha256:" + sha256Hex(config)},
+		"layers": descriptors,
+	})
+	require.NoError(t, err)
+	index, err := json.Marshal(map[string]any{"manifests": []map[string]string{{"digest": "sha256:" + sha256Hex(string(manifest))}}})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"index.json", index},
+		{"blobs/sha256/" + sha256Hex(string(manifest)), manifest},
+		{"blobs/sha256/" + sha256Hex(config), []byte(config)},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.data))}))
+		_, err := tw.Write(f.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func buildArchive(t *testing.T, headers ...*tar.Header) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range headers {
+		content := bytes.Repeat([]byte("x"), int(hdr.Size))
+		if strings.TrimPrefix(hdr.Name, "./") == DeploymentFileName {
+			content = []byte(testDeployment)
+			hdr.Size = int64(len(content))
+		} else if strings.HasSuffix(hdr.Name, ".tar") {
+			content = testImageArchive(t, hdr.Name)
+			hdr.Size = int64(len(content))
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(content)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func Test_Unpack_Valid(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "bundle.tar")
+	require.NoError(t, os.WriteFile(archivePath, buildArchive(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "./" + DeploymentFileName},
+		&tar.Header{Name: "init-1.0.tar", Size: 10},
+		&tar.Header{Name: "docker.io_library_app-latest.tar", Size: 10},
+	), 0o600))
+
+	// Without a manifest the bundle is incomplete
+	dst := t.TempDir()
+	_, err := Unpack(archivePath, dst, DefaultLimits, nil)
+	var bundleErr *Error
+	require.ErrorAs(t, err, &bundleErr)
+	require.Equal(t, []string{ManifestFileName}, bundleErr.Missing)
+
+	files := []string{DeploymentFileName, "docker.io_library_app-latest.tar", "init-1.0.tar"}
+	written, err := WriteManifest(dst, files, testImages, "alice", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{ManifestFileName}, written)
+
+	verified, err := Validate(dst, append(files, written...), nil)
+	require.NoError(t, err)
+	require.Equal(t, "alice", verified.Manifest.Creator)
+	require.Nil(t, verified.Publisher)
+	require.Len(t, verified.Manifest.Files, 3)
+}
+
+func Test_Extract_RejectsUnsafeEntries(t *testing.T) {
+	cases := map[string]*tar.Header{
+		"traversal":  {Name: "../escape.tar", Size: 1},
+		"absolute":   {Name: "/etc/passwd", Size: 1},
+		"symlink":    {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		"hardlink":   {Name: "link", Typeflag: tar.TypeLink, Linkname: DeploymentFileName},
+		"device":     {Name: "dev", Typeflag: tar.TypeChar},
+		"fifo":       {Name: "fifo", Typeflag: tar.TypeFifo},
+		"nested":     {Name: "dir/file.tar", Size: 1},
+		"shell":      {Name: "$(reboot).tar", Size: 1},
+		"separator":  {Name: "a;b.tar", Size: 1},
+		"large file": {Name: "large.bin", Size: 2048},
+	}
+
+	for name, hdr := range cases {
+		t.Run(name, func(t *testing.T) {
+			dst := t.TempDir()
+			archive := buildArchive(t, &tar.Header{Name: DeploymentFileName}, hdr)
+			_, err := Extract(bytes.NewReader(archive), dst, Limits{MaxFileSize: 1024, MaxTotalSize: 4096, MaxFiles: 10})
+
+			var bundleErr *Error
+			require.ErrorAs(t, err, &bundleErr)
+			require.NoFileExists(t, filepath.Join(filepath.Dir(dst), "escape.tar"))
+		})
+	}
+}
+
+func Test_Extract_Limits(t *testing.T) {
+	limits := Limits{MaxFileSize: 1024, MaxTotalSize: 1500, MaxFiles: 2}
+
+	_, err := Extract(bytes.NewReader(buildArchive(t, &tar.Header{Name: "a", Size: 1000}, &tar.Header{Name: "b", Size: 1000})), t.TempDir(), limits)
+	require.ErrorContains(t, err, "bundle is larger than")
+
+	_, err = Extract(bytes.NewReader(buildArchive(t, &tar.Header{Name: "a"}, &tar.Header{Name: "b"}, &tar.Header{Name: "c"})), t.TempDir(), limits)
+	require.ErrorContains(t, err, "more than 2 files")
+
+	_, err = Extract(bytes.NewReader(buildArchive(t, &tar.Header{Name: "a"}, &tar.Header{Name: "./a"})), t.TempDir(), limits)
+	require.ErrorContains(t, err, "more than once")
+
+	_, err = Extract(bytes.NewReader([]byte("not gzip")), t.TempDir(), limits)
+	require.ErrorContains(t, err, "not gzip compressed")
+}
+
+var testImages = []string{"init:1.0", "docker.io/library/app:latest"}
+
+// testBlob is the name of the blob file holding layer
+func testBlob(layer string) string {
+	return ociarchive.BlobName("sha256:" + sha256Hex(layer))
+}
+
+// writeTestBundle writes a complete bundle directory, with two images sharing a layer, and returns its files
+func writeTestBundle(t *testing.T, key ed25519.PrivateKey) (string, []string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	files := []string{DeploymentFileName, "docker.io_library_app-latest.tar", "init-1.0.tar", testBlob("base"), testBlob("app")}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DeploymentFileName), []byte(testDeployment), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker.io_library_app-latest.tar"), testImageArchive(t, "app", "base", "app"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "init-1.0.tar"), testImageArchive(t, "init", "base"), 0o600))
+	for _, layer := range []string{"base", "app"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, testBlob(layer)), []byte(layer), 0o600))
+	}
+
+	written, err := WriteManifest(dir, files, testImages, "alice", key)
+	require.NoError(t, err)
+	return dir, append(files, written...)
+}
+
+func Test_Validate_ReportsMissingAndExtra(t *testing.T) {
+	dir, _ := writeTestBundle(t, nil)
+
+	_, err := Validate(dir, []string{DeploymentFileName, ManifestFileName, "init-1.0.tar", "unreferenced.tar"}, nil)
+	var bundleErr *Error
+	require.ErrorAs(t, err, &bundleErr)
+	require.Equal(t, []string{"docker.io_library_app-latest.tar", testBlob("base")}, bundleErr.Missing)
+	require.Equal(t, []string{"unreferenced.tar"}, bundleErr.Extra)
+
+	_, err = Validate(dir, []string{"init-1.0.tar"}, nil)
+	require.ErrorAs(t, err, &bundleErr)
+	require.Equal(t, []string{DeploymentFileName, ManifestFileName}, bundleErr.Missing)
+}
+
+func Test_Validate_Signature(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPub, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	dir, files := writeTestBundle(t, key)
+	verified, err := Validate(dir, files, []ed25519.PublicKey{otherPub, pub})
+	require.NoError(t, err)
+	require.Equal(t, pub, verified.Publisher)
+
+	// Signed by a key that is not trusted
+	dir, files = writeTestBundle(t, otherKey)
+	_, err = Validate(dir, files, []ed25519.PublicKey{pub})
+	require.ErrorContains(t, err, "not signed by a trusted publisher")
+
+	// Unsigned bundles are rejected once publishers are configured
+	dir, files = writeTestBundle(t, nil)
+	_, err = Validate(dir, files, []ed25519.PublicKey{pub})
+	var bundleErr *Error
+	require.ErrorAs(t, err, &bundleErr)
+	require.Equal(t, []string{SignatureFileName}, bundleErr.Missing)
+}
+
+func Test_Validate_Manifest(t *testing.T) {
+	dir, files := writeTestBundle(t, nil)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, testBlob("base")), []byte("tampered"), 0o600))
+
+	_, err := Validate(dir, files, nil)
+	var bundleErr *Error
+	require.ErrorAs(t, err, &bundleErr)
+	require.Equal(t, []string{testBlob("base")}, bundleErr.Mismatched)
+
+	// Blobs must hold the content their name claims, even if the manifest agrees with them
+	dir, files = writeTestBundle(t, nil)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, testBlob("base")), []byte("tampered"), 0o600))
+	_, err = WriteManifest(dir, files[:5], testImages, "alice", nil)
+	require.NoError(t, err)
+	_, err = Validate(dir, files, nil)
+	require.ErrorAs(t, err, &bundleErr)
+	require.Equal(t, []string{testBlob("base")}, bundleErr.Mismatched)
+
+	// The manifest must agree with the deployment on the images
+	dir, files = writeTestBundle(t, nil)
+	_, err = WriteManifest(dir, files[:5], testImages[:1], "alice", nil)
+	require.NoError(t, err)
+	_, err = Validate(dir, files, nil)
+	require.ErrorContains(t, err, "do not match")
+
+	// Unknown format versions are rejected
+	dir, files = writeTestBundle(t, nil)
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	require.NoError(t, err)
+	data = bytes.Replace(data, []byte(`"version": 1`), []byte(`"version": 2`), 1)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ManifestFileName), data, 0o600))
+	_, err = Validate(dir, files, nil)
+	require.ErrorContains(t, err, "unsupported bundle format version 2")
+}
+
+func Test_Validate_ImageNames(t *testing.T) {
+	// Image references become file names, those a shell would interpret are refused
+	dir, files := writeTestBundle(t, nil)
+	deployment := strings.Replace(testDeployment, "image: init:1.0", "image: init:1.0`reboot`", 1)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DeploymentFileName), []byte(deployment), 0o600))
+	_, err := WriteManifest(dir, files[:5], []string{"init:1.0`reboot`", "docker.io/library/app:latest"}, "alice", nil)
+	require.NoError(t, err)
+
+	_, err = Validate(dir, files, nil)
+	var bundleErr *Error
+	require.ErrorAs(t, err, &bundleErr)
+	require.ErrorContains(t, err, "init:1.0`reboot`")
+
+	_, err = Validate(dir, append(files, "x;y"), nil)
+	require.ErrorAs(t, err, &bundleErr)
+}
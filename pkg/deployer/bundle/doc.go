@@ -0,0 +1,2 @@
+// Package bundle unpacks and validates uploaded deployment bundles.
+package bundle
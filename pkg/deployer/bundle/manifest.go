@@ -0,0 +1,105 @@
+package bundle
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// FormatVersion is the only bundle format version understood by the deployer
+	FormatVersion = 1
+
+	ManifestFileName  = "manifest.json"
+	SignatureFileName = "manifest.json.sig"
+)
+
+// Manifest describes the contents of a bundle. It's signed as a whole,
+// and pins every other file in the bundle by its digest.
+type Manifest struct {
+	Version   int         `json:"version"`
+	Creator   string      `json:"creator"`
+	CreatedAt time.Time   `json:"created_at"`
+	Images    []string    `json:"images"`
+	Files     []FileEntry `json:"files"`
+}
+
+type FileEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// WriteManifest writes the manifest of the files in dir, and its signature if a key is given.
+// It returns the names of the files written, to be archived along with the rest of the bundle.
+func WriteManifest(dir string, files []string, images []string, creator string, key ed25519.PrivateKey) ([]string, error) {
+	m := Manifest{
+		Version:   FormatVersion,
+		Creator:   creator,
+		CreatedAt: time.Now().UTC(),
+		Images:    append([]string{}, images...),
+		Files:     make([]FileEntry, 0, len(files)),
+	}
+	sort.Strings(m.Images)
+
+	for _, name := range files {
+		entry, err := hashFile(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, entry)
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ManifestFileName), data, 0o644); err != nil {
+		return nil, err
+	}
+	written := []string{ManifestFileName}
+
+	if key != nil {
+		signature := ed25519.Sign(key, data)
+		if err := os.WriteFile(filepath.Join(dir, SignatureFileName), signature, 0o644); err != nil {
+			return nil, err
+		}
+		written = append(written, SignatureFileName)
+	}
+
+	return written, nil
+}
+
+func hashFile(dir string, name string) (FileEntry, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return FileEntry{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return FileEntry{}, err
+	}
+
+	return FileEntry{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// verifySignature returns the trusted key the manifest is signed with
+func verifySignature(manifest []byte, signature []byte, trustedKeys []ed25519.PublicKey) (ed25519.PublicKey, bool) {
+	for _, key := range trustedKeys {
+		if ed25519.Verify(key, manifest, signature) {
+			return key, true
+		}
+	}
+	return nil, false
+}
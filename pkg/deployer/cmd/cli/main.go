@@ -1,31 +1,51 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
-	"strings"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"kutee/common"
+	"kutee/manifest"
+	"kutee/ociarchive"
+	"kutee/passwords"
+	"kutee/upload"
+
+	"deployer/bundle"
+	"deployer/httpserver"
+	"deployer/images"
+	"deployer/jobs"
+	"deployer/measurement"
+	"deployer/registry"
 
 	"github.com/urfave/cli/v2" // imports as package "cli"
 )
 
+// The deployer API doesn't issue tokens, only the orchestrator's does: the credentials are sent with
+// every request, best given through the environment rather than the command line
 var flags []cli.Flag = []cli.Flag{
 	&cli.StringFlag{
-		Name:  "username",
-		Value: "test",
-		Usage: "username to authenticate with",
+		Name:    "username",
+		Value:   "test",
+		Usage:   "username to authenticate with",
+		EnvVars: []string{"DEPLOYER_USERNAME"},
 	},
 	&cli.StringFlag{
-		Name:  "password",
-		Value: "test",
-		Usage: "password to authenticate with",
+		Name:    "password",
+		Value:   "test",
+		Usage:   "password to authenticate with",
+		EnvVars: []string{"DEPLOYER_PASSWORD"},
 	},
 	&cli.StringFlag{
 		Name:  "url",
@@ -46,6 +66,48 @@ var tmpBundleDirFlag cli.Flag = &cli.StringFlag{
 	Usage: "path to directory to keep the bundle in",
 }
 
+var signingKeyFlag cli.Flag = &cli.StringFlag{
+	Name:  "signing-key",
+	Value: "",
+	Usage: "path to the PEM encoded ed25519 key to sign the bundle with",
+}
+
+var creatorFlag cli.Flag = &cli.StringFlag{
+	Name:  "creator",
+	Value: os.Getenv("USER"),
+	Usage: "bundle creator recorded in the bundle manifest",
+}
+
+var keyOutFlag cli.Flag = &cli.StringFlag{
+	Name:  "out",
+	Value: "./signing-key.pem",
+	Usage: "path to write the private key to, the public key is written next to it with a .pub suffix",
+}
+
+var imageSourceFlag cli.Flag = &cli.StringSliceFlag{
+	Name:  "image-source",
+	Value: cli.NewStringSlice("docker"),
+	Usage: "where to read images from, tried in order: docker, oci-layout:<dir>, docker-archive:<path>, registry:<host>",
+}
+
+var pollIntervalFlag cli.Flag = &cli.DurationFlag{
+	Name:  "poll-interval",
+	Value: 5 * time.Second,
+	Usage: "how often to poll the deployment status",
+}
+
+var resumeFlag cli.Flag = &cli.BoolFlag{
+	Name:  "resume",
+	Value: false,
+	Usage: "resume the interrupted upload of the last bundle instead of building a new one",
+}
+
+var retriesFlag cli.Flag = &cli.IntFlag{
+	Name:  "retries",
+	Value: 3,
+	Usage: "how many times to retry a chunk of the upload that failed",
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "Deployer cli",
@@ -57,9 +119,22 @@ func main() {
 				Flags: append([]cli.Flag{
 					deploymentFileFlag,
 					tmpBundleDirFlag,
+					imageSourceFlag,
+					signingKeyFlag,
+					creatorFlag,
+					pollIntervalFlag,
+					resumeFlag,
+					retriesFlag,
 				}, flags...),
 				Action: runDeploy,
 			},
+			&cli.Command{
+				Name:   "keygen",
+				Usage:  "Generates an ed25519 key pair for signing bundles",
+				Flags:  []cli.Flag{keyOutFlag},
+				Action: runKeygen,
+			},
+			passwords.UserCommand(),
 		},
 	}
 
@@ -78,131 +153,283 @@ func runDeploy(cCtx *cli.Context) error {
 		Version: common.Version,
 	})
 
+	// Bundles are built anew every time, resume the upload of the last one instead
+	if cCtx.Bool("resume") {
+		if _, err := os.Stat(upload.StatePath("bundle.tar")); err == nil {
+			log.Info("resuming the upload of bundle.tar")
+			return uploadBundle(cCtx, log, "bundle.tar")
+		}
+		log.Info("no upload to resume, building the bundle")
+	}
+
 	// 1. Fetch all images from the deployment file
 	deploymentFileContent, err := os.ReadFile(cCtx.String("deployment-file"))
 	if err != nil {
 		panic(err)
 	}
 
-	images := []string{}
-	for _, line := range strings.Split(string(deploymentFileContent), "\n") {
-		line := strings.TrimSpace(line)
-		if len(line) > 7 && line[0:7] == "image: " {
-			images = append(images, strings.Split(line, " ")[1])
-		}
+	workload, err := manifest.Parse(deploymentFileContent)
+	if err != nil {
+		log.Error("could not parse the deployment file", "err", err)
+		return err
+	}
+
+	referenced_images, err := workload.Images()
+	if err != nil {
+		return err
 	}
 
-	// 2. Copy the deployment file to the bundle directory
+	// 2. Create the bundle directory
 	bundle_dir := cCtx.String("bundle-dir")
 	err = exec.Command("mkdir", "-p", bundle_dir).Run()
 	if err != nil {
 		panic(err)
 	}
 
-	err = exec.Command("cp", cCtx.String("deployment-file"), bundle_dir+"/deployment.yaml").Run()
+	// 3. Export all images to the bundle directory as OCI layouts, pinned by their image ID
+	work_dir, err := os.MkdirTemp("", "kutee-images-")
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer os.RemoveAll(work_dir)
 
-	// 3. Export all images to the bundle directory
+	sources := []images.Source{}
+	for _, spec := range cCtx.StringSlice("image-source") {
+		source, err := images.ParseSource(spec, work_dir)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+
+	// Layers are stored once, next to the image archives, however many images share them
 	image_archives := []string{}
-	for _, image := range images {
-		colon_escaped_image := strings.ReplaceAll(image, ":", "-")
-		image_tar_file := bundle_dir + "/" + colon_escaped_image + ".tar"
-		// TODO: replace also in the deployment file!
+	bundled_images := []string{}
+	blobs := []string{}
+	image_ids := make(map[string]string, len(referenced_images))
+	for _, image := range referenced_images {
+		img, err := images.Resolve(sources, image)
+		if err != nil {
+			log.Error("could not find image", "image", image, "err", err)
+			return err
+		}
 
-		output, err := exec.Command("docker", "image", "save", image, "-o", image_tar_file).CombinedOutput()
+		image_id, err := images.ID(img)
 		if err != nil {
-			fmt.Println(exec.Command("docker", "image", "save", image, "-o", image_tar_file).String())
-			fmt.Println(string(output))
-			panic(err)
+			return err
 		}
-		image_archives = append(image_archives, image_tar_file)
+		image_ids[image] = image_id
 
-		err = exec.Command("sed", "-i", "-e", "s/"+image+"/"+colon_escaped_image+"/", bundle_dir+"/deployment.yaml").Run()
+		image_tar_file := filepath.Join(bundle_dir, manifest.ArchiveName(image_id))
+		if slices.Contains(image_archives, image_tar_file) {
+			continue // another tag of an image that's already bundled
+		}
+
+		image_blobs, err := images.WriteArchive(image_tar_file, bundle_dir, img, image)
 		if err != nil {
-			panic(err)
+			log.Error("could not export image", "image", image, "err", err)
+			return err
+		}
+		for _, blob := range image_blobs {
+			if !slices.Contains(blobs, blob) {
+				blobs = append(blobs, blob)
+			}
 		}
+		image_archives = append(image_archives, image_tar_file)
+		bundled_images = append(bundled_images, image_id)
 	}
 
-	// 4. Tar the bundle and upload to Tstack server
-	files_to_archive := []string{bundle_dir + "/deployment.yaml"}
-	files_to_archive = append(files_to_archive, image_archives...)
+	// The deployment refers to the images by the IDs they are bundled under
+	err = workload.RewriteImages(func(image string) (string, error) {
+		return image_ids[image], nil
+	})
+	if err != nil {
+		return err
+	}
 
-	tar_args := []string{"--create", "-f", "bundle.tar", "-z"}
-	tar_args = append(tar_args, files_to_archive...)
+	rewritten, err := workload.Marshal()
+	if err != nil {
+		return err
+	}
 
-	err = exec.Command("tar", tar_args...).Run()
+	err = os.WriteFile(filepath.Join(bundle_dir, bundle.DeploymentFileName), rewritten, 0o644)
 	if err != nil {
 		panic(err)
 	}
 
-	r, w := io.Pipe()
-	m := multipart.NewWriter(w)
+	// 4. Write the bundle manifest, signed if a key is given
+	// The bundle is flat, all files are archived relative to the bundle directory
+	files_to_archive := []string{bundle.DeploymentFileName}
+	for _, image_archive := range image_archives {
+		files_to_archive = append(files_to_archive, filepath.Base(image_archive))
+	}
+	files_to_archive = append(files_to_archive, blobs...)
 
-	errCh := make(chan error, 1)
-	go func() {
-		defer w.Close()
-		defer m.Close()
-		part, err := m.CreateFormFile("deployment-bundle", "bundle.tar")
+	var bundle_size int64
+	for _, f := range files_to_archive {
+		info, err := os.Stat(filepath.Join(bundle_dir, f))
 		if err != nil {
-			log.Error("could not create multipart reader from file", "err", err)
-			errCh <- err
-			return
+			return err
 		}
-		file, err := os.Open("bundle.tar")
+		bundle_size += info.Size()
+	}
+	if bundle_size > ociarchive.MaxSize {
+		log.Error("bundle is too large", "size", bundle_size, "limit", ociarchive.MaxSize)
+		return fmt.Errorf("bundle is %d bytes, larger than the %d bytes limit", bundle_size, ociarchive.MaxSize)
+	}
+
+	var signing_key ed25519.PrivateKey
+	if path := cCtx.String("signing-key"); path != "" {
+		signing_key, err = bundle.LoadSigningKey(path)
 		if err != nil {
-			log.Error("could not open the file", "err", err)
-			errCh <- err
-			return
-		}
-		defer file.Close()
-		if _, err = io.Copy(part, file); err != nil {
-			log.Error("could not copy part", "err", err)
-			errCh <- err
-			return
-		}
-		errCh <- nil
-	}()
-
-	errCh2 := make(chan error, 1)
-	go func() {
-		client := &http.Client{}
-		req, err := http.NewRequest("POST", cCtx.String("url")+"/api/deploy", r)
+			log.Error("could not load the signing key", "err", err)
+			return err
+		}
+	}
+
+	manifest_files, err := bundle.WriteManifest(bundle_dir, files_to_archive, bundled_images, cCtx.String("creator"), signing_key)
+	if err != nil {
+		log.Error("could not write the bundle manifest", "err", err)
+		return err
+	}
+	files_to_archive = append(files_to_archive, manifest_files...)
+
+	// 5. Tar the bundle and upload to Tstack server
+
+	tar_args := []string{"--create", "-f", "bundle.tar", "-z", "-C", bundle_dir}
+	tar_args = append(tar_args, files_to_archive...)
+
+	err = exec.Command("tar", tar_args...).Run()
+	if err != nil {
+		panic(err)
+	}
+
+	return uploadBundle(cCtx, log, "bundle.tar")
+}
+
+// uploadBundle uploads the bundle in chunks and polls the deployment it starts.
+// An interrupted upload is resumed where it stopped.
+func uploadBundle(cCtx *cli.Context, log *slog.Logger, path string) error {
+	client := &upload.Client{
+		URL: cCtx.String("url") + "/api/uploads",
+		Authorize: func(req *http.Request) {
+			req.SetBasicAuth(cCtx.String("username"), cCtx.String("password"))
+		},
+		Retries: cCtx.Int("retries"),
+		Log:     log,
+	}
+
+	session, digest, err := client.Upload(path)
+	if err != nil {
+		log.Error("could not upload bundle", "err", err)
+		return errors.New("upload failed, rerun with --resume to continue it")
+	}
+
+	res, rb, err := client.Finalize(path, session, digest)
+	if err != nil {
+		log.Error("could not finalize the upload", "err", err)
+		return errors.New("upload failed, rerun with --resume to continue it")
+	}
+	log.With("resp", string(rb)).With("status", res.Status).Info("requested upload")
+
+	if res.StatusCode != http.StatusAccepted {
+		// Rejected bundles come back with the list of missing and extra files
+		return errors.New("deployment rejected: " + res.Status)
+	}
+
+	var deployment httpserver.DeployResponse
+	if err := json.Unmarshal(rb, &deployment); err != nil {
+		return err
+	}
+	if deployment.SHA256 != digest {
+		return errors.New("the deployer received " + deployment.SHA256 + ", expected " + digest)
+	}
+
+	return pollDeployment(cCtx, log, deployment.ID)
+}
+
+func runKeygen(cCtx *cli.Context) error {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	privPEM, pubPEM, err := bundle.EncodeKeyPair(key)
+	if err != nil {
+		return err
+	}
+
+	out := cCtx.String("out")
+	if err := os.WriteFile(out, privPEM, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(out+".pub", pubPEM, 0o644); err != nil {
+		return err
+	}
+
+	fmt.Print(string(pubPEM))
+	return nil
+}
+
+func pollDeployment(cCtx *cli.Context, log *slog.Logger, id string) error {
+	log = log.With("id", id)
+	reported := make(map[string]bool)
+
+	client := &http.Client{}
+	for {
+		req, err := http.NewRequest("GET", cCtx.String("url")+"/api/deployments/"+id, nil)
 		if err != nil {
 			log.Error("could not create request", "err", err)
-			errCh2 <- err
-			return
+			return err
 		}
-		req.Header.Add("Content-Type", m.FormDataContentType())
 		req.SetBasicAuth(cCtx.String("username"), cCtx.String("password"))
 
 		res, err := client.Do(req)
 		if err != nil {
-			log.Error("could not upload bundle", "err", err)
-			errCh2 <- err
-			return
+			log.Error("could not fetch deployment status", "err", err)
+			return err
 		}
 
-		log.With("status", res.Status).Info("requested upload")
-
-		errCh2 <- nil
-	}()
+		rb, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			log.Error("could not read deployment status", "err", err)
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			log.With("resp", string(rb)).With("status", res.Status).Error("could not fetch deployment status")
+			return errors.New("could not fetch deployment status: " + res.Status)
+		}
 
-	mpErr := <-errCh
-	postErr := <-errCh2
+		var deployment registry.Summary
+		if err := json.Unmarshal(rb, &deployment); err != nil {
+			log.Error("could not parse deployment status", "err", err)
+			return err
+		}
 
-	if postErr != nil {
-		log.Error("could not post", "err", postErr)
-	}
+		status := deployment.Job
+		for _, step := range status.Steps {
+			if step.Status.Done() && !reported[step.Name] {
+				reported[step.Name] = true
+				log.With("step", step.Name).With("status", step.Status).Info("deployment progress")
+			}
+		}
 
-	if mpErr != nil {
-		log.Error("could upload multipart", "err", mpErr)
-	}
+		switch status.Status {
+		case jobs.StatusSucceeded:
+			result, _ := json.Marshal(status.Result)
+			log.With("measurement", string(result)).Info("deployment finished")
+			var m measurement.Measurement
+			if err := json.Unmarshal(result, &m); err == nil && !m.Measured {
+				log.Warn("the deployer has no kernel configured, the bundle is not bound to the measurement")
+			}
+			fmt.Println(string(result))
+			return nil
+		case jobs.StatusFailed:
+			log.With("error", status.Error).Error("deployment failed")
+			return errors.New("deployment failed: " + status.Error)
+		}
 
-	if postErr != nil || mpErr != nil {
-		return errors.New("upload failed")
+		time.Sleep(cCtx.Duration("poll-interval"))
 	}
-
-	return nil
 }
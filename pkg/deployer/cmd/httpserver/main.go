@@ -1,15 +1,19 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"kutee/auth"
 	"kutee/common"
 
+	"deployer/bundle"
 	"deployer/httpserver"
+	"deployer/measurement"
 
 	"github.com/google/uuid"
 	"github.com/urfave/cli/v2" // imports as package "cli"
@@ -64,14 +68,58 @@ var flags []cli.Flag = []cli.Flag{
 	&cli.StringFlag{
 		Name:  "runtd",
 		Value: "./run_td.sh",
-		Usage: "path to runtd script to be used",
+		Usage: "path to runtd script to be used, receives TD_IMG and TD_PIDFILE in its environment",
+	},
+	&cli.StringFlag{
+		Name:  "state-dir",
+		Value: "./deployer-state",
+		Usage: "directory to keep the deployment registry and VM images in",
+	},
+	&cli.StringFlag{
+		Name:  "trusted-publishers",
+		Value: "",
+		Usage: "PEM file with the ed25519 public keys bundles must be signed with, unsigned bundles are accepted if not set",
+	},
+	&cli.StringFlag{
+		Name:  "firmware",
+		Value: "./OVMF.fd",
+		Usage: "path to the TDVF firmware the TD is booted with",
+	},
+	&cli.StringFlag{
+		Name:  "kernel",
+		Value: "",
+		Usage: "path to the kernel for direct boot, required to compute RTMR[1] and RTMR[2]",
+	},
+	&cli.StringFlag{
+		Name:  "initrd",
+		Value: "",
+		Usage: "path to the initrd for direct boot",
+	},
+	&cli.StringFlag{
+		Name:  "cmdline",
+		Value: "",
+		Usage: "kernel command line for direct boot",
 	},
 
 	&cli.StringFlag{
 		Name:  "auth",
-		Value: `{"test": "dGVzdOOwxEKY/BwUmvv0yJlvuSQnrkHkZJuTTKSVmRt4UrhV"}`, // test:test
+		Value: `{"test": "$argon2id$v=19$m=19456,t=2,p=1$VR63eVQtSSh7WUhLZkZKRw$fKZsI884LYO/bj+Hob7OwIrX1EoSeac511yfixop3CE"}`, // test:test
 		Usage: "authenticated users",
 	},
+	&cli.StringFlag{
+		Name:  "auth-tokens",
+		Value: `{}`,
+		Usage: "users authenticated by bearer tokens, with the hex sha256 of their tokens",
+	},
+	&cli.StringFlag{
+		Name:  "auth-roles",
+		Value: `{"test": ["admin"]}`,
+		Usage: "roles of the users: viewer, deployer, operator or admin",
+	},
+	&cli.StringSliceFlag{
+		Name:  "auth-default-role",
+		Usage: "roles of the users --auth-roles doesn't list, who are refused every request otherwise",
+	},
 }
 
 func main() {
@@ -101,6 +149,30 @@ func main() {
 				log = log.With("uid", id.String())
 			}
 
+			var trustedPublisherKeys []ed25519.PublicKey
+			if path := cCtx.String("trusted-publishers"); path != "" {
+				keys, err := bundle.LoadTrustedKeys(path)
+				if err != nil {
+					log.Error("could not load trusted publisher keys", "err", err)
+					return err
+				}
+				trustedPublisherKeys = keys
+			} else {
+				log.Warn("no trusted publishers configured, accepting unsigned bundles")
+			}
+
+			if cCtx.String("kernel") == "" {
+				log.Warn("no kernel configured, bundles are not bound to the measurement and deployments report measured: false")
+			}
+
+			authConfig := auth.EmptyConfig.
+				ParseJSONUsers([]byte(cCtx.String("auth"))).
+				ParseJSONTokens([]byte(cCtx.String("auth-tokens"))).
+				ParseJSONRoles([]byte(cCtx.String("auth-roles")))
+			for _, role := range cCtx.StringSlice("auth-default-role") {
+				authConfig.DefaultRoles = append(authConfig.DefaultRoles, auth.Role(role))
+			}
+
 			cfg := &httpserver.HTTPServerConfig{
 				ListenAddr:  listenAddr,
 				MetricsAddr: metricsAddr,
@@ -114,7 +186,16 @@ func main() {
 
 				BaseImagePath:   cCtx.String("baseimage"),
 				RunTdScriptPath: cCtx.String("runtd"),
-				Auth:            httpserver.EmptyAuthConfig.ParseJSONUsers([]byte(cCtx.String("auth"))),
+				StateDir:        cCtx.String("state-dir"),
+				Auth:            authConfig,
+
+				TrustedPublisherKeys: trustedPublisherKeys,
+				TDInputs: measurement.Inputs{
+					FirmwarePath: cCtx.String("firmware"),
+					KernelPath:   cCtx.String("kernel"),
+					InitrdPath:   cCtx.String("initrd"),
+					Cmdline:      cCtx.String("cmdline"),
+				},
 			}
 
 			srv, err := httpserver.New(cfg)
@@ -1,107 +1,138 @@
 package httpserver
 
 import (
-	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
+
+	"deployer/bundle"
+	"deployer/jobs"
+	"deployer/measurement"
+	"deployer/registry"
+	"kutee/upload"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 )
 
 type DeployerAPI struct {
 	BaseImagePath   string
 	RunTdScriptPath string
+	StateDir        string
+	TDInputs        measurement.Inputs
+	// TrustedPublisherKeys, if not empty, only allows bundles signed by one of the keys
+	TrustedPublisherKeys []ed25519.PublicKey
 
-	AuthenticatedUsers []BasicAuth
-	PasswordHasher     func(string) []byte
+	jobs     *jobs.Runner
+	registry *registry.Registry
+	uploads  *upload.Store
 
 	log *slog.Logger
 }
 
-func NewDeployerAPI(baseImagePath string, runTdScriptPath string, authorizedUsers map[string][]byte, pwHasher func(string) []byte, log *slog.Logger) *DeployerAPI {
-	api := &DeployerAPI{
-		BaseImagePath:      baseImagePath,
-		RunTdScriptPath:    runTdScriptPath,
-		AuthenticatedUsers: make([]BasicAuth, 0, len(authorizedUsers)),
-		PasswordHasher:     pwHasher,
-		log:                log,
-	}
-	for u, ph := range authorizedUsers {
-		api.AuthenticatedUsers = append(api.AuthenticatedUsers, BasicAuth{u, ph})
+func NewDeployerAPI(baseImagePath string, runTdScriptPath string, stateDir string, tdInputs measurement.Inputs, trustedPublisherKeys []ed25519.PublicKey, log *slog.Logger) (*DeployerAPI, error) {
+	deploymentRegistry, err := registry.Open(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the deployment registry: %w", err)
 	}
-	return api
-}
 
-type BasicAuth struct {
-	Username     string
-	PasswordHash []byte
-}
+	api := &DeployerAPI{
+		BaseImagePath:        baseImagePath,
+		RunTdScriptPath:      runTdScriptPath,
+		StateDir:             stateDir,
+		TDInputs:             tdInputs,
+		TrustedPublisherKeys: trustedPublisherKeys,
+		registry:             deploymentRegistry,
+		uploads:              upload.NewStore(filepath.Join(stateDir, "uploads"), MaxImageSize, UploadQuota),
+		log:                  log,
+	}
+	api.jobs = jobs.NewRunner(log, api.recordJobUpdate)
 
-func (s *DeployerAPI) AuthenticateAndHandle(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		u, p, ok := r.BasicAuth()
-		if !ok {
-			http.Error(w, "missing authentication", http.StatusUnauthorized)
-			return
+	// Jobs do not survive a restart, mark the ones that were in flight as failed
+	for _, d := range deploymentRegistry.List() {
+		if d.Job.Status.Done() {
+			continue
+		}
+		api.removeWorkspace(d.ID)
+		err := deploymentRegistry.Update(d.ID, func(d *registry.Deployment) {
+			d.Job.Status = jobs.StatusFailed
+			d.Job.Error = "interrupted by deployer restart"
+			d.Job.UpdatedAt = time.Now()
+		})
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		ph := s.PasswordHasher(p)
+	return api, nil
+}
 
-		for _, authenticatedUser := range s.AuthenticatedUsers {
-			if authenticatedUser.Username == u {
-				if bytes.Equal(authenticatedUser.PasswordHash, ph) {
-					handler(w, r)
-					return
-				}
-			}
-		}
+func (s *DeployerAPI) recordJobUpdate(snapshot jobs.Snapshot) {
+	err := s.registry.Update(snapshot.ID, func(d *registry.Deployment) {
+		d.Job = snapshot
+	})
+	if err != nil {
+		s.log.Error("could not record deployment progress", "id", snapshot.ID, "err", err)
+	}
 
-		http.Error(w, "", http.StatusUnauthorized)
+	// Failed deployments are kept in the registry for inspection, but not their files
+	if snapshot.Status == jobs.StatusFailed {
+		s.removeWorkspace(snapshot.ID)
 	}
 }
 
+// Shutdown cancels the in-flight deployments
+func (s *DeployerAPI) Shutdown() {
+	s.jobs.Shutdown()
+}
+
 const MaxImageSize = 1024 * 1024 * 500 // 500MiB
+
+// UploadQuota is how many bytes of uploads each user can have in progress
+const UploadQuota = 4 * MaxImageSize
+
 func (s *DeployerAPI) deploy(w http.ResponseWriter, r *http.Request) {
-	// Adjusted from https://github.com/Freshman-tech/file-upload/commit/f1638a7d39057122f97dd015bb1f5f3cda196ac0 (MIT)
+	// The bundle streams straight into the workspace, hashed on the way
 	r.Body = http.MaxBytesReader(w, r.Body, MaxImageSize)
-	if err := r.ParseMultipartForm(MaxImageSize); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// The argument to FormFile must match the name attribute
-	// of the file input on the frontend
-	file, fileHeader, err := r.FormFile("deployment-bundle")
+	part, err := upload.FormFile(r, "deployment-bundle")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if filepath.Ext(fileHeader.Filename) != ".tar" {
+	defer part.Close()
+
+	bundleName := filepath.Base(part.FileName())
+	if filepath.Ext(bundleName) != ".tar" {
 		http.Error(w, "only .tar archives are supported", http.StatusBadRequest)
 		return
 	}
 
-	defer file.Close()
-
-	// Create the uploads folder if it doesn't
-	// already exist
-	tmpDir := os.TempDir()
-	err = os.MkdirAll(tmpDir, os.ModePerm)
-	if err != nil {
-		s.log.Error("could not create temp dir", "err", err)
-		http.Error(w, "could not create temp dir", http.StatusInternalServerError)
+	// Every deployment gets its own workspace, removed if the deployment fails
+	id := uuid.Must(uuid.NewRandom()).String()
+	workspace, ok := s.createWorkspace(w, id)
+	if !ok {
 		return
 	}
-	// TODO: cleanup the temp dir!
 
-	fmt.Println(tmpDir)
+	submitted := false
+	defer func() {
+		if !submitted {
+			s.removeWorkspace(id)
+		}
+	}()
 
-	// Create a new file in the uploads directory
-	bundlePath := tmpDir + "/bundle.tar"
+	// Create a new file in the workspace
+	bundlePath := filepath.Join(workspace, "bundle.tar")
 	dst, err := os.Create(bundlePath)
 	if err != nil {
 		s.log.Error("could not create bundle file", "err", err)
@@ -111,60 +142,299 @@ func (s *DeployerAPI) deploy(w http.ResponseWriter, r *http.Request) {
 
 	defer dst.Close()
 
-	// Copy the uploaded file to the filesystem
-	// at the specified destination
-	_, err = io.Copy(dst, file)
+	_, bundleSHA256, err := upload.Copy(dst, part)
 	if err != nil {
+		s.log.Error("could not save bundle file", "err", err)
+		http.Error(w, "could not save bundle file: "+err.Error(), upload.CopyStatus(err))
+		return
+	}
+
+	if err := dst.Close(); err != nil {
 		s.log.Error("could not save bundle file", "err", err)
 		http.Error(w, "could not save bundle file", http.StatusInternalServerError)
 		return
 	}
 
+	submitted = s.submitBundle(w, id, bundleName, bundleSHA256)
+}
+
+func (s *DeployerAPI) createWorkspace(w http.ResponseWriter, id string) (string, bool) {
+	workspace := s.workspacePath(id)
+	if err := os.MkdirAll(workspace, 0o700); err != nil {
+		s.log.Error("could not create workspace", "err", err)
+		http.Error(w, "could not create workspace", http.StatusInternalServerError)
+		return "", false
+	}
+	return workspace, true
+}
+
+// submitBundle unpacks the bundle saved in the workspace of the deployment and submits its job.
+// It responds to the request either way, and reports whether the deployment was submitted.
+func (s *DeployerAPI) submitBundle(w http.ResponseWriter, id string, bundleName string, bundleSHA256 string) bool {
+	workspace := s.workspacePath(id)
+	bundlePath := filepath.Join(workspace, "bundle.tar")
+
 	// 1. Unpack the bundle archive
-	err = exec.Command("tar", "-x", "-z", "-f", bundlePath, "-C", tmpDir).Run()
-	if err != nil {
+	// 2. Make sure the archive contains the kubernetes deployment.yaml and container images
+	// The bundle manifest and its signature are verified before the base image is touched
+	verified, err := bundle.Unpack(bundlePath, filepath.Join(workspace, "bundle"), bundle.DefaultLimits, s.TrustedPublisherKeys)
+	var bundleErr *bundle.Error
+	if errors.As(err, &bundleErr) {
+		s.log.Info("rejected invalid bundle", "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		if err := json.NewEncoder(w).Encode(bundleErr); err != nil {
+			s.log.Error("could not write the response", "err", err)
+		}
+		return false
+	} else if err != nil {
 		s.log.Error("could not unpack bundle", "err", err)
 		http.Error(w, "could not unpack bundle", http.StatusInternalServerError)
+		return false
+	}
+
+	steps := s.deploymentSteps(workspace)
+	err = s.registry.Create(registry.Deployment{
+		ID:           id,
+		CreatedAt:    time.Now(),
+		BundleName:   bundleName,
+		BundleSHA256: bundleSHA256,
+		Creator:      verified.Manifest.Creator,
+		Publisher:    hex.EncodeToString(verified.Publisher),
+		Workspace:    workspace,
+		VMImagePath:  filepath.Join(workspace, "image.qcow2"),
+		Job:          jobs.NewSnapshot(id, steps),
+	})
+	if err != nil {
+		s.log.Error("could not register the deployment", "err", err)
+		http.Error(w, "could not register the deployment", http.StatusInternalServerError)
+		return false
+	}
+
+	s.jobs.Submit(id, steps)
+	s.log.Info("submitted deployment", "id", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(DeployResponse{ID: id, SHA256: bundleSHA256}); err != nil {
+		s.log.Error("could not write the response", "err", err)
+	}
+	return true
+}
+
+func (s *DeployerAPI) createUpload(w http.ResponseWriter, r *http.Request) {
+	s.uploads.HandleCreate(w, r)
+}
+
+func (s *DeployerAPI) getUpload(w http.ResponseWriter, r *http.Request) {
+	s.uploads.HandleStatus(w, r, chi.URLParam(r, "id"))
+}
+
+func (s *DeployerAPI) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	s.uploads.HandleChunk(w, r, chi.URLParam(r, "id"))
+}
+
+// finalizeUpload deploys a bundle uploaded in chunks, the same as if it was posted to deploy
+func (s *DeployerAPI) finalizeUpload(w http.ResponseWriter, r *http.Request) {
+	uploadID := chi.URLParam(r, "id")
+	session, dataPath, ok := s.uploads.ParseFinalize(w, r, uploadID)
+	if !ok {
 		return
 	}
 
-	// 2. Make sure the archive contains the kubernetes deployment.yaml and container images
+	if filepath.Ext(session.Filename) != ".tar" {
+		http.Error(w, "only .tar archives are supported", http.StatusBadRequest)
+		return
+	}
 
-	// 3. Copy the base VM image
-	vmImage := tmpDir + "/image.qcow2"
+	id := uuid.Must(uuid.NewRandom()).String()
+	workspace, ok := s.createWorkspace(w, id)
+	if !ok {
+		return
+	}
 
-	err = exec.Command("cp", s.BaseImagePath, vmImage).Run()
-	if err != nil {
-		s.log.Error("could not copy the baseimage", "err", err)
-		http.Error(w, "could not copy the baseimage", http.StatusInternalServerError)
+	if err := os.Rename(dataPath, filepath.Join(workspace, "bundle.tar")); err != nil {
+		s.log.Error("could not move the uploaded bundle", "err", err)
+		http.Error(w, "could not save bundle file", http.StatusInternalServerError)
+		s.removeWorkspace(id)
 		return
 	}
+	if err := s.uploads.Remove(uploadID); err != nil {
+		s.log.Error("could not remove the upload", "upload", uploadID, "err", err)
+	}
+
+	if !s.submitBundle(w, id, session.Filename, session.SHA256) {
+		s.removeWorkspace(id)
+	}
+}
+
+type DeployResponse struct {
+	ID string `json:"id"`
+	// SHA256 of the bundle as received
+	SHA256 string `json:"sha256"`
+}
+
+const (
+	StepUploaded       = "uploaded"
+	StepUnpacked       = "unpacked"
+	StepImageCopied    = "image_copied"
+	StepFilesInstalled = "files_installed"
+	StepMeasured       = "measured"
+	StepVMStarted      = "vm_started"
+)
+
+// deploymentSteps returns the pipeline turning an unpacked bundle into a running TD.
+// The job's result is the TD measurement.
+func (s *DeployerAPI) deploymentSteps(workspace string) []jobs.Step {
+	bundleDir := filepath.Join(workspace, "bundle")
+	vmImage := filepath.Join(workspace, "image.qcow2")
+	pidFile := filepath.Join(workspace, "td.pid")
+	var tdMeasurement *measurement.Measurement
+
+	return []jobs.Step{
+		{Name: StepUploaded},
+		{Name: StepUnpacked},
+		{Name: StepImageCopied, Run: func(ctx context.Context, job *jobs.Job) error {
+			// 3. Copy the base VM image
+			err := exec.CommandContext(ctx, "cp", s.BaseImagePath, vmImage).Run()
+			if err != nil {
+				return fmt.Errorf("could not copy the baseimage: %w", err)
+			}
+			return nil
+		}},
+		{Name: StepFilesInstalled, Run: func(ctx context.Context, job *jobs.Job) error {
+			// 4. Install the unpacked files into the image, one at a time and without a shell
+			entries, err := os.ReadDir(bundleDir)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if !entry.Type().IsRegular() || !bundle.ValidName(entry.Name()) {
+					return fmt.Errorf("refusing to install %q into the baseimage", entry.Name())
+				}
+				cmd := exec.CommandContext(ctx, "sudo", "virt-customize", "-a", vmImage, "--copy-in", filepath.Join(bundleDir, entry.Name())+":/kutee/")
+				output, err := cmd.CombinedOutput()
+				if err != nil {
+					s.log.With("cmd", cmd.String()).With("output", string(output)).Error("could not install a file into the baseimage", "err", err)
+					return fmt.Errorf("could not install %s into the baseimage: %w", entry.Name(), err)
+				}
+			}
+			s.log.With("files", len(entries)).Info("installed files into the image")
+			return nil
+		}},
+		{Name: StepMeasured, Run: func(ctx context.Context, job *jobs.Job) error {
+			// 5. Take the measurement of the image
+			bundleDigest, err := measurement.BundleDigest(bundleDir)
+			if err != nil {
+				return fmt.Errorf("could not digest the bundle: %w", err)
+			}
+
+			tdMeasurement, err = measurement.Measure(s.TDInputs, bundleDigest)
+			if err != nil {
+				return fmt.Errorf("could not measure the image: %w", err)
+			}
+			s.log.With("measurement", tdMeasurement).Info("measured the image")
+
+			// 7. Return the measurement as the job's result
+			job.SetResult(tdMeasurement)
+			return nil
+		}},
+		{Name: StepVMStarted, Run: func(ctx context.Context, job *jobs.Job) error {
+			// 6. Start the VM
+			cmd := exec.CommandContext(ctx, "bash", s.RunTdScriptPath)
+			cmd.Env = os.Environ()
+			cmd.Env = append(cmd.Env, "TD_IMG="+vmImage, "TD_FIRMWARE="+s.TDInputs.FirmwarePath, "TD_PIDFILE="+pidFile)
+			if s.TDInputs.KernelPath != "" {
+				cmd.Env = append(cmd.Env, "TD_KERNEL="+s.TDInputs.KernelPath, "TD_INITRD="+s.TDInputs.InitrdPath, "TD_CMDLINE="+tdMeasurement.Cmdline)
+			}
+			output, err := cmd.CombinedOutput()
+			if err != nil {
+				s.log.With("output", output).Error("could not run the image", "err", err)
+				return fmt.Errorf("could not run the image: %w", err)
+			}
+			s.log.With("output", output).Info("Running TD")
+
+			pid, err := readPidFile(pidFile)
+			if err != nil {
+				s.log.Warn("could not read the VMM pid, the TD will be looked up by its image on teardown", "err", err)
+				return nil
+			}
+			return s.registry.Update(job.ID(), func(d *registry.Deployment) {
+				d.Pid = pid
+			})
+		}},
+	}
+}
+
+func (s *DeployerAPI) workspacePath(id string) string {
+	return filepath.Join(s.StateDir, "workspaces", id)
+}
+
+func (s *DeployerAPI) removeWorkspace(id string) {
+	if err := os.RemoveAll(s.workspacePath(id)); err != nil {
+		s.log.Error("could not remove workspace", "id", id, "err", err)
+	}
+}
+
+func (s *DeployerAPI) listDeployments(w http.ResponseWriter, r *http.Request) {
+	deployments := s.registry.List()
+	summaries := make([]registry.Summary, len(deployments))
+	for i, d := range deployments {
+		summaries[i] = d.Summary()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summaries); err != nil {
+		s.log.Error("could not write the response", "err", err)
+	}
+}
 
-	// 4. Install the unpacked files into the image
-	cmd := exec.Command("find", tmpDir+"/bundle/", "-type", "f", "-exec", "sh", "-c", "sudo virt-customize -a "+vmImage+" --copy-in {}:/kutee/", ";")
-	output, err := cmd.CombinedOutput()
+func (s *DeployerAPI) getDeployment(w http.ResponseWriter, r *http.Request) {
+	deployment, err := s.registry.Get(chi.URLParam(r, "id"))
 	if err != nil {
-		s.log.With("cmd", cmd.String()).With("output", output).Error("could not load images into the baseimage", "err", err)
-		http.Error(w, "could not load images into the baseimage", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	s.log.With("cmd", cmd.String()).With("output", string(output)).Info("installed files into the image")
 
-	// 5. Take the measurement of the image
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deployment.Summary()); err != nil {
+		s.log.Error("could not write the response", "err", err)
+	}
+}
 
-	// 6. Start the VM
-	cmd = exec.Command("bash", s.RunTdScriptPath)
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "TD_IMG="+vmImage)
-	output, err = cmd.CombinedOutput()
+// deleteDeployment stops the TD and removes everything the deployment left on disk
+func (s *DeployerAPI) deleteDeployment(w http.ResponseWriter, r *http.Request) {
+	deployment, err := s.registry.Get(chi.URLParam(r, "id"))
 	if err != nil {
-		s.log.With("output", output).Error("could not run the image", "err", err)
-		http.Error(w, "could not run the image", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !deployment.Job.Status.Done() {
+		http.Error(w, "deployment is in progress", http.StatusConflict)
+		return
+	}
+
+	// The deployment is kept until its TD is known to be stopped, so that it can be retried
+	log := s.log.With("id", deployment.ID)
+	if err := stopTD(deployment.Pid, deployment.VMImagePath); err != nil {
+		log.Error("could not stop the TD", "pid", deployment.Pid, "err", err)
+		http.Error(w, "could not confirm the TD is stopped", http.StatusInternalServerError)
 		return
 	}
-	s.log.With("output", output).Info("Running TD")
 
-	// 7. Return the measurement
+	if err := os.RemoveAll(s.workspacePath(deployment.ID)); err != nil {
+		log.Error("could not remove the workspace", "err", err)
+		http.Error(w, "could not remove the workspace", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.registry.Delete(deployment.ID); err != nil && !errors.Is(err, registry.ErrNotFound) {
+		log.Error("could not remove the deployment", "err", err)
+		http.Error(w, "could not remove the deployment", http.StatusInternalServerError)
+		return
+	}
 
+	log.Info("deployment removed")
 	w.WriteHeader(http.StatusOK)
 }
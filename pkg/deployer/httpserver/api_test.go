@@ -0,0 +1,323 @@
+package httpserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"deployer/bundle"
+	"deployer/jobs"
+	"deployer/measurement"
+	"deployer/registry"
+
+	"kutee/auth"
+	"kutee/manifest"
+	"kutee/upload"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestFirmware writes a minimal TDVF image with a single measured page
+func writeTestFirmware(t *testing.T, path string) {
+	t.Helper()
+
+	fw := make([]byte, 3*4096)
+	metadata := 4096
+	copy(fw[metadata:], "TDVF")
+	binary.LittleEndian.PutUint32(fw[metadata+12:], 1)
+	binary.LittleEndian.PutUint32(fw[metadata+16+4:], 4096)       // raw data size
+	binary.LittleEndian.PutUint64(fw[metadata+16+8:], 0xffc00000) // memory address
+	binary.LittleEndian.PutUint64(fw[metadata+16+16:], 4096)      // memory size
+	binary.LittleEndian.PutUint32(fw[metadata+16+28:], 1)         // MR.EXTEND
+
+	footer := len(fw) - 48
+	copy(fw[footer:], []byte{0xde, 0x82, 0xb5, 0x96, 0xb2, 0x1f, 0xf7, 0x45, 0xba, 0xea, 0xa3, 0x66, 0xc5, 0x5a, 0x08, 0x2d})
+	binary.LittleEndian.PutUint16(fw[footer-2:], 16+2+4+2+16)
+	copy(fw[footer-2-16:], []byte{0x35, 0x65, 0x7a, 0xe4, 0x4a, 0x98, 0x98, 0x47, 0x86, 0x5e, 0x46, 0x85, 0xa7, 0xbf, 0x8e, 0xc2})
+	binary.LittleEndian.PutUint16(fw[footer-2-18:], 4+2+16)
+	binary.LittleEndian.PutUint32(fw[footer-2-22:], uint32(len(fw)-metadata))
+
+	require.NoError(t, os.WriteFile(path, fw, 0o600))
+}
+
+// setupTestDeployer creates a deployer whose VM tooling is replaced by fakes.
+// The fake virt-customize copies the files next to the VM image instead of into it.
+func setupTestDeployer(t *testing.T) *Server {
+	t.Helper()
+	return setupTestDeployerAuth(t, auth.DummyConfig)
+}
+
+// setupTestDeployerAuth is setupTestDeployer authenticating with authConfig
+func setupTestDeployerAuth(t *testing.T, authConfig auth.Config) *Server {
+	t.Helper()
+
+	toolsDir := t.TempDir()
+	fakeSudo := `#!/bin/sh
+# sudo virt-customize -a <image> --copy-in <file>:/kutee/
+mkdir -p "$3.kutee" && cp "${5%:/kutee/}" "$3.kutee/"
+`
+	require.NoError(t, os.WriteFile(filepath.Join(toolsDir, "sudo"), []byte(fakeSudo), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(toolsDir, "run_td.sh"), []byte("exit 0\n"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(toolsDir, "base.qcow2"), []byte("base image"), 0o600))
+	writeTestFirmware(t, filepath.Join(toolsDir, "OVMF.fd"))
+	t.Setenv("PATH", toolsDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	//nolint: exhaustruct
+	s, err := New(&HTTPServerConfig{
+		Log:             getTestLogger(),
+		StateDir:        t.TempDir(),
+		BaseImagePath:   filepath.Join(toolsDir, "base.qcow2"),
+		RunTdScriptPath: filepath.Join(toolsDir, "run_td.sh"),
+		TDInputs:        measurement.Inputs{FirmwarePath: filepath.Join(toolsDir, "OVMF.fd")},
+		Auth:            authConfig,
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.deployerAPI.Shutdown)
+	return s
+}
+
+// testImageArchive builds a distinct image archive without layers
+func testImageArchive(t *testing.T, i int) string {
+	t.Helper()
+
+	config := fmt.Sprintf(`{"i":%d}`, i)
+	configDigest := sha256.Sum256([]byte(config))
+	manifest := fmt.Sprintf(`{"config":{"digest":"sha256:%x"},"layers":[]}`, configDigest)
+	digest := sha256.Sum256([]byte(manifest))
+	index := fmt.Sprintf(`{"manifests":[{"digest":"sha256:%x"}]}`, digest)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"index.json":                                 index,
+		fmt.Sprintf("blobs/sha256/%x", digest):       manifest,
+		fmt.Sprintf("blobs/sha256/%x", configDigest): config,
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.String()
+}
+
+// buildTestBundle archives the files along with an unsigned manifest pinning them
+func buildTestBundle(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	dir := t.TempDir()
+	names := []string{}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+		names = append(names, name)
+	}
+
+	images, err := manifest.Images([]byte(files[bundle.DeploymentFileName]))
+	require.NoError(t, err)
+	manifestFiles, err := bundle.WriteManifest(dir, names, images, "test", nil)
+	require.NoError(t, err)
+	names = append(names, manifestFiles...)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(content))}))
+		_, err = tw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func postTestBundle(t *testing.T, s *Server, bundle []byte) *http.Response {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, newTestBundleRequest(t, bundle))
+	return w.Result()
+}
+
+func newTestBundleRequest(t *testing.T, bundle []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	part, err := m.CreateFormFile("deployment-bundle", "bundle.tar")
+	require.NoError(t, err)
+	_, err = part.Write(bundle)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/deploy", &body)
+	req.Header.Set("Content-Type", m.FormDataContentType())
+	req.SetBasicAuth("test", "test")
+	return req
+}
+
+func waitForDeployment(t *testing.T, s *Server, id string) registry.Deployment {
+	t.Helper()
+
+	var deployment registry.Deployment
+	require.Eventually(t, func() bool {
+		var err error
+		deployment, err = s.deployerAPI.registry.Get(id)
+		require.NoError(t, err)
+		return deployment.Job.Status.Done()
+	}, 10*time.Second, 10*time.Millisecond)
+	return deployment
+}
+
+func Test_Deploy_Concurrent(t *testing.T) {
+	s := setupTestDeployer(t)
+
+	const n = 8
+	bundles := make([]map[string]string, n)
+	bundleData := make([][]byte, n)
+	requests := make([]*http.Request, n)
+	for i := 0; i < n; i++ {
+		bundles[i] = map[string]string{
+			"deployment.yaml":            fmt.Sprintf("kind: Pod\nspec:\n  containers:\n  - name: app\n    image: app-%d\n", i),
+			fmt.Sprintf("app-%d.tar", i): testImageArchive(t, i),
+		}
+		bundleData[i] = buildTestBundle(t, bundles[i])
+		requests[i] = newTestBundleRequest(t, bundleData[i])
+	}
+
+	// Only the requests run concurrently, the responses are checked on the test goroutine
+	recorders := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.srv.Handler.ServeHTTP(recorders[i], requests[i])
+		}(i)
+	}
+	wg.Wait()
+
+	ids := make([]string, n)
+	for i, w := range recorders {
+		resp := w.Result()
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		var deployResp DeployResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&deployResp))
+		require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(bundleData[i])), deployResp.SHA256)
+		ids[i] = deployResp.ID
+	}
+
+	workspaces := make(map[string]bool)
+	for i, id := range ids {
+		deployment := waitForDeployment(t, s, id)
+		require.Equal(t, jobs.StatusSucceeded, deployment.Job.Status, deployment.Job.Error)
+		require.False(t, workspaces[deployment.Workspace])
+		workspaces[deployment.Workspace] = true
+
+		// Only this deployment's files were installed into its image
+		installed, err := os.ReadDir(deployment.VMImagePath + ".kutee")
+		require.NoError(t, err)
+		require.Len(t, installed, len(bundles[i])+1) // and the manifest
+		for name, content := range bundles[i] {
+			data, err := os.ReadFile(filepath.Join(deployment.VMImagePath+".kutee", name))
+			require.NoError(t, err)
+			require.Equal(t, content, string(data))
+		}
+
+		expectedDigest, err := measurement.BundleDigest(deployment.VMImagePath + ".kutee")
+		require.NoError(t, err)
+		require.Equal(t, expectedDigest, deployment.Job.Result.(*measurement.Measurement).BundleDigest)
+	}
+}
+
+func Test_Deploy_InvalidBundle(t *testing.T) {
+	s := setupTestDeployer(t)
+
+	resp := postTestBundle(t, s, buildTestBundle(t, map[string]string{
+		"deployment.yaml": "kind: Pod\nspec:\n  containers:\n  - name: app\n    image: app:latest\n",
+		"other.tar":       "image",
+	}))
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var bundleErr bundle.Error
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&bundleErr))
+	require.Equal(t, []string{"app-latest.tar"}, bundleErr.Missing)
+	require.Equal(t, []string{"other.tar"}, bundleErr.Extra)
+
+	// Nothing is left behind for rejected bundles
+	workspaces, err := os.ReadDir(filepath.Join(s.cfg.StateDir, "workspaces"))
+	require.NoError(t, err)
+	require.Empty(t, workspaces)
+	require.Empty(t, s.deployerAPI.registry.List())
+}
+
+func Test_Deploy_FailureRemovesWorkspace(t *testing.T) {
+	s := setupTestDeployer(t)
+	require.NoError(t, os.Remove(s.cfg.BaseImagePath))
+
+	resp := postTestBundle(t, s, buildTestBundle(t, map[string]string{"deployment.yaml": "kind: Pod\nspec: {}\n"}))
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var deployResp DeployResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&deployResp))
+
+	deployment := waitForDeployment(t, s, deployResp.ID)
+	require.Equal(t, jobs.StatusFailed, deployment.Job.Status)
+	require.NoDirExists(t, deployment.Workspace)
+}
+
+func Test_FinalizeUpload_NeedsDeploy(t *testing.T) {
+	tokens, err := auth.NewTokens([]byte(strings.Repeat("k", 32)), nil)
+	require.NoError(t, err)
+	authConfig := auth.DummyConfig
+	authConfig.Tokens = tokens
+	s := setupTestDeployerAuth(t, authConfig)
+	srv := httptest.NewServer(s.srv.Handler)
+	t.Cleanup(srv.Close)
+
+	path := filepath.Join(t.TempDir(), "bundle.tar")
+	require.NoError(t, os.WriteFile(path, buildTestBundle(t, map[string]string{"deployment.yaml": "kind: Pod\nspec: {}\n"}), 0o600))
+
+	// A token only allowed to upload uploads the bundle, but doesn't deploy it
+	token, _, err := tokens.Issue("test", []auth.Permission{auth.PermissionUpload}, time.Hour)
+	require.NoError(t, err)
+	client := &upload.Client{
+		URL:       srv.URL + "/api/uploads",
+		Authorize: func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) },
+	}
+	session, digest, err := client.Upload(path)
+	require.NoError(t, err)
+	res, _, err := client.Finalize(path, session, digest)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	require.Empty(t, s.deployerAPI.registry.List())
+
+	client.Authorize = func(req *http.Request) { req.SetBasicAuth("test", "test") }
+	res, rb, err := client.Finalize(path, session, digest)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, res.StatusCode, string(rb))
+
+	var deployResp DeployResponse
+	require.NoError(t, json.Unmarshal(rb, &deployResp))
+	waitForDeployment(t, s, deployResp.ID)
+}
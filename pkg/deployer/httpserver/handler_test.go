@@ -1,13 +1,20 @@
 package httpserver
 
 import (
+	"encoding/json"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"deployer/jobs"
+	"deployer/registry"
+	"kutee/auth"
 	"kutee/common"
 
 	"github.com/stretchr/testify/require"
@@ -33,7 +40,8 @@ func Test_Handlers_Healthcheck_Drain_Undrain(t *testing.T) {
 		DrainDuration: latency,
 		ListenAddr:    listenAddr,
 		Log:           getTestLogger(),
-		Auth:          DummyAuthConfig,
+		StateDir:      t.TempDir(),
+		Auth:          auth.DummyConfig,
 	})
 	require.NoError(t, err)
 
@@ -96,3 +104,110 @@ func Test_Handlers_Healthcheck_Drain_Undrain(t *testing.T) {
 		require.Equal(t, http.StatusOK, resp.StatusCode, "Healthcheck must return `Ok` after undraining")
 	}
 }
+
+func Test_Handlers_Deployments(t *testing.T) {
+	stateDir := t.TempDir()
+
+	//nolint: exhaustruct
+	s, err := New(&HTTPServerConfig{
+		Log:      getTestLogger(),
+		StateDir: stateDir,
+		Auth:     auth.DummyConfig,
+	})
+	require.NoError(t, err)
+
+	workspace := s.deployerAPI.workspacePath("finished")
+	vmImage := filepath.Join(workspace, "image.qcow2")
+	require.NoError(t, os.MkdirAll(workspace, 0o700))
+	require.NoError(t, os.WriteFile(vmImage, []byte("qcow2"), 0o600))
+	require.NoError(t, s.deployerAPI.registry.Create(registry.Deployment{
+		ID:          "finished",
+		CreatedAt:   time.Now(),
+		Workspace:   workspace,
+		VMImagePath: vmImage,
+		Job:         jobs.Snapshot{ID: "finished", Status: jobs.StatusSucceeded},
+	}))
+	require.NoError(t, s.deployerAPI.registry.Create(registry.Deployment{
+		ID:        "unknown-image",
+		CreatedAt: time.Now(),
+		Job:       jobs.Snapshot{ID: "unknown-image", Status: jobs.StatusSucceeded},
+	}))
+	require.NoError(t, s.deployerAPI.registry.Create(registry.Deployment{
+		ID:        "in-progress",
+		CreatedAt: time.Now(),
+		Job:       jobs.Snapshot{ID: "in-progress", Status: jobs.StatusRunning},
+	}))
+
+	do := func(method string, path string) *http.Response {
+		req := httptest.NewRequest(method, "http://localhost"+path, nil)
+		req.SetBasicAuth("test", "test")
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	{ // Wrong passwords are refused
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/api/deployments", nil)
+		req.SetBasicAuth("test", "wrong")
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	}
+
+	{ // List
+		resp := do(http.MethodGet, "/api/deployments")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NotContains(t, string(body), workspace, "host paths are not shown to clients")
+		var deployments []registry.Summary
+		require.NoError(t, json.Unmarshal(body, &deployments))
+		require.Len(t, deployments, 3)
+	}
+
+	{ // Deployments in progress can't be removed
+		resp := do(http.MethodDelete, "/api/deployments/in-progress")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusConflict, resp.StatusCode)
+	}
+
+	{ // Deployments are kept while their TD can't be confirmed stopped
+		resp := do(http.MethodDelete, "/api/deployments/unknown-image")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+		resp = do(http.MethodGet, "/api/deployments/unknown-image")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	{ // Teardown stops the TD, found by its image without a pid, and removes the workspace
+		vmm := exec.Command("sh", "-c", "while :; do sleep 1; done", vmImage)
+		require.NoError(t, vmm.Start())
+		exited := make(chan struct{})
+		go func() {
+			_ = vmm.Wait()
+			close(exited)
+		}()
+
+		resp := do(http.MethodDelete, "/api/deployments/finished")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoDirExists(t, workspace)
+		<-exited
+	}
+
+	{ // Inspect
+		resp := do(http.MethodGet, "/api/deployments/finished")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = do(http.MethodGet, "/api/deployments/in-progress")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var deployment registry.Summary
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&deployment))
+		require.Equal(t, jobs.StatusRunning, deployment.Job.Status)
+	}
+}
@@ -2,13 +2,14 @@ package httpserver
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/json"
+	"crypto/ed25519"
 	"errors"
 	"log/slog"
 	"net/http"
 	"time"
 
+	"deployer/measurement"
+	"kutee/auth"
 	"kutee/common"
 	"kutee/metrics"
 
@@ -31,35 +32,12 @@ type HTTPServerConfig struct {
 
 	BaseImagePath   string
 	RunTdScriptPath string
-	Auth            AuthConfig
-}
-
-type AuthConfig struct {
-	AuthenticatedUsers map[string][]byte
-	PasswordHasher     func(string) []byte
-}
+	StateDir        string
+	TDInputs        measurement.Inputs
+	Auth            auth.Config
 
-var EmptyAuthConfig AuthConfig = AuthConfig{
-	AuthenticatedUsers: make(map[string][]byte),
-	PasswordHasher: func(p string) []byte {
-		return sha256.New().Sum([]byte(p))
-	},
-}
-
-func (a AuthConfig) ParseJSONUsers(jsonConfig []byte) AuthConfig {
-	if err := json.Unmarshal(jsonConfig, &(a.AuthenticatedUsers)); err != nil {
-		panic(err)
-	}
-	return a
-}
-
-var DummyAuthConfig AuthConfig = AuthConfig{
-	AuthenticatedUsers: map[string][]byte{
-		"test": []byte("test"),
-	},
-	PasswordHasher: func(p string) []byte {
-		return []byte(p)
-	},
+	// TrustedPublisherKeys, if not empty, only allows bundles signed by one of the keys
+	TrustedPublisherKeys []ed25519.PublicKey
 }
 
 type Server struct {
@@ -67,7 +45,8 @@ type Server struct {
 	isReady atomic.Bool
 	log     *slog.Logger
 
-	deployerAPI *DeployerAPI
+	deployerAPI   *DeployerAPI
+	authenticator auth.Authenticator
 
 	srv     *http.Server
 	metrics *metrics.MetricsServer
@@ -79,12 +58,23 @@ func New(cfg *HTTPServerConfig) (srv *Server, err error) {
 		return nil, err
 	}
 
+	authenticator, err := auth.New(cfg.Auth, cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	deployerAPI, err := NewDeployerAPI(cfg.BaseImagePath, cfg.RunTdScriptPath, cfg.StateDir, cfg.TDInputs, cfg.TrustedPublisherKeys, cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+
 	srv = &Server{
-		cfg:         cfg,
-		log:         cfg.Log,
-		deployerAPI: NewDeployerAPI(cfg.BaseImagePath, cfg.RunTdScriptPath, cfg.Auth.AuthenticatedUsers, cfg.Auth.PasswordHasher, cfg.Log),
-		srv:         nil,
-		metrics:     metricsSrv,
+		cfg:           cfg,
+		log:           cfg.Log,
+		deployerAPI:   deployerAPI,
+		authenticator: authenticator,
+		srv:           nil,
+		metrics:       metricsSrv,
 	}
 	srv.isReady.Swap(true)
 
@@ -105,13 +95,23 @@ func New(cfg *HTTPServerConfig) (srv *Server, err error) {
 		}
 	}
 
-	measureAuthenticateAndHandle := func(name string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
-		return measureAndHandle(name, srv.deployerAPI.AuthenticateAndHandle(handler))
+	authenticate := auth.Middleware(srv.authenticator)
+	measureAuthenticateAndHandle := func(name string, permission auth.Permission, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		authorize := auth.Authorize(srv.log, permission)
+		return measureAndHandle(name, authenticate(authorize(http.HandlerFunc(handler))).ServeHTTP)
 	}
 
 	mux := chi.NewRouter()
 
-	mux.With(srv.httpLogger).Post("/api/deploy", measureAuthenticateAndHandle("deploy", srv.deployerAPI.deploy))
+	mux.With(srv.httpLogger).Post("/api/deploy", measureAuthenticateAndHandle("deploy", auth.PermissionDeploy, srv.deployerAPI.deploy))
+	mux.With(srv.httpLogger).Post("/api/uploads", measureAuthenticateAndHandle("create_upload", auth.PermissionUpload, srv.deployerAPI.createUpload))
+	mux.With(srv.httpLogger).Get("/api/uploads/{id}", measureAuthenticateAndHandle("get_upload", auth.PermissionUpload, srv.deployerAPI.getUpload))
+	mux.With(srv.httpLogger).Put("/api/uploads/{id}", measureAuthenticateAndHandle("upload_chunk", auth.PermissionUpload, srv.deployerAPI.uploadChunk))
+	// Finalizing an upload deploys it
+	mux.With(srv.httpLogger).Post("/api/uploads/{id}/finalize", measureAuthenticateAndHandle("finalize_upload", auth.PermissionDeploy, srv.deployerAPI.finalizeUpload))
+	mux.With(srv.httpLogger).Get("/api/deployments", measureAuthenticateAndHandle("list_deployments", auth.PermissionRead, srv.deployerAPI.listDeployments))
+	mux.With(srv.httpLogger).Get("/api/deployments/{id}", measureAuthenticateAndHandle("get_deployment", auth.PermissionRead, srv.deployerAPI.getDeployment))
+	mux.With(srv.httpLogger).Delete("/api/deployments/{id}", measureAuthenticateAndHandle("delete_deployment", auth.PermissionOperate, srv.deployerAPI.deleteDeployment))
 
 	mux.With(srv.httpLogger).Get("/livez", srv.handleLivenessCheck)
 	mux.With(srv.httpLogger).Get("/readyz", srv.handleReadinessCheck)
@@ -168,6 +168,9 @@ func (s *Server) Shutdown() {
 		s.log.Info("HTTP server gracefully stopped")
 	}
 
+	// deployment jobs
+	s.deployerAPI.Shutdown()
+
 	// metrics
 	if len(s.cfg.MetricsAddr) != 0 {
 		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.GracefulShutdownDuration)
@@ -0,0 +1,122 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const vmmStopTimeout = 10 * time.Second
+
+func readPidFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// stopVMM terminates the VMM running vmImage. The process' command line is
+// checked first so that a recycled pid does not take down an unrelated process.
+func stopVMM(pid int, vmImage string) error {
+	procCmdline := fmt.Sprintf("/proc/%d/cmdline", pid)
+	cmdline, err := os.ReadFile(procCmdline)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // already exited
+	} else if err != nil {
+		return err
+	}
+
+	if vmImage == "" || !bytes.Contains(cmdline, []byte(vmImage)) {
+		return nil // pid belongs to some other process by now
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		return err
+	}
+
+	deadline := time.Now().Add(vmmStopTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(procCmdline); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	deadline = time.Now().Add(vmmStopTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(procCmdline); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("process %d did not exit", pid)
+}
+
+// findVMMs returns the processes whose command line refers to vmImage
+func findVMMs(vmImage string) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue // not a process
+		}
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ESRCH) {
+			continue // exited meanwhile
+		} else if err != nil {
+			return nil, err
+		}
+		if bytes.Contains(cmdline, []byte(vmImage)) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// stopTD terminates the VMM running vmImage, and returns an error unless no process uses the image anymore.
+// run_td.sh may not have written the pid of the VMM, it's then found by the image it runs.
+func stopTD(pid int, vmImage string) error {
+	if vmImage == "" {
+		return errors.New("the VM image of the TD is unknown")
+	}
+
+	if pid != 0 {
+		if err := stopVMM(pid, vmImage); err != nil {
+			return err
+		}
+	}
+
+	pids, err := findVMMs(vmImage)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := stopVMM(pid, vmImage); err != nil {
+			return err
+		}
+	}
+
+	if pids, err := findVMMs(vmImage); err != nil {
+		return err
+	} else if len(pids) > 0 {
+		return fmt.Errorf("processes %v still use the VM image", pids)
+	}
+	return nil
+}
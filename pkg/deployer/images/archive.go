@@ -0,0 +1,236 @@
+package images
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"kutee/ociarchive"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ID is the image ID, the digest of its config, which deployments are pinned to
+func ID(img v1.Image) (string, error) {
+	config, err := img.ConfigName()
+	if err != nil {
+		return "", err
+	}
+	return config.String(), nil
+}
+
+// dockerManifestEntry is an entry of the manifest.json `docker load` reads,
+// written alongside the OCI layout so that the archive loads into both docker and containerd
+type dockerManifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// WriteArchive writes img as a tarred OCI image layout to dst, tagged as ref.
+// Blobs are stored by their digest, the archive is reproducible for a given image.
+// If blobDir is set, layers are stored there instead, once for all the images sharing them,
+// and the names of the layer blobs the image needs are returned. See ociarchive.Assemble.
+func WriteArchive(dst string, blobDir string, img v1.Image, ref string) ([]string, error) {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	aw := &archiveWriter{tw: tw, blobDir: blobDir, written: make(map[v1.Hash]bool)}
+
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+			return nil, err
+		}
+	}
+
+	configName, err := img.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := aw.writeBlob(configName, rawConfig); err != nil {
+		return nil, err
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	entry := dockerManifestEntry{Config: blobPath(configName)}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if err := aw.writeLayer(digest, layer); err != nil {
+			return nil, err
+		}
+		entry.Layers = append(entry.Layers, blobPath(digest))
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	if err := aw.writeBlob(digest, rawManifest); err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{}
+	if tag, err := name.NewTag(ref); err == nil {
+		annotations["io.containerd.image.name"] = tag.Name()
+		annotations[refNameAnnotation] = tag.TagStr()
+		entry.RepoTags = []string{tag.Name()}
+	}
+
+	index, err := json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests: []v1.Descriptor{{
+			MediaType:   mediaType,
+			Size:        int64(len(rawManifest)),
+			Digest:      digest,
+			Annotations: annotations,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	dockerManifest, err := json.Marshal([]dockerManifestEntry{entry})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{"index.json", index},
+		{"manifest.json", dockerManifest},
+	} {
+		if err := aw.writeFile(file.name, file.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return aw.blobs, f.Close()
+}
+
+type archiveWriter struct {
+	tw      *tar.Writer
+	blobDir string
+	blobs   []string
+	written map[v1.Hash]bool
+}
+
+func (w *archiveWriter) writeFile(name string, data []byte) error {
+	if err := w.tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(data)
+	return err
+}
+
+func (w *archiveWriter) writeBlob(digest v1.Hash, data []byte) error {
+	if w.written[digest] {
+		return nil
+	}
+	w.written[digest] = true
+	return w.writeFile(blobPath(digest), data)
+}
+
+func (w *archiveWriter) writeLayer(digest v1.Hash, layer v1.Layer) error {
+	if w.written[digest] {
+		return nil
+	}
+	w.written[digest] = true
+
+	if w.blobDir != "" {
+		w.blobs = append(w.blobs, ociarchive.BlobName(digest.String()))
+		return writeBlobFile(filepath.Join(w.blobDir, ociarchive.BlobName(digest.String())), layer)
+	}
+
+	size, err := layer.Size()
+	if err != nil {
+		return err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := w.tw.WriteHeader(&tar.Header{Name: blobPath(digest), Typeflag: tar.TypeReg, Mode: 0o644, Size: size}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w.tw, rc, size)
+	return err
+}
+
+func blobPath(digest v1.Hash) string {
+	return path.Join("blobs", digest.Algorithm, digest.Hex)
+}
+
+// writeBlobFile stores a layer under its digest, unless another image already stored it
+func writeBlobFile(dst string, layer v1.Layer) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".blob-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, rc); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	// Layers are verified against their digest on assembly, but fail early on a bad source
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	if err := ociarchive.VerifyBlob(tmp.Name(), digest.String()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
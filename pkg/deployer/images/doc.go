@@ -0,0 +1,3 @@
+// Package images resolves the images of a deployment from a Docker daemon, OCI layouts,
+// docker-archive tarballs or a registry, and writes them into the bundle as OCI layouts.
+package images
@@ -0,0 +1,232 @@
+package images
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kutee/ociarchive"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/require"
+)
+
+func requireSameImage(t *testing.T, expected, actual v1.Image) {
+	t.Helper()
+
+	expectedID, err := ID(expected)
+	require.NoError(t, err)
+	actualID, err := ID(actual)
+	require.NoError(t, err)
+	require.Equal(t, expectedID, actualID)
+}
+
+func Test_LayoutSource(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, p.AppendImage(img, layout.WithAnnotations(map[string]string{refNameAnnotation: "1.0"})))
+
+	source, err := ParseSource("oci-layout:"+dir, t.TempDir())
+	require.NoError(t, err)
+
+	found, err := source.Image("registry.example.com/app:1.0")
+	require.NoError(t, err)
+	requireSameImage(t, img, found)
+
+	_, err = source.Image("registry.example.com/app:2.0")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func Test_ArchiveSource(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	tag, err := name.NewTag("app:latest")
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "images.tar")
+	require.NoError(t, tarball.WriteToFile(path, tag, img))
+
+	source, err := ParseSource("docker-archive:"+path, t.TempDir())
+	require.NoError(t, err)
+
+	// Tags are compared normalized
+	found, err := source.Image("docker.io/library/app:latest")
+	require.NoError(t, err)
+	requireSameImage(t, img, found)
+
+	_, err = source.Image("other:latest")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func Test_RegistrySource(t *testing.T) {
+	srv := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	ref, err := name.ParseReference(host+"/team/app:1.0", name.Insecure)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	source, err := ParseSource("registry:http://"+host, t.TempDir())
+	require.NoError(t, err)
+
+	// Looked up on the local registry, whatever registry the deployment names
+	found, err := Resolve([]Source{source}, "registry.example.com/team/app:1.0")
+	require.NoError(t, err)
+	requireSameImage(t, img, found)
+
+	_, err = Resolve([]Source{source}, "registry.example.com/team/app:2.0")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func Test_WriteArchive(t *testing.T) {
+	img, err := random.Image(1024, 3)
+	require.NoError(t, err)
+
+	dst := filepath.Join(t.TempDir(), "app.tar")
+	blobs, err := WriteArchive(dst, "", img, "app:latest")
+	require.NoError(t, err)
+	require.Empty(t, blobs)
+
+	// The archive is a docker-loadable tarball...
+	tag, err := name.NewTag("app:latest")
+	require.NoError(t, err)
+	loaded, err := tarball.ImageFromPath(dst, &tag)
+	require.NoError(t, err)
+	requireSameImage(t, img, loaded)
+
+	// ...and an OCI layout
+	dir := t.TempDir()
+	extractTar(t, dst, dir)
+	source := &LayoutSource{Path: dir}
+	found, err := source.Image("docker.io/library/app:latest")
+	require.NoError(t, err)
+	requireSameImage(t, img, found)
+
+	expectedDigest, err := img.Digest()
+	require.NoError(t, err)
+	foundDigest, err := found.Digest()
+	require.NoError(t, err)
+	require.Equal(t, expectedDigest, foundDigest)
+
+	// The orchestrator reads the same name, digest and ID from the archive
+	id, err := ID(img)
+	require.NoError(t, err)
+	archived, err := ociarchive.Images(dst)
+	require.NoError(t, err)
+	require.Equal(t, []ociarchive.Image{{Name: tag.Name(), Digest: expectedDigest.String(), ID: id}}, archived)
+
+	// Writing the same image again produces the same archive
+	again := filepath.Join(t.TempDir(), "app.tar")
+	_, err = WriteArchive(again, "", img, "app:latest")
+	require.NoError(t, err)
+	a, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	b, err := os.ReadFile(again)
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+}
+
+func Test_WriteArchive_SharedBlobs(t *testing.T) {
+	base, err := random.Image(1024, 2)
+	require.NoError(t, err)
+	layer, err := random.Layer(512, types.DockerLayer)
+	require.NoError(t, err)
+	app, err := mutate.AppendLayers(base, layer)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	baseBlobs, err := WriteArchive(filepath.Join(dir, "base.tar"), dir, base, "base:latest")
+	require.NoError(t, err)
+	require.Len(t, baseBlobs, 2)
+	appBlobs, err := WriteArchive(filepath.Join(dir, "app.tar"), dir, app, "app:latest")
+	require.NoError(t, err)
+	require.Len(t, appBlobs, 3)
+	require.Subset(t, appBlobs, baseBlobs)
+
+	// The base layers are only stored once
+	blobFiles, err := filepath.Glob(filepath.Join(dir, "*.blob"))
+	require.NoError(t, err)
+	require.Len(t, blobFiles, 3)
+
+	layers, err := ociarchive.Layers(filepath.Join(dir, "app.tar"))
+	require.NoError(t, err)
+	require.Len(t, layers, 3)
+
+	// The orchestrator reassembles the full image from the shared blobs
+	assembled := filepath.Join(t.TempDir(), "app.tar")
+	f, err := os.Create(assembled)
+	require.NoError(t, err)
+	require.NoError(t, ociarchive.Assemble(f, filepath.Join(dir, "app.tar"), dir))
+	require.NoError(t, f.Close())
+
+	tag, err := name.NewTag("app:latest")
+	require.NoError(t, err)
+	loaded, err := tarball.ImageFromPath(assembled, &tag)
+	require.NoError(t, err)
+	requireSameImage(t, app, loaded)
+	loadedLayers, err := loaded.Layers()
+	require.NoError(t, err)
+	require.Len(t, loadedLayers, 3)
+	for _, l := range loadedLayers {
+		rc, err := l.Compressed()
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+	}
+
+	// Layers are verified against their digest
+	require.NoError(t, os.WriteFile(blobFiles[0], []byte("tampered"), 0o644))
+	require.ErrorContains(t, ociarchive.Assemble(io.Discard, filepath.Join(dir, "app.tar"), dir), "does not match its digest")
+
+	require.NoError(t, os.Remove(blobFiles[0]))
+	require.ErrorIs(t, ociarchive.Assemble(io.Discard, filepath.Join(dir, "app.tar"), dir), ociarchive.ErrMissingBlobs)
+}
+
+func extractTar(t *testing.T, src string, dst string) {
+	t.Helper()
+
+	f, err := os.Open(src)
+	require.NoError(t, err)
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		require.NoError(t, err)
+
+		target := filepath.Join(dst, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			require.NoError(t, os.MkdirAll(target, 0o755))
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(target, data, 0o644))
+	}
+}
@@ -0,0 +1,249 @@
+package images
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"kutee/manifest"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// ErrNotFound is returned by sources that do not have the requested image
+var ErrNotFound = errors.New("image not found")
+
+// refNameAnnotation names the images of an OCI layout, see the OCI image spec
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Platform is the platform images are resolved for when a source holds several, the TD's
+var Platform = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+// Source provides the images referenced by a deployment
+type Source interface {
+	Image(ref string) (v1.Image, error)
+	String() string
+}
+
+// ParseSource creates a source from its command line form:
+//
+//	docker                   the local Docker daemon, through `docker image save`
+//	oci-layout:<dir>         an OCI image layout directory, images are looked up by their ref name annotation
+//	docker-archive:<path>    a `docker save` tarball, images are looked up by their repo tags
+//	registry:<host>          a registry, the image's repository and tag are looked up on host.
+//	                         Prefix host with http:// for registries that are not served over TLS.
+//
+// workDir holds temporary files for sources that need them, the docker source stores its exports there.
+func ParseSource(spec string, workDir string) (Source, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "docker":
+		return &DaemonSource{WorkDir: workDir}, nil
+	case "oci-layout":
+		return &LayoutSource{Path: arg}, nil
+	case "docker-archive":
+		return &ArchiveSource{Path: arg}, nil
+	case "registry":
+		insecure := strings.HasPrefix(arg, "http://")
+		return &RegistrySource{Host: strings.TrimPrefix(arg, "http://"), Insecure: insecure}, nil
+	}
+	return nil, fmt.Errorf("unknown image source %q", spec)
+}
+
+// Resolve returns the image from the first source that has it
+func Resolve(sources []Source, ref string) (v1.Image, error) {
+	for _, source := range sources {
+		img, err := source.Image(ref)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read %s from %s: %w", ref, source, err)
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("%s: %w in any of the image sources", ref, ErrNotFound)
+}
+
+// LayoutSource reads images from an OCI image layout
+type LayoutSource struct {
+	Path string
+}
+
+func (s *LayoutSource) String() string { return "oci-layout:" + s.Path }
+
+func (s *LayoutSource) Image(ref string) (v1.Image, error) {
+	p, err := layout.FromPath(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range indexManifest.Manifests {
+		if !layoutRefMatches(desc.Annotations, ref) {
+			continue
+		}
+		if desc.MediaType.IsIndex() {
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			return platformImage(child)
+		}
+		return index.Image(desc.Digest)
+	}
+	return nil, ErrNotFound
+}
+
+// layoutRefMatches compares ref to the names an image is annotated with in a layout.
+// The OCI ref name annotation is usually just the tag, containerd stores the full name.
+func layoutRefMatches(annotations map[string]string, ref string) bool {
+	if annotations["io.containerd.image.name"] != "" && sameReference(annotations["io.containerd.image.name"], ref) {
+		return true
+	}
+	refName := annotations[refNameAnnotation]
+	if refName == "" {
+		return false
+	}
+	if refName == ref || sameReference(refName, ref) {
+		return true
+	}
+	parsed, err := name.ParseReference(ref)
+	return err == nil && parsed.Identifier() == refName
+}
+
+// ArchiveSource reads images from a docker-archive tarball
+type ArchiveSource struct {
+	Path string
+}
+
+func (s *ArchiveSource) String() string { return "docker-archive:" + s.Path }
+
+func (s *ArchiveSource) Image(ref string) (v1.Image, error) {
+	opener := func() (io.ReadCloser, error) { return os.Open(s.Path) }
+	archiveManifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range archiveManifest {
+		for _, repoTag := range desc.RepoTags {
+			if !sameReference(repoTag, ref) {
+				continue
+			}
+			tag, err := name.NewTag(repoTag)
+			if err != nil {
+				return nil, err
+			}
+			return tarball.Image(opener, &tag)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// DaemonSource exports images from the local Docker daemon
+type DaemonSource struct {
+	WorkDir string
+}
+
+func (s *DaemonSource) String() string { return "docker" }
+
+func (s *DaemonSource) Image(ref string) (v1.Image, error) {
+	archive := filepath.Join(s.WorkDir, manifest.ArchiveName(ref))
+	output, err := exec.Command("docker", "image", "save", ref, "-o", archive).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "No such image") {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("docker image save failed: %w: %s", err, output)
+	}
+
+	return (&ArchiveSource{Path: archive}).Image(ref)
+}
+
+// RegistrySource pulls images from a registry, such as a local registry:2
+type RegistrySource struct {
+	Host     string
+	Insecure bool
+}
+
+func (s *RegistrySource) String() string { return "registry:" + s.Host }
+
+func (s *RegistrySource) Image(ref string) (v1.Image, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []name.Option{}
+	if s.Insecure {
+		opts = append(opts, name.Insecure)
+	}
+
+	// The image keeps its repository and tag or digest, but is looked up on Host
+	local, err := name.ParseReference(s.Host+"/"+parsed.Context().RepositoryStr()+separator(parsed)+parsed.Identifier(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := remote.Image(local, remote.WithPlatform(Platform), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	return img, err
+}
+
+func separator(ref name.Reference) string {
+	if _, ok := ref.(name.Digest); ok {
+		return "@"
+	}
+	return ":"
+}
+
+// sameReference compares references once normalized, docker.io/library/app:latest is the same image as app
+func sameReference(a, b string) bool {
+	ra, err := name.ParseReference(a)
+	if err != nil {
+		return false
+	}
+	rb, err := name.ParseReference(b)
+	if err != nil {
+		return false
+	}
+	return ra.Name() == rb.Name()
+}
+
+// platformImage picks the image for Platform out of a multi-platform index
+func platformImage(index v1.ImageIndex) (v1.Image, error) {
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range indexManifest.Manifests {
+		if desc.Platform == nil || desc.Platform.Satisfies(Platform) {
+			return index.Image(desc.Digest)
+		}
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNotFound, Platform.String())
+}
@@ -0,0 +1,2 @@
+// Package jobs runs multi-step pipelines in the background and records their progress.
+package jobs
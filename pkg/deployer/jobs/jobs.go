@@ -0,0 +1,221 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+func (s Status) Done() bool {
+	return s == StatusSucceeded || s == StatusFailed
+}
+
+// Step is a single named stage of a job.
+// Run may be nil for steps completed before the job was submitted.
+type Step struct {
+	Name string
+	Run  func(ctx context.Context, job *Job) error
+}
+
+type StepStatus struct {
+	Name        string     `json:"name"`
+	Status      Status     `json:"status"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// Snapshot is a point-in-time copy of a job's state
+type Snapshot struct {
+	ID        string       `json:"id"`
+	Status    Status       `json:"status"`
+	Steps     []StepStatus `json:"steps"`
+	Error     string       `json:"error,omitempty"`
+	Result    any          `json:"result,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+type Job struct {
+	mu       sync.Mutex
+	snapshot Snapshot
+	steps    []Step
+
+	onUpdate func(Snapshot)
+}
+
+func (j *Job) ID() string {
+	return j.snapshot.ID
+}
+
+// SetResult records the job's result, returned to clients once available
+func (j *Job) SetResult(result any) {
+	j.mu.Lock()
+	j.snapshot.Result = result
+	j.snapshot.UpdatedAt = time.Now()
+	j.mu.Unlock()
+	j.notify()
+}
+
+func (j *Job) Snapshot() Snapshot {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.snapshot
+	s.Steps = append([]StepStatus(nil), j.snapshot.Steps...)
+	return s
+}
+
+func (j *Job) setStep(i int, status Status) {
+	j.mu.Lock()
+	now := time.Now()
+	j.snapshot.Steps[i].Status = status
+	if status.Done() {
+		j.snapshot.Steps[i].CompletedAt = &now
+	}
+	j.snapshot.UpdatedAt = now
+	j.mu.Unlock()
+	j.notify()
+}
+
+func (j *Job) setStatus(status Status, err error) {
+	j.mu.Lock()
+	j.snapshot.Status = status
+	if err != nil {
+		j.snapshot.Error = err.Error()
+	}
+	j.snapshot.UpdatedAt = time.Now()
+	j.mu.Unlock()
+	j.notify()
+}
+
+// notify is only called from the job's own goroutine, so updates are delivered in order
+func (j *Job) notify() {
+	if j.onUpdate != nil {
+		j.onUpdate(j.Snapshot())
+	}
+}
+
+func (j *Job) run(ctx context.Context, log *slog.Logger) {
+	j.setStatus(StatusRunning, nil)
+	for i, step := range j.steps {
+		if step.Run == nil {
+			j.setStep(i, StatusSucceeded)
+			continue
+		}
+
+		j.setStep(i, StatusRunning)
+		if err := step.Run(ctx, j); err != nil {
+			log.Error("job step failed", "step", step.Name, "err", err)
+			j.setStep(i, StatusFailed)
+			j.setStatus(StatusFailed, err)
+			return
+		}
+		j.setStep(i, StatusSucceeded)
+		log.Info("job step completed", "step", step.Name)
+	}
+	j.setStatus(StatusSucceeded, nil)
+}
+
+// FinishedJobRetention is how long finished jobs are kept by the runner, their outcome is
+// meant to be persisted through onUpdate
+const FinishedJobRetention = time.Hour
+
+// Runner executes submitted jobs in the background and keeps track of them
+type Runner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.RWMutex
+	jobs map[string]*Job
+	// retention is how long finished jobs are kept
+	retention time.Duration
+
+	onUpdate func(Snapshot)
+
+	log *slog.Logger
+}
+
+// NewRunner creates a job runner. onUpdate, if set, is called with the
+// job's snapshot after every change to its state.
+func NewRunner(log *slog.Logger, onUpdate func(Snapshot)) *Runner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		ctx:       ctx,
+		cancel:    cancel,
+		jobs:      make(map[string]*Job),
+		retention: FinishedJobRetention,
+		onUpdate:  onUpdate,
+		log:       log,
+	}
+}
+
+// NewSnapshot returns the initial state of a job with the given steps
+func NewSnapshot(id string, steps []Step) Snapshot {
+	now := time.Now()
+	snapshot := Snapshot{
+		ID:        id,
+		Status:    StatusPending,
+		Steps:     make([]StepStatus, len(steps)),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for i, step := range steps {
+		snapshot.Steps[i] = StepStatus{Name: step.Name, Status: StatusPending}
+	}
+	return snapshot
+}
+
+// Submit registers a new job and starts executing its steps in order
+func (r *Runner) Submit(id string, steps []Step) *Job {
+	job := &Job{
+		steps:    steps,
+		snapshot: NewSnapshot(id, steps),
+		onUpdate: r.onUpdate,
+	}
+
+	r.mu.Lock()
+	r.prune()
+	r.jobs[job.ID()] = job
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		job.run(r.ctx, r.log.With("job", job.ID()))
+	}()
+
+	return job
+}
+
+// prune forgets the jobs finished for longer than the retention, r.mu must be held
+func (r *Runner) prune() {
+	cutoff := time.Now().Add(-r.retention)
+	for id, job := range r.jobs {
+		snapshot := job.Snapshot()
+		if snapshot.Status.Done() && snapshot.UpdatedAt.Before(cutoff) {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+func (r *Runner) Get(id string) (*Job, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	job, ok := r.jobs[id]
+	return job, ok
+}
+
+// Shutdown cancels the running jobs and waits for them to return
+func (r *Runner) Shutdown() {
+	r.cancel()
+	r.wg.Wait()
+}
@@ -0,0 +1,99 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func waitDone(t *testing.T, job *Job) Snapshot {
+	t.Helper()
+	require.Eventually(t, func() bool { return job.Snapshot().Status.Done() }, 5*time.Second, 10*time.Millisecond)
+	return job.Snapshot()
+}
+
+func Test_Runner_RecordsProgress(t *testing.T) {
+	r := NewRunner(slog.New(slog.NewTextHandler(os.Stdout, nil)), nil)
+	defer r.Shutdown()
+
+	release := make(chan struct{})
+	job := r.Submit(uuid.Must(uuid.NewRandom()).String(), []Step{
+		{Name: "uploaded"},
+		{Name: "blocked", Run: func(ctx context.Context, job *Job) error {
+			<-release
+			job.SetResult("measurement")
+			return nil
+		}},
+		{Name: "last", Run: func(ctx context.Context, job *Job) error { return nil }},
+	})
+
+	require.Eventually(t, func() bool { return job.Snapshot().Steps[1].Status == StatusRunning }, time.Second, 10*time.Millisecond)
+	snapshot := job.Snapshot()
+	require.Equal(t, StatusRunning, snapshot.Status)
+	require.Equal(t, StatusSucceeded, snapshot.Steps[0].Status)
+	require.NotNil(t, snapshot.Steps[0].CompletedAt)
+	require.Equal(t, StatusPending, snapshot.Steps[2].Status)
+
+	close(release)
+	snapshot = waitDone(t, job)
+	require.Equal(t, StatusSucceeded, snapshot.Status)
+	require.Equal(t, "measurement", snapshot.Result)
+
+	found, ok := r.Get(job.ID())
+	require.True(t, ok)
+	require.Equal(t, job, found)
+
+	_, ok = r.Get("missing")
+	require.False(t, ok)
+}
+
+func Test_Runner_StopsOnFailure(t *testing.T) {
+	r := NewRunner(slog.New(slog.NewTextHandler(os.Stdout, nil)), nil)
+	defer r.Shutdown()
+
+	ran := false
+	job := r.Submit(uuid.Must(uuid.NewRandom()).String(), []Step{
+		{Name: "failing", Run: func(ctx context.Context, job *Job) error { return errors.New("boom") }},
+		{Name: "skipped", Run: func(ctx context.Context, job *Job) error { ran = true; return nil }},
+	})
+
+	snapshot := waitDone(t, job)
+	require.Equal(t, StatusFailed, snapshot.Status)
+	require.Equal(t, "boom", snapshot.Error)
+	require.Equal(t, StatusFailed, snapshot.Steps[0].Status)
+	require.Equal(t, StatusPending, snapshot.Steps[1].Status)
+	require.False(t, ran)
+}
+
+func Test_Runner_PrunesFinishedJobs(t *testing.T) {
+	r := NewRunner(slog.New(slog.NewTextHandler(os.Stdout, nil)), nil)
+	defer r.Shutdown()
+	r.retention = 200 * time.Millisecond
+
+	release := make(chan struct{})
+	running := r.Submit(uuid.Must(uuid.NewRandom()).String(), []Step{
+		{Name: "blocked", Run: func(ctx context.Context, job *Job) error { <-release; return nil }},
+	})
+	finished := r.Submit(uuid.Must(uuid.NewRandom()).String(), []Step{{Name: "uploaded"}})
+	waitDone(t, finished)
+
+	// Finished jobs are kept for the retention, running ones until they finish
+	r.Submit(uuid.Must(uuid.NewRandom()).String(), nil)
+	_, ok := r.Get(finished.ID())
+	require.True(t, ok)
+
+	time.Sleep(2 * r.retention)
+	r.Submit(uuid.Must(uuid.NewRandom()).String(), nil)
+	_, ok = r.Get(finished.ID())
+	require.False(t, ok)
+	_, ok = r.Get(running.ID())
+	require.True(t, ok)
+
+	close(release)
+}
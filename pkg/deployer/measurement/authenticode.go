@@ -0,0 +1,90 @@
+package measurement
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var ErrInvalidPE = errors.New("kernel is not a valid PE image")
+
+// authenticodeHash computes the Authenticode (sha384) digest of a PE image,
+// which is what the firmware extends into RTMR[1] when starting the kernel
+func authenticodeHash(pe []byte) ([]byte, error) {
+	if len(pe) < 0x40 || string(pe[0:2]) != "MZ" {
+		return nil, ErrInvalidPE
+	}
+
+	peOffset := int(binary.LittleEndian.Uint32(pe[0x3c:]))
+	if peOffset+24 > len(pe) || string(pe[peOffset:peOffset+4]) != "PE\x00\x00" {
+		return nil, ErrInvalidPE
+	}
+
+	coff := peOffset + 4
+	nSections := int(binary.LittleEndian.Uint16(pe[coff+2:]))
+	optHeaderSize := int(binary.LittleEndian.Uint16(pe[coff+16:]))
+	optHeader := coff + 20
+	if optHeader+optHeaderSize > len(pe) || optHeaderSize < 2 {
+		return nil, ErrInvalidPE
+	}
+
+	var dataDirs int
+	switch binary.LittleEndian.Uint16(pe[optHeader:]) {
+	case 0x10b: // PE32
+		dataDirs = optHeader + 96
+	case 0x20b: // PE32+
+		dataDirs = optHeader + 112
+	default:
+		return nil, ErrInvalidPE
+	}
+
+	checksum := optHeader + 64
+	certDir := dataDirs + 4*8
+	if certDir+8 > optHeader+optHeaderSize {
+		return nil, ErrInvalidPE
+	}
+
+	sizeOfHeaders := int(binary.LittleEndian.Uint32(pe[optHeader+60:]))
+	certSize := int(binary.LittleEndian.Uint32(pe[certDir+4:]))
+	if sizeOfHeaders > len(pe) || sizeOfHeaders < certDir+8 || certSize > len(pe) {
+		return nil, ErrInvalidPE
+	}
+
+	h := sha512.New384()
+	h.Write(pe[:checksum])
+	h.Write(pe[checksum+4 : certDir])
+	h.Write(pe[certDir+8 : sizeOfHeaders])
+
+	type section struct{ offset, size int }
+	sections := make([]section, 0, nSections)
+	sectionTable := optHeader + optHeaderSize
+	for i := 0; i < nSections; i++ {
+		entry := sectionTable + i*40
+		if entry+40 > len(pe) {
+			return nil, ErrInvalidPE
+		}
+		size := int(binary.LittleEndian.Uint32(pe[entry+16:]))
+		offset := int(binary.LittleEndian.Uint32(pe[entry+20:]))
+		if size == 0 {
+			continue
+		}
+		if offset+size > len(pe) {
+			return nil, ErrInvalidPE
+		}
+		sections = append(sections, section{offset, size})
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].offset < sections[j].offset })
+
+	hashed := sizeOfHeaders
+	for _, s := range sections {
+		h.Write(pe[s.offset : s.offset+s.size])
+		hashed += s.size
+	}
+
+	if trailer := len(pe) - certSize; hashed < trailer {
+		h.Write(pe[hashed:trailer])
+	}
+
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,3 @@
+// Package measurement computes the expected TDX measurements (MRTD and RTMRs)
+// of a TD booted from a given firmware, kernel, initrd and command line.
+package measurement
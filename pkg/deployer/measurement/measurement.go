@@ -0,0 +1,161 @@
+package measurement
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// BundleDigestParam is the kernel command line parameter binding the files
+// installed into /kutee/ to RTMR[2]. kutee-start refuses to boot if the
+// files on disk do not match it.
+const BundleDigestParam = "kutee.bundle_digest"
+
+// Inputs describe how the TD is booted. KernelPath, InitrdPath and Cmdline
+// are only used for direct kernel boot, without a kernel RTMR[1] and RTMR[2]
+// are not computed.
+type Inputs struct {
+	FirmwarePath string
+	KernelPath   string
+	InitrdPath   string
+	Cmdline      string
+}
+
+// Measurement holds the expected, hex-encoded, TD measurements.
+// RTMR[0] depends on the VMM configuration (ACPI tables, TD HOB) and
+// RTMR[3] is extended at runtime, neither is computed.
+type Measurement struct {
+	MRTD         string `json:"mrtd"`
+	RTMR1        string `json:"rtmr1,omitempty"`
+	RTMR2        string `json:"rtmr2,omitempty"`
+	Cmdline      string `json:"cmdline,omitempty"`
+	BundleDigest string `json:"bundle_digest"`
+	// Measured tells whether the bundle is bound to the measurement, through the command line
+	// measured into RTMR[2]. Without a kernel only the firmware is measured, whatever the TD runs.
+	Measured bool `json:"measured"`
+}
+
+// Measure computes the expected measurement of a TD booted from inputs with the bundle installed.
+// The bundle digest is appended to the kernel command line, the resulting command line is returned
+// in the measurement and must be passed to the VMM as-is.
+func Measure(inputs Inputs, bundleDigest string) (*Measurement, error) {
+	fw, err := os.ReadFile(inputs.FirmwarePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read firmware: %w", err)
+	}
+
+	mrtd, err := computeMrtd(fw)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute MRTD: %w", err)
+	}
+
+	m := &Measurement{
+		MRTD:         hex.EncodeToString(mrtd),
+		BundleDigest: bundleDigest,
+	}
+
+	if inputs.KernelPath == "" {
+		return m, nil
+	}
+
+	kernel, err := os.ReadFile(inputs.KernelPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read kernel: %w", err)
+	}
+
+	kernelHash, err := authenticodeHash(kernel)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash kernel: %w", err)
+	}
+
+	rtmr1 := newRtmr()
+	rtmr1.extend(kernelHash)
+	rtmr1.extend(sha384([]byte("Calling EFI Application from Boot Option")))
+	rtmr1.extend(sha384([]byte{0, 0, 0, 0})) // separator
+	rtmr1.extend(sha384([]byte("Exit Boot Services Invocation")))
+	rtmr1.extend(sha384([]byte("Exit Boot Services Returned with Success")))
+
+	m.Cmdline = strings.TrimSpace(inputs.Cmdline + " " + BundleDigestParam + "=" + bundleDigest)
+
+	// The firmware sees the command line with the initrd appended by qemu
+	measuredCmdline := m.Cmdline
+	if inputs.InitrdPath != "" {
+		measuredCmdline += " initrd=initrd"
+	}
+
+	rtmr2 := newRtmr()
+	rtmr2.extend(sha384(utf16le(measuredCmdline + "\x00")))
+
+	if inputs.InitrdPath != "" {
+		initrd, err := os.ReadFile(inputs.InitrdPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read initrd: %w", err)
+		}
+		rtmr2.extend(sha384(initrd))
+	}
+
+	m.RTMR1 = hex.EncodeToString(rtmr1[:])
+	m.RTMR2 = hex.EncodeToString(rtmr2[:])
+	m.Measured = true
+	return m, nil
+}
+
+// BundleDigest computes the digest of the files in dir as installed into /kutee/.
+// It matches `sha384sum` of the sorted files, piped through `sha384sum` again.
+func BundleDigest(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	h := sha512.New384()
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", sha384(data), name)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type rtmr [sha512.Size384]byte
+
+func newRtmr() *rtmr {
+	return &rtmr{}
+}
+
+func (r *rtmr) extend(digest []byte) {
+	h := sha512.New384()
+	h.Write(r[:])
+	h.Write(digest)
+	copy(r[:], h.Sum(nil))
+}
+
+func sha384(data []byte) []byte {
+	h := sha512.Sum384(data)
+	return h[:]
+}
+
+func utf16le(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	out := make([]byte, 0, 2*len(codes))
+	for _, c := range codes {
+		out = append(out, byte(c), byte(c>>8))
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package measurement
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// buildTestFirmware lays out a minimal OVMF image with a TDVF metadata describing a single
+// measured page, a single unmeasured page and permanent memory, which is not added
+func buildTestFirmware(t *testing.T) []byte {
+	t.Helper()
+
+	fw := make([]byte, 4*pageSize)
+	for i := 0; i < pageSize; i++ {
+		fw[i] = byte(i)
+	}
+
+	metadata := 2 * pageSize
+	copy(fw[metadata:], "TDVF")
+	binary.LittleEndian.PutUint32(fw[metadata+4:], tdvfMetadataHeaderSize+3*tdvfSectionEntrySize)
+	binary.LittleEndian.PutUint32(fw[metadata+8:], 1)
+	binary.LittleEndian.PutUint32(fw[metadata+12:], 3)
+
+	sections := []tdvfSection{
+		{DataOffset: 0, RawDataSize: pageSize, MemoryAddress: 0xffc00000, MemoryDataSize: pageSize, Type: 0, Attributes: tdvfSectionAttributeMrExtend},
+		{DataOffset: 0, RawDataSize: 0, MemoryAddress: 0x800000, MemoryDataSize: pageSize, Type: 3, Attributes: 0},
+		{DataOffset: 0, RawDataSize: 0, MemoryAddress: 0x1000000, MemoryDataSize: 2 * pageSize, Type: tdvfSectionTypePermMem, Attributes: tdvfSectionAttributePageAug},
+	}
+	for i, s := range sections {
+		entry := metadata + tdvfMetadataHeaderSize + i*tdvfSectionEntrySize
+		binary.LittleEndian.PutUint32(fw[entry:], s.DataOffset)
+		binary.LittleEndian.PutUint32(fw[entry+4:], s.RawDataSize)
+		binary.LittleEndian.PutUint64(fw[entry+8:], s.MemoryAddress)
+		binary.LittleEndian.PutUint64(fw[entry+16:], s.MemoryDataSize)
+		binary.LittleEndian.PutUint32(fw[entry+24:], s.Type)
+		binary.LittleEndian.PutUint32(fw[entry+28:], s.Attributes)
+	}
+
+	// OVMF table: [offset u32][len u16][guid] followed by [table len u16][footer guid] 48 bytes before the end
+	footer := len(fw) - 48
+	copy(fw[footer:], ovmfTableFooterGUID)
+	binary.LittleEndian.PutUint16(fw[footer-2:], 16+2+4+2+16)
+	entry := footer - 2
+	copy(fw[entry-16:], tdxMetadataOffsetGUID)
+	binary.LittleEndian.PutUint16(fw[entry-18:], 4+2+16)
+	binary.LittleEndian.PutUint32(fw[entry-22:], uint32(len(fw)-metadata))
+
+	return fw
+}
+
+func Test_ComputeMrtd(t *testing.T) {
+	fw := buildTestFirmware(t)
+
+	sections, err := parseTdvfSections(fw)
+	require.NoError(t, err)
+	require.Len(t, sections, 3)
+	require.Equal(t, uint64(0xffc00000), sections[0].MemoryAddress)
+
+	expected := sha512.New384()
+	op := func(name string, gpa uint64) []byte {
+		buf := make([]byte, 128)
+		copy(buf, name)
+		binary.LittleEndian.PutUint64(buf[16:], gpa)
+		return buf
+	}
+	expected.Write(op("MEM.PAGE.ADD", 0xffc00000))
+	for chunk := 0; chunk < pageSize; chunk += 256 {
+		expected.Write(op("MR.EXTEND", 0xffc00000+uint64(chunk)))
+		expected.Write(fw[chunk : chunk+256])
+	}
+	expected.Write(op("MEM.PAGE.ADD", 0x800000))
+
+	mrtd, err := computeMrtd(fw)
+	require.NoError(t, err)
+	require.Equal(t, expected.Sum(nil), mrtd)
+	// As computed independently of this package, the permanent memory is not part of it
+	require.Equal(t, "ca8101522746d74fc973adecba34dc1ea06623404d20e0ca92bdc402f2ee445565fff220eb12fb2a5f4c095b44f18038", hex.EncodeToString(mrtd))
+
+	_, err = computeMrtd(make([]byte, pageSize))
+	require.ErrorIs(t, err, ErrNoTdvfMetadata)
+}
+
+func Test_BundleDigest_MatchesShell(t *testing.T) {
+	if _, err := exec.LookPath("sha384sum"); err != nil {
+		t.Skip("sha384sum not available")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "deployment.yaml"), []byte("kind: Pod\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a-image.tar"), []byte("image"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "B-image.tar"), []byte("other image"), 0o600))
+
+	digest, err := BundleDigest(dir)
+	require.NoError(t, err)
+
+	// Same pipeline as kutee-start in image/setup.sh
+	cmd := exec.Command("bash", "-c", `find . -maxdepth 1 -type f -printf '%P\n' | LC_ALL=C sort | xargs -r -d '\n' sha384sum | sha384sum | cut -d' ' -f1`)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	require.Equal(t, strings.TrimSpace(string(out)), digest)
+}
+
+func Test_Measure_FirmwareOnly(t *testing.T) {
+	fwPath := filepath.Join(t.TempDir(), "OVMF.fd")
+	require.NoError(t, os.WriteFile(fwPath, buildTestFirmware(t), 0o600))
+
+	m, err := Measure(Inputs{FirmwarePath: fwPath}, "digest")
+	require.NoError(t, err)
+	require.Len(t, m.MRTD, 2*sha512.Size384)
+	require.Empty(t, m.RTMR1)
+	require.Empty(t, m.RTMR2)
+	require.Equal(t, "digest", m.BundleDigest)
+	// Without a kernel, nothing binds the bundle to the measurement
+	require.False(t, m.Measured)
+
+	_, err = hex.DecodeString(m.MRTD)
+	require.NoError(t, err)
+}
+
+func Test_RtmrExtend(t *testing.T) {
+	r := newRtmr()
+	digest := sha384([]byte("event"))
+	r.extend(digest)
+
+	expected := sha512.Sum384(append(make([]byte, sha512.Size384), digest...))
+	require.Equal(t, expected[:], r[:])
+}
@@ -0,0 +1,157 @@
+package measurement
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const pageSize = 4096
+
+// GUIDs are stored in their little-endian (EFI) byte order
+var (
+	ovmfTableFooterGUID   = []byte{0xde, 0x82, 0xb5, 0x96, 0xb2, 0x1f, 0xf7, 0x45, 0xba, 0xea, 0xa3, 0x66, 0xc5, 0x5a, 0x08, 0x2d} // 96b582de-1fb2-45f7-baea-a366c55a082d
+	tdxMetadataOffsetGUID = []byte{0x35, 0x65, 0x7a, 0xe4, 0x4a, 0x98, 0x98, 0x47, 0x86, 0x5e, 0x46, 0x85, 0xa7, 0xbf, 0x8e, 0xc2} // e47a6535-984a-4798-865e-4685a7bf8ec2
+)
+
+const (
+	tdvfSectionAttributeMrExtend = 1 << 0
+	// tdvfSectionAttributePageAug marks the sections the TD accepts itself, the VMM doesn't add them
+	tdvfSectionAttributePageAug = 1 << 1
+
+	tdvfSectionTypePermMem = 4
+
+	tdvfMetadataHeaderSize = 16
+	tdvfSectionEntrySize   = 32
+)
+
+var ErrNoTdvfMetadata = errors.New("firmware does not contain TDVF metadata")
+
+type tdvfSection struct {
+	DataOffset     uint32
+	RawDataSize    uint32
+	MemoryAddress  uint64
+	MemoryDataSize uint64
+	Type           uint32
+	Attributes     uint32
+}
+
+// findOvmfTableEntry walks the GUIDed table at the end of an OVMF image, see qemu's pc_system_ovmf_table_find
+func findOvmfTableEntry(fw []byte, guid []byte) ([]byte, bool) {
+	if len(fw) < 48 {
+		return nil, false
+	}
+
+	footer := len(fw) - 48
+	if !bytes.Equal(fw[footer:footer+16], ovmfTableFooterGUID) {
+		return nil, false
+	}
+
+	ptr := footer - 2
+	tableLen := int(binary.LittleEndian.Uint16(fw[ptr:])) - 16 - 2
+	if tableLen <= 0 || tableLen > ptr {
+		return nil, false
+	}
+
+	for tableLen >= 16+2 {
+		entryGUID := fw[ptr-16 : ptr]
+		entryLen := int(binary.LittleEndian.Uint16(fw[ptr-16-2:]))
+		if entryLen < 16+2 || entryLen > tableLen {
+			return nil, false
+		}
+
+		ptr -= entryLen
+		tableLen -= entryLen
+		if bytes.Equal(entryGUID, guid) {
+			return fw[ptr : ptr+entryLen-16-2], true
+		}
+	}
+
+	return nil, false
+}
+
+func parseTdvfSections(fw []byte) ([]tdvfSection, error) {
+	data, ok := findOvmfTableEntry(fw, tdxMetadataOffsetGUID)
+	if !ok || len(data) < 4 {
+		return nil, ErrNoTdvfMetadata
+	}
+
+	offset := len(fw) - int(binary.LittleEndian.Uint32(data))
+	if offset < 0 || offset+tdvfMetadataHeaderSize > len(fw) {
+		return nil, fmt.Errorf("invalid TDVF metadata offset %d", offset)
+	}
+
+	header := fw[offset : offset+tdvfMetadataHeaderSize]
+	if string(header[0:4]) != "TDVF" {
+		return nil, fmt.Errorf("invalid TDVF metadata signature %q", header[0:4])
+	}
+
+	nSections := int(binary.LittleEndian.Uint32(header[12:16]))
+	entries := offset + tdvfMetadataHeaderSize
+	if entries+nSections*tdvfSectionEntrySize > len(fw) {
+		return nil, fmt.Errorf("TDVF metadata with %d sections does not fit the firmware", nSections)
+	}
+
+	sections := make([]tdvfSection, nSections)
+	if err := binary.Read(bytes.NewReader(fw[entries:entries+nSections*tdvfSectionEntrySize]), binary.LittleEndian, sections); err != nil {
+		return nil, err
+	}
+
+	for _, s := range sections {
+		if uint64(s.DataOffset)+uint64(s.RawDataSize) > uint64(len(fw)) {
+			return nil, fmt.Errorf("TDVF section at %#x points outside of the firmware", s.MemoryAddress)
+		}
+		if s.MemoryAddress%pageSize != 0 || s.MemoryDataSize%pageSize != 0 {
+			return nil, fmt.Errorf("TDVF section at %#x is not page aligned", s.MemoryAddress)
+		}
+	}
+
+	return sections, nil
+}
+
+// computeMrtd replays the TDH.MEM.PAGE.ADD and TDH.MR.EXTEND operations
+// the VMM performs when loading the TDVF sections into the TD
+func computeMrtd(fw []byte) ([]byte, error) {
+	sections, err := parseTdvfSections(fw)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha512.New384()
+	buf := make([]byte, 128)
+	for _, s := range sections {
+		// Permanent memory is accepted by the TD at runtime, with TDH.MEM.PAGE.AUG which isn't measured
+		if s.Type == tdvfSectionTypePermMem || s.Attributes&tdvfSectionAttributePageAug != 0 {
+			continue
+		}
+
+		// Memory past the raw data is zero-filled
+		mem := make([]byte, s.MemoryDataSize)
+		copy(mem, fw[s.DataOffset:s.DataOffset+min(s.RawDataSize, uint32(s.MemoryDataSize))])
+
+		for page := uint64(0); page < s.MemoryDataSize; page += pageSize {
+			gpa := s.MemoryAddress + page
+
+			clear(buf)
+			copy(buf, "MEM.PAGE.ADD")
+			binary.LittleEndian.PutUint64(buf[16:], gpa)
+			h.Write(buf)
+
+			if s.Attributes&tdvfSectionAttributeMrExtend == 0 {
+				continue
+			}
+
+			for chunk := uint64(0); chunk < pageSize; chunk += 256 {
+				clear(buf)
+				copy(buf, "MR.EXTEND")
+				binary.LittleEndian.PutUint64(buf[16:], gpa+chunk)
+				h.Write(buf)
+				h.Write(mem[page+chunk : page+chunk+256])
+			}
+		}
+	}
+
+	return h.Sum(nil), nil
+}
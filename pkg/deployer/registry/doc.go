@@ -0,0 +1,2 @@
+// Package registry persists the deployments started by the deployer.
+package registry
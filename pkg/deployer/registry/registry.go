@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"deployer/jobs"
+	"kutee/statefile"
+)
+
+var ErrNotFound = errors.New("deployment not found")
+
+const registryFileName = "deployments.json"
+
+type Deployment struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	BundleName   string `json:"bundle_name"`
+	BundleSHA256 string `json:"bundle_sha256"`
+	Creator      string `json:"creator"`
+	// Publisher is the hex encoded key the bundle is signed with, empty for unsigned bundles
+	Publisher string `json:"publisher,omitempty"`
+
+	// Workspace holds the bundle and the VM image, it lives as long as the deployment
+	Workspace   string `json:"workspace"`
+	VMImagePath string `json:"vm_image_path"`
+	// Pid of the VMM running the TD, zero until it's started
+	Pid int `json:"pid,omitempty"`
+
+	Job jobs.Snapshot `json:"job"`
+}
+
+// Summary is what clients are shown of a deployment, it leaves out the deployer's host paths and processes
+type Summary struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	BundleName   string `json:"bundle_name"`
+	BundleSHA256 string `json:"bundle_sha256"`
+	Creator      string `json:"creator"`
+	Publisher    string `json:"publisher,omitempty"`
+
+	Job jobs.Snapshot `json:"job"`
+}
+
+func (d Deployment) Summary() Summary {
+	return Summary{
+		ID:           d.ID,
+		CreatedAt:    d.CreatedAt,
+		BundleName:   d.BundleName,
+		BundleSHA256: d.BundleSHA256,
+		Creator:      d.Creator,
+		Publisher:    d.Publisher,
+		Job:          d.Job,
+	}
+}
+
+// Registry keeps the deployments in a JSON file in the state directory
+type Registry struct {
+	deployments *statefile.Map[Deployment]
+}
+
+// Open loads the registry from stateDir, creating the directory if needed
+func Open(stateDir string) (*Registry, error) {
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	deployments, err := statefile.OpenMap[Deployment](filepath.Join(stateDir, registryFileName))
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{deployments: deployments}, nil
+}
+
+func (r *Registry) Get(id string) (Deployment, error) {
+	d, ok := r.deployments.Get(id)
+	if !ok {
+		return Deployment{}, ErrNotFound
+	}
+	return d, nil
+}
+
+// List returns all deployments, oldest first
+func (r *Registry) List() []Deployment {
+	return r.deployments.List(func(a, b Deployment) bool { return a.CreatedAt.Before(b.CreatedAt) })
+}
+
+func (r *Registry) Create(d Deployment) error {
+	created, err := r.deployments.Create(d.ID, d)
+	if err == nil && !created {
+		return errors.New("deployment already exists")
+	}
+	return err
+}
+
+// Update applies fn to the stored deployment and persists the result
+func (r *Registry) Update(id string, fn func(d *Deployment)) error {
+	found, err := r.deployments.Update(id, fn)
+	if err == nil && !found {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *Registry) Delete(id string) error {
+	found, err := r.deployments.Delete(id)
+	if err == nil && !found {
+		return ErrNotFound
+	}
+	return err
+}
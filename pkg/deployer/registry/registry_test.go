@@ -0,0 +1,43 @@
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"deployer/jobs"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Registry_Persists(t *testing.T) {
+	stateDir := t.TempDir()
+
+	r, err := Open(stateDir)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, r.Create(Deployment{ID: "b", CreatedAt: now.Add(time.Second), Job: jobs.Snapshot{ID: "b", Status: jobs.StatusRunning}}))
+	require.NoError(t, r.Create(Deployment{ID: "a", CreatedAt: now, Job: jobs.Snapshot{ID: "a", Status: jobs.StatusPending}}))
+	require.Error(t, r.Create(Deployment{ID: "a"}))
+
+	require.NoError(t, r.Update("b", func(d *Deployment) { d.Pid = 42 }))
+	require.ErrorIs(t, r.Update("missing", func(d *Deployment) {}), ErrNotFound)
+
+	reopened, err := Open(stateDir)
+	require.NoError(t, err)
+
+	deployments := reopened.List()
+	require.Len(t, deployments, 2)
+	require.Equal(t, "a", deployments[0].ID)
+	require.Equal(t, "b", deployments[1].ID)
+	require.Equal(t, 42, deployments[1].Pid)
+
+	require.NoError(t, reopened.Delete("a"))
+	require.ErrorIs(t, reopened.Delete("a"), ErrNotFound)
+	_, err = reopened.Get("a")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	reopened, err = Open(stateDir)
+	require.NoError(t, err)
+	require.Len(t, reopened.List(), 1)
+}
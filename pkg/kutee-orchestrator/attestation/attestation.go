@@ -0,0 +1,130 @@
+package attestation
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ReportDataSize is the size of the data an attestation binds to the TD
+const ReportDataSize = 64
+
+var (
+	ErrInvalidEvidence = errors.New("invalid attestation evidence")
+	// ErrNotAllowed is returned for TDs whose measurement the policy does not allow
+	ErrNotAllowed = errors.New("measurement is not allowed")
+)
+
+// Measurement is the hex encoded measurement of a TD, as the deployer computes it
+type Measurement struct {
+	MRTD  string `json:"mrtd"`
+	RTMR0 string `json:"rtmr0,omitempty"`
+	RTMR1 string `json:"rtmr1,omitempty"`
+	RTMR2 string `json:"rtmr2,omitempty"`
+	RTMR3 string `json:"rtmr3,omitempty"`
+	// TDAttributes and XFAM are the little endian attributes and extended features the TD runs with
+	TDAttributes string `json:"td_attributes,omitempty"`
+	XFAM         string `json:"xfam,omitempty"`
+	// MRConfigID, MROwner and MROwnerConfig are provided by the host when creating the TD
+	MRConfigID    string `json:"mrconfigid,omitempty"`
+	MROwner       string `json:"mrowner,omitempty"`
+	MROwnerConfig string `json:"mrownerconfig,omitempty"`
+}
+
+// tdAttributesDebug is the bit of the first byte of TDAttributes set for debug TDs, whose
+// memory and registers the host can read and write
+const tdAttributesDebug = 0x01
+
+// Debug tells whether the measurement is that of a debug TD, or has attributes that are not hex
+func (m *Measurement) Debug() bool {
+	attributes, err := hex.DecodeString(m.TDAttributes)
+	return err != nil || len(attributes) > 0 && attributes[0]&tdAttributesDebug != 0
+}
+
+// Issuer produces evidence that the TD it runs in attests reportData
+type Issuer interface {
+	Issue(reportData [ReportDataSize]byte) ([]byte, error)
+}
+
+// Verifier checks evidence produced by an Issuer, and returns the measurement it proves
+type Verifier interface {
+	Verify(evidence []byte, reportData [ReportDataSize]byte) (*Measurement, error)
+}
+
+// Policy lists the measurements of the TDs trusted. RTMR0, RTMR3, TDAttributes and XFAM can have
+// any value if an allowed measurement leaves them empty, MRConfigID, MROwner and MROwnerConfig must
+// be zeros. Debug TDs are never trusted.
+type Policy struct {
+	Allowed []Measurement
+}
+
+// LoadPolicy reads a JSON list of measurements, or a single one such as the deployer's measurement.json.
+// Measurements need an MRTD, RTMR1 and RTMR2, so that only the measured kernel, initrd and command line
+// are trusted.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err = json.Unmarshal(data, &p.Allowed)
+	} else {
+		var m Measurement
+		err = json.Unmarshal(data, &m)
+		p.Allowed = []Measurement{m}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid measurement policy %s: %w", path, err)
+	}
+
+	for _, m := range p.Allowed {
+		if m.MRTD == "" || m.RTMR1 == "" || m.RTMR2 == "" {
+			return nil, fmt.Errorf("invalid measurement policy %s: measurements need an mrtd, rtmr1 and rtmr2, "+
+				"measured with the kernel the TD boots", path)
+		}
+	}
+	return p, nil
+}
+
+// Check returns ErrNotAllowed unless the measurement matches one of the allowed ones
+func (p *Policy) Check(m *Measurement) error {
+	if m.Debug() {
+		return fmt.Errorf("%w: debug TD, mrtd %s", ErrNotAllowed, m.MRTD)
+	}
+	for _, allowed := range p.Allowed {
+		if matches(allowed.MRTD, m.MRTD) && matches(allowed.RTMR0, m.RTMR0) && matches(allowed.RTMR1, m.RTMR1) &&
+			matches(allowed.RTMR2, m.RTMR2) && matches(allowed.RTMR3, m.RTMR3) &&
+			matches(allowed.TDAttributes, m.TDAttributes) && matches(allowed.XFAM, m.XFAM) &&
+			matchesOrZero(allowed.MRConfigID, m.MRConfigID) && matchesOrZero(allowed.MROwner, m.MROwner) &&
+			matchesOrZero(allowed.MROwnerConfig, m.MROwnerConfig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: mrtd %s", ErrNotAllowed, m.MRTD)
+}
+
+func matches(allowed string, actual string) bool {
+	if allowed == "" {
+		return true
+	}
+	a, err := hex.DecodeString(allowed)
+	if err != nil {
+		return false
+	}
+	b, err := hex.DecodeString(actual)
+	return err == nil && bytes.Equal(a, b)
+}
+
+// matchesOrZero is matches for the registers which must be zeros unless allowed otherwise
+func matchesOrZero(allowed string, actual string) bool {
+	if allowed != "" {
+		return matches(allowed, actual)
+	}
+	b, err := hex.DecodeString(actual)
+	return err == nil && bytes.Count(b, []byte{0}) == len(b)
+}
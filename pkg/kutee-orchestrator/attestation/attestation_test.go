@@ -0,0 +1,66 @@
+package attestation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Policy(t *testing.T) {
+	mrtd := strings.Repeat("aa", 48)
+	rtmr1 := strings.Repeat("dd", 48)
+	rtmr2 := strings.Repeat("bb", 48)
+	trusted := Measurement{MRTD: mrtd, RTMR1: rtmr1, RTMR2: rtmr2}
+
+	// The deployer's measurement.json is a policy of its own
+	path := filepath.Join(t.TempDir(), "measurement.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"mrtd": "`+mrtd+`", "rtmr1": "`+rtmr1+`", "rtmr2": "`+strings.ToUpper(rtmr2)+`", "bundle_digest": "ff"}`), 0o600))
+	p, err := LoadPolicy(path)
+	require.NoError(t, err)
+
+	require.NoError(t, p.Check(&trusted))
+	require.NoError(t, p.Check(&Measurement{MRTD: mrtd, RTMR0: strings.Repeat("cc", 48), RTMR1: rtmr1, RTMR2: rtmr2,
+		TDAttributes: "0000001000000000", MRConfigID: strings.Repeat("00", 48)}))
+	require.ErrorIs(t, p.Check(&Measurement{MRTD: mrtd, RTMR1: rtmr1, RTMR2: strings.Repeat("cc", 48)}), ErrNotAllowed)
+	require.ErrorIs(t, p.Check(&Measurement{MRTD: strings.Repeat("cc", 48), RTMR1: rtmr1, RTMR2: rtmr2}), ErrNotAllowed)
+
+	// Debug TDs are refused, and so are the registers the host sets unless the policy allows them
+	debug := trusted
+	debug.TDAttributes = "0100000000000000"
+	require.ErrorIs(t, p.Check(&debug), ErrNotAllowed)
+	owned := trusted
+	owned.MROwner = strings.Repeat("ee", 48)
+	require.ErrorIs(t, p.Check(&owned), ErrNotAllowed)
+	require.NoError(t, (&Policy{Allowed: []Measurement{owned}}).Check(&owned))
+
+	// Measurements without the kernel's RTMRs would trust any kernel, initrd and command line
+	for _, policy := range []string{
+		`[{"rtmr1": "` + rtmr1 + `", "rtmr2": "` + rtmr2 + `"}]`,
+		`{"mrtd": "` + mrtd + `", "bundle_digest": "ff"}`,
+		`{"mrtd": "` + mrtd + `", "rtmr1": "` + rtmr1 + `"}`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(policy), 0o600))
+		_, err = LoadPolicy(path)
+		require.ErrorContains(t, err, "need an mrtd, rtmr1 and rtmr2")
+	}
+}
+
+func Test_Mock(t *testing.T) {
+	issuer := &MockIssuer{Measurement: Measurement{MRTD: "aa"}}
+	var reportData [ReportDataSize]byte
+	copy(reportData[:], "data")
+
+	evidence, err := issuer.Issue(reportData)
+	require.NoError(t, err)
+
+	m, err := MockVerifier{}.Verify(evidence, reportData)
+	require.NoError(t, err)
+	require.Equal(t, "aa", m.MRTD)
+
+	var other [ReportDataSize]byte
+	_, err = MockVerifier{}.Verify(evidence, other)
+	require.ErrorIs(t, err, ErrInvalidEvidence)
+}
@@ -0,0 +1,2 @@
+// Package attestation proves to peers which code a TD runs, and checks their proofs.
+package attestation
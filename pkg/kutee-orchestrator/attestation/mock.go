@@ -0,0 +1,35 @@
+package attestation
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MockIssuer issues evidence claiming Measurement, which anyone can forge.
+// It's only meant for tests and development outside of a TD.
+type MockIssuer struct {
+	Measurement Measurement
+}
+
+type mockEvidence struct {
+	Measurement Measurement `json:"measurement"`
+	ReportData  []byte      `json:"report_data"`
+}
+
+func (i *MockIssuer) Issue(reportData [ReportDataSize]byte) ([]byte, error) {
+	return json.Marshal(mockEvidence{Measurement: i.Measurement, ReportData: reportData[:]})
+}
+
+// MockVerifier accepts the evidence of a MockIssuer
+type MockVerifier struct{}
+
+func (MockVerifier) Verify(evidence []byte, reportData [ReportDataSize]byte) (*Measurement, error) {
+	var e mockEvidence
+	if err := json.Unmarshal(evidence, &e); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEvidence, err)
+	}
+	if string(e.ReportData) != string(reportData[:]) {
+		return nil, fmt.Errorf("%w: the evidence attests other report data", ErrInvalidEvidence)
+	}
+	return &e.Measurement, nil
+}
@@ -0,0 +1,79 @@
+package attestation
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/google/go-tdx-guest/abi"
+	"github.com/google/go-tdx-guest/client"
+	pb "github.com/google/go-tdx-guest/proto/tdx"
+	"github.com/google/go-tdx-guest/verify"
+)
+
+// TDXIssuer issues TDX quotes, through the kernel's configfs-tsm interface
+type TDXIssuer struct{}
+
+func (TDXIssuer) Issue(reportData [ReportDataSize]byte) ([]byte, error) {
+	provider, err := client.GetQuoteProvider()
+	if err != nil {
+		return nil, err
+	}
+	quote, err := client.GetRawQuote(provider, reportData)
+	if err != nil {
+		return nil, fmt.Errorf("could not get a TDX quote: %w", err)
+	}
+	return quote, nil
+}
+
+// TDXVerifier checks TDX quotes against Intel's root of trust, with the collateral and
+// revocation lists of Intel's PCS
+type TDXVerifier struct{}
+
+func (TDXVerifier) Verify(evidence []byte, reportData [ReportDataSize]byte) (*Measurement, error) {
+	parsed, err := abi.QuoteToProto(evidence)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEvidence, err)
+	}
+	quote, ok := parsed.(*pb.QuoteV4)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported quote %T", ErrInvalidEvidence, parsed)
+	}
+
+	options := verify.DefaultOptions()
+	options.GetCollateral = true
+	options.CheckRevocations = true
+	if err := verify.TdxQuote(quote, options); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEvidence, err)
+	}
+
+	body := quote.GetTdQuoteBody()
+	if !bytes.Equal(body.GetReportData(), reportData[:]) {
+		return nil, fmt.Errorf("%w: the quote attests other report data", ErrInvalidEvidence)
+	}
+
+	rtmrs := body.GetRtmrs()
+	if len(rtmrs) != 4 {
+		return nil, fmt.Errorf("%w: the quote has %d RTMRs", ErrInvalidEvidence, len(rtmrs))
+	}
+	if len(body.GetTdAttributes()) != 8 {
+		return nil, fmt.Errorf("%w: the quote has %d bytes of TD attributes", ErrInvalidEvidence, len(body.GetTdAttributes()))
+	}
+	m := &Measurement{
+		MRTD:          hex.EncodeToString(body.GetMrTd()),
+		RTMR0:         hex.EncodeToString(rtmrs[0]),
+		RTMR1:         hex.EncodeToString(rtmrs[1]),
+		RTMR2:         hex.EncodeToString(rtmrs[2]),
+		RTMR3:         hex.EncodeToString(rtmrs[3]),
+		TDAttributes:  hex.EncodeToString(body.GetTdAttributes()),
+		XFAM:          hex.EncodeToString(body.GetXfam()),
+		MRConfigID:    hex.EncodeToString(body.GetMrConfigId()),
+		MROwner:       hex.EncodeToString(body.GetMrOwner()),
+		MROwnerConfig: hex.EncodeToString(body.GetMrOwnerConfig()),
+	}
+	// The host can read and write the memory of debug TDs, whatever they measure
+	if m.Debug() {
+		return nil, fmt.Errorf("%w: debug TD, mrtd %s", ErrNotAllowed, m.MRTD)
+	}
+	return m, nil
+}
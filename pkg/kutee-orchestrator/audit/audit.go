@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	// ActionRotateSecret is a rotation of an autosecret, which restarts the workloads using it
+	ActionRotateSecret = "rotate_secret"
+	ActionIssueToken   = "issue_token"
+	ActionRevokeToken  = "revoke_token"
+)
+
+type Entry struct {
+	Time time.Time `json:"time"`
+	// User is who made the change
+	User     string `json:"user"`
+	Action   string `json:"action"`
+	Workload string `json:"workload,omitempty"`
+	// Secret is the secret rotated
+	Secret string `json:"secret,omitempty"`
+	// Token is the id of the token issued or revoked
+	Token string `json:"token,omitempty"`
+	// SHA256 is the digest of the manifest applied, empty for deletions
+	SHA256   string `json:"sha256,omitempty"`
+	Revision int    `json:"revision,omitempty"`
+	// Error is set when the change failed, the cluster may have been partially changed
+	Error string `json:"error,omitempty"`
+}
+
+// Log appends entries to a file, one JSON object per line.
+// Entries are written before Record returns, and never rewritten.
+type Log struct {
+	path string
+
+	mu sync.Mutex
+}
+
+// Open returns the log at path, creating its directory if needed
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return &Log{path: path}, nil
+}
+
+func (l *Log) Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Entries returns the recorded entries, oldest first
+func (l *Log) Entries() ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []Entry{}
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,33 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Log(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "audit.log")
+
+	l, err := Open(path)
+	require.NoError(t, err)
+
+	entries, err := l.Entries()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.NoError(t, l.Record(Entry{User: "alice", Action: ActionCreate, Workload: "a", SHA256: "ab", Revision: 1}))
+	require.NoError(t, l.Record(Entry{User: "bob", Action: ActionDelete, Workload: "a", Error: "unreachable"}))
+
+	// Entries survive the log being reopened
+	l, err = Open(path)
+	require.NoError(t, err)
+	entries, err = l.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "alice", entries[0].User)
+	require.False(t, entries[0].Time.IsZero())
+	require.Equal(t, ActionDelete, entries[1].Action)
+	require.Equal(t, "unreachable", entries[1].Error)
+}
@@ -0,0 +1,2 @@
+// Package audit records the changes made to the workloads of the orchestrator.
+package audit
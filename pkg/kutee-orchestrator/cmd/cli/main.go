@@ -1,14 +1,30 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"kutee/auth"
 	"kutee/common"
+	"kutee/ociarchive"
+	"kutee/passwords"
+	"kutee/upload"
+
+	"kutee-orchestrator/attestation"
+	"kutee-orchestrator/httpserver"
+	"kutee-orchestrator/ratls"
 
 	"github.com/urfave/cli/v2" // imports as package "cli"
 )
@@ -25,26 +41,100 @@ var flags []cli.Flag = []cli.Flag{
 		Usage: "log debug messages",
 	},
 	&cli.StringFlag{
-		Name:  "username",
-		Value: "test",
-		Usage: "username to authenticate with",
+		Name:    "username",
+		Value:   "test",
+		Usage:   "username to authenticate with, unless a token is stored for the url",
+		EnvVars: []string{"KUTEE_USERNAME"},
 	},
 	&cli.StringFlag{
-		Name:  "password",
-		Value: "test",
-		Usage: "password to authenticate with",
+		Name:    "password",
+		Value:   "test",
+		Usage:   "password to authenticate with, unless a token is stored for the url",
+		EnvVars: []string{"KUTEE_PASSWORD"},
 	},
 	&cli.StringFlag{
 		Name:  "url",
 		Value: "http://localhost:8087",
 		Usage: "kutee service url",
 	},
+	&cli.StringFlag{
+		Name:  "token-file",
+		Value: defaultTokenFile(),
+		Usage: "file keeping the tokens created for each url, used until they expire",
+	},
+	&cli.StringFlag{
+		Name:  "measurements",
+		Value: "",
+		Usage: "JSON measurement, or list of them, of the orchestrators trusted, as the deployer computes them. Needed for https urls, whose attestation is verified before anything is sent",
+	},
+	&cli.StringFlag{
+		Name:  "attestation",
+		Value: "tdx",
+		Usage: "how to verify the attestation of https urls: tdx, or mock, which anyone can forge",
+	},
+	&cli.StringFlag{
+		Name:  "client-cert",
+		Value: "",
+		Usage: "PEM client certificate to authenticate with over https, instead of the username and password unless they are set",
+	},
+	&cli.StringFlag{
+		Name:  "client-key",
+		Value: "",
+		Usage: "PEM key of the client certificate",
+	},
+}
+
+var blobDirFlag cli.Flag = &cli.StringFlag{
+	Name:  "blob-dir",
+	Value: "",
+	Usage: "directory holding the layer blobs of the image, defaults to the image's directory",
 }
 
 var imageFlag cli.Flag = &cli.StringFlag{
 	Name:  "image",
 	Value: "img.tar",
-	Usage: "path to image to upload",
+	Usage: "path to image to upload, named as the deployer bundles it (docker.io_library_app-latest.tar for docker.io/library/app:latest)",
+}
+
+var retriesFlag cli.Flag = &cli.IntFlag{
+	Name:  "retries",
+	Value: 3,
+	Usage: "how many times to retry a chunk of an upload that failed, rerun to resume it afterwards",
+}
+
+var manifestFlag cli.Flag = &cli.StringFlag{
+	Name:     "manifest",
+	Usage:    "path to the kubernetes manifest of the workload",
+	Required: true,
+}
+
+var secretNameFlag cli.Flag = &cli.StringFlag{
+	Name:     "name",
+	Usage:    "name of the autosecret, as the workloads refer to it",
+	Required: true,
+}
+
+var tokenFlags []cli.Flag = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "scope",
+		Usage: "permission of the token (read, upload, deploy, operate, audit, revoke_tokens), all the user's if none",
+	},
+	&cli.StringFlag{
+		Name:  "ttl",
+		Value: "1h",
+		Usage: "how long the token is valid for",
+	},
+}
+
+var tokenIDFlag cli.Flag = &cli.StringFlag{
+	Name:  "id",
+	Usage: "id of the token to revoke, as recorded in the audit log, the stored token if empty",
+}
+
+var workloadIDFlag cli.Flag = &cli.StringFlag{
+	Name:     "id",
+	Usage:    "id of the workload, as returned when it was created",
+	Required: true,
 }
 
 func main() {
@@ -59,6 +149,8 @@ func main() {
 				Usage: "Uploads an image tarball",
 				Flags: append([]cli.Flag{
 					imageFlag,
+					blobDirFlag,
+					retriesFlag,
 				}, flags...),
 				Action: runUpload,
 			},
@@ -68,6 +160,67 @@ func main() {
 				Flags:  flags,
 				Action: runStart,
 			},
+			&cli.Command{
+				Name:  "workload",
+				Usage: "Manages the workloads submitted to the orchestrator",
+				Subcommands: []*cli.Command{
+					&cli.Command{
+						Name:   "create",
+						Usage:  "Submits a manifest as a new workload, and applies it",
+						Flags:  append([]cli.Flag{manifestFlag}, flags...),
+						Action: runWorkloadCreate,
+					},
+					&cli.Command{
+						Name:   "update",
+						Usage:  "Applies a manifest as the new revision of a workload",
+						Flags:  append([]cli.Flag{workloadIDFlag, manifestFlag}, flags...),
+						Action: runWorkloadUpdate,
+					},
+					&cli.Command{
+						Name:   "list",
+						Usage:  "Lists the workloads",
+						Flags:  flags,
+						Action: runWorkloadList,
+					},
+					&cli.Command{
+						Name:   "delete",
+						Usage:  "Deletes a workload from the cluster",
+						Flags:  append([]cli.Flag{workloadIDFlag}, flags...),
+						Action: runWorkloadDelete,
+					},
+				},
+			},
+			&cli.Command{
+				Name:  "secret",
+				Usage: "Manages the autosecrets of the workloads",
+				Subcommands: []*cli.Command{
+					&cli.Command{
+						Name:   "rotate",
+						Usage:  "Replaces an autosecret with a new one, and restarts the pods using it",
+						Flags:  append([]cli.Flag{secretNameFlag}, flags...),
+						Action: runSecretRotate,
+					},
+				},
+			},
+			&cli.Command{
+				Name:  "token",
+				Usage: "Manages the API tokens, which the other commands use instead of the password",
+				Subcommands: []*cli.Command{
+					&cli.Command{
+						Name:   "create",
+						Usage:  "Exchanges the username and password for a token, and stores it until it expires or the orchestrator restarts",
+						Flags:  append(tokenFlags, flags...),
+						Action: runTokenCreate,
+					},
+					&cli.Command{
+						Name:   "revoke",
+						Usage:  "Revokes the stored token and forgets it, or any token by its id",
+						Flags:  append([]cli.Flag{tokenIDFlag}, flags...),
+						Action: runTokenRevoke,
+					},
+				},
+			},
+			passwords.UserCommand(),
 		},
 	}
 
@@ -86,74 +239,82 @@ func runUpload(cCtx *cli.Context) error {
 		Version: common.Version,
 	})
 
-	r, w := io.Pipe()
-	m := multipart.NewWriter(w)
+	image := cCtx.String("image")
+	blobDir := cCtx.String("blob-dir")
+	if blobDir == "" {
+		blobDir = filepath.Dir(image)
+	}
 
-	errCh := make(chan error, 1)
-	go func() {
-		defer w.Close()
-		defer m.Close()
-		part, err := m.CreateFormFile("image-tarball", cCtx.String("image"))
-		if err != nil {
-			log.Error("could not create multipart reader from file", "err", err)
-			errCh <- err
-			return
-		}
-		file, err := os.Open(cCtx.String("image"))
-		if err != nil {
-			log.Error("could not open the file", "err", err)
-			errCh <- err
-			return
-		}
-		defer file.Close()
-		if _, err = io.Copy(part, file); err != nil {
-			log.Error("could not copy part", "err", err)
-			errCh <- err
-			return
-		}
-		errCh <- nil
-	}()
+	// The layers of the image are uploaded first, the server assembles the image from them
+	layers, err := ociarchive.Layers(image)
+	if err != nil {
+		log.Error("could not read the image archive", "err", err)
+		return err
+	}
+	missing, err := ociarchive.MissingBlobs(image, blobDir)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errors.New("missing layer blobs: " + strings.Join(missing, ", "))
+	}
 
-	errCh2 := make(chan error, 1)
-	go func() {
-		client := &http.Client{}
-		req, err := http.NewRequest("POST", cCtx.String("url")+"/api/upload_image", r)
-		if err != nil {
-			log.Error("could not create request", "err", err)
-			errCh2 <- err
-			return
+	for _, layer := range layers {
+		blob := filepath.Join(blobDir, ociarchive.BlobName(layer))
+		if _, err := os.Stat(blob); errors.Is(err, os.ErrNotExist) {
+			continue // stored in the archive itself
 		}
-		req.Header.Add("Content-Type", m.FormDataContentType())
-		req.SetBasicAuth(cCtx.String("username"), cCtx.String("password"))
-
-		res, err := client.Do(req)
-		if err != nil {
-			log.Error("could not upload image", "err", err)
-			errCh2 <- err
-			return
+		if err := uploadFile(cCtx, log, blob); err != nil {
+			return err
 		}
+	}
 
-		rb, _ := io.ReadAll(res.Body)
-		log.With("resp", rb).With("status", res.Status).Info("requested upload")
+	return uploadFile(cCtx, log, image)
+}
+
+// uploadFile uploads the file in chunks, resuming a previous upload of it that was interrupted
+func uploadFile(cCtx *cli.Context, log *slog.Logger, path string) error {
+	log = log.With("file", filepath.Base(path))
 
-		errCh2 <- nil
-	}()
+	httpClient, err := newHTTPClient(cCtx)
+	if err != nil {
+		return err
+	}
 
-	mpErr := <-errCh
-	postErr := <-errCh2
+	client := &upload.Client{
+		HTTPClient: httpClient,
+		URL:        cCtx.String("url") + "/api/uploads",
+		Authorize: func(req *http.Request) {
+			authorize(cCtx, req)
+		},
+		Retries: cCtx.Int("retries"),
+		Log:     log,
+	}
 
-	if postErr != nil {
-		log.Error("could not post", "err", postErr)
+	session, digest, err := client.Upload(path)
+	if err != nil {
+		log.Error("could not upload", "err", err)
+		return err
 	}
 
-	if mpErr != nil {
-		log.Error("could upload multipart", "err", mpErr)
+	res, rb, err := client.Finalize(path, session, digest)
+	if err != nil {
+		log.Error("could not finalize the upload", "err", err)
+		return err
 	}
+	log.With("resp", string(rb)).With("status", res.Status).Info("requested upload")
 
-	if postErr != nil || mpErr != nil {
-		return errors.New("upload failed")
+	if res.StatusCode != http.StatusOK {
+		return errors.New("upload rejected: " + res.Status)
 	}
 
+	var uploaded httpserver.UploadResponse
+	if err := json.Unmarshal(rb, &uploaded); err != nil {
+		return err
+	}
+	if uploaded.SHA256 != digest {
+		return errors.New("the server received " + uploaded.SHA256 + ", expected " + digest)
+	}
 	return nil
 }
 
@@ -167,13 +328,16 @@ func runStart(cCtx *cli.Context) error {
 		Version: common.Version,
 	})
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", cCtx.String("url")+"/api/start_workload", nil)
+	client, err := newHTTPClient(cCtx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cCtx.String("url")+"/api/start_workload", nil)
 	if err != nil {
 		log.Error("could not create request", "err", err)
 		return err
 	}
-	req.SetBasicAuth(cCtx.String("username"), cCtx.String("password"))
+	authorize(cCtx, req)
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -181,12 +345,274 @@ func runStart(cCtx *cli.Context) error {
 		return err
 	}
 
-	rb, _ := io.ReadAll(res.Body)
+	defer res.Body.Close()
+
+	rb, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Error("could not read response", "err", err)
+		return err
+	}
 	log.With("resp", rb).With("status", res.Status).Info("requested start")
 
 	return nil
 }
 
+// requestAPI sends a request to the API at path, and returns the response body if it succeeded
+func requestAPI(cCtx *cli.Context, method string, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, cCtx.String("url")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	authorize(cCtx, req)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/yaml")
+	}
+	return sendRequest(cCtx, req)
+}
+
+// sendRequest sends the request, and returns the response body if it succeeded
+func sendRequest(cCtx *cli.Context, req *http.Request) ([]byte, error) {
+	log := common.SetupLogger(&common.LoggingOpts{
+		Debug:   cCtx.Bool("log-debug"),
+		JSON:    cCtx.Bool("log-json"),
+		Version: common.Version,
+	})
+
+	client, err := newHTTPClient(cCtx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Error("could not send request", "err", err)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	rb, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		log.Error("request failed", "status", res.Status, "resp", strings.TrimSpace(string(rb)))
+		// Tokens don't outlive the orchestrator, the one stored is of no use anymore
+		if res.StatusCode == http.StatusUnauthorized && strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+			if err := storeToken(cCtx, nil); err != nil {
+				return nil, err
+			}
+			return nil, errors.New("request failed: the stored token is no longer valid, the orchestrator may have restarted: create a new one")
+		}
+		return nil, errors.New("request failed: " + res.Status)
+	}
+	return rb, nil
+}
+
+func sendManifest(cCtx *cli.Context, method string, path string) error {
+	f, err := os.Open(cCtx.String("manifest"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rb, err := requestAPI(cCtx, method, "/api/workloads"+path, f)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(rb)
+	return err
+}
+
+func runWorkloadCreate(cCtx *cli.Context) error {
+	return sendManifest(cCtx, http.MethodPost, "")
+}
+
+func runWorkloadUpdate(cCtx *cli.Context) error {
+	return sendManifest(cCtx, http.MethodPut, "/"+cCtx.String("id"))
+}
+
+func runWorkloadList(cCtx *cli.Context) error {
+	rb, err := requestAPI(cCtx, http.MethodGet, "/api/workloads", nil)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(rb)
+	return err
+}
+
+func runWorkloadDelete(cCtx *cli.Context) error {
+	_, err := requestAPI(cCtx, http.MethodDelete, "/api/workloads/"+cCtx.String("id"), nil)
+	return err
+}
+
+func runSecretRotate(cCtx *cli.Context) error {
+	rb, err := requestAPI(cCtx, http.MethodPost, "/api/secrets/"+url.PathEscape(cCtx.String("name"))+"/rotate", nil)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(rb)
+	return err
+}
+
+// tokenExpiryMargin is how long before they expire stored tokens stop being used
+const tokenExpiryMargin = time.Minute
+
+func defaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".kutee-tokens.json"
+	}
+	return filepath.Join(dir, "kutee", "tokens.json")
+}
+
+// loadTokens returns the stored tokens by url
+func loadTokens(cCtx *cli.Context) (map[string]httpserver.TokenResponse, error) {
+	tokens := make(map[string]httpserver.TokenResponse)
+	data, err := os.ReadFile(cCtx.String("token-file"))
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// storeToken stores the token for the url, or forgets it if token is nil
+func storeToken(cCtx *cli.Context, token *httpserver.TokenResponse) error {
+	tokens, err := loadTokens(cCtx)
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		delete(tokens, cCtx.String("url"))
+	} else {
+		tokens[cCtx.String("url")] = *token
+	}
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := cCtx.String("token-file")
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// storedToken returns the token stored for the url, if it's still valid
+func storedToken(cCtx *cli.Context) (string, bool) {
+	tokens, err := loadTokens(cCtx)
+	if err != nil {
+		return "", false
+	}
+	token, found := tokens[cCtx.String("url")]
+	if !found || time.Now().Add(tokenExpiryMargin).After(token.ExpiresAt) {
+		return "", false
+	}
+	return token.Token, true
+}
+
+// authorize authenticates the request with the token stored for the url, or the username and
+// password, unless a client certificate authenticates it
+func authorize(cCtx *cli.Context, req *http.Request) {
+	if token, ok := storedToken(cCtx); ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+	if cCtx.String("client-cert") != "" && !cCtx.IsSet("username") {
+		return
+	}
+	req.SetBasicAuth(cCtx.String("username"), cCtx.String("password"))
+}
+
+// newHTTPClient returns a client that only connects to https urls whose RA-TLS certificate attests
+// one of the orchestrators trusted, so that credentials are never sent to others
+func newHTTPClient(cCtx *cli.Context) (*http.Client, error) {
+	if !strings.HasPrefix(cCtx.String("url"), "https://") {
+		return http.DefaultClient, nil
+	}
+
+	path := cCtx.String("measurements")
+	if path == "" {
+		return nil, errors.New("https urls need the --measurements of the orchestrator, to verify its attestation")
+	}
+	policy, err := attestation.LoadPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var verifier attestation.Verifier
+	switch provider := cCtx.String("attestation"); provider {
+	case "tdx":
+		verifier = attestation.TDXVerifier{}
+	case "mock":
+		verifier = attestation.MockVerifier{}
+	default:
+		return nil, fmt.Errorf("unknown attestation %q", provider)
+	}
+
+	var clientCerts []tls.Certificate
+	if certFile := cCtx.String("client-cert"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, cCtx.String("client-key"))
+		if err != nil {
+			return nil, err
+		}
+		clientCerts = append(clientCerts, cert)
+	}
+	return ratls.NewClient(verifier, policy, clientCerts...), nil
+}
+
+func runTokenCreate(cCtx *cli.Context) error {
+	scopes := []auth.Permission{}
+	for _, scope := range cCtx.StringSlice("scope") {
+		scopes = append(scopes, auth.Permission(scope))
+	}
+	body, err := json.Marshal(httpserver.TokenRequest{Scopes: scopes, TTL: cCtx.String("ttl")})
+	if err != nil {
+		return err
+	}
+
+	// Tokens don't issue tokens, the credentials are needed
+	req, err := http.NewRequest(http.MethodPost, cCtx.String("url")+"/api/tokens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(cCtx.String("username"), cCtx.String("password"))
+	req.Header.Set("Content-Type", "application/json")
+	rb, err := sendRequest(cCtx, req)
+	if err != nil {
+		return err
+	}
+
+	var token httpserver.TokenResponse
+	if err := json.Unmarshal(rb, &token); err != nil {
+		return err
+	}
+	if err := storeToken(cCtx, &token); err != nil {
+		return err
+	}
+	fmt.Printf("stored token %s with scopes %v, valid until %s\n", token.ID, token.Scopes, token.ExpiresAt.Local().Format(time.RFC3339))
+	return nil
+}
+
+func runTokenRevoke(cCtx *cli.Context) error {
+	if id := cCtx.String("id"); id != "" {
+		_, err := requestAPI(cCtx, http.MethodDelete, "/api/tokens/"+url.PathEscape(id), nil)
+		return err
+	}
+
+	if _, ok := storedToken(cCtx); !ok {
+		return errors.New("no valid token is stored for " + cCtx.String("url"))
+	}
+	if _, err := requestAPI(cCtx, http.MethodDelete, "/api/tokens/current", nil); err != nil {
+		return err
+	}
+	return storeToken(cCtx, nil)
+}
+
 func runCli(cCtx *cli.Context) error {
 	logJSON := cCtx.Bool("log-json")
 	logDebug := cCtx.Bool("log-debug")
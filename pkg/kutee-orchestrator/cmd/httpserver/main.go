@@ -1,13 +1,25 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"kutee-orchestrator/attestation"
 	"kutee-orchestrator/httpserver"
+	"kutee-orchestrator/kube"
+	"kutee-orchestrator/policy"
+	"kutee-orchestrator/ratls"
+	"kutee-orchestrator/secrets"
+	"kutee/auth"
 	"kutee/common"
 
 	"github.com/google/uuid"
@@ -55,11 +67,138 @@ var flags []cli.Flag = []cli.Flag{
 		Value: 45,
 		Usage: "seconds to wait in drain HTTP request",
 	},
+	&cli.StringFlag{
+		Name:  "images-dir",
+		Value: "",
+		Usage: "directory of image archives and their layer blobs to load on startup, as installed by the deployer",
+	},
+	&cli.StringFlag{
+		Name:  "image-loader",
+		Value: "minikube",
+		Usage: "how to load images into the cluster: minikube, containerd, or fake to not load them",
+	},
+	&cli.StringFlag{
+		Name:  "containerd-address",
+		Value: httpserver.DefaultContainerdAddress,
+		Usage: "containerd socket the containerd image loader connects to",
+	},
+	&cli.StringFlag{
+		Name:  "containerd-namespace",
+		Value: httpserver.DefaultContainerdNamespace,
+		Usage: "containerd namespace the containerd image loader imports images into",
+	},
+	&cli.StringFlag{
+		Name:  "cluster-client",
+		Value: "kubectl",
+		Usage: "how to talk to the cluster: kubectl, client-go, or fake to keep it in memory",
+	},
+	&cli.StringFlag{
+		Name:  "kubectl",
+		Value: strings.Join(kube.DefaultKubectl, " "),
+		Usage: "command running kubectl, for the kubectl cluster client",
+	},
+	&cli.StringFlag{
+		Name:  "kubeconfig",
+		Value: "",
+		Usage: "kubeconfig of the client-go cluster client, the in-cluster config if empty",
+	},
+	&cli.StringFlag{
+		Name:  "namespace",
+		Value: kube.DefaultNamespace,
+		Usage: "namespace to run the workload in",
+	},
+	&cli.StringFlag{
+		Name:  "policy",
+		Value: "",
+		Usage: "JSON policy workloads must follow, the default policy if empty: gvisor, no host namespaces, no privileges, limited volume types, cpu and memory limits",
+	},
+	&cli.StringFlag{
+		Name:  "state-dir",
+		Value: httpserver.DefaultStateDir,
+		Usage: "directory to keep the submitted workloads, the audit log and the revoked tokens in",
+	},
+	&cli.StringFlag{
+		Name:  "root-source",
+		Value: "file",
+		Usage: "where the root autosecrets are derived from comes from: memory for a new one kept in TD memory, peer for that of --peer-url, or file for --sealing-root, in plaintext outside of a TD",
+	},
+	&cli.StringFlag{
+		Name:  "sealing-root",
+		Value: "",
+		Usage: "file keeping the root of --root-source file, created if missing, sealing-root in the state directory if empty",
+	},
+	&cli.StringFlag{
+		Name:  "sealing-identity",
+		Value: "none",
+		Usage: "identity autosecrets are bound to: tdx for the measurement of the TD, or none outside of a TD",
+	},
+	&cli.BoolFlag{
+		Name:  "insecure-sealing",
+		Value: false,
+		Usage: "accept, in a TD, a root file the host can read and autosecrets not bound to the TD, for debugging",
+	},
+	&cli.StringFlag{
+		Name:  "attestation",
+		Value: "tdx",
+		Usage: "how to attest to peers and clients, and verify peers: tdx, or mock outside of a TD, which anyone can forge",
+	},
+	&cli.StringFlag{
+		Name:  "tls",
+		Value: "none",
+		Usage: "how to serve the API: ratls for TLS with a certificate generated in the TD, attested as --attestation, or none for plain HTTP",
+	},
+	&cli.StringSliceFlag{
+		Name:  "tls-hosts",
+		Usage: "DNS names and IP addresses of the TLS certificate",
+	},
+	&cli.StringFlag{
+		Name:  "client-ca",
+		Value: "",
+		Usage: "PEM certificates of the CAs of client certificates, which authenticate the clients by their common name",
+	},
+	&cli.BoolFlag{
+		Name:  "require-client-cert",
+		Value: false,
+		Usage: "refuse the TLS connections without a client certificate of --client-ca",
+	},
+	&cli.StringFlag{
+		Name:  "peer-measurements",
+		Value: "",
+		Usage: "JSON measurement, or list of them, of the peers trusted with autosecrets, as the deployer computes them with the kernel. Releasing secrets to peers is disabled if empty",
+	},
+	&cli.StringFlag{
+		Name:  "peer-url",
+		Value: "",
+		Usage: "orchestrator of an existing instance to fetch the autosecrets from on startup, instead of deriving them",
+	},
+	&cli.StringSliceFlag{
+		Name:  "peer-secrets",
+		Usage: "autosecrets to fetch from the peer, those of the workload file if empty",
+	},
+	&cli.StringFlag{
+		Name:  "image-allowlist",
+		Value: "",
+		Usage: "bundle manifest.json, or file of sha256 image digests one per line, listing the only images allowed to be loaded and run",
+	},
 	&cli.StringFlag{
 		Name:  "auth",
-		Value: `{"test": "dGVzdOOwxEKY/BwUmvv0yJlvuSQnrkHkZJuTTKSVmRt4UrhV"}`, // test:test
+		Value: `{"test": "$argon2id$v=19$m=19456,t=2,p=1$VR63eVQtSSh7WUhLZkZKRw$fKZsI884LYO/bj+Hob7OwIrX1EoSeac511yfixop3CE"}`, // test:test
 		Usage: "authenticated users",
 	},
+	&cli.StringFlag{
+		Name:  "auth-tokens",
+		Value: `{}`,
+		Usage: "users authenticated by bearer tokens, with the hex sha256 of their tokens",
+	},
+	&cli.StringFlag{
+		Name:  "auth-roles",
+		Value: `{"test": ["admin"]}`,
+		Usage: "roles of the users: viewer, deployer, operator or admin",
+	},
+	&cli.StringSliceFlag{
+		Name:  "auth-default-role",
+		Usage: "roles of the users --auth-roles doesn't list, who are refused every request otherwise",
+	},
 }
 
 func main() {
@@ -89,6 +228,216 @@ func main() {
 				log = log.With("uid", id.String())
 			}
 
+			var imageLoader httpserver.ImageLoader
+			switch loader := cCtx.String("image-loader"); loader {
+			case "minikube":
+				imageLoader = httpserver.MinikubeLoader{}
+			case "containerd":
+				imageLoader = &httpserver.ContainerdLoader{
+					Address:   cCtx.String("containerd-address"),
+					Namespace: cCtx.String("containerd-namespace"),
+				}
+			case "fake":
+				imageLoader = &httpserver.FakeImageLoader{}
+			default:
+				return fmt.Errorf("unknown image loader %q", loader)
+			}
+
+			var cluster kube.ClusterClient
+			switch client := cCtx.String("cluster-client"); client {
+			case "kubectl":
+				cluster = &kube.Kubectl{Command: strings.Fields(cCtx.String("kubectl")), Namespace: cCtx.String("namespace")}
+			case "client-go":
+				var err error
+				cluster, err = kube.NewClientGo(cCtx.String("kubeconfig"), cCtx.String("namespace"))
+				if err != nil {
+					log.Error("failed to create the cluster client", "err", err)
+					return err
+				}
+			case "fake":
+				fake := kube.NewFake()
+				fake.Namespace = cCtx.String("namespace")
+				cluster = fake
+			default:
+				return fmt.Errorf("unknown cluster client %q", client)
+			}
+
+			var imageAllowlist httpserver.ImageAllowlist
+			if path := cCtx.String("image-allowlist"); path != "" {
+				var err error
+				imageAllowlist, err = httpserver.LoadImageAllowlist(path)
+				if err != nil {
+					log.Error("failed to load the image allowlist", "err", err)
+					return err
+				}
+				log.Info("loaded the image allowlist", "images", len(imageAllowlist))
+			} else {
+				log.Warn("no image allowlist, any image can be loaded and run")
+			}
+
+			var workloadPolicy *policy.Policy
+			if path := cCtx.String("policy"); path != "" {
+				var err error
+				workloadPolicy, err = policy.Load(path)
+				if err != nil {
+					log.Error("failed to load the workload policy", "err", err)
+					return err
+				}
+			}
+
+			// In a TD, the host reads the disk: the root is only kept there, and autosecrets only
+			// left unbound, when debugging
+			_, err := secrets.TDXIdentity()
+			inTD := err == nil
+			insecureSealing := func(msg string) error {
+				if inTD && !cCtx.Bool("insecure-sealing") {
+					return errors.New(msg + " in a TD, unless --insecure-sealing")
+				}
+				log.Warn(msg)
+				return nil
+			}
+
+			var identity []byte
+			switch sealingIdentity := cCtx.String("sealing-identity"); sealingIdentity {
+			case "tdx":
+				identity, err = secrets.TDXIdentity()
+				if err != nil {
+					log.Error("failed to read the identity of the TD", "err", err)
+					return err
+				}
+			case "none":
+				if err := insecureSealing("autosecrets are not bound to the identity of the TD"); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown sealing identity %q", sealingIdentity)
+			}
+
+			var issuer attestation.Issuer
+			var verifier attestation.Verifier
+			mockAttestation := false
+			switch provider := cCtx.String("attestation"); provider {
+			case "tdx":
+				issuer, verifier = attestation.TDXIssuer{}, attestation.TDXVerifier{}
+			case "mock":
+				issuer, verifier = &attestation.MockIssuer{}, attestation.MockVerifier{}
+				mockAttestation = true
+			default:
+				return fmt.Errorf("unknown attestation %q", provider)
+			}
+
+			var peers *secrets.Peers
+			if path := cCtx.String("peer-measurements"); path != "" {
+				peerPolicy, err := attestation.LoadPolicy(path)
+				if err != nil {
+					log.Error("failed to load the peer measurements", "err", err)
+					return err
+				}
+				if mockAttestation {
+					log.Warn("peers are attested with mock evidence, which anyone can forge")
+				}
+				peers = &secrets.Peers{Policy: peerPolicy, Issuer: issuer, Verifier: verifier}
+			}
+			peerURL := cCtx.String("peer-url")
+			if peerURL != "" && peers == nil {
+				return errors.New("fetching autosecrets from a peer needs its measurements")
+			}
+
+			// Secrets imported from peers are sealed with the root: those of a root only kept
+			// in memory don't outlive it
+			var root []byte
+			importDir := filepath.Join(cCtx.String("state-dir"), httpserver.ImportedSecretsDir)
+			switch rootSource := cCtx.String("root-source"); rootSource {
+			case "memory":
+				root, err = secrets.GenerateRoot()
+				importDir = ""
+			case "peer":
+				if peerURL == "" {
+					return errors.New("fetching the sealing root from a peer needs --peer-url")
+				}
+				root, err = peers.FetchRoot(cCtx.Context, ratls.NewClient(verifier, peers.Policy), peerURL)
+			case "file":
+				sealingRoot := cCtx.String("sealing-root")
+				if sealingRoot == "" {
+					sealingRoot = filepath.Join(cCtx.String("state-dir"), httpserver.SealingRootFile)
+				}
+				if err := insecureSealing("the sealing root is kept in plaintext in " + sealingRoot); err != nil {
+					return err
+				}
+				root, err = secrets.LoadOrCreateRoot(sealingRoot)
+			default:
+				return fmt.Errorf("unknown sealing root source %q", rootSource)
+			}
+			if err != nil {
+				log.Error("failed to load the sealing root", "err", err)
+				return err
+			}
+
+			secretStore, err := secrets.NewStore(root, identity, importDir)
+			if err != nil {
+				return err
+			}
+
+			if peerURL != "" {
+				names := cCtx.StringSlice("peer-secrets")
+				if len(names) == 0 {
+					workload, err := os.ReadFile(httpserver.WorkloadFile)
+					if err != nil {
+						log.Error("failed to read the workload's autosecrets", "err", err)
+						return err
+					}
+					names, err = httpserver.AutosecretNames(workload)
+					if err != nil {
+						log.Error("failed to read the workload's autosecrets", "err", err)
+						return err
+					}
+				}
+				if err := peers.FetchMissing(cCtx.Context, ratls.NewClient(verifier, peers.Policy), peerURL, secretStore, names); err != nil {
+					log.Error("failed to fetch the autosecrets from the peer", "peer", peerURL, "err", err)
+					return err
+				}
+				log.Info("fetched the autosecrets from the peer", "peer", peerURL, "secrets", names)
+			}
+
+			var tlsConfig *tls.Config
+			switch mode := cCtx.String("tls"); mode {
+			case "ratls":
+				if mockAttestation {
+					log.Warn("the TLS certificate is attested with mock evidence, which anyone can forge")
+				}
+				cert, err := ratls.NewCertificate(issuer, cCtx.StringSlice("tls-hosts"))
+				if err != nil {
+					log.Error("failed to generate the TLS certificate", "err", err)
+					return err
+				}
+
+				var clientCAs *x509.CertPool
+				if path := cCtx.String("client-ca"); path != "" {
+					if clientCAs, err = ratls.LoadCertPool(path); err != nil {
+						log.Error("failed to load the client CAs", "err", err)
+						return err
+					}
+				} else if cCtx.Bool("require-client-cert") {
+					return errors.New("requiring client certificates needs their --client-ca")
+				}
+				tlsConfig = ratls.ServerConfig(cert, clientCAs, cCtx.Bool("require-client-cert"))
+			case "none":
+				if cCtx.String("client-ca") != "" || cCtx.Bool("require-client-cert") {
+					return errors.New("client certificates need --tls ratls")
+				}
+				log.Warn("serving the API in plain HTTP, credentials cross the network in cleartext")
+			default:
+				return fmt.Errorf("unknown tls %q", mode)
+			}
+
+			authConfig := auth.EmptyConfig.
+				ParseJSONUsers([]byte(cCtx.String("auth"))).
+				ParseJSONTokens([]byte(cCtx.String("auth-tokens"))).
+				ParseJSONRoles([]byte(cCtx.String("auth-roles")))
+			for _, role := range cCtx.StringSlice("auth-default-role") {
+				authConfig.DefaultRoles = append(authConfig.DefaultRoles, auth.Role(role))
+			}
+
 			cfg := &httpserver.HTTPServerConfig{
 				ListenAddr:  listenAddr,
 				MetricsAddr: metricsAddr,
@@ -100,7 +449,24 @@ func main() {
 				ReadTimeout:              60 * time.Second,
 				WriteTimeout:             30 * time.Second,
 
-				Auth: httpserver.EmptyAuthConfig.ParseJSONUsers([]byte(cCtx.String("auth"))),
+				Auth: authConfig,
+				TLS:  tlsConfig,
+
+				ImageLoader:    imageLoader,
+				ImageAllowlist: imageAllowlist,
+				Policy:         workloadPolicy,
+				Cluster:        cluster,
+				Namespace:      cCtx.String("namespace"),
+				Secrets:        secretStore,
+				Peers:          peers,
+				StateDir:       cCtx.String("state-dir"),
+			}
+
+			if imagesDir := cCtx.String("images-dir"); imagesDir != "" {
+				if err := httpserver.LoadImages(cCtx.Context, imageLoader, imageAllowlist, imagesDir); err != nil {
+					log.Error("failed to load images", "err", err)
+					return err
+				}
 			}
 
 			srv, err := httpserver.New(cfg)
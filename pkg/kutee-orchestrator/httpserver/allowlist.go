@@ -0,0 +1,95 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"kutee/ociarchive"
+)
+
+// ImageAllowlist holds the digests of the only images the orchestrator loads and runs.
+// A nil allowlist allows every image.
+type ImageAllowlist map[string]bool
+
+// LoadImageAllowlist reads the allowlist from a bundle manifest, whose images the deployer pins by ID,
+// or from a text file with one sha256:<hex> digest per line. Empty lines and # comments are ignored.
+func LoadImageAllowlist(path string) (ImageAllowlist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []string
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var bundleManifest struct {
+			Images []string `json:"images"`
+		}
+		if err := json.Unmarshal(data, &bundleManifest); err != nil {
+			return nil, fmt.Errorf("invalid bundle manifest %s: %w", path, err)
+		}
+		digests = bundleManifest.Images
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			if line = strings.TrimSpace(line); line != "" {
+				digests = append(digests, line)
+			}
+		}
+	}
+
+	allowlist := make(ImageAllowlist, len(digests))
+	for _, digest := range digests {
+		if !validDigest(digest) {
+			return nil, fmt.Errorf("invalid image digest %q in %s", digest, path)
+		}
+		allowlist[digest] = true
+	}
+	return allowlist, nil
+}
+
+func validDigest(digest string) bool {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hexDigest) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(hexDigest)
+	return err == nil
+}
+
+// AllowsImage reports whether the image of an archive is allowed, by its ID or its manifest digest
+func (a ImageAllowlist) AllowsImage(image ociarchive.Image) bool {
+	return a == nil || a[image.ID] || a[image.Digest]
+}
+
+// AllowsRef reports whether a workload may run the image ref. Only refs pinned to an allowed digest are,
+// either an image ID or name@digest.
+func (a ImageAllowlist) AllowsRef(ref string) bool {
+	if a == nil {
+		return true
+	}
+	if a[ref] {
+		return true
+	}
+	_, digest, ok := strings.Cut(ref, "@")
+	return ok && a[digest]
+}
+
+// RefusedImages returns the images of the archive at archivePath that are not allowed
+func (a ImageAllowlist) RefusedImages(archivePath string) ([]string, error) {
+	images, err := ociarchive.Images(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	refused := []string{}
+	for _, image := range images {
+		if !a.AllowsImage(image) {
+			refused = append(refused, image.ID)
+		}
+	}
+	return refused, nil
+}
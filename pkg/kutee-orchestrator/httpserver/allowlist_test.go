@@ -0,0 +1,46 @@
+package httpserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kutee/ociarchive"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoadImageAllowlist(t *testing.T) {
+	allowed := "sha256:" + strings.Repeat("ab", 32)
+	other := "sha256:" + strings.Repeat("cd", 32)
+	dir := t.TempDir()
+
+	// Bundle manifests list the images by ID
+	manifestPath := filepath.Join(dir, "manifest.json")
+	require.NoError(t, os.WriteFile(manifestPath, []byte(`{"version":1,"images":["`+allowed+`"],"files":[]}`), 0o600))
+	fromManifest, err := LoadImageAllowlist(manifestPath)
+	require.NoError(t, err)
+	require.Equal(t, ImageAllowlist{allowed: true}, fromManifest)
+
+	listPath := filepath.Join(dir, "allowlist")
+	require.NoError(t, os.WriteFile(listPath, []byte("# the app\n"+allowed+"\n\n"+other+" # the sidecar\n"), 0o600))
+	fromList, err := LoadImageAllowlist(listPath)
+	require.NoError(t, err)
+	require.Equal(t, ImageAllowlist{allowed: true, other: true}, fromList)
+
+	require.NoError(t, os.WriteFile(listPath, []byte("app:latest\n"), 0o600))
+	_, err = LoadImageAllowlist(listPath)
+	require.ErrorContains(t, err, "invalid image digest")
+
+	require.True(t, fromManifest.AllowsRef(allowed))
+	require.True(t, fromManifest.AllowsRef("app@"+allowed))
+	require.False(t, fromManifest.AllowsRef(other))
+	require.False(t, fromManifest.AllowsRef("app:latest"))
+	require.True(t, fromManifest.AllowsImage(ociarchive.Image{Digest: other, ID: allowed}))
+	require.False(t, fromManifest.AllowsImage(ociarchive.Image{Digest: other, ID: other}))
+
+	// Without an allowlist, everything is allowed
+	var none ImageAllowlist
+	require.True(t, none.AllowsRef("app:latest"))
+}
@@ -8,7 +8,9 @@ import (
 	"testing"
 	"time"
 
-	"github.com/flashbots/go-template/common"
+	"kutee/auth"
+	"kutee/common"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -32,7 +34,8 @@ func Test_Handlers_Healthcheck_Drain_Undrain(t *testing.T) {
 		DrainDuration: latency,
 		ListenAddr:    listenAddr,
 		Log:           getTestLogger(),
-		Auth:          DummyAuthConfig,
+		Auth:          auth.DummyConfig,
+		StateDir:      t.TempDir(),
 	})
 	require.NoError(t, err)
 
@@ -0,0 +1,139 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"kutee/ociarchive"
+)
+
+// ImageLoader loads image archives into the cluster's image store
+type ImageLoader interface {
+	// Load imports the images of the complete archive at archivePath, and returns them as the image store has them
+	Load(ctx context.Context, archivePath string) ([]ociarchive.Image, error)
+}
+
+// MinikubeLoader loads images with `minikube image load`, and checks that minikube lists them afterwards
+type MinikubeLoader struct{}
+
+type minikubeImage struct {
+	ID       string   `json:"id"`
+	RepoTags []string `json:"repoTags"`
+}
+
+func (MinikubeLoader) Load(ctx context.Context, archivePath string) ([]ociarchive.Image, error) {
+	images, err := ociarchive.Images(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "minikube", "image", "load", archivePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("minikube image load failed: %w: %s", err, output)
+	}
+
+	output, err := exec.CommandContext(ctx, "minikube", "image", "ls", "--format", "json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the images of minikube: %w", err)
+	}
+
+	var listed []minikubeImage
+	if err := json.Unmarshal(output, &listed); err != nil {
+		return nil, fmt.Errorf("could not parse the images of minikube: %w", err)
+	}
+
+	loaded := make([]ociarchive.Image, 0, len(images))
+	for _, image := range images {
+		i := findMinikubeImage(listed, image.ID)
+		if i < 0 {
+			return nil, fmt.Errorf("image %s was not loaded, minikube does not list it", image.ID)
+		}
+		if image.Name == "" && len(listed[i].RepoTags) > 0 {
+			image.Name = listed[i].RepoTags[0]
+		}
+		loaded = append(loaded, image)
+	}
+	return loaded, nil
+}
+
+// findMinikubeImage returns the index of the image with the given ID, minikube lists IDs without their algorithm
+func findMinikubeImage(listed []minikubeImage, id string) int {
+	for i, image := range listed {
+		if image.ID == id || "sha256:"+image.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// FakeImageLoader loads nothing, it returns the images of the archives and records them.
+// It's meant for tests and running without a cluster.
+type FakeImageLoader struct {
+	// Err, if set, fails every load
+	Err error
+
+	mu     sync.Mutex
+	loaded []ociarchive.Image
+}
+
+func (f *FakeImageLoader) Load(ctx context.Context, archivePath string) ([]ociarchive.Image, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	images, err := ociarchive.Images(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loaded = append(f.loaded, images...)
+	return images, nil
+}
+
+// Loaded returns the images loaded so far
+func (f *FakeImageLoader) Loaded() []ociarchive.Image {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ociarchive.Image{}, f.loaded...)
+}
+
+// imageMatches reports whether ref, as the workload refers to it, is the loaded image
+func imageMatches(ref string, image ociarchive.Image) bool {
+	if ref == image.ID || ref == image.Digest {
+		return true
+	}
+	if name, digest, ok := strings.Cut(ref, "@"); ok {
+		return digest == image.Digest && (image.Name == "" || repository(normalizeImageName(name)) == repository(normalizeImageName(image.Name)))
+	}
+	return image.Name != "" && normalizeImageName(ref) == normalizeImageName(image.Name)
+}
+
+// normalizeImageName expands a docker image name the way docker and containerd do,
+// app:1.0 is docker.io/library/app:1.0, and app is docker.io/library/app:latest
+func normalizeImageName(name string) string {
+	name = strings.TrimPrefix(name, "index.docker.io/")
+	domain, _, ok := strings.Cut(name, "/")
+	if !ok || (!strings.ContainsAny(domain, ".:") && domain != "localhost") {
+		if !ok {
+			name = "library/" + name
+		}
+		name = "docker.io/" + name
+	}
+	if !strings.Contains(name, "@") && !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+		name += ":latest"
+	}
+	return name
+}
+
+func repository(name string) string {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i]
+	}
+	return name
+}
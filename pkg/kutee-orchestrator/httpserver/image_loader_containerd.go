@@ -0,0 +1,74 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"kutee/ociarchive"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	DefaultContainerdAddress = "/run/containerd/containerd.sock"
+	// DefaultContainerdNamespace is the namespace the kubelet runs images from
+	DefaultContainerdNamespace = "k8s.io"
+)
+
+// ContainerdLoader imports images straight into containerd, and unpacks them for its default snapshotter
+type ContainerdLoader struct {
+	Address   string
+	Namespace string
+}
+
+func (l *ContainerdLoader) Load(ctx context.Context, archivePath string) ([]ociarchive.Image, error) {
+	client, err := containerd.New(l.Address, containerd.WithDefaultNamespace(l.Namespace))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to containerd: %w", err)
+	}
+	defer client.Close()
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	imported, err := client.Import(ctx, f,
+		containerd.WithImportPlatform(platforms.DefaultStrict()),
+		// Untagged images are named after their digest, the kubelet finds them by ID
+		containerd.WithDigestRef(func(d digest.Digest) string { return "import-kutee@" + d.String() }),
+		containerd.WithSkipDigestRef(func(name string) bool { return name != "" }),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not import %s: %w", archivePath, err)
+	}
+
+	loaded := make([]ociarchive.Image, 0, len(imported))
+	for _, i := range imported {
+		image, err := loadedImage(ctx, client, i)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, image)
+	}
+	return loaded, nil
+}
+
+func loadedImage(ctx context.Context, client *containerd.Client, i images.Image) (ociarchive.Image, error) {
+	image := containerd.NewImage(client, i)
+	if err := image.Unpack(ctx, ""); err != nil {
+		return ociarchive.Image{}, fmt.Errorf("could not unpack %s: %w", i.Name, err)
+	}
+
+	config, err := image.Config(ctx)
+	if err != nil {
+		return ociarchive.Image{}, fmt.Errorf("could not read the config of %s: %w", i.Name, err)
+	}
+
+	return ociarchive.Image{Name: i.Name, Digest: i.Target.Digest.String(), ID: config.Digest.String()}, nil
+}
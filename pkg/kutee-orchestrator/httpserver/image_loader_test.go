@@ -0,0 +1,37 @@
+package httpserver
+
+import (
+	"testing"
+
+	"kutee/ociarchive"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ImageMatches(t *testing.T) {
+	image := ociarchive.Image{
+		Name:   "index.docker.io/library/app:latest",
+		Digest: "sha256:" + "aa00000000000000000000000000000000000000000000000000000000000000",
+		ID:     "sha256:" + "bb00000000000000000000000000000000000000000000000000000000000000",
+	}
+
+	for _, ref := range []string{
+		"app",
+		"app:latest",
+		"docker.io/library/app:latest",
+		image.ID,
+		"app@" + image.Digest,
+	} {
+		require.True(t, imageMatches(ref, image), ref)
+	}
+
+	for _, ref := range []string{
+		"app:1.0",
+		"other/app:latest",
+		"ghcr.io/library/app:latest",
+		"other@" + image.Digest,
+		"sha256:" + "cc00000000000000000000000000000000000000000000000000000000000000",
+	} {
+		require.False(t, imageMatches(ref, image), ref)
+	}
+}
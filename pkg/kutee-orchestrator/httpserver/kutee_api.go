@@ -1,167 +1,886 @@
 package httpserver
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/hex"
-	"io"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"kutee/auth"
+	"kutee/manifest"
+	"kutee/ociarchive"
+	"kutee/upload"
+
+	"kutee-orchestrator/attestation"
+	"kutee-orchestrator/audit"
+	"kutee-orchestrator/kube"
+	"kutee-orchestrator/policy"
+	"kutee-orchestrator/secrets"
+	"kutee-orchestrator/workloads"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type KuteeAPI struct {
-	AuthenticatedUsers []BasicAuth
-	PasswordHasher     func(string) []byte
+	imageLoader    ImageLoader
+	imageAllowlist ImageAllowlist
+	policy         *policy.Policy
+	cluster        kube.ClusterClient
+	namespace      string
+	secrets        *secrets.Store
+	peers          *secrets.Peers
+	tokens         *auth.Tokens
+	uploads        *upload.Store
+
+	// imageDir holds the uploaded image archives and the layer blobs they share, imagesMu
+	// serializes the changes to it so that its quota holds
+	imagesMu   sync.Mutex
+	imageDir   string
+	imageQuota int64
+
+	// workloadsMu serializes the changes to the workloads, which check each other's objects
+	workloadsMu sync.Mutex
+	workloads   *workloads.Store
+	auditLog    *audit.Log
+
+	log *slog.Logger
 }
 
-func NewKuteeAPI(authorizedUsers map[string][]byte, pwHasher func(string) []byte) *KuteeAPI {
-	api := &KuteeAPI{
-		AuthenticatedUsers: make([]BasicAuth, 0, len(authorizedUsers)),
-		PasswordHasher:     pwHasher,
+func NewKuteeAPI(imageLoader ImageLoader, imageAllowlist ImageAllowlist, workloadPolicy *policy.Policy, cluster kube.ClusterClient, namespace string, secretStore *secrets.Store, peers *secrets.Peers, tokens *auth.Tokens, stateDir string, log *slog.Logger) (*KuteeAPI, error) {
+	workloadStore, err := workloads.Open(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the workload store: %w", err)
 	}
-	for u, ph := range authorizedUsers {
-		api.AuthenticatedUsers = append(api.AuthenticatedUsers, BasicAuth{u, ph})
+	auditLog, err := audit.Open(filepath.Join(stateDir, AuditLogFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not open the audit log: %w", err)
+	}
+
+	api := &KuteeAPI{
+		cluster:        cluster,
+		namespace:      namespace,
+		secrets:        secretStore,
+		peers:          peers,
+		tokens:         tokens,
+		imageLoader:    imageLoader,
+		imageAllowlist: imageAllowlist,
+		policy:         workloadPolicy,
+		uploads:        upload.NewStore(filepath.Join(stateDir, ImagesDir, "uploads"), MaxImageSize, UploadQuota),
+		imageDir:       filepath.Join(stateDir, ImagesDir),
+		imageQuota:     ImageQuota,
+		workloads:      workloadStore,
+		auditLog:       auditLog,
+		log:            log,
 	}
-	return api
+	return api, nil
 }
 
-type BasicAuth struct {
-	Username     string
-	PasswordHash []byte
+// AuditLogFile is the name of the audit log in the state directory
+const AuditLogFile = "audit.log"
+
+// WorkloadFile is the manifest started by start_workload, installed by the deployer
+const WorkloadFile = "workload.yaml"
+
+// workloadArchives maps the names of the image tarballs the workload needs to the images they hold
+func workloadArchives(workloadFile string) (map[string]string, error) {
+	data, err := os.ReadFile(workloadFile)
+	if err != nil {
+		return nil, err
+	}
+	return manifestArchives(data)
 }
 
-func (s *KuteeAPI) AuthenticateAndHandle(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		u, p, ok := r.BasicAuth()
-		if !ok {
-			http.Error(w, "missing authentication", http.StatusUnauthorized)
-			return
-		}
+func manifestArchives(data []byte) (map[string]string, error) {
+	images, err := manifest.Images(data)
+	if err != nil {
+		return nil, err
+	}
 
-		ph := s.PasswordHasher(p)
+	archives := make(map[string]string, len(images))
+	for _, image := range images {
+		archives[manifest.ArchiveName(image)] = image
+	}
+	return archives, nil
+}
 
-		for _, authenticatedUser := range s.AuthenticatedUsers {
-			if authenticatedUser.Username == u {
-				if bytes.Equal(authenticatedUser.PasswordHash, ph) {
-					handler(w, r)
-					return
-				}
-			}
-		}
+// referencedArchives are the image tarballs of WorkloadFile, if the deployer installed one,
+// and of the stored workloads
+func (s *KuteeAPI) referencedArchives() (map[string]string, error) {
+	archives, err := workloadArchives(WorkloadFile)
+	if errors.Is(err, os.ErrNotExist) {
+		archives = make(map[string]string)
+	} else if err != nil {
+		return nil, err
+	}
 
-		http.Error(w, "", http.StatusUnauthorized)
+	for _, workload := range s.workloads.List() {
+		stored, err := manifestArchives([]byte(workload.Manifest))
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(archives, stored)
 	}
+	return archives, nil
 }
 
-const MaxImageSize = 1024 * 1024 * 500 // 500MiB
+const MaxImageSize = ociarchive.MaxSize
+
+// ImageQuota is how many bytes of image archives and layer blobs are kept
+const ImageQuota = 8 * MaxImageSize
+
+// UnreferencedBlobRetention is how long layer blobs no image archive uses are kept,
+// for the archive to be uploaded after its layers
+const UnreferencedBlobRetention = time.Hour
+
+// ErrImageQuotaExceeded is returned for uploads that don't fit in ImageQuota
+var ErrImageQuotaExceeded = errors.New("not enough space left for images")
+
+// UploadQuota is how many bytes of uploads each user can have in progress, the layers of an image
+// and the image itself
+const UploadQuota = 4 * MaxImageSize
+
+// uploadImageTarball accepts image archives and the layer blobs they are assembled from.
+// Blobs are uploaded first, an archive is loaded once all of its layers are available.
 func (s *KuteeAPI) uploadImageTarball(w http.ResponseWriter, r *http.Request) {
-	// Adjusted from https://github.com/Freshman-tech/file-upload/commit/f1638a7d39057122f97dd015bb1f5f3cda196ac0 (MIT)
+	// The file streams straight into the image directory, hashed on the way
 	r.Body = http.MaxBytesReader(w, r.Body, MaxImageSize)
-	if err := r.ParseMultipartForm(MaxImageSize); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// The argument to FormFile must match the name attribute
-	// of the file input on the frontend
-	file, fileHeader, err := r.FormFile("image-tarball")
+	part, err := upload.FormFile(r, "image-tarball")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if filepath.Ext(fileHeader.Filename) != ".tar" {
-		http.Error(w, "only .tar images are supported", http.StatusBadRequest)
+	defer part.Close()
+
+	name := filepath.Base(part.FileName())
+	digest, isBlob, ok := s.checkImageName(w, name)
+	if !ok {
 		return
 	}
 
-	defer file.Close()
-
 	// Create the uploads folder if it doesn't
 	// already exist
-	imgDir := os.TempDir() + "/image"
-	err = os.MkdirAll(imgDir, os.ModePerm)
+	err = os.MkdirAll(s.imageDir, 0o700)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Create a new file in the uploads directory
-	imagePath := imgDir + "/" + fileHeader.Filename
-	dst, err := os.Create(imagePath)
+	// Uploads are written next to their final name, so that a partial upload is never used
+	dst, err := os.CreateTemp(s.imageDir, tempUploadPrefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	defer os.Remove(dst.Name())
 	defer dst.Close()
 
-	// Copy the uploaded file to the filesystem
-	// at the specified destination
-	_, err = io.Copy(dst, file)
+	_, sha256Hex, err := upload.Copy(dst, part)
+	if err == nil {
+		err = dst.Close()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), upload.CopyStatus(err))
+		return
+	}
+
+	s.installImage(w, r, name, digest, isBlob, dst.Name(), sha256Hex)
+}
+
+// UploadResponse is returned for every file installed, with the sha256 it was received with.
+// Images lists the images of an archive as the cluster's image store has them.
+type UploadResponse struct {
+	Name   string             `json:"name"`
+	SHA256 string             `json:"sha256"`
+	Images []ociarchive.Image `json:"images,omitempty"`
+}
+
+// checkImageName responds with an error if name is neither a layer blob nor an image of a workload.
+// It returns the digest of blobs.
+func (s *KuteeAPI) checkImageName(w http.ResponseWriter, name string) (digest string, isBlob bool, ok bool) {
+	digest, isBlob = ociarchive.ParseBlobName(name)
+	if !isBlob && filepath.Ext(name) != ".tar" {
+		http.Error(w, "only .tar images and sha256-<digest>.blob layers are supported", http.StatusBadRequest)
+		return "", false, false
+	}
+
+	if !isBlob {
+		// Only accept the images the workloads run, named the way the deployer bundles them
+		referenced, err := s.referencedArchives()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return "", false, false
+		}
+		if _, ok := referenced[name]; !ok {
+			http.Error(w, name+" is not an image of the workload", http.StatusBadRequest)
+			return "", false, false
+		}
+	}
+	return digest, isBlob, true
+}
+
+// installImage moves an uploaded file from uploadPath into the image directory, and loads it if it's an image
+// archive. It responds to the request either way. sha256Hex is the digest of the upload, computed
+// as it was received, blobs are checked against it rather than read again.
+func (s *KuteeAPI) installImage(w http.ResponseWriter, r *http.Request, name string, digest string, isBlob bool, uploadPath string, sha256Hex string) {
+	if isBlob && "sha256:"+sha256Hex != digest {
+		http.Error(w, fmt.Sprintf("blob %s does not match its digest, got sha256:%s", name, sha256Hex), http.StatusBadRequest)
+		return
+	}
+
+	imagePath := filepath.Join(s.imageDir, name)
+	if err := s.storeImageFile(uploadPath, imagePath); errors.Is(err, ErrImageQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if isBlob {
+		writeUploadResponse(w, UploadResponse{Name: name, SHA256: sha256Hex})
+		return
+	}
+
+	missing, err := ociarchive.MissingBlobs(imagePath, s.imageDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(missing) > 0 {
+		http.Error(w, "upload the layers first, missing: "+strings.Join(missing, ", "), http.StatusBadRequest)
+		return
+	}
+
+	// The archive must hold the image the workload runs, whatever it was named, before anything is loaded
+	images, err := ociarchive.Images(imagePath)
+	if err != nil {
+		_ = os.Remove(imagePath)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	referenced, err := s.referencedArchives()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !slices.ContainsFunc(images, func(image ociarchive.Image) bool { return imageMatches(referenced[name], image) }) {
+		_ = os.Remove(imagePath)
+		http.Error(w, fmt.Sprintf("%s does not hold %s, it holds %v", name, referenced[name], images), http.StatusBadRequest)
+		return
+	}
 
-	cmd := exec.Command("minikube", "image", "load", imagePath)
-	if err := cmd.Run(); err != nil {
+	loaded, err := loadImage(r.Context(), s.imageLoader, s.imageAllowlist, imagePath, s.imageDir)
+	if errors.Is(err, ErrImageNotAllowed) {
+		_ = os.Remove(imagePath)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	writeUploadResponse(w, UploadResponse{Name: name, SHA256: sha256Hex, Images: loaded})
+}
+
+// tempUploadPrefix starts the names of the files being uploaded into the image directory
+const tempUploadPrefix = ".upload-"
+
+// storeImageFile moves the file at uploadPath to imagePath, if it fits in the quota once the
+// layer blobs that are not used anymore are removed
+func (s *KuteeAPI) storeImageFile(uploadPath string, imagePath string) error {
+	s.imagesMu.Lock()
+	defer s.imagesMu.Unlock()
+
+	if err := os.MkdirAll(s.imageDir, 0o700); err != nil {
+		return err
+	}
+	if err := s.removeUnreferencedBlobs(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(uploadPath)
+	if err != nil {
+		return err
+	}
+	used, err := s.imageUsage(filepath.Base(imagePath))
+	if err != nil {
+		return err
+	}
+	if used+info.Size() > s.imageQuota {
+		return fmt.Errorf("%w: %d bytes are used, the quota is %d", ErrImageQuotaExceeded, used, s.imageQuota)
+	}
+
+	return os.Rename(uploadPath, imagePath)
+}
+
+// imageUsage is the size of the archives and blobs in the image directory, but the one named
+// replaced. Files still being uploaded are not counted. s.imagesMu must be held.
+func (s *KuteeAPI) imageUsage(replaced string) (int64, error) {
+	entries, err := os.ReadDir(s.imageDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var used int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == replaced || strings.HasPrefix(entry.Name(), tempUploadPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		used += info.Size()
+	}
+	return used, nil
+}
+
+// removeUnreferencedBlobs deletes the layer blobs no image archive uses, once they had
+// UnreferencedBlobRetention for the archive to be uploaded. s.imagesMu must be held.
+func (s *KuteeAPI) removeUnreferencedBlobs() error {
+	archives, err := filepath.Glob(filepath.Join(s.imageDir, "*.tar"))
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	for _, archive := range archives {
+		layers, err := ociarchive.Layers(archive)
+		if err != nil {
+			s.log.Warn("could not list the layers of an image archive", "archive", filepath.Base(archive), "err", err)
+			continue
+		}
+		for _, layer := range layers {
+			referenced[ociarchive.BlobName(layer)] = true
+		}
+	}
+
+	entries, err := os.ReadDir(s.imageDir)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-UnreferencedBlobRetention)
+	for _, entry := range entries {
+		if _, isBlob := ociarchive.ParseBlobName(entry.Name()); !isBlob || referenced[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.imageDir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.log.Info("removed unreferenced layer blob", "blob", entry.Name())
+	}
+	return nil
+}
+
+func writeUploadResponse(w http.ResponseWriter, resp UploadResponse) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *KuteeAPI) createUpload(w http.ResponseWriter, r *http.Request) {
+	s.uploads.HandleCreate(w, r)
+}
+
+func (s *KuteeAPI) getUpload(w http.ResponseWriter, r *http.Request) {
+	s.uploads.HandleStatus(w, r, chi.URLParam(r, "id"))
+}
+
+func (s *KuteeAPI) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	s.uploads.HandleChunk(w, r, chi.URLParam(r, "id"))
+}
+
+// finalizeUpload installs an image archive or layer blob uploaded in chunks, the same as if it was
+// posted to upload_image
+func (s *KuteeAPI) finalizeUpload(w http.ResponseWriter, r *http.Request) {
+	uploadID := chi.URLParam(r, "id")
+	session, dataPath, ok := s.uploads.ParseFinalize(w, r, uploadID)
+	if !ok {
+		return
+	}
+	defer s.uploads.Remove(uploadID) //nolint:errcheck
+
+	digest, isBlob, ok := s.checkImageName(w, session.Filename)
+	if !ok {
+		return
+	}
+
+	s.installImage(w, r, session.Filename, digest, isBlob, dataPath, session.SHA256)
+}
+
+// ErrImageNotAllowed is returned for images that are not on the allowlist
+var ErrImageNotAllowed = errors.New("image is not on the allowlist")
+
+// loadImage assembles the archive at imagePath with the layers from blobDir, and loads it into the cluster.
+// Archives holding images that are not allowed are refused before anything is loaded.
+func loadImage(ctx context.Context, loader ImageLoader, allowlist ImageAllowlist, imagePath string, blobDir string) ([]ociarchive.Image, error) {
+	refused, err := allowlist.RefusedImages(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(refused) > 0 {
+		return nil, fmt.Errorf("%w: %s holds %s", ErrImageNotAllowed, filepath.Base(imagePath), strings.Join(refused, ", "))
+	}
+
+	assembled, err := os.CreateTemp("", "kutee-image-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(assembled.Name())
+	defer assembled.Close()
+
+	if err := ociarchive.Assemble(assembled, imagePath, blobDir); err != nil {
+		return nil, err
+	}
+	if err := assembled.Close(); err != nil {
+		return nil, err
+	}
+
+	loaded, err := loader.Load(ctx, assembled.Name())
+	if err != nil {
+		return nil, fmt.Errorf("could not load %s: %w", filepath.Base(imagePath), err)
+	}
+	return loaded, nil
+}
+
+// LoadImages loads every image archive in dir, assembled from the layer blobs next to them,
+// as installed by the deployer
+func LoadImages(ctx context.Context, loader ImageLoader, allowlist ImageAllowlist, dir string) error {
+	archives, err := filepath.Glob(filepath.Join(dir, "*.tar"))
+	if err != nil {
+		return err
+	}
+
+	for _, archive := range archives {
+		if _, err := loadImage(ctx, loader, allowlist, archive, dir); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *KuteeAPI) startWorkload(w http.ResponseWriter, r *http.Request) {
-	err := s.autogenerateSecrets("workload.yaml")
+	archives, err := workloadArchives(WorkloadFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only pinned, allowed images run, so that the measurement describes the workload
+	refused := []string{}
+	for _, image := range archives {
+		if !s.imageAllowlist.AllowsRef(image) {
+			refused = append(refused, image)
+		}
+	}
+	if len(refused) > 0 {
+		sort.Strings(refused)
+		http.Error(w, "the workload runs images that are not on the allowlist: "+strings.Join(refused, ", "), http.StatusForbidden)
+		return
+	}
+
+	workload, err := os.ReadFile(WorkloadFile)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !s.checkPolicy(w, workload) {
+		return
+	}
+	if _, err := AutosecretTemplates(workload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	applied, err := s.applyWorkload(r.Context(), workload)
+	if err != nil {
+		http.Error(w, err.Error(), clusterErrorStatus(err))
+		return
+	}
 
-	cmd := exec.Command("minikube", "kubectl", "--", "apply", "-f", "workload.yaml")
-	if err := cmd.Run(); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(applied)
+}
+
+// stopWorkload deletes the objects of the workload from the cluster
+func (s *KuteeAPI) stopWorkload(w http.ResponseWriter, r *http.Request) {
+	workload, err := os.ReadFile(WorkloadFile)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if err := s.cluster.DeleteWorkload(r.Context(), workload); err != nil {
+		http.Error(w, "could not delete the workload: "+err.Error(), clusterErrorStatus(err))
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *KuteeAPI) autogenerateSecrets(deploymentFile string) error {
-	// For each km-autosecret_* in deployment create a secret
+func (s *KuteeAPI) getPodStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.cluster.GetPodStatus(r.Context(), chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), clusterErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
 
-	data, err := os.ReadFile("workload.yaml")
+// clusterErrorStatus is the status to respond with when the cluster fails a request
+func clusterErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, kube.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, kube.ErrAlreadyExists):
+		return http.StatusConflict
+	case errors.Is(err, kube.ErrInvalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// AutosecretNames returns the sorted names of the autosecrets the pods of the workload refer to
+func AutosecretNames(workload []byte) ([]string, error) {
+	refs, err := kube.SecretRefs(workload)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range refs {
+		if strings.HasPrefix(name, secrets.AutosecretPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// AutosecretTemplates returns the templates of the autosecrets the pods of the workload refer to, by name.
+// Templates are annotated on the objects, autosecrets without one have the default template.
+func AutosecretTemplates(workload []byte) (map[string]secrets.Template, error) {
+	names, err := AutosecretNames(workload)
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.Parse(workload)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]secrets.Template, len(names))
+	for _, obj := range m.Objects() {
+		annotations, err := obj.Annotations()
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range annotations {
+			name, ok := strings.CutPrefix(key, secrets.TemplateAnnotationPrefix)
+			if !ok {
+				continue
+			}
+			if !slices.Contains(names, name) {
+				return nil, fmt.Errorf("%w: %s %s has a template for %s, which no pod refers to", secrets.ErrInvalidTemplate, obj.Kind, obj.Name, name)
+			}
+			template, err := secrets.ParseTemplate(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s, secret %s: %w", obj.Kind, obj.Name, name, err)
+			}
+			if existing, ok := templates[name]; ok && !reflect.DeepEqual(existing, template) {
+				return nil, fmt.Errorf("%w: the objects have different templates for %s", secrets.ErrInvalidTemplate, name)
+			}
+			templates[name] = template
+		}
 	}
 
-	autosecrets_to_generate := []string{}
-	lines := strings.Split(string(data), "\n")
+	for _, name := range names {
+		if _, ok := templates[name]; !ok {
+			templates[name] = secrets.DefaultTemplate()
+		}
+	}
+	return templates, nil
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "name: km-autosecret") {
-			autosecrets_to_generate = append(autosecrets_to_generate, line[6:])
+// checkTemplates returns an error if the workload and the other manifests have different templates for an autosecret
+func checkTemplates(workload []byte, others [][]byte) error {
+	templates, err := AutosecretTemplates(workload)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range others {
+		// Manifests without valid templates never had their autosecrets generated
+		otherTemplates, err := AutosecretTemplates(other)
+		if err != nil {
+			continue
+		}
+		for name, template := range templates {
+			if otherTemplate, ok := otherTemplates[name]; ok && !reflect.DeepEqual(template, otherTemplate) {
+				return fmt.Errorf("%w: %s is used by another workload with a different template", errTemplateConflict, name)
+			}
 		}
 	}
+	return nil
+}
+
+// errTemplateConflict is returned when workloads disagree on the keys of an autosecret
+var errTemplateConflict = errors.New("conflicting autosecret templates")
+
+func (s *KuteeAPI) autogenerateSecrets(ctx context.Context, workload []byte) error {
+	templates, err := AutosecretTemplates(workload)
+	if err != nil {
+		return err
+	}
 
-	for _, autosecret := range autosecrets_to_generate {
-		// TODO: use a persistent, recoverable source of secrets. Cross-attest to fetch the relevant secrets.
-		secret := make([]byte, 32)
-		_, err := rand.Read(secret)
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, autosecret := range names {
+		// Secrets are derived from the sealing root, fetched from a peer or rotated. Their keys are
+		// derived from them, applying them again changes nothing, and recreates them identically
+		// if the cluster lost them.
+		data, err := s.autosecretData(autosecret, templates[autosecret])
 		if err != nil {
 			return err
 		}
-		cmd := exec.Command("minikube", "kubectl", "--", "create", "secret", "generic", autosecret, "--from-literal", "KM_AUTOSECRET_TOKEN="+hex.EncodeToString(secret))
-		if err := cmd.Run(); err != nil {
+		if err := s.cluster.ApplySecret(ctx, autosecret, data); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
+
+// autosecretData is the data of the cluster secret holding an autosecret, generated with its template
+func (s *KuteeAPI) autosecretData(name string, template secrets.Template) (map[string][]byte, error) {
+	secret, err := s.secrets.Secret(name)
+	if err != nil {
+		return nil, err
+	}
+	return template.Generate(secret)
+}
+
+// deployedTemplate returns the template the manifests have for the autosecret, false if none refer to it
+func deployedTemplate(name string, manifests [][]byte) (secrets.Template, bool, error) {
+	for _, m := range manifests {
+		templates, err := AutosecretTemplates(m)
+		if err != nil {
+			return nil, false, err
+		}
+		if template, ok := templates[name]; ok {
+			return template, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// deployedManifests are the manifests of WorkloadFile, if the deployer installed one that can be started,
+// and of the stored workloads
+func (s *KuteeAPI) deployedManifests() ([][]byte, error) {
+	manifests := [][]byte{}
+	workload, err := os.ReadFile(WorkloadFile)
+	if err == nil {
+		if _, err := AutosecretTemplates(workload); err == nil {
+			manifests = append(manifests, workload)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, stored := range s.workloads.List() {
+		manifests = append(manifests, []byte(stored.Manifest))
+	}
+	return manifests, nil
+}
+
+// RotateResponse is returned for a rotated secret, with the objects restarted to use it
+type RotateResponse struct {
+	Name      string           `json:"name"`
+	Restarted []kube.ObjectRef `json:"restarted"`
+}
+
+// rotateSecret replaces an autosecret with a random one, and restarts the pods referring to it
+func (s *KuteeAPI) rotateSecret(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !strings.HasPrefix(name, secrets.AutosecretPrefix) {
+		http.Error(w, fmt.Sprintf("only %s secrets can be rotated", secrets.AutosecretPrefix), http.StatusBadRequest)
+		return
+	}
+
+	// Workloads must not change while their pods are restarted
+	s.workloadsMu.Lock()
+	defer s.workloadsMu.Unlock()
+
+	manifests, err := s.deployedManifests()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	template, ok, err := deployedTemplate(name, manifests)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		template = secrets.DefaultTemplate()
+	}
+
+	_, err = s.secrets.Rotate(name)
+	if errors.Is(err, secrets.ErrInvalidName) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	restarted, err := s.restartDependents(r.Context(), name, template, manifests)
+	s.recordChange(r, audit.Entry{Action: audit.ActionRotateSecret, Secret: name}, err)
+	if err != nil {
+		http.Error(w, "could not rotate the secret: "+err.Error(), clusterErrorStatus(err))
+		return
+	}
+
+	s.log.Info("rotated secret", "name", name, "restarted", restarted)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(RotateResponse{Name: name, Restarted: restarted})
+}
+
+// restartDependents applies the rotated secret, and restarts the objects of the manifests referring to it
+func (s *KuteeAPI) restartDependents(ctx context.Context, name string, template secrets.Template, manifests [][]byte) ([]kube.ObjectRef, error) {
+	data, err := s.autosecretData(name, template)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cluster.ApplySecret(ctx, name, data); err != nil {
+		return nil, err
+	}
+
+	restarted := []kube.ObjectRef{}
+	for _, m := range manifests {
+		dependent, err := kube.DependentObjects(m, name)
+		if err != nil {
+			return nil, err
+		}
+		if dependent == nil {
+			continue
+		}
+		refs, err := s.cluster.RestartWorkload(ctx, dependent)
+		if err != nil {
+			return nil, err
+		}
+		restarted = append(restarted, refs...)
+	}
+	return restarted, nil
+}
+
+// PublicKeysResponse holds the public halves of the keys of an autosecret, by the name of their key
+type PublicKeysResponse struct {
+	Name   string            `json:"name"`
+	Public map[string]string `json:"public"`
+}
+
+// getPublicKeys returns the public halves of the keys of an autosecret the workloads use
+func (s *KuteeAPI) getPublicKeys(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	s.workloadsMu.Lock()
+	manifests, err := s.deployedManifests()
+	s.workloadsMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	template, ok, err := deployedTemplate(name, manifests)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "no workload uses secret "+name, http.StatusNotFound)
+		return
+	}
+
+	secret, err := s.secrets.Secret(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	public, err := template.Public(secret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(PublicKeysResponse{Name: name, Public: public})
+}
+
+// releaseSecrets seals the requested autosecrets to a peer instance, once its attestation is verified
+func (s *KuteeAPI) releaseSecrets(w http.ResponseWriter, r *http.Request) {
+	if s.peers == nil {
+		http.Error(w, "releasing secrets to peers is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req secrets.PeerRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxWorkloadSize)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.peers.Release(s.secrets, &req)
+	switch {
+	case errors.Is(err, attestation.ErrNotAllowed):
+		s.log.Warn("refused to release secrets to a peer", "names", req.Names, "err", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, attestation.ErrInvalidEvidence):
+		s.log.Warn("refused to release secrets to a peer", "names", req.Names, "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, secrets.ErrInvalidName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		s.log.Error("could not release secrets to a peer", "names", req.Names, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("released secrets to a peer", "names", req.Names)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
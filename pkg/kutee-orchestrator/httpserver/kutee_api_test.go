@@ -0,0 +1,506 @@
+package httpserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kutee/auth"
+	"kutee/ociarchive"
+	"kutee/passwords"
+	"kutee/upload"
+
+	"kutee-orchestrator/attestation"
+	"kutee-orchestrator/audit"
+	"kutee-orchestrator/kube"
+	"kutee-orchestrator/secrets"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTestWorkload runs the test in a directory with a workload running docker.io/library/app:latest
+func setupTestWorkload(t *testing.T) *Server {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	require.NoError(t, os.WriteFile(WorkloadFile, []byte("kind: Pod\nspec:\n  containers:\n  - name: app\n    image: docker.io/library/app:latest\n"), 0o600))
+
+	//nolint: exhaustruct
+	s, err := New(&HTTPServerConfig{
+		Log:         getTestLogger(),
+		Auth:        auth.DummyConfig,
+		ImageLoader: &FakeImageLoader{},
+		Cluster:     kube.NewFake(),
+		StateDir:    t.TempDir(),
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func uploadTestFile(t *testing.T, s *Server, name string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	part, err := m.CreateFormFile("image-tarball", name)
+	require.NoError(t, err)
+	_, err = part.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/upload_image", &body)
+	req.Header.Set("Content-Type", m.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.kuteeAPI.uploadImageTarball(w, req)
+	return w
+}
+
+func Test_UploadImageTarball_RejectsUnreferencedImages(t *testing.T) {
+	s := setupTestWorkload(t)
+
+	w := uploadTestFile(t, s, "other.tar", []byte("image"))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "not an image of the workload")
+}
+
+func Test_UploadImageTarball_Blobs(t *testing.T) {
+	s := setupTestWorkload(t)
+
+	layer := []byte("layer")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+
+	// Blobs must hold the content their name claims
+	w := uploadTestFile(t, s, ociarchive.BlobName(digest), []byte("tampered"))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.NoFileExists(t, filepath.Join(s.kuteeAPI.imageDir, ociarchive.BlobName(digest)))
+
+	// Images are only loaded once all of their layers were uploaded
+	archive := testArchive(t, "docker.io/library/app:latest", digest)
+	w = uploadTestFile(t, s, "docker.io_library_app-latest.tar", archive)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), digest)
+	require.Empty(t, s.kuteeAPI.imageLoader.(*FakeImageLoader).Loaded())
+
+	w = uploadTestFile(t, s, ociarchive.BlobName(digest), layer)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp UploadResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, "sha256:"+resp.SHA256, digest)
+	require.FileExists(t, filepath.Join(s.kuteeAPI.imageDir, ociarchive.BlobName(digest)))
+
+	// The response lists the images as they were loaded
+	w = uploadTestFile(t, s, "docker.io_library_app-latest.tar", archive)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(archive)), resp.SHA256)
+	require.Len(t, resp.Images, 1)
+	require.Equal(t, "docker.io/library/app:latest", resp.Images[0].Name)
+	require.Equal(t, s.kuteeAPI.imageLoader.(*FakeImageLoader).Loaded(), resp.Images)
+
+	// The layers of installed images are kept
+	blobPath := filepath.Join(s.kuteeAPI.imageDir, ociarchive.BlobName(digest))
+	old := time.Now().Add(-2 * UnreferencedBlobRetention)
+	require.NoError(t, os.Chtimes(blobPath, old, old))
+	other := []byte("other layer")
+	w = uploadTestFile(t, s, ociarchive.BlobName(fmt.Sprintf("sha256:%x", sha256.Sum256(other))), other)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.FileExists(t, blobPath)
+}
+
+func Test_UploadImageTarball_Quota(t *testing.T) {
+	s := setupTestWorkload(t)
+
+	layer := []byte("layer")
+	layerPath := filepath.Join(s.kuteeAPI.imageDir, ociarchive.BlobName(fmt.Sprintf("sha256:%x", sha256.Sum256(layer))))
+	other := []byte("other layer")
+	s.kuteeAPI.imageQuota = int64(len(other)) + 1
+
+	w := uploadTestFile(t, s, filepath.Base(layerPath), layer)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Blobs that don't fit are refused
+	otherName := ociarchive.BlobName(fmt.Sprintf("sha256:%x", sha256.Sum256(other)))
+	w = uploadTestFile(t, s, otherName, other)
+	require.Equal(t, http.StatusInsufficientStorage, w.Code)
+	require.NoFileExists(t, filepath.Join(s.kuteeAPI.imageDir, otherName))
+
+	// Re-uploading a blob doesn't count it twice
+	w = uploadTestFile(t, s, filepath.Base(layerPath), layer)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Blobs no image uses are removed once they had the time to be used
+	old := time.Now().Add(-2 * UnreferencedBlobRetention)
+	require.NoError(t, os.Chtimes(layerPath, old, old))
+	w = uploadTestFile(t, s, otherName, other)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoFileExists(t, layerPath)
+	require.FileExists(t, filepath.Join(s.kuteeAPI.imageDir, otherName))
+}
+
+func Test_UploadImageTarball_RejectsOtherImages(t *testing.T) {
+	s := setupTestWorkload(t)
+
+	// An archive named after the workload's image, holding another one
+	w := uploadTestFile(t, s, "docker.io_library_app-latest.tar", testArchive(t, "docker.io/library/other:latest"))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "does not hold docker.io/library/app:latest")
+	require.NoFileExists(t, filepath.Join(s.kuteeAPI.imageDir, "docker.io_library_app-latest.tar"))
+	require.Empty(t, s.kuteeAPI.imageLoader.(*FakeImageLoader).Loaded())
+}
+
+// testArchive builds an image archive without its layers, named name
+func testArchive(t *testing.T, name string, layers ...string) []byte {
+	t.Helper()
+
+	config := fmt.Sprintf(`{"name":%q}`, name)
+	layerDescriptors := []string{}
+	for _, layer := range layers {
+		layerDescriptors = append(layerDescriptors, fmt.Sprintf(`{"digest":%q}`, layer))
+	}
+	manifest := fmt.Sprintf(`{"config":{"digest":"sha256:%x"},"layers":[%s]}`, sha256.Sum256([]byte(config)), strings.Join(layerDescriptors, ","))
+	index := fmt.Sprintf(`{"manifests":[{"digest":"sha256:%x","annotations":{"io.containerd.image.name":%q}}]}`, sha256.Sum256([]byte(manifest)), name)
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for name, content := range map[string]string{
+		"index.json": index,
+		fmt.Sprintf("blobs/sha256/%x", sha256.Sum256([]byte(manifest))): manifest,
+		fmt.Sprintf("blobs/sha256/%x", sha256.Sum256([]byte(config))):   config,
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return archive.Bytes()
+}
+
+func Test_FinalizeUpload_Blob(t *testing.T) {
+	s := setupTestWorkload(t)
+	srv := httptest.NewServer(s.srv.Handler)
+	t.Cleanup(srv.Close)
+
+	layer := []byte("layer")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	path := filepath.Join(t.TempDir(), ociarchive.BlobName(digest))
+	require.NoError(t, os.WriteFile(path, layer, 0o600))
+
+	client := &upload.Client{
+		URL:       srv.URL + "/api/uploads",
+		Authorize: func(req *http.Request) { req.SetBasicAuth("test", "test") },
+		ChunkSize: 2,
+	}
+	session, sha, err := client.Upload(path)
+	require.NoError(t, err)
+
+	res, _, err := client.Finalize(path, session, sha)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.FileExists(t, filepath.Join(s.kuteeAPI.imageDir, ociarchive.BlobName(digest)))
+	require.NoFileExists(t, filepath.Join(s.kuteeAPI.imageDir, "uploads", session.ID+".data"))
+}
+
+func Test_Roles(t *testing.T) {
+	setupTestWorkload(t)
+	cfg := auth.DummyConfig
+	cfg.AuthenticatedUsers = map[string]string{"ci": mustHash(t, "ci"), "test": mustHash(t, "test")}
+	cfg.Roles = map[string][]auth.Role{"ci": {auth.RoleDeployer}, "test": {auth.RoleOperator}}
+
+	//nolint: exhaustruct
+	s, err := New(&HTTPServerConfig{
+		Log:         getTestLogger(),
+		Auth:        cfg,
+		ImageLoader: &FakeImageLoader{},
+		Cluster:     kube.NewFake(),
+		StateDir:    t.TempDir(),
+	})
+	require.NoError(t, err)
+	srv := httptest.NewServer(s.srv.Handler)
+	t.Cleanup(srv.Close)
+
+	// CI uploads images
+	path := filepath.Join(t.TempDir(), "layer")
+	require.NoError(t, os.WriteFile(path, []byte("layer"), 0o600))
+	client := &upload.Client{
+		URL:       srv.URL + "/api/uploads",
+		Authorize: func(req *http.Request) { req.SetBasicAuth("ci", "ci") },
+	}
+	_, _, err = client.Upload(path)
+	require.NoError(t, err)
+
+	// but doesn't start workloads, nor read the audit log
+	request := func(user string, method string, path string) int {
+		req := httptest.NewRequest(method, "http://localhost"+path, nil)
+		req.SetBasicAuth(user, user)
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	require.Equal(t, http.StatusForbidden, request("ci", http.MethodPost, "/api/start_workload"))
+	require.Equal(t, http.StatusForbidden, request("ci", http.MethodGet, "/api/audit"))
+	require.Equal(t, http.StatusOK, request("ci", http.MethodGet, "/api/workloads"))
+	// Only admins read the audit log
+	require.Equal(t, http.StatusForbidden, request("test", http.MethodGet, "/api/audit"))
+	// Workloads are not started nor stopped by GET requests, which links and prefetchers send
+	require.Equal(t, http.StatusMethodNotAllowed, request("test", http.MethodGet, "/api/start_workload"))
+	require.Equal(t, http.StatusMethodNotAllowed, request("test", http.MethodGet, "/api/stop_workload"))
+}
+
+func mustHash(t *testing.T, password string) string {
+	hash, err := passwords.Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}.Hash(password)
+	require.NoError(t, err)
+	return hash
+}
+
+func Test_ImageAllowlist(t *testing.T) {
+	s := setupTestWorkload(t)
+	s.kuteeAPI.imageAllowlist = ImageAllowlist{"sha256:" + strings.Repeat("ab", 32): true}
+
+	// Images that are not allowed are not loaded, whatever they are named
+	w := uploadTestFile(t, s, "docker.io_library_app-latest.tar", testArchive(t, "docker.io/library/app:latest"))
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), "not on the allowlist")
+	require.Empty(t, s.kuteeAPI.imageLoader.(*FakeImageLoader).Loaded())
+	require.NoFileExists(t, filepath.Join(s.kuteeAPI.imageDir, "docker.io_library_app-latest.tar"))
+
+	// Nor run, the workload must pin its images to allowed digests
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/start_workload", nil)
+	w = httptest.NewRecorder()
+	s.kuteeAPI.startWorkload(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, w.Body.String(), "docker.io/library/app:latest")
+}
+
+func Test_StartWorkload(t *testing.T) {
+	s := setupTestWorkload(t)
+	require.NoError(t, os.WriteFile(WorkloadFile, []byte(`kind: Pod
+apiVersion: v1
+metadata:
+  name: app
+spec:
+  runtimeClassName: gvisor
+  containers:
+  - name: app
+    image: docker.io/library/app:latest
+    resources:
+      limits:
+        cpu: "1"
+        memory: 256Mi
+    env:
+    - name: TOKEN
+      valueFrom:
+        secretKeyRef:
+          name: km-autosecret-token
+          key: KM_AUTOSECRET_TOKEN
+`), 0o600))
+	cluster := s.kuteeAPI.cluster.(*kube.Fake)
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/api/start_workload", nil)
+	w := httptest.NewRecorder()
+	s.kuteeAPI.startWorkload(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var applied []kube.ObjectRef
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &applied))
+	require.Equal(t, []kube.ObjectRef{{Kind: "Pod", Namespace: kube.DefaultNamespace, Name: "app"}}, applied)
+
+	secret, ok := cluster.Secret("km-autosecret-token")
+	require.True(t, ok)
+	require.Len(t, secret["KM_AUTOSECRET_TOKEN"], 64)
+
+	// Starting the workload again keeps its secrets
+	w = httptest.NewRecorder()
+	s.kuteeAPI.startWorkload(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	again, ok := cluster.Secret("km-autosecret-token")
+	require.True(t, ok)
+	require.Equal(t, secret, again)
+
+	// Pods are looked up by name
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "app")
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/api/pods/app", nil)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	s.kuteeAPI.getPodStatus(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status kube.PodStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal(t, "Running", status.Phase)
+
+	req = httptest.NewRequest(http.MethodPost, "http://localhost/api/stop_workload", nil)
+	w = httptest.NewRecorder()
+	s.kuteeAPI.stopWorkload(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/api/pods/app", nil)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	w = httptest.NewRecorder()
+	s.kuteeAPI.getPodStatus(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func Test_Autosecrets_Persist(t *testing.T) {
+	stateDir := t.TempDir()
+	workload := []byte("kind: Pod\nmetadata:\n  name: app\nspec:\n  containers:\n  - name: app\n    image: app\n    envFrom:\n    - secretRef:\n        name: km-autosecret-db\n")
+
+	secret := func() []byte {
+		//nolint: exhaustruct
+		s, err := New(&HTTPServerConfig{
+			Log:      getTestLogger(),
+			Auth:     auth.DummyConfig,
+			Cluster:  kube.NewFake(),
+			StateDir: stateDir,
+		})
+		require.NoError(t, err)
+		require.NoError(t, s.kuteeAPI.autogenerateSecrets(context.Background(), workload))
+
+		data, ok := s.kuteeAPI.cluster.(*kube.Fake).Secret("km-autosecret-db")
+		require.True(t, ok)
+		return data["KM_AUTOSECRET_TOKEN"]
+	}
+
+	// A restarted orchestrator recreates the secrets a new cluster lost, identically
+	first := secret()
+	require.Len(t, first, 2*secrets.SecretSize)
+	require.Equal(t, first, secret())
+}
+
+func Test_ReleaseSecrets(t *testing.T) {
+	s := setupTestWorkload(t)
+	trusted := attestation.Measurement{MRTD: strings.Repeat("aa", 48)}
+	peers := &secrets.Peers{
+		Issuer:   &attestation.MockIssuer{Measurement: trusted},
+		Verifier: attestation.MockVerifier{},
+		Policy:   &attestation.Policy{Allowed: []attestation.Measurement{trusted}},
+	}
+
+	srv := httptest.NewServer(s.srv.Handler)
+	defer srv.Close()
+
+	// Releasing secrets is only enabled with the measurements of the peers
+	_, err := peers.Fetch(context.Background(), srv.Client(), srv.URL, []string{"km-autosecret-db"})
+	require.ErrorContains(t, err, "404")
+
+	s.kuteeAPI.peers = peers
+	fetched, err := peers.Fetch(context.Background(), srv.Client(), srv.URL, []string{"km-autosecret-db"})
+	require.NoError(t, err)
+	expected, err := s.kuteeAPI.secrets.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	require.Equal(t, expected, fetched["km-autosecret-db"])
+
+	untrusted := *peers
+	untrusted.Issuer = &attestation.MockIssuer{Measurement: attestation.Measurement{MRTD: strings.Repeat("bb", 48)}}
+	_, err = untrusted.Fetch(context.Background(), srv.Client(), srv.URL, []string{"km-autosecret-db"})
+	require.ErrorContains(t, err, "403")
+}
+
+func Test_AutosecretNames(t *testing.T) {
+	// Pods named like autosecrets are not secrets
+	names, err := AutosecretNames([]byte(`kind: Pod
+metadata:
+  name: km-autosecret-app
+spec:
+  containers:
+  - name: app
+    image: app
+    envFrom:
+    - secretRef:
+        name: km-autosecret-db
+    - secretRef:
+        name: tls
+  volumes:
+  - name: token
+    secret:
+      secretName: km-autosecret-token
+`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"km-autosecret-db", "km-autosecret-token"}, names)
+}
+
+func Test_RotateSecret(t *testing.T) {
+	s := setupTestWorkload(t)
+	require.NoError(t, os.WriteFile(WorkloadFile, []byte(`kind: Pod
+metadata:
+  name: app
+spec:
+  containers:
+  - name: app
+    image: app
+    envFrom:
+    - secretRef:
+        name: km-autosecret-token
+---
+kind: Pod
+metadata:
+  name: other
+spec:
+  containers:
+  - name: other
+    image: other
+`), 0o600))
+	cluster := s.kuteeAPI.cluster.(*kube.Fake)
+	workload, err := os.ReadFile(WorkloadFile)
+	require.NoError(t, err)
+	applied, err := s.kuteeAPI.applyWorkload(context.Background(), workload)
+	require.NoError(t, err)
+	require.Len(t, applied, 2)
+	before, ok := cluster.Secret("km-autosecret-token")
+	require.True(t, ok)
+
+	rotate := func(name string) *httptest.ResponseRecorder {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", name)
+		req := httptest.NewRequest(http.MethodPost, "http://localhost/api/secrets/"+name+"/rotate", nil)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		s.kuteeAPI.rotateSecret(w, req)
+		return w
+	}
+
+	w := rotate("km-autosecret-token")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp RotateResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	app := kube.ObjectRef{Kind: "Pod", Namespace: kube.DefaultNamespace, Name: "app"}
+	require.Equal(t, RotateResponse{Name: "km-autosecret-token", Restarted: []kube.ObjectRef{app}}, resp)
+
+	// The pods using the secret are restarted with the new one, the others are left alone
+	after, ok := cluster.Secret("km-autosecret-token")
+	require.True(t, ok)
+	require.NotEqual(t, before, after)
+	require.Equal(t, 1, cluster.Restarts(app))
+	require.Equal(t, 0, cluster.Restarts(kube.ObjectRef{Kind: "Pod", Namespace: kube.DefaultNamespace, Name: "other"}))
+
+	// Applying the workload again keeps the rotated secret
+	_, err = s.kuteeAPI.applyWorkload(context.Background(), workload)
+	require.NoError(t, err)
+	again, ok := cluster.Secret("km-autosecret-token")
+	require.True(t, ok)
+	require.Equal(t, after, again)
+
+	entries, err := s.kuteeAPI.auditLog.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, audit.ActionRotateSecret, entries[0].Action)
+	require.Equal(t, "km-autosecret-token", entries[0].Secret)
+
+	// Only autosecrets are rotated
+	require.Equal(t, http.StatusBadRequest, rotate("tls").Code)
+}
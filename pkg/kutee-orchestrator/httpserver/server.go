@@ -2,16 +2,22 @@ package httpserver
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"path/filepath"
 	"time"
 
+	"kutee/auth"
 	"kutee/common"
 	"kutee/metrics"
 
+	"kutee-orchestrator/kube"
+	"kutee-orchestrator/policy"
+	"kutee-orchestrator/secrets"
+
 	"github.com/flashbots/go-utils/httplogger"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -29,43 +35,48 @@ type HTTPServerConfig struct {
 	ReadTimeout              time.Duration
 	WriteTimeout             time.Duration
 
-	Auth AuthConfig
-}
-
-type AuthConfig struct {
-	AuthenticatedUsers map[string][]byte
-	PasswordHasher     func(string) []byte
-}
+	Auth auth.Config
+	// TLS, if not nil, serves the API over TLS, with an RA-TLS certificate from ratls.ServerConfig
+	TLS *tls.Config
 
-var EmptyAuthConfig AuthConfig = AuthConfig{
-	AuthenticatedUsers: make(map[string][]byte),
-	PasswordHasher: func(p string) []byte {
-		return sha256.New().Sum([]byte(p))
-	},
+	// ImageLoader loads uploaded images into the cluster, minikube's by default
+	ImageLoader ImageLoader
+	// ImageAllowlist, if not nil, only allows the images it lists to be loaded and run
+	ImageAllowlist ImageAllowlist
+	// Policy is enforced on the workloads started, policy.Default() if nil
+	Policy *policy.Policy
+	// Cluster runs the workload, through minikube's kubectl by default
+	Cluster kube.ClusterClient
+	// Namespace is the one Cluster puts the objects without a namespace in, kube.DefaultNamespace if empty
+	Namespace string
+	// Secrets derives the workloads' autosecrets. If nil, they are derived from a sealing root kept
+	// in plaintext in StateDir, bound to no identity, which is only fit outside of a TD.
+	Secrets *secrets.Store
+	// Peers, if not nil, releases autosecrets to the peer instances it trusts
+	Peers *secrets.Peers
+	// StateDir keeps the submitted workloads, the uploaded images, the audit log and the revoked tokens,
+	// DefaultStateDir if empty
+	StateDir string
 }
 
-func (a AuthConfig) ParseJSONUsers(jsonConfig []byte) AuthConfig {
-	if err := json.Unmarshal(jsonConfig, &(a.AuthenticatedUsers)); err != nil {
-		panic(err)
-	}
-	return a
-}
+const DefaultStateDir = "./orchestrator-state"
 
-var DummyAuthConfig AuthConfig = AuthConfig{
-	AuthenticatedUsers: map[string][]byte{
-		"test": []byte("test"),
-	},
-	PasswordHasher: func(p string) []byte {
-		return []byte(p)
-	},
-}
+const (
+	// SealingRootFile is the name of the sealing root in the state directory, unless it's configured
+	SealingRootFile = "sealing-root"
+	// ImportedSecretsDir keeps the secrets fetched from peers in the state directory
+	ImportedSecretsDir = "imported-secrets"
+	// ImagesDir keeps the uploaded image archives and their layer blobs in the state directory
+	ImagesDir = "images"
+)
 
 type Server struct {
 	cfg     *HTTPServerConfig
 	isReady atomic.Bool
 	log     *slog.Logger
 
-	kuteeAPI *KuteeAPI
+	kuteeAPI      *KuteeAPI
+	authenticator auth.Authenticator
 
 	srv     *http.Server
 	metrics *metrics.MetricsServer
@@ -77,12 +88,75 @@ func New(cfg *HTTPServerConfig) (srv *Server, err error) {
 		return nil, err
 	}
 
+	imageLoader := cfg.ImageLoader
+	if imageLoader == nil {
+		imageLoader = MinikubeLoader{}
+	}
+
+	cluster := cfg.Cluster
+	if cluster == nil {
+		cluster = &kube.Kubectl{}
+	}
+
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = kube.DefaultNamespace
+	}
+
+	workloadPolicy := cfg.Policy
+	if workloadPolicy == nil {
+		workloadPolicy = policy.Default()
+	}
+
+	stateDir := cfg.StateDir
+	if stateDir == "" {
+		stateDir = DefaultStateDir
+	}
+
+	secretStore := cfg.Secrets
+	if secretStore == nil {
+		root, err := secrets.LoadOrCreateRoot(filepath.Join(stateDir, SealingRootFile))
+		if err != nil {
+			return nil, fmt.Errorf("could not load the sealing root: %w", err)
+		}
+		if secretStore, err = secrets.NewStore(root, nil, filepath.Join(stateDir, ImportedSecretsDir)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Tokens are signed with a key that never leaves memory, they are valid until the orchestrator restarts
+	tokenKey, err := auth.GenerateTokenKey()
+	if err != nil {
+		return nil, err
+	}
+	revocations, err := auth.OpenRevocations(filepath.Join(stateDir, RevokedTokensFile))
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := auth.NewTokens(tokenKey, revocations)
+	if err != nil {
+		return nil, err
+	}
+
+	authConfig := cfg.Auth
+	authConfig.Tokens = tokens
+	authenticator, err := auth.New(authConfig, cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	kuteeAPI, err := NewKuteeAPI(imageLoader, cfg.ImageAllowlist, workloadPolicy, cluster, namespace, secretStore, cfg.Peers, tokens, stateDir, cfg.Log)
+	if err != nil {
+		return nil, err
+	}
+
 	srv = &Server{
-		cfg:      cfg,
-		log:      cfg.Log,
-		kuteeAPI: NewKuteeAPI(cfg.Auth.AuthenticatedUsers, cfg.Auth.PasswordHasher),
-		srv:      nil,
-		metrics:  metricsSrv,
+		cfg:           cfg,
+		log:           cfg.Log,
+		kuteeAPI:      kuteeAPI,
+		authenticator: authenticator,
+		srv:           nil,
+		metrics:       metricsSrv,
 	}
 	srv.isReady.Swap(true)
 
@@ -103,14 +177,42 @@ func New(cfg *HTTPServerConfig) (srv *Server, err error) {
 		}
 	}
 
-	measureAuthenticateAndHandle := func(name string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
-		return measureAndHandle(name, srv.kuteeAPI.AuthenticateAndHandle(handler))
+	authenticate := auth.Middleware(srv.authenticator)
+	measureAuthenticateAndHandle := func(name string, permission auth.Permission, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		authorize := auth.Authorize(srv.log, permission)
+		return measureAndHandle(name, authenticate(authorize(http.HandlerFunc(handler))).ServeHTTP)
+	}
+	// Requests anyone authenticated may send, whatever their permissions
+	measureAndAuthenticate := func(name string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+		return measureAndHandle(name, authenticate(http.HandlerFunc(handler)).ServeHTTP)
 	}
 
 	mux := chi.NewRouter()
 
-	mux.With(srv.httpLogger).Post("/api/upload_image", measureAuthenticateAndHandle("upload_image", srv.kuteeAPI.uploadImageTarball))
-	mux.With(srv.httpLogger).Get("/api/start_workload", measureAuthenticateAndHandle("start_workload", srv.kuteeAPI.startWorkload))
+	mux.With(srv.httpLogger).Post("/api/upload_image", measureAuthenticateAndHandle("upload_image", auth.PermissionUpload, srv.kuteeAPI.uploadImageTarball))
+	mux.With(srv.httpLogger).Post("/api/uploads", measureAuthenticateAndHandle("create_upload", auth.PermissionUpload, srv.kuteeAPI.createUpload))
+	mux.With(srv.httpLogger).Get("/api/uploads/{id}", measureAuthenticateAndHandle("get_upload", auth.PermissionUpload, srv.kuteeAPI.getUpload))
+	mux.With(srv.httpLogger).Put("/api/uploads/{id}", measureAuthenticateAndHandle("upload_chunk", auth.PermissionUpload, srv.kuteeAPI.uploadChunk))
+	mux.With(srv.httpLogger).Post("/api/uploads/{id}/finalize", measureAuthenticateAndHandle("finalize_upload", auth.PermissionUpload, srv.kuteeAPI.finalizeUpload))
+	mux.With(srv.httpLogger).Post("/api/start_workload", measureAuthenticateAndHandle("start_workload", auth.PermissionOperate, srv.kuteeAPI.startWorkload))
+	mux.With(srv.httpLogger).Post("/api/stop_workload", measureAuthenticateAndHandle("stop_workload", auth.PermissionOperate, srv.kuteeAPI.stopWorkload))
+	mux.With(srv.httpLogger).Get("/api/pods/{name}", measureAuthenticateAndHandle("get_pod_status", auth.PermissionRead, srv.kuteeAPI.getPodStatus))
+	mux.With(srv.httpLogger).Post("/api/workloads", measureAuthenticateAndHandle("create_workload", auth.PermissionOperate, srv.kuteeAPI.createWorkload))
+	mux.With(srv.httpLogger).Get("/api/workloads", measureAuthenticateAndHandle("list_workloads", auth.PermissionRead, srv.kuteeAPI.listWorkloads))
+	mux.With(srv.httpLogger).Get("/api/workloads/{id}", measureAuthenticateAndHandle("get_workload", auth.PermissionRead, srv.kuteeAPI.getWorkload))
+	mux.With(srv.httpLogger).Put("/api/workloads/{id}", measureAuthenticateAndHandle("update_workload", auth.PermissionOperate, srv.kuteeAPI.updateWorkload))
+	mux.With(srv.httpLogger).Delete("/api/workloads/{id}", measureAuthenticateAndHandle("delete_workload", auth.PermissionOperate, srv.kuteeAPI.deleteWorkload))
+	mux.With(srv.httpLogger).Get("/api/audit", measureAuthenticateAndHandle("get_audit_log", auth.PermissionAudit, srv.kuteeAPI.getAuditLog))
+	mux.With(srv.httpLogger).Post("/api/secrets/{name}/rotate", measureAuthenticateAndHandle("rotate_secret", auth.PermissionOperate, srv.kuteeAPI.rotateSecret))
+	mux.With(srv.httpLogger).Post("/api/tokens", measureAuthenticateAndHandle("issue_token", auth.PermissionRead, srv.kuteeAPI.issueToken))
+	mux.With(srv.httpLogger).Delete("/api/tokens/current", measureAndAuthenticate("revoke_current_token", srv.kuteeAPI.revokeCurrentToken))
+	mux.With(srv.httpLogger).Delete("/api/tokens/{id}", measureAuthenticateAndHandle("revoke_token", auth.PermissionRevokeTokens, srv.kuteeAPI.revokeToken))
+
+	// Peers authenticate with their attestation
+	mux.With(srv.httpLogger).Post("/api/peer/secrets", measureAndHandle("release_secrets", srv.kuteeAPI.releaseSecrets))
+
+	// The public halves of the autosecrets' keys are for anyone talking to the workloads
+	mux.With(srv.httpLogger).Get("/api/secrets/{name}/public", measureAndHandle("get_public_keys", srv.kuteeAPI.getPublicKeys))
 
 	mux.With(srv.httpLogger).Get("/livez", srv.handleLivenessCheck)
 	mux.With(srv.httpLogger).Get("/readyz", srv.handleReadinessCheck)
@@ -127,6 +229,7 @@ func New(cfg *HTTPServerConfig) (srv *Server, err error) {
 		Handler:      mux,
 		ReadTimeout:  cfg.ReadTimeout,
 		WriteTimeout: cfg.WriteTimeout,
+		TLSConfig:    cfg.TLS,
 	}
 
 	return srv, nil
@@ -150,8 +253,15 @@ func (s *Server) RunInBackground() {
 
 	// api
 	go func() {
-		s.log.Info("Starting HTTP server", "listenAddress", s.cfg.ListenAddr)
-		if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.log.Info("Starting HTTP server", "listenAddress", s.cfg.ListenAddr, "tls", s.srv.TLSConfig != nil)
+		var err error
+		if s.srv.TLSConfig != nil {
+			// The certificates are in the TLS config
+			err = s.srv.ListenAndServeTLS("", "")
+		} else {
+			err = s.srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			s.log.Error("HTTP server failed", "err", err)
 		}
 	}()
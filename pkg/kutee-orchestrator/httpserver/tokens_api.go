@@ -0,0 +1,135 @@
+package httpserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"kutee/auth"
+
+	"kutee-orchestrator/audit"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultTokenTTL is how long tokens are valid for, unless requested otherwise
+const DefaultTokenTTL = time.Hour
+
+// MaxTokenRequestSize limits the token requests
+const MaxTokenRequestSize = 4096
+
+// RevokedTokensFile keeps the ids of the revoked tokens in the state directory
+const RevokedTokensFile = "revoked-tokens.json"
+
+type TokenRequest struct {
+	// Scopes are the permissions of the token, all the user's if empty
+	Scopes []auth.Permission `json:"scopes,omitempty"`
+	// TTL is how long the token is valid for, as a duration such as 30m, DefaultTokenTTL if empty
+	TTL string `json:"ttl,omitempty"`
+}
+
+type TokenResponse struct {
+	Token     string            `json:"token"`
+	ID        string            `json:"id"`
+	Scopes    []auth.Permission `json:"scopes"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// issueToken exchanges the credentials of the request for a token with the scopes requested
+func (s *KuteeAPI) issueToken(w http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	if principal.Method == auth.MethodToken {
+		http.Error(w, "tokens can't issue tokens, authenticate with credentials", http.StatusForbidden)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxTokenRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request TokenRequest
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &request); err != nil {
+			http.Error(w, "could not parse the token request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ttl := DefaultTokenTTL
+	if request.TTL != "" {
+		if ttl, err = time.ParseDuration(request.TTL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	scopes := request.Scopes
+	if len(scopes) == 0 {
+		scopes = principal.Permissions()
+	}
+	for _, scope := range scopes {
+		if !principal.Can(scope) {
+			http.Error(w, fmt.Sprintf("%s lacks the %s permission", principal.Name, scope), http.StatusForbidden)
+			return
+		}
+	}
+
+	token, claims, err := s.tokens.Issue(principal.Name, scopes, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.recordChange(r, audit.Entry{Action: audit.ActionIssueToken, Token: claims.ID}, nil)
+	s.log.Info("issued token", "user", principal.Name, "id", claims.ID, "scopes", scopes, "ttl", ttl)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(TokenResponse{
+		Token:     token,
+		ID:        claims.ID,
+		Scopes:    scopes,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+// revokeToken revokes the token of the id, as recorded in the audit log when it was issued
+func (s *KuteeAPI) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if decoded, err := hex.DecodeString(id); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid token id", http.StatusBadRequest)
+		return
+	}
+	s.revoke(w, r, id)
+}
+
+// revokeCurrentToken revokes the token the request is authenticated with. Every token can revoke
+// itself, whatever its scopes.
+func (s *KuteeAPI) revokeCurrentToken(w http.ResponseWriter, r *http.Request) {
+	principal := auth.PrincipalFrom(r.Context())
+	if principal == nil {
+		http.Error(w, auth.ErrNoCredentials.Error(), http.StatusUnauthorized)
+		return
+	}
+	id := principal.TokenID
+	if id == "" {
+		http.Error(w, "the request is not authenticated with a token", http.StatusBadRequest)
+		return
+	}
+	s.revoke(w, r, id)
+}
+
+func (s *KuteeAPI) revoke(w http.ResponseWriter, r *http.Request, id string) {
+	err := s.tokens.Revoke(id)
+	s.recordChange(r, audit.Entry{Action: audit.ActionRevokeToken, Token: id}, err)
+	if err != nil {
+		http.Error(w, "could not revoke the token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.log.Info("revoked token", "id", id)
+	w.WriteHeader(http.StatusOK)
+}
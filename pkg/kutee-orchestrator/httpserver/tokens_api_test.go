@@ -0,0 +1,68 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kutee-orchestrator/audit"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Tokens(t *testing.T) {
+	s := setupTestWorkload(t)
+
+	request := func(method string, path string, body string, authorize func(req *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+		authorize(req)
+		w := httptest.NewRecorder()
+		s.srv.Handler.ServeHTTP(w, req)
+		return w
+	}
+	basic := func(req *http.Request) { req.SetBasicAuth("test", "test") }
+
+	w := request(http.MethodPost, "/api/tokens", `{"scopes": ["read"], "ttl": "10m"}`, basic)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var issued TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &issued))
+	bearer := func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+issued.Token) }
+
+	// The token only has its scopes
+	require.Equal(t, http.StatusOK, request(http.MethodGet, "/api/workloads", "", bearer).Code)
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/workloads", testWorkloadManifest, bearer).Code)
+	// and doesn't issue other tokens
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/tokens", "", bearer).Code)
+
+	require.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/tokens", `{"scopes": ["everything"]}`, basic).Code)
+	require.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/api/tokens", `{"ttl": "1000h"}`, basic).Code)
+
+	// Revoked tokens are refused
+	require.Equal(t, http.StatusOK, request(http.MethodDelete, "/api/tokens/current", "", bearer).Code)
+	require.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/workloads", "", bearer).Code)
+	require.Equal(t, http.StatusBadRequest, request(http.MethodDelete, "/api/tokens/current", "", basic).Code)
+	require.Equal(t, http.StatusOK, request(http.MethodDelete, "/api/tokens/"+issued.ID, "", basic).Code)
+
+	// Tokens revoke themselves without the read permission
+	w = request(http.MethodPost, "/api/tokens", `{"scopes": ["upload"], "ttl": "10m"}`, basic)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var uploadOnly TokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &uploadOnly))
+	uploadBearer := func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+uploadOnly.Token) }
+	require.Equal(t, http.StatusForbidden, request(http.MethodGet, "/api/workloads", "", uploadBearer).Code)
+	require.Equal(t, http.StatusOK, request(http.MethodDelete, "/api/tokens/current", "", uploadBearer).Code)
+	require.Equal(t, http.StatusUnauthorized, request(http.MethodDelete, "/api/tokens/current", "", uploadBearer).Code)
+	require.Equal(t, http.StatusUnauthorized, request(http.MethodDelete, "/api/tokens/current", "", func(req *http.Request) {}).Code)
+
+	entries, err := s.kuteeAPI.auditLog.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	require.Equal(t, audit.ActionIssueToken, entries[0].Action)
+	require.Equal(t, issued.ID, entries[0].Token)
+	require.Equal(t, audit.ActionRevokeToken, entries[1].Action)
+	require.Equal(t, "test", entries[1].User)
+	require.Equal(t, audit.ActionRevokeToken, entries[4].Action)
+	require.Equal(t, uploadOnly.ID, entries[4].Token)
+}
@@ -0,0 +1,344 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"kutee/auth"
+	"kutee/manifest"
+
+	"kutee-orchestrator/audit"
+	"kutee-orchestrator/kube"
+	"kutee-orchestrator/policy"
+	"kutee-orchestrator/workloads"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// MaxWorkloadSize limits the manifests submitted to the workloads API
+const MaxWorkloadSize = 1 << 20
+
+// startedWorkload names the workload of WorkloadFile, started by start_workload, among the stored ones
+const startedWorkload = "started by start_workload"
+
+// readWorkload reads the manifest from the request body and checks that it can be applied as
+// workload id, responding with an error if it can't. id is empty for new workloads.
+func (s *KuteeAPI) readWorkload(w http.ResponseWriter, r *http.Request, id string) ([]byte, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxWorkloadSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("the manifest is larger than %d bytes", MaxWorkloadSize), http.StatusRequestEntityTooLarge)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if !s.checkPolicy(w, data) {
+		return nil, false
+	}
+
+	objects, err := kube.ManifestObjects(data, s.namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if len(objects) == 0 {
+		http.Error(w, "the manifest has no objects", http.StatusBadRequest)
+		return nil, false
+	}
+
+	images, err := manifest.Images(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	refused := []string{}
+	for _, image := range images {
+		if !s.imageAllowlist.AllowsRef(image) {
+			refused = append(refused, image)
+		}
+	}
+	if len(refused) > 0 {
+		sort.Strings(refused)
+		http.Error(w, "the workload runs images that are not on the allowlist: "+strings.Join(refused, ", "), http.StatusForbidden)
+		return nil, false
+	}
+
+	// The other workloads, including the one started by start_workload
+	others := map[string][]byte{}
+	if workload, err := os.ReadFile(WorkloadFile); err == nil {
+		others[startedWorkload] = workload
+	} else if !errors.Is(err, os.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	for _, other := range s.workloads.List() {
+		if other.ID != id {
+			others[other.ID] = []byte(other.Manifest)
+		}
+	}
+
+	// Workloads sharing an autosecret must agree on its keys
+	otherManifests := make([][]byte, 0, len(others))
+	for _, other := range others {
+		otherManifests = append(otherManifests, other)
+	}
+	err = checkTemplates(data, otherManifests)
+	if errors.Is(err, errTemplateConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Workloads own their objects, deleting one must not delete the objects of another
+	for owner, other := range others {
+		owned, err := kube.ManifestObjects(other, s.namespace)
+		if owner == startedWorkload && errors.Is(err, kube.ErrInvalid) {
+			continue // it can't be started, so it has no objects
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		for _, obj := range objects {
+			if slices.Contains(owned, obj) {
+				http.Error(w, fmt.Sprintf("%s belongs to the workload %s", obj, owner), http.StatusConflict)
+				return nil, false
+			}
+		}
+	}
+
+	return data, true
+}
+
+// checkPolicy responds with the violations of the manifest if it breaks the workload policy
+func (s *KuteeAPI) checkPolicy(w http.ResponseWriter, data []byte) bool {
+	err := s.policy.Check(data)
+	var policyErr *policy.Error
+	if errors.As(err, &policyErr) {
+		s.log.Info("rejected workload", "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		if err := json.NewEncoder(w).Encode(policyErr); err != nil {
+			s.log.Error("could not write the response", "err", err)
+		}
+		return false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// applyWorkload creates the secrets the workload needs and applies it
+func (s *KuteeAPI) applyWorkload(ctx context.Context, data []byte) ([]kube.ObjectRef, error) {
+	if err := s.autogenerateSecrets(ctx, data); err != nil {
+		return nil, fmt.Errorf("could not generate the workload's secrets: %w", err)
+	}
+
+	applied, err := s.cluster.ApplyManifest(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply the workload: %w", err)
+	}
+	return applied, nil
+}
+
+// rollBack puts the cluster back the way it was before current was applied over previous, the
+// workload's last revision, nil for new workloads. Failures are logged, the client gets the error
+// of the change rolled back.
+func (s *KuteeAPI) rollBack(ctx context.Context, previous []byte, current []byte) {
+	ctx = context.WithoutCancel(ctx)
+
+	added, err := kube.RemovedObjects(current, previous, s.namespace)
+	if err == nil && added != nil {
+		err = s.cluster.DeleteWorkload(ctx, added)
+	}
+	if err == nil && previous != nil {
+		_, err = s.cluster.ApplyManifest(ctx, previous)
+	}
+	if err != nil {
+		s.log.Error("could not roll back the workload, the cluster may have objects no workload owns", "err", err)
+	}
+}
+
+// recordChange adds the change to the audit log, with its error if it failed
+func (s *KuteeAPI) recordChange(r *http.Request, entry audit.Entry, err error) {
+	entry.User = auth.User(r)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := s.auditLog.Record(entry); err != nil {
+		s.log.Error("could not record the change in the audit log", "action", entry.Action, "workload", entry.Workload, "err", err)
+	}
+}
+
+func writeWorkload(w http.ResponseWriter, status int, workload workloads.Workload) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(workload)
+}
+
+// createWorkload stores the manifest of the request body as a new workload, and applies it
+func (s *KuteeAPI) createWorkload(w http.ResponseWriter, r *http.Request) {
+	s.workloadsMu.Lock()
+	defer s.workloadsMu.Unlock()
+
+	data, ok := s.readWorkload(w, r, "")
+	if !ok {
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	now := time.Now().UTC()
+	workload := workloads.Workload{
+		ID:        uuid.Must(uuid.NewRandom()).String(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Creator:   auth.User(r),
+		Revision:  1,
+		Manifest:  string(data),
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+
+	applied, err := s.applyWorkload(r.Context(), data)
+	if err == nil {
+		workload.Objects = applied
+		if err = s.workloads.Create(workload); err != nil {
+			s.log.Error("could not store the workload", "id", workload.ID, "err", err)
+		}
+	}
+	s.recordChange(r, audit.Entry{Action: audit.ActionCreate, Workload: workload.ID, SHA256: workload.SHA256, Revision: workload.Revision}, err)
+	if err != nil {
+		s.rollBack(r.Context(), nil, data)
+		http.Error(w, err.Error(), clusterErrorStatus(err))
+		return
+	}
+
+	writeWorkload(w, http.StatusCreated, workload)
+}
+
+func (s *KuteeAPI) listWorkloads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.workloads.List())
+}
+
+func (s *KuteeAPI) getWorkload(w http.ResponseWriter, r *http.Request) {
+	workload, err := s.workloads.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeWorkload(w, http.StatusOK, workload)
+}
+
+// updateWorkload applies the manifest of the request body as the new revision of the workload.
+// Objects the new revision no longer has are deleted.
+func (s *KuteeAPI) updateWorkload(w http.ResponseWriter, r *http.Request) {
+	s.workloadsMu.Lock()
+	defer s.workloadsMu.Unlock()
+
+	workload, err := s.workloads.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	data, ok := s.readWorkload(w, r, workload.ID)
+	if !ok {
+		return
+	}
+
+	removed, err := kube.RemovedObjects([]byte(workload.Manifest), data, s.namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	entry := audit.Entry{Action: audit.ActionUpdate, Workload: workload.ID, SHA256: hex.EncodeToString(sum[:]), Revision: workload.Revision + 1}
+	applied, err := s.applyWorkload(r.Context(), data)
+	if err == nil && removed != nil {
+		if err = s.cluster.DeleteWorkload(r.Context(), removed); err != nil {
+			err = fmt.Errorf("could not delete the objects the workload no longer has: %w", err)
+		}
+	}
+	if err == nil {
+		err = s.workloads.Update(workload.ID, func(stored *workloads.Workload) {
+			stored.UpdatedAt = time.Now().UTC()
+			stored.Revision = entry.Revision
+			stored.Manifest = string(data)
+			stored.SHA256 = entry.SHA256
+			stored.Objects = applied
+		})
+		if err != nil {
+			s.log.Error("could not store the workload", "id", workload.ID, "err", err)
+		}
+	}
+	s.recordChange(r, entry, err)
+	if err != nil {
+		s.rollBack(r.Context(), []byte(workload.Manifest), data)
+		http.Error(w, err.Error(), clusterErrorStatus(err))
+		return
+	}
+
+	workload, err = s.workloads.Get(workload.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeWorkload(w, http.StatusOK, workload)
+}
+
+// deleteWorkload deletes the objects of the workload from the cluster, and forgets it
+func (s *KuteeAPI) deleteWorkload(w http.ResponseWriter, r *http.Request) {
+	s.workloadsMu.Lock()
+	defer s.workloadsMu.Unlock()
+
+	workload, err := s.workloads.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = s.cluster.DeleteWorkload(r.Context(), []byte(workload.Manifest))
+	s.recordChange(r, audit.Entry{Action: audit.ActionDelete, Workload: workload.ID, Revision: workload.Revision}, err)
+	if err != nil {
+		http.Error(w, "could not delete the workload: "+err.Error(), clusterErrorStatus(err))
+		return
+	}
+
+	if err := s.workloads.Delete(workload.ID); err != nil {
+		s.log.Error("could not forget the workload", "id", workload.ID, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// getAuditLog returns the changes made to the workloads, oldest first
+func (s *KuteeAPI) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.auditLog.Entries()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
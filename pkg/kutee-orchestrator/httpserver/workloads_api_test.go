@@ -0,0 +1,295 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"kutee-orchestrator/audit"
+	"kutee-orchestrator/kube"
+	"kutee-orchestrator/policy"
+	"kutee-orchestrator/workloads"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testWorkloadManifest = `apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  runtimeClassName: gvisor
+  containers:
+  - name: app
+    image: docker.io/library/app:latest
+    resources:
+      limits:
+        cpu: "1"
+        memory: 256Mi
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`
+
+func requestWorkloads(t *testing.T, s *Server, method string, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "http://localhost/api/workloads"+path, strings.NewReader(body))
+	req.SetBasicAuth("test", "test")
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, req)
+	return w
+}
+
+func Test_Workloads(t *testing.T) {
+	s := setupTestWorkload(t)
+	cluster := s.kuteeAPI.cluster.(*kube.Fake)
+
+	w := requestWorkloads(t, s, http.MethodPost, "", testWorkloadManifest)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created workloads.Workload
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.Equal(t, "test", created.Creator)
+	require.Equal(t, 1, created.Revision)
+	require.Len(t, created.Objects, 2)
+	_, ok := cluster.Object(kube.ObjectRef{Kind: "Service", Namespace: kube.DefaultNamespace, Name: "app"})
+	require.True(t, ok)
+
+	// Objects belong to a single workload
+	w = requestWorkloads(t, s, http.MethodPost, "", testWorkloadManifest)
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.Contains(t, w.Body.String(), created.ID)
+
+	w = requestWorkloads(t, s, http.MethodGet, "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed []workloads.Workload
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed, 1)
+	require.Equal(t, created.ID, listed[0].ID)
+
+	// Updates apply the new revision and delete the objects it no longer has
+	podOnly := strings.Split(testWorkloadManifest, "---")[0]
+	w = requestWorkloads(t, s, http.MethodPut, "/"+created.ID, podOnly)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var updated workloads.Workload
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	require.Equal(t, 2, updated.Revision)
+	require.Equal(t, podOnly, updated.Manifest)
+	require.NotEqual(t, created.SHA256, updated.SHA256)
+	_, ok = cluster.Object(kube.ObjectRef{Kind: "Service", Namespace: kube.DefaultNamespace, Name: "app"})
+	require.False(t, ok)
+
+	w = requestWorkloads(t, s, http.MethodDelete, "/"+created.ID, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	objects, err := cluster.ListWorkloads(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, objects)
+
+	w = requestWorkloads(t, s, http.MethodGet, "/"+created.ID, "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// Every change is recorded, with who made it
+	entries, err := s.kuteeAPI.auditLog.Entries()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for i, action := range []string{audit.ActionCreate, audit.ActionUpdate, audit.ActionDelete} {
+		require.Equal(t, action, entries[i].Action)
+		require.Equal(t, created.ID, entries[i].Workload)
+		require.Equal(t, "test", entries[i].User)
+	}
+	require.Equal(t, updated.SHA256, entries[1].SHA256)
+}
+
+func Test_Workloads_Ownership(t *testing.T) {
+	s := setupTestWorkload(t)
+	deployed := strings.Replace(strings.Split(testWorkloadManifest, "---")[0], "name: app\n", "name: deployed\n", 1)
+	require.NoError(t, os.WriteFile(WorkloadFile, []byte(deployed), 0o600))
+
+	// The objects of the workload started by start_workload are not for the taking
+	w := requestWorkloads(t, s, http.MethodPost, "", deployed)
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), "start_workload")
+
+	w = requestWorkloads(t, s, http.MethodPost, "", testWorkloadManifest)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	// Objects without a namespace are in the cluster client's
+	explicit := strings.Replace(strings.Split(testWorkloadManifest, "---")[0], "name: app\n", "name: app\n  namespace: default\n", 1)
+	w = requestWorkloads(t, s, http.MethodPost, "", explicit)
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+}
+
+// failingCluster applies manifests, and then fails if fail is set, as if an object was refused
+type failingCluster struct {
+	*kube.Fake
+	fail bool
+}
+
+func (c *failingCluster) ApplyManifest(ctx context.Context, manifest []byte) ([]kube.ObjectRef, error) {
+	refs, err := c.Fake.ApplyManifest(ctx, manifest)
+	if c.fail {
+		return nil, errors.New("apply failed")
+	}
+	return refs, err
+}
+
+func Test_Workloads_RollBack(t *testing.T) {
+	s := setupTestWorkload(t)
+	cluster := &failingCluster{Fake: kube.NewFake(), fail: true}
+	s.kuteeAPI.cluster = cluster
+
+	// Workloads that fail to apply leave nothing behind
+	w := requestWorkloads(t, s, http.MethodPost, "", testWorkloadManifest)
+	require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+	objects, err := cluster.ListWorkloads(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, objects)
+	require.Empty(t, s.kuteeAPI.workloads.List())
+
+	cluster.fail = false
+	w = requestWorkloads(t, s, http.MethodPost, "", testWorkloadManifest)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created workloads.Workload
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	// Updates that fail leave the previous revision
+	updated := strings.Split(testWorkloadManifest, "---")[0] + "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: added\n"
+	cluster.fail = true
+	w = requestWorkloads(t, s, http.MethodPut, "/"+created.ID, updated)
+	require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+	_, ok := cluster.Object(kube.ObjectRef{Kind: "ConfigMap", Namespace: kube.DefaultNamespace, Name: "added"})
+	require.False(t, ok)
+	_, ok = cluster.Object(kube.ObjectRef{Kind: "Service", Namespace: kube.DefaultNamespace, Name: "app"})
+	require.True(t, ok)
+	stored, err := s.kuteeAPI.workloads.Get(created.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, stored.Revision)
+}
+
+func Test_Workloads_Invalid(t *testing.T) {
+	s := setupTestWorkload(t)
+	s.kuteeAPI.imageAllowlist = ImageAllowlist{}
+
+	cases := map[string]struct {
+		manifest string
+		status   int
+	}{
+		"invalid yaml":      {"kind: Pod\nspec: [\n", http.StatusBadRequest},
+		"no objects":        {"# nothing\n", http.StatusBadRequest},
+		"unnamed object":    {"kind: Service\napiVersion: v1\n", http.StatusBadRequest},
+		"image not allowed": {testWorkloadManifest, http.StatusForbidden},
+		"breaks the policy": {strings.Replace(testWorkloadManifest, "gvisor", "runc", 1), http.StatusBadRequest},
+		"too large":         {strings.Repeat("#", MaxWorkloadSize+1), http.StatusRequestEntityTooLarge},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := requestWorkloads(t, s, http.MethodPost, "", c.manifest)
+			require.Equal(t, c.status, w.Code, w.Body.String())
+		})
+	}
+
+	require.Empty(t, s.kuteeAPI.workloads.List())
+	entries, err := s.kuteeAPI.auditLog.Entries()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func Test_Workloads_UploadImage(t *testing.T) {
+	s := setupTestWorkload(t)
+	require.NoError(t, os.Remove(WorkloadFile))
+
+	archive := testArchive(t, "docker.io/library/app:latest")
+	w := uploadTestFile(t, s, "docker.io_library_app-latest.tar", archive)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Images of submitted workloads can be uploaded once they are
+	w = requestWorkloads(t, s, http.MethodPost, "", testWorkloadManifest)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = uploadTestFile(t, s, "docker.io_library_app-latest.tar", archive)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func Test_Workloads_Policy(t *testing.T) {
+	s := setupTestWorkload(t)
+
+	manifest := strings.Replace(testWorkloadManifest, "  runtimeClassName: gvisor\n", "  hostNetwork: true\n", 1)
+	w := requestWorkloads(t, s, http.MethodPost, "", manifest)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Every violation is listed
+	var resp policy.Error
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	fields := []string{}
+	for _, v := range resp.Violations {
+		fields = append(fields, v.Field)
+	}
+	require.Equal(t, []string{"spec.runtimeClassName", "spec.hostNetwork"}, fields)
+	require.Empty(t, s.kuteeAPI.workloads.List())
+}
+
+func templatedWorkload(name string, annotations string) string {
+	return `apiVersion: v1
+kind: Pod
+metadata:
+  name: ` + name + `
+  annotations:
+` + annotations + `
+spec:
+  runtimeClassName: gvisor
+  containers:
+  - name: app
+    image: docker.io/library/app:latest
+    resources:
+      limits:
+        cpu: "1"
+        memory: 256Mi
+    envFrom:
+    - secretRef:
+        name: km-autosecret-node
+`
+}
+
+func Test_Workloads_AutosecretTemplates(t *testing.T) {
+	s := setupTestWorkload(t)
+	cluster := s.kuteeAPI.cluster.(*kube.Fake)
+
+	template := `    autosecret.kutee/km-autosecret-node: '{"NODE_KEY": {"type": "ed25519"}, "DB_PASSWORD": {"type": "password", "length": 24}}'`
+	w := requestWorkloads(t, s, http.MethodPost, "", templatedWorkload("node", template))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	secret, ok := cluster.Secret("km-autosecret-node")
+	require.True(t, ok)
+	require.Len(t, secret, 3)
+	require.Len(t, secret["DB_PASSWORD"], 24)
+
+	// Anyone can get the public halves of the keys
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/api/secrets/km-autosecret-node/public", nil)
+	w = httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var public PublicKeysResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &public))
+	require.Equal(t, map[string]string{"NODE_KEY_PUBLIC": string(secret["NODE_KEY_PUBLIC"])}, public.Public)
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/api/secrets/km-autosecret-other/public", nil)
+	w = httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// Workloads sharing the secret must agree on its keys
+	w = requestWorkloads(t, s, http.MethodPost, "", templatedWorkload("other", "    team: other"))
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	w = requestWorkloads(t, s, http.MethodPost, "", templatedWorkload("other", template))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = requestWorkloads(t, s, http.MethodPost, "", templatedWorkload("invalid", `    autosecret.kutee/km-autosecret-invalid: '{"KEY": {"type": "rsa"}}'`))
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), "no pod refers to")
+}
@@ -0,0 +1,263 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// listedResources are the resources of listedKinds
+var listedResources = []schema.GroupVersionResource{
+	{Version: "v1", Resource: "pods"},
+	{Group: "apps", Version: "v1", Resource: "deployments"},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"},
+	{Group: "apps", Version: "v1", Resource: "daemonsets"},
+	{Group: "batch", Version: "v1", Resource: "jobs"},
+	{Group: "batch", Version: "v1", Resource: "cronjobs"},
+	{Version: "v1", Resource: "services"},
+	{Version: "v1", Resource: "configmaps"},
+}
+
+// ClientGo talks to the Kubernetes API directly. Manifests are applied server side.
+type ClientGo struct {
+	Namespace string
+
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	mapper    meta.ResettableRESTMapper
+}
+
+// NewClientGo connects with the kubeconfig at the given path, or the in-cluster config if it's empty
+func NewClientGo(kubeconfig string, namespace string) (*ClientGo, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the kubernetes config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	return &ClientGo{
+		Namespace: namespace,
+		clientset: clientset,
+		dynamic:   dynamicClient,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery())),
+	}, nil
+}
+
+// apiError wraps the errors callers handle, the API's message says what went wrong
+func apiError(action string, ref ObjectRef, err error) error {
+	switch {
+	case apierrors.IsNotFound(err):
+		return fmt.Errorf("could not %s %s: %w: %w", action, ref, ErrNotFound, err)
+	case apierrors.IsAlreadyExists(err):
+		return fmt.Errorf("could not %s %s: %w: %w", action, ref, ErrAlreadyExists, err)
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		return fmt.Errorf("could not %s %s: %w: %w", action, ref, ErrInvalid, err)
+	default:
+		return fmt.Errorf("could not %s %s: %w", action, ref, err)
+	}
+}
+
+// resource returns the client for the object's resource
+func (c *ClientGo) resource(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		// The kind may have just been installed
+		c.mapper.Reset()
+		mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w kind %s: %w", ErrInvalid, gvk, err)
+	}
+
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return c.dynamic.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+	}
+	return c.dynamic.Resource(mapping.Resource), nil
+}
+
+func (c *ClientGo) objects(manifest []byte) ([]*unstructured.Unstructured, []ObjectRef, error) {
+	objects, err := prepareObjects(manifest, c.Namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decoded := make([]*unstructured.Unstructured, 0, len(objects))
+	refs := make([]ObjectRef, 0, len(objects))
+	for _, obj := range objects {
+		data, err := obj.JSON()
+		if err != nil {
+			return nil, nil, err
+		}
+		u := &unstructured.Unstructured{}
+		if err := u.UnmarshalJSON(data); err != nil {
+			return nil, nil, fmt.Errorf("%w object %s: %w", ErrInvalid, objectRef(obj), err)
+		}
+		decoded = append(decoded, u)
+		refs = append(refs, objectRef(obj))
+	}
+	return decoded, refs, nil
+}
+
+func (c *ClientGo) ApplyManifest(ctx context.Context, manifest []byte) ([]ObjectRef, error) {
+	objects, refs, err := c.objects(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	force := true
+	for i, obj := range objects {
+		resource, err := c.resource(obj)
+		if err != nil {
+			return nil, err
+		}
+		data, err := obj.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		_, err = resource.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: ManagedBy, Force: &force})
+		if err != nil {
+			return nil, apiError("apply", refs[i], err)
+		}
+	}
+	return refs, nil
+}
+
+func (c *ClientGo) ApplySecret(ctx context.Context, name string, data map[string][]byte) error {
+	s, err := json.Marshal(secret(name, c.Namespace, data))
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = c.clientset.CoreV1().Secrets(c.Namespace).Patch(ctx, name, types.ApplyPatchType, s, metav1.PatchOptions{FieldManager: ManagedBy, Force: &force})
+	if err != nil {
+		return apiError("apply", ObjectRef{Kind: "Secret", Namespace: c.Namespace, Name: name}, err)
+	}
+	return nil
+}
+
+func (c *ClientGo) GetPodStatus(ctx context.Context, name string) (*PodStatus, error) {
+	pod, err := c.clientset.CoreV1().Pods(c.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, apiError("get", ObjectRef{Kind: "Pod", Namespace: c.Namespace, Name: name}, err)
+	}
+	return podStatus(pod), nil
+}
+
+func (c *ClientGo) DeleteWorkload(ctx context.Context, manifest []byte) error {
+	objects, refs, err := c.objects(manifest)
+	if err != nil {
+		return err
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	for i, obj := range objects {
+		resource, err := c.resource(obj)
+		if err != nil {
+			return err
+		}
+		err = resource.Delete(ctx, obj.GetName(), metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return apiError("delete", refs[i], err)
+		}
+	}
+	return nil
+}
+
+func (c *ClientGo) ListWorkloads(ctx context.Context) ([]ObjectRef, error) {
+	refs := []ObjectRef{}
+	for _, gvr := range listedResources {
+		list, err := c.dynamic.Resource(gvr).List(ctx, metav1.ListOptions{LabelSelector: ManagedByLabel + "=" + ManagedBy})
+		if err != nil {
+			return nil, fmt.Errorf("could not list %s: %w", gvr.Resource, err)
+		}
+		for _, item := range list.Items {
+			refs = append(refs, ObjectRef{Kind: item.GetKind(), Namespace: item.GetNamespace(), Name: item.GetName()})
+		}
+	}
+	return refs, nil
+}
+
+func (c *ClientGo) RestartWorkload(ctx context.Context, manifest []byte) ([]ObjectRef, error) {
+	objects, refs, err := c.objects(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	restarted := []ObjectRef{}
+	restartedAt := time.Now().UTC().Format(time.RFC3339)
+	for i, obj := range objects {
+		if !isRestarted(obj.GetKind()) {
+			continue
+		}
+		resource, err := c.resource(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		if obj.GetKind() == "Pod" {
+			err = c.recreatePod(ctx, resource, obj)
+		} else {
+			patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{%q:%q}}}}}`, RestartedAtAnnotation, restartedAt)
+			_, err = resource.Patch(ctx, obj.GetName(), types.MergePatchType, []byte(patch), metav1.PatchOptions{FieldManager: ManagedBy})
+		}
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, apiError("restart", refs[i], err)
+		}
+		restarted = append(restarted, refs[i])
+	}
+	return restarted, nil
+}
+
+// recreatePod deletes the pod, waits for it to be gone and applies it again
+func (c *ClientGo) recreatePod(ctx context.Context, resource dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	if err := resource.Delete(ctx, obj.GetName(), metav1.DeleteOptions{}); err != nil {
+		return err
+	}
+	err := wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+		_, err := resource.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = resource.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: ManagedBy, Force: &force})
+	return err
+}
@@ -0,0 +1,2 @@
+// Package kube is how the orchestrator talks to the cluster it runs workloads on.
+package kube
@@ -0,0 +1,152 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Fake keeps the cluster in memory, for tests and running without a cluster.
+// Pods it applies are reported running unless their status is set.
+type Fake struct {
+	Namespace string
+
+	mu       sync.Mutex
+	objects  map[ObjectRef][]byte
+	secrets  map[string]map[string][]byte
+	statuses map[string]*PodStatus
+	restarts map[ObjectRef]int
+}
+
+func NewFake() *Fake {
+	return &Fake{
+		Namespace: DefaultNamespace,
+		objects:   make(map[ObjectRef][]byte),
+		secrets:   make(map[string]map[string][]byte),
+		statuses:  make(map[string]*PodStatus),
+		restarts:  make(map[ObjectRef]int),
+	}
+}
+
+func (f *Fake) ApplyManifest(ctx context.Context, manifest []byte) ([]ObjectRef, error) {
+	objects, err := prepareObjects(manifest, f.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	refs := make([]ObjectRef, 0, len(objects))
+	for _, obj := range objects {
+		data, err := obj.JSON()
+		if err != nil {
+			return nil, err
+		}
+		f.objects[objectRef(obj)] = data
+		refs = append(refs, objectRef(obj))
+	}
+	return refs, nil
+}
+
+func (f *Fake) ApplySecret(ctx context.Context, name string, data map[string][]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[name] = data
+	return nil
+}
+
+func (f *Fake) GetPodStatus(ctx context.Context, name string) (*PodStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if status, ok := f.statuses[name]; ok {
+		return status, nil
+	}
+	if _, ok := f.objects[ObjectRef{Kind: "Pod", Namespace: f.Namespace, Name: name}]; ok {
+		return &PodStatus{Name: name, Namespace: f.Namespace, Phase: "Running", Ready: true, Containers: []ContainerStatus{}}, nil
+	}
+	return nil, fmt.Errorf("pod %s: %w", name, ErrNotFound)
+}
+
+func (f *Fake) DeleteWorkload(ctx context.Context, manifest []byte) error {
+	objects, err := prepareObjects(manifest, f.Namespace)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, obj := range objects {
+		delete(f.objects, objectRef(obj))
+	}
+	return nil
+}
+
+func (f *Fake) ListWorkloads(ctx context.Context) ([]ObjectRef, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	refs := make([]ObjectRef, 0, len(f.objects))
+	for ref := range f.objects {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs, nil
+}
+
+func (f *Fake) RestartWorkload(ctx context.Context, manifest []byte) ([]ObjectRef, error) {
+	objects, err := prepareObjects(manifest, f.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	restarted := []ObjectRef{}
+	for _, obj := range objects {
+		ref := objectRef(obj)
+		if _, ok := f.objects[ref]; !ok || !isRestarted(obj.Kind) {
+			continue
+		}
+		// Bare pods are new pods, with the status of a new pod
+		if obj.Kind == "Pod" {
+			delete(f.statuses, obj.Name)
+		}
+		f.restarts[ref]++
+		restarted = append(restarted, ref)
+	}
+	return restarted, nil
+}
+
+// Restarts returns how many times an object was restarted
+func (f *Fake) Restarts(ref ObjectRef) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.restarts[ref]
+}
+
+// Object returns the JSON of an applied object
+func (f *Fake) Object(ref ObjectRef) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[ref]
+	return data, ok
+}
+
+// Secret returns the data of a secret
+func (f *Fake) Secret(name string) (map[string][]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.secrets[name]
+	return data, ok
+}
+
+// SetPodStatus sets the status reported for a pod
+func (f *Fake) SetPodStatus(status *PodStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[status.Name] = status
+}
@@ -0,0 +1,303 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	"kutee/manifest"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrInvalid is returned when the cluster rejects an object as invalid
+	ErrInvalid = errors.New("invalid")
+)
+
+const (
+	DefaultNamespace = "default"
+
+	// ManagedByLabel marks the objects applied by the orchestrator, to list them
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedBy      = "kutee-orchestrator"
+)
+
+// ObjectRef names an object of the cluster
+type ObjectRef struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (r ObjectRef) String() string {
+	return r.Kind + " " + r.Namespace + "/" + r.Name
+}
+
+type ContainerStatus struct {
+	Name string `json:"name"`
+	// State is waiting, running or terminated
+	State        string `json:"state"`
+	Reason       string `json:"reason,omitempty"`
+	Message      string `json:"message,omitempty"`
+	Ready        bool   `json:"ready"`
+	RestartCount int32  `json:"restart_count"`
+}
+
+type PodStatus struct {
+	Name       string            `json:"name"`
+	Namespace  string            `json:"namespace"`
+	Phase      string            `json:"phase"`
+	Reason     string            `json:"reason,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Ready      bool              `json:"ready"`
+	Containers []ContainerStatus `json:"containers"`
+}
+
+// ClusterClient runs workloads on the cluster
+type ClusterClient interface {
+	// ApplyManifest creates or updates every object of the manifest, and returns them.
+	// Objects without a namespace are put in the client's namespace.
+	ApplyManifest(ctx context.Context, manifest []byte) ([]ObjectRef, error)
+	// ApplySecret creates an opaque secret in the client's namespace, or replaces its data
+	ApplySecret(ctx context.Context, name string, data map[string][]byte) error
+	// GetPodStatus returns the status of a pod in the client's namespace
+	GetPodStatus(ctx context.Context, name string) (*PodStatus, error)
+	// DeleteWorkload deletes the objects of the manifest, those already gone are skipped
+	DeleteWorkload(ctx context.Context, manifest []byte) error
+	// ListWorkloads lists the objects applied by the orchestrator
+	ListWorkloads(ctx context.Context) ([]ObjectRef, error)
+	// RestartWorkload restarts the pods of the manifest's objects, and returns the objects restarted.
+	// Controllers roll their pods out again, bare pods are deleted and applied again.
+	// Kinds in restartedKinds are the only ones restarted, objects not in the cluster are skipped.
+	RestartWorkload(ctx context.Context, manifest []byte) ([]ObjectRef, error)
+}
+
+// restartedKinds are the kinds RestartWorkload restarts, jobs pick up changes on their next run
+var restartedKinds = []string{"Pod", "Deployment", "StatefulSet", "DaemonSet"}
+
+// RestartedAtAnnotation is set on the pod template of controllers to roll out their pods,
+// as kubectl rollout restart does
+const RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// listedKinds are the kinds ListWorkloads looks for
+var listedKinds = []string{"Pod", "Deployment", "StatefulSet", "DaemonSet", "Job", "CronJob", "Service", "ConfigMap"}
+
+// prepareObjects parses the manifest and labels its objects as managed by the orchestrator,
+// in namespace unless they have their own or it's empty
+func prepareObjects(data []byte, namespace string) ([]*manifest.Object, error) {
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w manifest: %w", ErrInvalid, err)
+	}
+
+	objects := m.Objects()
+	for _, obj := range objects {
+		if obj.Kind == "" || obj.Name == "" {
+			return nil, fmt.Errorf("%w manifest: objects need a kind and a name", ErrInvalid)
+		}
+		if obj.Namespace == "" && namespace != "" {
+			obj.SetNamespace(namespace)
+		}
+		obj.SetLabel(ManagedByLabel, ManagedBy)
+	}
+	return objects, nil
+}
+
+// isRestarted reports whether RestartWorkload restarts objects of the kind
+func isRestarted(kind string) bool {
+	return slices.Contains(restartedKinds, kind)
+}
+
+func objectRef(obj *manifest.Object) ObjectRef {
+	return ObjectRef{Kind: obj.Kind, Namespace: obj.Namespace, Name: obj.Name}
+}
+
+func secret(name string, namespace string, data map[string][]byte) *corev1.Secret {
+	s := &corev1.Secret{
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+	s.APIVersion, s.Kind = "v1", "Secret"
+	s.Name, s.Namespace = name, namespace
+	s.Labels = map[string]string{ManagedByLabel: ManagedBy}
+	return s
+}
+
+func podStatus(pod *corev1.Pod) *PodStatus {
+	status := &PodStatus{
+		Name:       pod.Name,
+		Namespace:  pod.Namespace,
+		Phase:      string(pod.Status.Phase),
+		Reason:     pod.Status.Reason,
+		Message:    pod.Status.Message,
+		Containers: []ContainerStatus{},
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			status.Ready = condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	for _, c := range pod.Status.ContainerStatuses {
+		container := ContainerStatus{Name: c.Name, Ready: c.Ready, RestartCount: c.RestartCount}
+		switch {
+		case c.State.Running != nil:
+			container.State = "running"
+		case c.State.Terminated != nil:
+			container.State = "terminated"
+			container.Reason, container.Message = c.State.Terminated.Reason, c.State.Terminated.Message
+		case c.State.Waiting != nil:
+			container.State = "waiting"
+			container.Reason, container.Message = c.State.Waiting.Reason, c.State.Waiting.Message
+		}
+		status.Containers = append(status.Containers, container)
+	}
+	return status
+}
+
+// ManifestObjects validates the manifest the way the clients do, and returns its objects.
+// Objects without a namespace are in namespace, the client's, as they are applied.
+func ManifestObjects(manifest []byte, namespace string) ([]ObjectRef, error) {
+	objects, err := prepareObjects(manifest, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]ObjectRef, 0, len(objects))
+	for _, obj := range objects {
+		refs = append(refs, objectRef(obj))
+	}
+	return refs, nil
+}
+
+// RemovedObjects returns a manifest of the objects of previous that current no longer has,
+// nil if there are none. Objects without a namespace are in namespace, the client's.
+func RemovedObjects(previous []byte, current []byte, namespace string) ([]byte, error) {
+	kept, err := ManifestObjects(current, namespace)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := prepareObjects(previous, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return selectObjects(objects, func(obj *manifest.Object) bool { return !slices.Contains(kept, objectRef(obj)) })
+}
+
+// selectObjects returns a manifest of the objects selected, nil if there are none
+func selectObjects(objects []*manifest.Object, selected func(obj *manifest.Object) bool) ([]byte, error) {
+	var data []byte
+	for _, obj := range objects {
+		if !selected(obj) {
+			continue
+		}
+		objJSON, err := obj.JSON()
+		if err != nil {
+			return nil, err
+		}
+		// JSON documents are YAML documents
+		data = append(append(data, "---\n"...), objJSON...)
+		data = append(data, '\n')
+	}
+	return data, nil
+}
+
+// SecretRefs maps the names of the secrets the pods of the manifest's objects refer to,
+// to the objects referring to each. Environment variables, envFrom, and secret and projected
+// volumes are looked at.
+func SecretRefs(manifest []byte) (map[string][]ObjectRef, error) {
+	objects, err := prepareObjects(manifest, "")
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string][]ObjectRef)
+	for _, obj := range objects {
+		names, err := podSecretNames(obj)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			refs[name] = append(refs[name], objectRef(obj))
+		}
+	}
+	return refs, nil
+}
+
+// DependentObjects returns a manifest of the objects whose pods refer to the secret,
+// nil if there are none
+func DependentObjects(data []byte, secret string) ([]byte, error) {
+	objects, err := prepareObjects(data, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var podErr error
+	dependent, err := selectObjects(objects, func(obj *manifest.Object) bool {
+		names, err := podSecretNames(obj)
+		podErr = errors.Join(podErr, err)
+		return slices.Contains(names, secret)
+	})
+	if err := errors.Join(podErr, err); err != nil {
+		return nil, err
+	}
+	return dependent, nil
+}
+
+// podSecretNames returns the sorted names of the secrets the object's pod spec refers to,
+// none for kinds that do not run pods
+func podSecretNames(obj *manifest.Object) ([]string, error) {
+	specJSON, _, err := obj.PodSpec()
+	if err != nil || specJSON == nil {
+		return nil, err
+	}
+	var spec corev1.PodSpec
+	if err := json.Unmarshal(specJSON, &spec); err != nil {
+		return nil, fmt.Errorf("%w pod spec of %s: %w", ErrInvalid, objectRef(obj), err)
+	}
+
+	names := make(map[string]bool)
+	for _, volume := range spec.Volumes {
+		if volume.Secret != nil {
+			names[volume.Secret.SecretName] = true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					names[source.Secret.Name] = true
+				}
+			}
+		}
+	}
+
+	containers := append(slices.Clone(spec.InitContainers), spec.Containers...)
+	for _, ephemeral := range spec.EphemeralContainers {
+		containers = append(containers, corev1.Container(ephemeral.EphemeralContainerCommon))
+	}
+	for _, container := range containers {
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				names[env.ValueFrom.SecretKeyRef.Name] = true
+			}
+		}
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil {
+				names[envFrom.SecretRef.Name] = true
+			}
+		}
+	}
+
+	delete(names, "")
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
@@ -0,0 +1,261 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testWorkload = `apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  containers:
+  - name: app
+    image: app:latest
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+  namespace: other
+  labels:
+    tier: web
+`
+
+// fakeKubectl is a kubectl that records its arguments and stdin, and fails with stderr if it's given
+func fakeKubectl(t *testing.T, stdout string, stderr string) (*Kubectl, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"stdout": stdout, "stderr": stderr} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+
+	script := `#!/bin/sh
+echo "$@" > "` + dir + `/args"
+cat > "` + dir + `/stdin"
+cat "` + dir + `/stdout"
+if [ -s "` + dir + `/stderr" ]; then cat "` + dir + `/stderr" >&2; exit 1; fi
+`
+	path := filepath.Join(dir, "kubectl")
+	require.NoError(t, os.WriteFile(path, []byte(script), 0o700))
+	return &Kubectl{Command: []string{path}, Namespace: "kutee"}, dir
+}
+
+func Test_Kubectl_ApplyManifest(t *testing.T) {
+	k, dir := fakeKubectl(t, "", "")
+
+	refs, err := k.ApplyManifest(context.Background(), []byte(testWorkload))
+	require.NoError(t, err)
+	require.Equal(t, []ObjectRef{{"Pod", "kutee", "app"}, {"Service", "other", "app"}}, refs)
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Equal(t, "apply -f -\n", string(args))
+
+	// Objects are applied labeled, in the client's namespace unless they have one
+	stdin, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	require.NoError(t, err)
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Namespace string            `json:"namespace"`
+				Labels    map[string]string `json:"labels"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(stdin, &list))
+	require.Len(t, list.Items, 2)
+	require.Equal(t, "kutee", list.Items[0].Metadata.Namespace)
+	require.Equal(t, map[string]string{ManagedByLabel: ManagedBy}, list.Items[0].Metadata.Labels)
+	require.Equal(t, "other", list.Items[1].Metadata.Namespace)
+	require.Equal(t, map[string]string{"tier": "web", ManagedByLabel: ManagedBy}, list.Items[1].Metadata.Labels)
+}
+
+func Test_Kubectl_Errors(t *testing.T) {
+	k, _ := fakeKubectl(t, "", `Error from server (NotFound): pods "app" not found`)
+	_, err := k.GetPodStatus(context.Background(), "app")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorContains(t, err, `pods "app" not found`)
+
+	k, _ = fakeKubectl(t, "", `Error from server (AlreadyExists): secrets "token" already exists`)
+	_, err = k.ApplyManifest(context.Background(), []byte(testWorkload))
+	require.ErrorIs(t, err, ErrAlreadyExists)
+
+	// Whatever kubectl says is kept, rather than its exit status alone
+	k, _ = fakeKubectl(t, "", "The connection to the server localhost:8080 was refused")
+	_, err = k.ListWorkloads(context.Background())
+	require.ErrorContains(t, err, "connection to the server localhost:8080 was refused")
+	require.False(t, errors.Is(err, ErrNotFound))
+}
+
+func Test_Kubectl_GetPodStatus(t *testing.T) {
+	pod := `{"metadata":{"name":"app","namespace":"kutee"},"status":{"phase":"Pending",
+		"conditions":[{"type":"Ready","status":"False"}],
+		"containerStatuses":[{"name":"app","ready":false,"restartCount":2,"state":{"waiting":{"reason":"ImagePullBackOff","message":"no such image"}}}]}}`
+	k, _ := fakeKubectl(t, pod, "")
+
+	status, err := k.GetPodStatus(context.Background(), "app")
+	require.NoError(t, err)
+	require.Equal(t, &PodStatus{
+		Name:      "app",
+		Namespace: "kutee",
+		Phase:     "Pending",
+		Containers: []ContainerStatus{
+			{Name: "app", State: "waiting", Reason: "ImagePullBackOff", Message: "no such image", RestartCount: 2},
+		},
+	}, status)
+}
+
+func Test_Fake(t *testing.T) {
+	f := NewFake()
+	ctx := context.Background()
+
+	refs, err := f.ApplyManifest(ctx, []byte(testWorkload))
+	require.NoError(t, err)
+
+	listed, err := f.ListWorkloads(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, refs, listed)
+
+	status, err := f.GetPodStatus(ctx, "app")
+	require.NoError(t, err)
+	require.Equal(t, "Running", status.Phase)
+
+	require.NoError(t, f.ApplySecret(ctx, "token", map[string][]byte{"TOKEN": []byte("secret")}))
+	require.NoError(t, f.ApplySecret(ctx, "token", map[string][]byte{"TOKEN": []byte("rotated")}))
+	secret, ok := f.Secret("token")
+	require.True(t, ok)
+	require.Equal(t, "rotated", string(secret["TOKEN"]))
+
+	restarted, err := f.RestartWorkload(ctx, []byte(testWorkload))
+	require.NoError(t, err)
+	require.Equal(t, []ObjectRef{{"Pod", DefaultNamespace, "app"}}, restarted)
+	require.Equal(t, 1, f.Restarts(restarted[0]))
+
+	require.NoError(t, f.DeleteWorkload(ctx, []byte(testWorkload)))
+	listed, err = f.ListWorkloads(ctx)
+	require.NoError(t, err)
+	require.Empty(t, listed)
+
+	_, err = f.GetPodStatus(ctx, "app")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = f.ApplyManifest(ctx, []byte("kind: Pod\n"))
+	require.ErrorIs(t, err, ErrInvalid)
+}
+
+func Test_RemovedObjects(t *testing.T) {
+	refs, err := ManifestObjects([]byte(testWorkload), DefaultNamespace)
+	require.NoError(t, err)
+	require.Equal(t, []ObjectRef{{"Pod", "default", "app"}, {"Service", "other", "app"}}, refs)
+
+	podOnly := "apiVersion: v1\nkind: Pod\nmetadata:\n  name: app\nspec:\n  containers:\n  - name: app\n    image: app:v2\n"
+	removed, err := RemovedObjects([]byte(testWorkload), []byte(podOnly), DefaultNamespace)
+	require.NoError(t, err)
+	refs, err = ManifestObjects(removed, DefaultNamespace)
+	require.NoError(t, err)
+	require.Equal(t, []ObjectRef{{"Service", "other", "app"}}, refs)
+
+	removed, err = RemovedObjects([]byte(testWorkload), []byte(testWorkload), DefaultNamespace)
+	require.NoError(t, err)
+	require.Nil(t, removed)
+
+	// Objects in the client's namespace are the same whether or not it's written
+	explicit := strings.Replace(podOnly, "  name: app\n", "  name: app\n  namespace: default\n", 1)
+	removed, err = RemovedObjects([]byte(podOnly), []byte(explicit), DefaultNamespace)
+	require.NoError(t, err)
+	require.Nil(t, removed)
+}
+
+const testSecretWorkload = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: init:latest
+        env:
+        - name: TOKEN
+          valueFrom:
+            secretKeyRef:
+              name: km-autosecret-token
+              key: KM_AUTOSECRET_TOKEN
+      containers:
+      - name: web
+        image: web:latest
+        envFrom:
+        - secretRef:
+            name: km-autosecret-db
+      volumes:
+      - name: tls
+        secret:
+          secretName: tls
+      - name: projected
+        projected:
+          sources:
+          - secret:
+              name: km-autosecret-token
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: km-autosecret-lookalike
+spec:
+  containers:
+  - name: app
+    image: app:latest
+    envFrom:
+    - secretRef:
+        name: km-autosecret-db
+`
+
+func Test_SecretRefs(t *testing.T) {
+	refs, err := SecretRefs([]byte(testSecretWorkload))
+	require.NoError(t, err)
+
+	web := ObjectRef{"Deployment", "", "web"}
+	pod := ObjectRef{"Pod", "", "km-autosecret-lookalike"}
+	// Only secret references count, not the names of other objects
+	require.Equal(t, map[string][]ObjectRef{
+		"km-autosecret-token": {web},
+		"km-autosecret-db":    {web, pod},
+		"tls":                 {web},
+	}, refs)
+
+	dependent, err := DependentObjects([]byte(testSecretWorkload), "km-autosecret-token")
+	require.NoError(t, err)
+	objects, err := ManifestObjects(dependent, "")
+	require.NoError(t, err)
+	require.Equal(t, []ObjectRef{web}, objects)
+
+	dependent, err = DependentObjects([]byte(testSecretWorkload), "unused")
+	require.NoError(t, err)
+	require.Nil(t, dependent)
+}
+
+func Test_Kubectl_RestartWorkload(t *testing.T) {
+	// kubectl delete names the pods it deleted, those that were not running are not started
+	k, dir := fakeKubectl(t, "pod/app\n", "")
+
+	refs, err := k.RestartWorkload(context.Background(), []byte(testSecretWorkload+"---\n"+testWorkload))
+	require.NoError(t, err)
+	// Services have no pods to restart
+	require.Equal(t, []ObjectRef{{"Deployment", "kutee", "web"}, {"Pod", "kutee", "app"}}, refs)
+
+	// Controllers are rolled out after the bare pods are applied again
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	require.Equal(t, "rollout restart deployment/web --namespace kutee\n", string(args))
+}
@@ -0,0 +1,231 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"kutee/manifest"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultKubectl is the kubectl of minikube, which the TD runs
+var DefaultKubectl = []string{"minikube", "kubectl", "--"}
+
+// Kubectl runs kubectl, and returns its error output with its failures
+type Kubectl struct {
+	// Command runs kubectl, DefaultKubectl if empty
+	Command   []string
+	Namespace string
+}
+
+func (k *Kubectl) namespace() string {
+	if k.Namespace == "" {
+		return DefaultNamespace
+	}
+	return k.Namespace
+}
+
+func (k *Kubectl) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	command := k.Command
+	if len(command) == 0 {
+		command = DefaultKubectl
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:], args...)...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, kubectlError(args[0], stderr.String(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// kubectlError tells apart the failures callers handle from kubectl's output, which is all it has
+func kubectlError(verb string, stderr string, err error) error {
+	stderr = strings.TrimSpace(stderr)
+	if stderr == "" {
+		return fmt.Errorf("kubectl %s: %w", verb, err)
+	}
+
+	switch {
+	case strings.Contains(stderr, "(NotFound)"):
+		return fmt.Errorf("kubectl %s: %w: %s", verb, ErrNotFound, stderr)
+	case strings.Contains(stderr, "(AlreadyExists)"):
+		return fmt.Errorf("kubectl %s: %w: %s", verb, ErrAlreadyExists, stderr)
+	case strings.Contains(stderr, "(Invalid)"), strings.Contains(stderr, "(BadRequest)"), strings.Contains(stderr, "error validating"):
+		return fmt.Errorf("kubectl %s: %w: %s", verb, ErrInvalid, stderr)
+	default:
+		return fmt.Errorf("kubectl %s: %s: %w", verb, stderr, err)
+	}
+}
+
+// objectsJSON encodes the objects as a List, which kubectl reads from stdin
+func objectsJSON(data []byte, namespace string) ([]byte, []ObjectRef, error) {
+	objects, err := prepareObjects(data, namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items := make([]json.RawMessage, 0, len(objects))
+	refs := make([]ObjectRef, 0, len(objects))
+	for _, obj := range objects {
+		item, err := obj.JSON()
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, item)
+		refs = append(refs, objectRef(obj))
+	}
+
+	list, err := json.Marshal(map[string]any{"apiVersion": "v1", "kind": "List", "items": items})
+	return list, refs, err
+}
+
+func (k *Kubectl) ApplyManifest(ctx context.Context, manifest []byte) ([]ObjectRef, error) {
+	list, refs, err := objectsJSON(manifest, k.namespace())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := k.run(ctx, list, "apply", "-f", "-"); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (k *Kubectl) ApplySecret(ctx context.Context, name string, data map[string][]byte) error {
+	s, err := json.Marshal(secret(name, k.namespace(), data))
+	if err != nil {
+		return err
+	}
+
+	_, err = k.run(ctx, s, "apply", "-f", "-")
+	return err
+}
+
+func (k *Kubectl) GetPodStatus(ctx context.Context, name string) (*PodStatus, error) {
+	out, err := k.run(ctx, nil, "get", "pod", name, "--namespace", k.namespace(), "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(out, &pod); err != nil {
+		return nil, fmt.Errorf("could not parse pod %s: %w", name, err)
+	}
+	return podStatus(&pod), nil
+}
+
+func (k *Kubectl) DeleteWorkload(ctx context.Context, manifest []byte) error {
+	list, _, err := objectsJSON(manifest, k.namespace())
+	if err != nil {
+		return err
+	}
+
+	_, err = k.run(ctx, list, "delete", "--ignore-not-found", "-f", "-")
+	return err
+}
+
+func (k *Kubectl) ListWorkloads(ctx context.Context) ([]ObjectRef, error) {
+	kinds := make([]string, 0, len(listedKinds))
+	for _, kind := range listedKinds {
+		kinds = append(kinds, strings.ToLower(kind))
+	}
+
+	out, err := k.run(ctx, nil, "get", strings.Join(kinds, ","), "--all-namespaces", "--selector", ManagedByLabel+"="+ManagedBy, "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Items []struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("could not parse the workloads: %w", err)
+	}
+
+	refs := make([]ObjectRef, 0, len(list.Items))
+	for _, item := range list.Items {
+		refs = append(refs, ObjectRef{Kind: item.Kind, Namespace: item.Metadata.Namespace, Name: item.Metadata.Name})
+	}
+	return refs, nil
+}
+
+func (k *Kubectl) RestartWorkload(ctx context.Context, data []byte) ([]ObjectRef, error) {
+	objects, err := prepareObjects(data, k.namespace())
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := selectObjects(objects, func(obj *manifest.Object) bool { return obj.Kind == "Pod" })
+	if err != nil {
+		return nil, err
+	}
+	deleted := map[string]bool{}
+	if pods != nil {
+		list, _, err := objectsJSON(pods, k.namespace())
+		if err != nil {
+			return nil, err
+		}
+		// Pods are gone once delete returns, their names can be used again
+		out, err := k.run(ctx, list, "delete", "--ignore-not-found", "--wait", "--output", "name", "-f", "-")
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range strings.Fields(string(out)) {
+			deleted[strings.TrimPrefix(name, "pod/")] = true
+		}
+	}
+
+	// Only the pods that were running are applied again
+	deletedPods, err := selectObjects(objects, func(obj *manifest.Object) bool { return obj.Kind == "Pod" && deleted[obj.Name] })
+	if err != nil {
+		return nil, err
+	}
+	if deletedPods != nil {
+		list, _, err := objectsJSON(deletedPods, k.namespace())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := k.run(ctx, list, "apply", "-f", "-"); err != nil {
+			return nil, err
+		}
+	}
+
+	restarted := []ObjectRef{}
+	for _, obj := range objects {
+		switch {
+		case !isRestarted(obj.Kind):
+			continue
+		case obj.Kind == "Pod":
+			if !deleted[obj.Name] {
+				continue
+			}
+		default:
+			_, err := k.run(ctx, nil, "rollout", "restart", strings.ToLower(obj.Kind)+"/"+obj.Name, "--namespace", obj.Namespace)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		restarted = append(restarted, objectRef(obj))
+	}
+	return restarted, nil
+}
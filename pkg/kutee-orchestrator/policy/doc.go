@@ -0,0 +1,2 @@
+// Package policy checks that workload manifests keep the isolation the orchestrator relies on.
+package policy
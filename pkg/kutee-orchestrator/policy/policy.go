@@ -0,0 +1,258 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"kutee/manifest"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Policy is the rule set workloads must follow. The zero Policy allows everything.
+type Policy struct {
+	// AllowedKinds, if not nil, are the only kinds of objects workloads may have. Kinds that act on
+	// the cluster or the node, as in PersistentVolume, RuntimeClass or ClusterRole, must not be listed.
+	AllowedKinds []string `json:"allowed_kinds,omitempty"`
+	// RuntimeClassName, if not empty, is the runtime class every pod must run with
+	RuntimeClassName string `json:"runtime_class_name,omitempty"`
+	// ForbidHostNamespaces forbids hostNetwork, hostPID and hostIPC
+	ForbidHostNamespaces bool `json:"forbid_host_namespaces,omitempty"`
+	// ForbidPrivileged forbids privileged containers, privilege escalation, and the pod and container
+	// security settings that weaken the sandbox: sysctls, SELinux options, unconfined seccomp profiles,
+	// unmasked /proc mounts and Windows host processes
+	ForbidPrivileged bool `json:"forbid_privileged,omitempty"`
+	// ForbidAddedCapabilities forbids adding capabilities to containers
+	ForbidAddedCapabilities bool `json:"forbid_added_capabilities,omitempty"`
+	// AllowedVolumeTypes, if not nil, are the only volume types pods may use, as in emptyDir
+	AllowedVolumeTypes []string `json:"allowed_volume_types,omitempty"`
+	// RequiredLimits are the resources every container must have a limit for, as in memory
+	RequiredLimits []string `json:"required_limits,omitempty"`
+}
+
+// Default keeps workloads in gVisor, away from the host, and within limits
+func Default() *Policy {
+	return &Policy{
+		AllowedKinds:            []string{"Pod", "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job", "CronJob", "Service", "ConfigMap", "Secret", "PersistentVolumeClaim", "NetworkPolicy"},
+		RuntimeClassName:        "gvisor",
+		ForbidHostNamespaces:    true,
+		ForbidPrivileged:        true,
+		ForbidAddedCapabilities: true,
+		AllowedVolumeTypes:      []string{"configMap", "secret", "emptyDir", "projected", "downwardAPI", "persistentVolumeClaim"},
+		RequiredLimits:          []string{"cpu", "memory"},
+	}
+}
+
+// Load reads a JSON policy, fields it does not set are not enforced.
+// Unknown fields are refused, a misspelled rule would not be enforced either.
+func Load(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Policy{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(p); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Violation is a field of an object of the manifest that breaks the policy
+type Violation struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Container string `json:"container,omitempty"`
+	// Field is the path of the field in the object, as in spec.template.spec.hostNetwork
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s %s: %s: %s", v.Kind, v.Name, v.Field, v.Message)
+}
+
+// Error is returned for manifests that break the policy, with all of their violations
+type Error struct {
+	Reason     string      `json:"error"`
+	Violations []Violation `json:"violations"`
+}
+
+func (e *Error) Error() string {
+	violations := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		violations = append(violations, v.String())
+	}
+	return e.Reason + ": " + strings.Join(violations, "; ")
+}
+
+// Check returns an *Error listing the violations of the manifest, if it has any
+func (p *Policy) Check(data []byte) error {
+	m, err := manifest.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	violations := []Violation{}
+	for _, obj := range m.Objects() {
+		if p.AllowedKinds != nil && !slices.Contains(p.AllowedKinds, obj.Kind) {
+			violations = append(violations, Violation{Kind: obj.Kind, Name: obj.Name, Field: "kind", Message: fmt.Sprintf("kind %s is not allowed", obj.Kind)})
+			continue
+		}
+
+		specJSON, path, err := obj.PodSpec()
+		if err != nil {
+			return err
+		}
+		if specJSON == nil {
+			continue
+		}
+
+		var spec corev1.PodSpec
+		if err := json.Unmarshal(specJSON, &spec); err != nil {
+			return fmt.Errorf("%s %s has an invalid pod spec: %w", obj.Kind, obj.Name, err)
+		}
+		// The typed spec drops the fields of volume types it does not know, they must be checked too
+		var volumes struct {
+			Volumes []map[string]json.RawMessage `json:"volumes"`
+		}
+		if err := json.Unmarshal(specJSON, &volumes); err != nil {
+			return fmt.Errorf("%s %s has invalid volumes: %w", obj.Kind, obj.Name, err)
+		}
+
+		c := &checker{policy: p, kind: obj.Kind, name: obj.Name, path: path}
+		c.checkPod(&spec, volumes.Volumes)
+		violations = append(violations, c.violations...)
+	}
+
+	if len(violations) > 0 {
+		return &Error{Reason: "the manifest breaks the workload policy", Violations: violations}
+	}
+	return nil
+}
+
+// checker collects the violations of a pod spec, at path in the object kind/name
+type checker struct {
+	policy *Policy
+	kind   string
+	name   string
+	path   string
+
+	violations []Violation
+}
+
+func (c *checker) violation(container string, field string, format string, args ...any) {
+	c.violations = append(c.violations, Violation{
+		Kind:      c.kind,
+		Name:      c.name,
+		Container: container,
+		Field:     c.path + "." + field,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *checker) checkPod(spec *corev1.PodSpec, volumes []map[string]json.RawMessage) {
+	p := c.policy
+
+	if p.RuntimeClassName != "" && (spec.RuntimeClassName == nil || *spec.RuntimeClassName != p.RuntimeClassName) {
+		c.violation("", "runtimeClassName", "must be %s", p.RuntimeClassName)
+	}
+
+	if p.ForbidHostNamespaces {
+		if spec.HostNetwork {
+			c.violation("", "hostNetwork", "host namespaces are forbidden")
+		}
+		if spec.HostPID {
+			c.violation("", "hostPID", "host namespaces are forbidden")
+		}
+		if spec.HostIPC {
+			c.violation("", "hostIPC", "host namespaces are forbidden")
+		}
+	}
+
+	if sc := spec.SecurityContext; sc != nil && p.ForbidPrivileged {
+		if len(sc.Sysctls) > 0 {
+			c.violation("", "securityContext.sysctls", "sysctls are forbidden")
+		}
+		c.checkSandbox("", "securityContext", sc.SELinuxOptions, sc.SeccompProfile, sc.WindowsOptions)
+	}
+
+	if p.AllowedVolumeTypes != nil {
+		for i, volume := range volumes {
+			types := make([]string, 0, len(volume))
+			for field := range volume {
+				if field != "name" {
+					types = append(types, field)
+				}
+			}
+			sort.Strings(types)
+			for _, t := range types {
+				if !slices.Contains(p.AllowedVolumeTypes, t) {
+					c.violation("", fmt.Sprintf("volumes[%d].%s", i, t), "volume type %s is not allowed", t)
+				}
+			}
+		}
+	}
+
+	for i := range spec.InitContainers {
+		c.checkContainer(fmt.Sprintf("initContainers[%d]", i), &spec.InitContainers[i], true)
+	}
+	for i := range spec.Containers {
+		c.checkContainer(fmt.Sprintf("containers[%d]", i), &spec.Containers[i], true)
+	}
+	for i := range spec.EphemeralContainers {
+		// Ephemeral containers can't have resources
+		container := corev1.Container(spec.EphemeralContainers[i].EphemeralContainerCommon)
+		c.checkContainer(fmt.Sprintf("ephemeralContainers[%d]", i), &container, false)
+	}
+}
+
+func (c *checker) checkContainer(field string, container *corev1.Container, hasResources bool) {
+	p := c.policy
+
+	if sc := container.SecurityContext; sc != nil {
+		if p.ForbidPrivileged && sc.Privileged != nil && *sc.Privileged {
+			c.violation(container.Name, field+".securityContext.privileged", "privileged containers are forbidden")
+		}
+		if p.ForbidPrivileged && sc.AllowPrivilegeEscalation != nil && *sc.AllowPrivilegeEscalation {
+			c.violation(container.Name, field+".securityContext.allowPrivilegeEscalation", "privilege escalation is forbidden")
+		}
+		if p.ForbidAddedCapabilities && sc.Capabilities != nil && len(sc.Capabilities.Add) > 0 {
+			c.violation(container.Name, field+".securityContext.capabilities.add", "adding capabilities is forbidden")
+		}
+		if p.ForbidPrivileged {
+			if sc.ProcMount != nil && *sc.ProcMount == corev1.UnmaskedProcMount {
+				c.violation(container.Name, field+".securityContext.procMount", "unmasked /proc mounts are forbidden")
+			}
+			c.checkSandbox(container.Name, field+".securityContext", sc.SELinuxOptions, sc.SeccompProfile, sc.WindowsOptions)
+		}
+	}
+
+	if hasResources {
+		for _, resource := range p.RequiredLimits {
+			if _, ok := container.Resources.Limits[corev1.ResourceName(resource)]; !ok {
+				c.violation(container.Name, field+".resources.limits."+resource, "a %s limit is required", resource)
+			}
+		}
+	}
+}
+
+// checkSandbox checks the security settings pods and containers share, at field
+func (c *checker) checkSandbox(container string, field string, seLinux *corev1.SELinuxOptions, seccomp *corev1.SeccompProfile, windows *corev1.WindowsSecurityContextOptions) {
+	if seLinux != nil {
+		c.violation(container, field+".seLinuxOptions", "SELinux options are forbidden")
+	}
+	if seccomp != nil && seccomp.Type == corev1.SeccompProfileTypeUnconfined {
+		c.violation(container, field+".seccompProfile", "unconfined seccomp profiles are forbidden")
+	}
+	if windows != nil && windows.HostProcess != nil && *windows.HostProcess {
+		c.violation(container, field+".windowsOptions.hostProcess", "host processes are forbidden")
+	}
+}
@@ -0,0 +1,177 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const compliantPod = `apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  runtimeClassName: gvisor
+  containers:
+  - name: app
+    image: app:latest
+    resources:
+      limits:
+        cpu: "1"
+        memory: 256Mi
+  volumes:
+  - name: data
+    emptyDir: {}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`
+
+const breakingDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      hostNetwork: true
+      hostPID: true
+      containers:
+      - name: web
+        image: web:latest
+        securityContext:
+          privileged: true
+          capabilities:
+            add: [NET_ADMIN]
+        resources:
+          limits:
+            memory: 256Mi
+      volumes:
+      - name: root
+        hostPath:
+          path: /
+`
+
+func Test_Check_Default(t *testing.T) {
+	require.NoError(t, Default().Check([]byte(compliantPod)))
+
+	err := Default().Check([]byte(breakingDeployment))
+	var policyErr *Error
+	require.True(t, errors.As(err, &policyErr))
+
+	fields := []string{}
+	for _, v := range policyErr.Violations {
+		require.Equal(t, "Deployment", v.Kind)
+		require.Equal(t, "web", v.Name)
+		fields = append(fields, v.Field)
+	}
+	require.Equal(t, []string{
+		"spec.template.spec.runtimeClassName",
+		"spec.template.spec.hostNetwork",
+		"spec.template.spec.hostPID",
+		"spec.template.spec.volumes[0].hostPath",
+		"spec.template.spec.containers[0].securityContext.privileged",
+		"spec.template.spec.containers[0].securityContext.capabilities.add",
+		"spec.template.spec.containers[0].resources.limits.cpu",
+	}, fields)
+	require.Equal(t, "web", policyErr.Violations[4].Container)
+	require.Contains(t, err.Error(), "Deployment web: spec.template.spec.hostPID: host namespaces are forbidden")
+}
+
+const clusterObjects = `apiVersion: v1
+kind: PersistentVolume
+metadata:
+  name: host
+spec:
+  hostPath:
+    path: /
+---
+apiVersion: node.k8s.io/v1
+kind: RuntimeClass
+metadata:
+  name: gvisor
+handler: runc
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: admin
+`
+
+const weakenedPod = `apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  runtimeClassName: gvisor
+  securityContext:
+    sysctls:
+    - name: kernel.shm_rmid_forced
+      value: "1"
+    seccompProfile:
+      type: Unconfined
+  containers:
+  - name: app
+    image: app:latest
+    securityContext:
+      procMount: Unmasked
+      seLinuxOptions:
+        type: spc_t
+    resources:
+      limits:
+        cpu: "1"
+        memory: 256Mi
+`
+
+func Test_Check_Default_Sandbox(t *testing.T) {
+	// Objects acting on the cluster or the node are refused, whatever they hold
+	err := Default().Check([]byte(clusterObjects))
+	var policyErr *Error
+	require.True(t, errors.As(err, &policyErr))
+	kinds := []string{}
+	for _, v := range policyErr.Violations {
+		require.Equal(t, "kind", v.Field)
+		kinds = append(kinds, v.Kind)
+	}
+	require.Equal(t, []string{"PersistentVolume", "RuntimeClass", "ClusterRoleBinding"}, kinds)
+
+	err = Default().Check([]byte(weakenedPod))
+	require.True(t, errors.As(err, &policyErr))
+	fields := []string{}
+	for _, v := range policyErr.Violations {
+		fields = append(fields, v.Field)
+	}
+	require.Equal(t, []string{
+		"spec.securityContext.sysctls",
+		"spec.securityContext.seccompProfile",
+		"spec.containers[0].securityContext.procMount",
+		"spec.containers[0].securityContext.seLinuxOptions",
+	}, fields)
+}
+
+func Test_Check_Configured(t *testing.T) {
+	// Only the rules the policy sets are enforced
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"allowed_volume_types": ["hostPath"]}`), 0o600))
+	p, err := Load(path)
+	require.NoError(t, err)
+	require.NoError(t, p.Check([]byte(breakingDeployment)))
+
+	err = p.Check([]byte(compliantPod))
+	var policyErr *Error
+	require.True(t, errors.As(err, &policyErr))
+	require.Len(t, policyErr.Violations, 1)
+	require.Equal(t, "spec.volumes[0].emptyDir", policyErr.Violations[0].Field)
+
+	require.NoError(t, (&Policy{}).Check([]byte(breakingDeployment)))
+
+	// Misspelled rules are refused rather than not enforced
+	require.NoError(t, os.WriteFile(path, []byte(`{"forbid_privileges": true}`), 0o600))
+	_, err = Load(path)
+	require.ErrorContains(t, err, "forbid_privileges")
+}
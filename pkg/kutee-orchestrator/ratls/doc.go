@@ -0,0 +1,3 @@
+// Package ratls serves and verifies RA-TLS: TLS certificates generated in the TD, whose key is
+// bound to the TD by the attestation embedded in them as an extension.
+package ratls
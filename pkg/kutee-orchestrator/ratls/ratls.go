@@ -0,0 +1,170 @@
+package ratls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"kutee-orchestrator/attestation"
+)
+
+// OIDEvidence is the extension holding the attestation evidence, the OID of TDX quotes in Intel's RA-TLS
+var OIDEvidence = asn1.ObjectIdentifier{1, 2, 840, 113741, 1, 5, 5, 1, 6}
+
+// CertificateValidity is how long the certificates generated are valid for, they are generated
+// anew on every start
+const CertificateValidity = 365 * 24 * time.Hour
+
+var ErrNoEvidence = errors.New("the certificate has no attestation evidence")
+
+// reportData binds the attestation to the certificate's public key
+func reportData(cert *x509.Certificate) [attestation.ReportDataSize]byte {
+	return sha512.Sum512(cert.RawSubjectPublicKeyInfo)
+}
+
+// NewCertificate generates a key and a self-signed certificate for the hosts, with the evidence
+// the issuer produces for the key
+func NewCertificate(issuer attestation.Issuer, hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	evidence, err := issuer.Issue(sha512.Sum512(spki))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not attest the certificate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: "kutee orchestrator"},
+		NotBefore:       now.Add(-time.Minute),
+		NotAfter:        now.Add(CertificateValidity),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: []pkix.Extension{{Id: OIDEvidence, Value: evidence}},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Verify checks that the certificate is self-signed and valid, and that its evidence attests its
+// key, in a TD the policy allows
+func Verify(cert *x509.Certificate, verifier attestation.Verifier, policy *attestation.Policy) (*attestation.Measurement, error) {
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return nil, fmt.Errorf("the certificate is not self-signed: %w", err)
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("the certificate is expired or not yet valid")
+	}
+
+	var evidence []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(OIDEvidence) {
+			evidence = ext.Value
+		}
+	}
+	if evidence == nil {
+		return nil, ErrNoEvidence
+	}
+
+	measurement, err := verifier.Verify(evidence, reportData(cert))
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.Check(measurement); err != nil {
+		return nil, err
+	}
+	return measurement, nil
+}
+
+// ServerConfig serves the certificate. Client certificates signed by clientCAs are verified, and
+// required if requireClientCerts; they are not requested if clientCAs is nil.
+func ServerConfig(cert tls.Certificate, clientCAs *x509.CertPool, requireClientCerts bool) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.NoClientCert,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCerts {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config
+}
+
+// ClientConfig only connects to servers whose certificate Verify accepts, before anything is sent
+// to them. clientCerts are presented to the servers requesting them.
+func ClientConfig(verifier attestation.Verifier, policy *attestation.Policy, clientCerts ...tls.Certificate) *tls.Config {
+	return &tls.Config{
+		// The certificates are self-signed, VerifyConnection checks their attestation instead
+		InsecureSkipVerify: true, //nolint:gosec
+		MinVersion:         tls.VersionTLS12,
+		Certificates:       clientCerts,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("the server presented no certificate")
+			}
+			_, err := Verify(state.PeerCertificates[0], verifier, policy)
+			return err
+		},
+	}
+}
+
+// NewClient returns an HTTP client for the servers ClientConfig connects to, plain HTTP is unaffected
+func NewClient(verifier attestation.Verifier, policy *attestation.Policy, clientCerts ...tls.Certificate) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = ClientConfig(verifier, policy, clientCerts...)
+	return &http.Client{Transport: transport}
+}
+
+// LoadCertPool reads the PEM certificates of a file
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
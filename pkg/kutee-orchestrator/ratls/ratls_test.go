@@ -0,0 +1,114 @@
+package ratls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kutee-orchestrator/attestation"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testClientCert returns a CA, and a client certificate for name it signed
+func testClientCert(t *testing.T, name string) (*x509.CertPool, tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func Test_RATLS(t *testing.T) {
+	measurement := attestation.Measurement{MRTD: strings.Repeat("aa", 48)}
+	cert, err := NewCertificate(&attestation.MockIssuer{Measurement: measurement}, []string{"127.0.0.1", "localhost"})
+	require.NoError(t, err)
+
+	verified, err := Verify(cert.Leaf, attestation.MockVerifier{}, &attestation.Policy{Allowed: []attestation.Measurement{measurement}})
+	require.NoError(t, err)
+	require.Equal(t, measurement, *verified)
+
+	clientCAs, clientCert := testClientCert(t, "alice")
+	requests := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}))
+	srv.TLS = ServerConfig(cert, clientCAs, true)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	trusted := &attestation.Policy{Allowed: []attestation.Measurement{measurement}}
+	res, err := NewClient(attestation.MockVerifier{}, trusted, clientCert).Get(srv.URL)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, "alice", string(body))
+
+	// Servers in other TDs get nothing
+	other := &attestation.Policy{Allowed: []attestation.Measurement{{MRTD: strings.Repeat("bb", 48)}}}
+	_, err = NewClient(attestation.MockVerifier{}, other, clientCert).Get(srv.URL)
+	require.ErrorIs(t, err, attestation.ErrNotAllowed)
+
+	// Client certificates are required
+	_, err = NewClient(attestation.MockVerifier{}, trusted).Get(srv.URL)
+	require.Error(t, err)
+	require.Equal(t, 1, requests)
+}
+
+func Test_Verify_NoEvidence(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	_, err = Verify(cert, attestation.MockVerifier{}, &attestation.Policy{})
+	require.ErrorIs(t, err, ErrNoEvidence)
+}
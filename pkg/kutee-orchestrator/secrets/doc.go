@@ -0,0 +1,5 @@
+// Package secrets derives the autosecrets of workloads from a sealing root, so that they are
+// the same every time they are created. The root only protects the secrets while it stays in the
+// memory of TDs: it is generated there, or released by an attested peer, unless it's kept in a
+// plaintext file outside of a TD.
+package secrets
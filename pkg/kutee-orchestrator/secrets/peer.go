@@ -0,0 +1,232 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"kutee-orchestrator/attestation"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ReleasablePrefix is the prefix of the secrets peers can fetch, those of the workloads
+const ReleasablePrefix = AutosecretPrefix
+
+// PeerRequest asks a peer for secrets. Evidence attests PublicKey, an X25519 key the
+// requester holds, so that only the attested TD can open the secrets.
+type PeerRequest struct {
+	Names     []string `json:"names"`
+	PublicKey []byte   `json:"public_key"`
+	Evidence  []byte   `json:"evidence"`
+}
+
+// PeerResponse holds the secrets, sealed to the requester's key with the peer's one.
+// Evidence attests both keys, so that the requester knows which TD sent the secrets.
+type PeerResponse struct {
+	PublicKey []byte            `json:"public_key"`
+	Evidence  []byte            `json:"evidence"`
+	Secrets   map[string][]byte `json:"secrets"`
+}
+
+func requestReportData(requesterKey []byte) [attestation.ReportDataSize]byte {
+	return sha512.Sum512(append([]byte("kutee peer secrets request\x00"), requesterKey...))
+}
+
+func responseReportData(requesterKey []byte, peerKey []byte) [attestation.ReportDataSize]byte {
+	data := append([]byte("kutee peer secrets response\x00"), requesterKey...)
+	return sha512.Sum512(append(data, peerKey...))
+}
+
+// transportAEAD is the cipher both sides derive from their keys
+func transportAEAD(private *ecdh.PrivateKey, public *ecdh.PublicKey, requesterKey []byte, peerKey []byte) (cipher.AEAD, error) {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	info := append(append([]byte("kutee peer secrets\x00"), requesterKey...), peerKey...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// Peers releases secrets to, and fetches secrets from, the other instances the policy trusts
+type Peers struct {
+	Issuer   attestation.Issuer
+	Verifier attestation.Verifier
+	Policy   *attestation.Policy
+}
+
+// Release seals the requested secrets of the store to the requester, once its attestation
+// is verified against the policy. Only workload secrets and the sealing root, RootName, are released.
+func (p *Peers) Release(store *Store, req *PeerRequest) (*PeerResponse, error) {
+	for _, name := range req.Names {
+		if name != RootName && !strings.HasPrefix(name, ReleasablePrefix) {
+			return nil, fmt.Errorf("%w %q, only %s secrets are released", ErrInvalidName, name, ReleasablePrefix)
+		}
+	}
+
+	requesterKey, err := ecdh.X25519().NewPublicKey(req.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid public key: %w", attestation.ErrInvalidEvidence, err)
+	}
+	measurement, err := p.Verifier.Verify(req.Evidence, requestReportData(req.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Policy.Check(measurement); err != nil {
+		return nil, err
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	peerKey := private.PublicKey().Bytes()
+	aead, err := transportAEAD(private, requesterKey, req.PublicKey, peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &PeerResponse{PublicKey: peerKey, Secrets: make(map[string][]byte, len(req.Names))}
+	for _, name := range req.Names {
+		secret := store.root
+		if name != RootName {
+			if secret, err = store.Secret(name); err != nil {
+				return nil, err
+			}
+		}
+		if resp.Secrets[name], err = sealAEAD(aead, name, secret); err != nil {
+			return nil, err
+		}
+	}
+
+	resp.Evidence, err = p.Issuer.Issue(responseReportData(req.PublicKey, peerKey))
+	if err != nil {
+		return nil, fmt.Errorf("could not attest the response: %w", err)
+	}
+	return resp, nil
+}
+
+// Fetch requests the named secrets from the peer at url, the orchestrator's base URL.
+// The peer's attestation is verified against the policy before its secrets are used.
+func (p *Peers) Fetch(ctx context.Context, client *http.Client, url string, names []string) (map[string][]byte, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	requesterKey := private.PublicKey().Bytes()
+	evidence, err := p.Issuer.Issue(requestReportData(requesterKey))
+	if err != nil {
+		return nil, fmt.Errorf("could not attest the request: %w", err)
+	}
+
+	body, err := json.Marshal(PeerRequest{Names: names, PublicKey: requesterKey, Evidence: evidence})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/api/peer/secrets", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	rb, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the peer refused to release the secrets: %s: %s", res.Status, strings.TrimSpace(string(rb)))
+	}
+
+	var resp PeerResponse
+	if err := json.Unmarshal(rb, &resp); err != nil {
+		return nil, err
+	}
+
+	measurement, err := p.Verifier.Verify(resp.Evidence, responseReportData(requesterKey, resp.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("could not verify the peer: %w", err)
+	}
+	if err := p.Policy.Check(measurement); err != nil {
+		return nil, fmt.Errorf("could not verify the peer: %w", err)
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := transportAEAD(private, peerKey, requesterKey, resp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string][]byte, len(names))
+	for _, name := range names {
+		sealed, ok := resp.Secrets[name]
+		if !ok {
+			return nil, fmt.Errorf("the peer did not release %s", name)
+		}
+		if secrets[name], err = openAEAD(aead, name, sealed); err != nil {
+			return nil, fmt.Errorf("could not open %s: %w", name, err)
+		}
+	}
+	return secrets, nil
+}
+
+// FetchRoot fetches the sealing root of the peer at url, so that the TD derives the same secrets
+// without the root ever leaving TD memory
+func (p *Peers) FetchRoot(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	fetched, err := p.Fetch(ctx, client, url, []string{RootName})
+	if err != nil {
+		return nil, err
+	}
+	if len(fetched[RootName]) != RootSize {
+		return nil, fmt.Errorf("the peer released a sealing root of %d bytes, expected %d", len(fetched[RootName]), RootSize)
+	}
+	return fetched[RootName], nil
+}
+
+// FetchMissing imports the named secrets from the peer at url, skipping those already imported
+func (p *Peers) FetchMissing(ctx context.Context, client *http.Client, url string, store *Store, names []string) error {
+	missing := []string{}
+	for _, name := range names {
+		imported, err := store.Imported(name)
+		if err != nil {
+			return err
+		}
+		if !imported {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	fetched, err := p.Fetch(ctx, client, url, missing)
+	if err != nil {
+		return err
+	}
+	for _, name := range missing {
+		if err := store.Import(name, fetched[name]); err != nil {
+			return fmt.Errorf("could not import %s: %w", name, err)
+		}
+	}
+	return nil
+}
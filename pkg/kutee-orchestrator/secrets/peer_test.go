@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kutee-orchestrator/attestation"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	trusted   = attestation.Measurement{MRTD: strings.Repeat("aa", 48), RTMR2: strings.Repeat("bb", 48)}
+	untrusted = attestation.Measurement{MRTD: strings.Repeat("aa", 48), RTMR2: strings.Repeat("cc", 48)}
+)
+
+func testPeers(m attestation.Measurement) *Peers {
+	return &Peers{
+		Issuer:   &attestation.MockIssuer{Measurement: m},
+		Verifier: attestation.MockVerifier{},
+		Policy:   &attestation.Policy{Allowed: []attestation.Measurement{trusted}},
+	}
+}
+
+// servePeer serves the secrets of store the way the orchestrator does
+func servePeer(t *testing.T, peers *Peers, store *Store) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req PeerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := peers.Release(store, &req)
+		if errors.Is(err, attestation.ErrNotAllowed) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_Peers_Fetch(t *testing.T) {
+	existing, err := NewStore(bytes.Repeat([]byte{1}, RootSize), []byte("old measurement"), "")
+	require.NoError(t, err)
+	srv := servePeer(t, testPeers(trusted), existing)
+
+	// An upgraded instance derives other secrets, it fetches the existing ones instead
+	upgraded, err := NewStore(bytes.Repeat([]byte{2}, RootSize), []byte("new measurement"), t.TempDir())
+	require.NoError(t, err)
+	names := []string{"km-autosecret-db", "km-autosecret-api"}
+	require.NoError(t, testPeers(trusted).FetchMissing(context.Background(), srv.Client(), srv.URL, upgraded, names))
+
+	for _, name := range names {
+		expected, err := existing.Secret(name)
+		require.NoError(t, err)
+		actual, err := upgraded.Secret(name)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+
+	// Secrets already imported are not fetched again
+	require.NoError(t, testPeers(trusted).FetchMissing(context.Background(), srv.Client(), "http://127.0.0.1:0", upgraded, names))
+}
+
+func Test_Peers_Refused(t *testing.T) {
+	store, err := NewStore(bytes.Repeat([]byte{1}, RootSize), nil, "")
+	require.NoError(t, err)
+	srv := servePeer(t, testPeers(trusted), store)
+
+	// Instances the policy does not trust get nothing
+	_, err = testPeers(untrusted).Fetch(context.Background(), srv.Client(), srv.URL, []string{"km-autosecret-db"})
+	require.ErrorContains(t, err, "403")
+
+	// Nor do requests for secrets other than the workloads'
+	_, err = testPeers(trusted).Fetch(context.Background(), srv.Client(), srv.URL, []string{"orchestrator-root"})
+	require.ErrorContains(t, err, "400")
+
+	// And secrets from an untrusted peer are not used
+	untrustedSrv := servePeer(t, &Peers{
+		Issuer:   &attestation.MockIssuer{Measurement: untrusted},
+		Verifier: attestation.MockVerifier{},
+		Policy:   &attestation.Policy{Allowed: []attestation.Measurement{trusted, untrusted}},
+	}, store)
+	_, err = testPeers(trusted).Fetch(context.Background(), untrustedSrv.Client(), untrustedSrv.URL, []string{"km-autosecret-db"})
+	require.ErrorIs(t, err, attestation.ErrNotAllowed)
+}
+
+func Test_Peers_Release_Replayed(t *testing.T) {
+	store, err := NewStore(bytes.Repeat([]byte{1}, RootSize), nil, "")
+	require.NoError(t, err)
+	peers := testPeers(trusted)
+
+	// Evidence only attests the key it was issued for
+	evidence, err := peers.Issuer.Issue(requestReportData(bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, err)
+	_, err = peers.Release(store, &PeerRequest{Names: []string{"km-autosecret-db"}, PublicKey: bytes.Repeat([]byte{2}, 32), Evidence: evidence})
+	require.ErrorIs(t, err, attestation.ErrInvalidEvidence)
+}
+
+func Test_Peers_FetchRoot(t *testing.T) {
+	root, err := GenerateRoot()
+	require.NoError(t, err)
+	existing, err := NewStore(root, []byte("measurement"), "")
+	require.NoError(t, err)
+	srv := servePeer(t, testPeers(trusted), existing)
+
+	// A new instance with the peer's root derives the same secrets, without a root on its disk
+	fetched, err := testPeers(trusted).FetchRoot(context.Background(), srv.Client(), srv.URL)
+	require.NoError(t, err)
+	joined, err := NewStore(fetched, []byte("measurement"), "")
+	require.NoError(t, err)
+	expected, err := existing.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	actual, err := joined.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// Nor is the root taken from a peer the policy doesn't trust
+	untrustedSrv := servePeer(t, testPeers(untrusted), existing)
+	_, err = testPeers(trusted).FetchRoot(context.Background(), untrustedSrv.Client(), untrustedSrv.URL)
+	require.ErrorIs(t, err, attestation.ErrNotAllowed)
+}
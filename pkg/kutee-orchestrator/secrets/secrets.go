@@ -0,0 +1,242 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"kutee/statefile"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// RootSize is the size of the sealing root
+	RootSize = 32
+	// SecretSize is the size of the secrets, anything else a workload needs is derived from them
+	SecretSize = 32
+)
+
+// AutosecretPrefix is the prefix of the secrets the orchestrator generates for the workloads
+const AutosecretPrefix = "km-autosecret"
+
+var ErrInvalidName = errors.New("invalid secret name")
+
+// secretName is a Kubernetes secret name, which is safe to use as a file name
+var secretName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]{0,251}[a-z0-9])?$`)
+
+// RootName is the name the sealing root is released to peers under
+const RootName = "kutee-sealing-root"
+
+// GenerateRoot returns a new random sealing root. It is meant to be kept in the memory of the TD
+// only, and shared with the peers the TD trusts.
+func GenerateRoot() ([]byte, error) {
+	root := make([]byte, RootSize)
+	if _, err := rand.Read(root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// LoadOrCreateRoot reads the sealing root at path, generating it the first time.
+// The root is kept in plaintext: whoever reads the file derives every secret, which the host
+// can do for the disk of a TD. It is for running outside of TDs only.
+func LoadOrCreateRoot(path string) ([]byte, error) {
+	root, err := os.ReadFile(path)
+	if err == nil {
+		if len(root) != RootSize {
+			return nil, fmt.Errorf("sealing root %s is %d bytes, expected %d", path, len(root), RootSize)
+		}
+		return root, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	root, err = GenerateRoot()
+	if err != nil {
+		return nil, err
+	}
+	if err := statefile.Write(path, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// Store derives secrets from a sealing root, bound to an identity such as the measurement
+// of the TD. The same root and identity always derive the same secrets.
+// Secrets imported from a peer take precedence, they are kept sealed in the import directory.
+type Store struct {
+	root      []byte
+	identity  []byte
+	importDir string
+
+	mu       sync.Mutex
+	imported map[string][]byte
+}
+
+// NewStore returns a store deriving secrets from root, identity may be empty.
+// Imported secrets are only kept in memory if importDir is empty.
+func NewStore(root []byte, identity []byte, importDir string) (*Store, error) {
+	if len(root) != RootSize {
+		return nil, fmt.Errorf("the sealing root is %d bytes, expected %d", len(root), RootSize)
+	}
+	return &Store{root: root, identity: identity, importDir: importDir, imported: make(map[string][]byte)}, nil
+}
+
+func (s *Store) derive(info string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	kdf := hkdf.New(sha256.New, s.root, s.identity, []byte(info))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Secret returns the secret of the given name, as imported or derived from the sealing root
+func (s *Store) Secret(name string) ([]byte, error) {
+	if !secretName.MatchString(name) {
+		return nil, fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+
+	imported, err := s.importedSecret(name)
+	if err != nil || imported != nil {
+		return imported, err
+	}
+
+	secret, err := s.derive("kutee autosecret\x00"+name, SecretSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive secret %s: %w", name, err)
+	}
+	return secret, nil
+}
+
+// Imported reports whether the secret was imported from a peer
+func (s *Store) Imported(name string) (bool, error) {
+	secret, err := s.importedSecret(name)
+	return secret != nil, err
+}
+
+// Rotate replaces the secret with a random one, kept sealed like imported secrets.
+// The secret is never derived from the sealing root again.
+func (s *Store) Rotate(name string) ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := s.Import(name, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Import keeps a secret fetched from a peer, in place of the one the store derives
+func (s *Store) Import(name string, secret []byte) error {
+	if !secretName.MatchString(name) {
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+	if len(secret) != SecretSize {
+		return fmt.Errorf("secret %s is %d bytes, expected %d", name, len(secret), SecretSize)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.importDir != "" {
+		sealed, err := s.seal(name, secret)
+		if err != nil {
+			return err
+		}
+		if err := statefile.Write(s.importPath(name), sealed); err != nil {
+			return err
+		}
+	}
+	s.imported[name] = secret
+	return nil
+}
+
+func (s *Store) importPath(name string) string {
+	return filepath.Join(s.importDir, name+".sealed")
+}
+
+func (s *Store) importedSecret(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if secret, ok := s.imported[name]; ok {
+		return secret, nil
+	}
+	if s.importDir == "" {
+		return nil, nil
+	}
+
+	sealed, err := os.ReadFile(s.importPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	secret, err := s.unseal(name, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("could not unseal imported secret %s: %w", name, err)
+	}
+	s.imported[name] = secret
+	return secret, nil
+}
+
+func (s *Store) sealingAEAD() (cipher.AEAD, error) {
+	key, err := s.derive("kutee imported secrets", 32)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// seal encrypts the secret to the sealing root and identity, authenticating its name
+func (s *Store) seal(name string, secret []byte) ([]byte, error) {
+	aead, err := s.sealingAEAD()
+	if err != nil {
+		return nil, err
+	}
+	return sealAEAD(aead, name, secret)
+}
+
+func (s *Store) unseal(name string, sealed []byte) ([]byte, error) {
+	aead, err := s.sealingAEAD()
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(aead, name, sealed)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD encrypts plaintext with a random nonce, which the result starts with
+func sealAEAD(aead cipher.AEAD, name string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(name)), nil
+}
+
+func openAEAD(aead cipher.AEAD, name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(name))
+}
@@ -0,0 +1,138 @@
+package secrets
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoadOrCreateRoot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "sealing-root")
+
+	root, err := LoadOrCreateRoot(path)
+	require.NoError(t, err)
+	require.Len(t, root, RootSize)
+
+	// The root is kept, so that secrets survive restarts
+	again, err := LoadOrCreateRoot(path)
+	require.NoError(t, err)
+	require.Equal(t, root, again)
+
+	require.NoError(t, os.WriteFile(path, []byte("short"), 0o600))
+	_, err = LoadOrCreateRoot(path)
+	require.Error(t, err)
+}
+
+func Test_Store_Secret(t *testing.T) {
+	root := bytes.Repeat([]byte{1}, RootSize)
+	s, err := NewStore(root, []byte("measurement"), "")
+	require.NoError(t, err)
+
+	secret, err := s.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	require.Len(t, secret, SecretSize)
+
+	// Secrets are recreated identically
+	recreated, err := NewStore(root, []byte("measurement"), "")
+	require.NoError(t, err)
+	again, err := recreated.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	require.Equal(t, secret, again)
+
+	// And differ by name, root and identity
+	other, err := s.Secret("km-autosecret-api")
+	require.NoError(t, err)
+	require.NotEqual(t, secret, other)
+
+	otherIdentity, err := NewStore(root, []byte("other measurement"), "")
+	require.NoError(t, err)
+	other, err = otherIdentity.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	require.NotEqual(t, secret, other)
+
+	otherRoot, err := NewStore(bytes.Repeat([]byte{2}, RootSize), []byte("measurement"), "")
+	require.NoError(t, err)
+	other, err = otherRoot.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	require.NotEqual(t, secret, other)
+
+	_, err = s.Secret("../sealing-root")
+	require.ErrorIs(t, err, ErrInvalidName)
+	_, err = NewStore(root[:16], nil, "")
+	require.Error(t, err)
+}
+
+func Test_Store_Import(t *testing.T) {
+	root := bytes.Repeat([]byte{1}, RootSize)
+	dir := t.TempDir()
+	s, err := NewStore(root, []byte("measurement"), dir)
+	require.NoError(t, err)
+
+	imported := bytes.Repeat([]byte{3}, SecretSize)
+	require.NoError(t, s.Import("km-autosecret-db", imported))
+	require.Error(t, s.Import("km-autosecret-db", imported[:16]))
+
+	// Imported secrets are kept sealed, and survive restarts
+	sealed, err := os.ReadFile(filepath.Join(dir, "km-autosecret-db.sealed"))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(sealed, imported))
+
+	restarted, err := NewStore(root, []byte("measurement"), dir)
+	require.NoError(t, err)
+	ok, err := restarted.Imported("km-autosecret-db")
+	require.NoError(t, err)
+	require.True(t, ok)
+	secret, err := restarted.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	require.Equal(t, imported, secret)
+
+	// Only the TD that sealed them can open them
+	other, err := NewStore(root, []byte("other measurement"), dir)
+	require.NoError(t, err)
+	_, err = other.Secret("km-autosecret-db")
+	require.Error(t, err)
+}
+
+func Test_Store_Rotate(t *testing.T) {
+	root := bytes.Repeat([]byte{1}, RootSize)
+	dir := t.TempDir()
+	s, err := NewStore(root, nil, dir)
+	require.NoError(t, err)
+
+	derived, err := s.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	rotated, err := s.Rotate("km-autosecret-db")
+	require.NoError(t, err)
+	require.NotEqual(t, derived, rotated)
+
+	// The rotated secret replaces the derived one across restarts
+	restarted, err := NewStore(root, nil, dir)
+	require.NoError(t, err)
+	secret, err := restarted.Secret("km-autosecret-db")
+	require.NoError(t, err)
+	require.Equal(t, rotated, secret)
+
+	_, err = s.Rotate("../db")
+	require.ErrorIs(t, err, ErrInvalidName)
+}
+
+func Test_ReportIdentity(t *testing.T) {
+	report := make([]byte, tdReportSize)
+	mrtd := tdInfoOffset + 16
+	copy(report[mrtd:], bytes.Repeat([]byte{0xaa}, measureSize))
+	// RTMR[0] is skipped
+	copy(report[mrtd+4*measureSize:], bytes.Repeat([]byte{0xbb}, measureSize))
+	copy(report[mrtd+5*measureSize:], bytes.Repeat([]byte{0xcc}, measureSize))
+	copy(report[mrtd+6*measureSize:], bytes.Repeat([]byte{0xdd}, measureSize))
+
+	identity, err := reportIdentity(report)
+	require.NoError(t, err)
+	expected := append(append(bytes.Repeat([]byte{0xaa}, measureSize), bytes.Repeat([]byte{0xcc}, measureSize)...), bytes.Repeat([]byte{0xdd}, measureSize)...)
+	require.Equal(t, expected, identity)
+
+	_, err = reportIdentity(report[:100])
+	require.Error(t, err)
+}
@@ -0,0 +1,47 @@
+package secrets
+
+import (
+	"errors"
+)
+
+// ErrNoTDX is returned when the TD's report can't be read, outside of a TD
+var ErrNoTDX = errors.New("not running in a TDX guest")
+
+const (
+	tdReportSize = 1024
+	// tdInfoOffset is where TDINFO_STRUCT starts, after REPORTMACSTRUCT, TEE_TCB_INFO and a reserved field
+	tdInfoOffset = 256 + 239 + 17
+	measureSize  = 48
+)
+
+// TDXIdentity returns the MRTD, RTMR[1] and RTMR[2] of the TD the orchestrator runs in.
+// They measure the firmware, the kernel and its command line, which binds the installed bundle,
+// the same registers the deployer computes. RTMR[0] depends on the VMM configuration
+// and RTMR[3] is extended at runtime, neither is included.
+func TDXIdentity() ([]byte, error) {
+	report, err := tdReport(make([]byte, 64))
+	if err != nil {
+		return nil, err
+	}
+	return reportIdentity(report)
+}
+
+// reportIdentity extracts MRTD, RTMR[1] and RTMR[2] from a TDREPORT_STRUCT
+func reportIdentity(report []byte) ([]byte, error) {
+	if len(report) != tdReportSize {
+		return nil, errors.New("invalid TD report size")
+	}
+
+	// TDINFO_STRUCT: ATTRIBUTES, XFAM, MRTD, MRCONFIGID, MROWNER, MROWNERCONFIG, RTMR[0..3]
+	mrtd := tdInfoOffset + 8 + 8
+	rtmr := func(i int) []byte {
+		offset := mrtd + 4*measureSize + i*measureSize
+		return report[offset : offset+measureSize]
+	}
+
+	identity := make([]byte, 0, 3*measureSize)
+	identity = append(identity, report[mrtd:mrtd+measureSize]...)
+	identity = append(identity, rtmr(1)...)
+	identity = append(identity, rtmr(2)...)
+	return identity, nil
+}
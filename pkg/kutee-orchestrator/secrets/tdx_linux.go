@@ -0,0 +1,39 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// tdxGuestDevice is the TDX guest driver, which returns the TD's report
+const tdxGuestDevice = "/dev/tdx_guest"
+
+// tdxCmdGetReport0 is TDX_CMD_GET_REPORT0, _IOWR('T', 1, struct tdx_report_req)
+const tdxCmdGetReport0 = 0xc4405401
+
+type tdxReportReq struct {
+	reportData [64]byte
+	tdReport   [tdReportSize]byte
+}
+
+func tdReport(reportData []byte) ([]byte, error) {
+	f, err := os.Open(tdxGuestDevice)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoTDX
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var req tdxReportReq
+	copy(req.reportData[:], reportData)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), tdxCmdGetReport0, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return nil, fmt.Errorf("could not get the TD report: %w", errno)
+	}
+	return req.tdReport[:], nil
+}
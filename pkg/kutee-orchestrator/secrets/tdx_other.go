@@ -0,0 +1,7 @@
+//go:build !linux
+
+package secrets
+
+func tdReport(reportData []byte) ([]byte, error) {
+	return nil, ErrNoTDX
+}
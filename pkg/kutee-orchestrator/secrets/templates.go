@@ -0,0 +1,357 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"regexp"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"golang.org/x/crypto/hkdf"
+)
+
+// TemplateAnnotationPrefix is followed by the name of an autosecret in the annotations holding its template.
+// An object referring to km-autosecret-node could be annotated with
+//
+//	autosecret.kutee/km-autosecret-node: '{"NODE_KEY": {"type": "ed25519"}, "DB_PASSWORD": {"type": "password", "length": 24}}'
+const TemplateAnnotationPrefix = "autosecret.kutee/"
+
+// The types of keys of a template. Keypairs and TLS keys have a public half, stored under
+// the name of the key followed by PublicSuffix.
+const (
+	// KeySeed is the secret itself, hex encoded, as autosecrets without templates hold it
+	KeySeed = "seed"
+	// KeyToken is Length random bytes, hex encoded
+	KeyToken = "token"
+	// KeyPassword is Length characters of Alphabet
+	KeyPassword = "password"
+	// KeyEd25519 is a hex encoded ed25519 seed, its public key is hex encoded
+	KeyEd25519 = "ed25519"
+	// KeySecp256k1 is a hex encoded secp256k1 private key, its public key is hex encoded uncompressed
+	KeySecp256k1 = "secp256k1"
+	// KeyTLS is a PEM encoded ed25519 private key, its public half is a PEM encoded self-signed
+	// certificate for Hosts. Ed25519 signatures are deterministic, the certificate is the same
+	// every time it's generated.
+	KeyTLS = "tls"
+)
+
+// PublicSuffix is appended to the name of a key for its public half
+const PublicSuffix = "_PUBLIC"
+
+const (
+	DefaultTokenLength    = 32
+	DefaultPasswordLength = 32
+	// DefaultAlphabet is the characters of passwords without an alphabet
+	DefaultAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+	maxLength   = 1024
+	maxAlphabet = 256
+)
+
+var ErrInvalidTemplate = errors.New("invalid autosecret template")
+
+// secretKey is a key of the data of a Kubernetes secret
+var secretKey = regexp.MustCompile(`^[-._a-zA-Z0-9]{1,253}$`)
+
+// KeyTemplate is how a key of a secret is generated
+type KeyTemplate struct {
+	Type string `json:"type"`
+	// Length is the size of tokens in bytes and of passwords in characters, their default if 0
+	Length int `json:"length,omitempty"`
+	// Alphabet is the characters passwords are made of, DefaultAlphabet if empty
+	Alphabet string `json:"alphabet,omitempty"`
+	// Hosts are the DNS names and IP addresses of TLS certificates, the first one is their common name
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// Template maps the keys of a secret to how they are generated from the secret
+type Template map[string]KeyTemplate
+
+// DefaultTemplate is the template of autosecrets without one, KM_AUTOSECRET_TOKEN holding the secret
+func DefaultTemplate() Template {
+	return Template{"KM_AUTOSECRET_TOKEN": {Type: KeySeed}}
+}
+
+// ParseTemplate decodes and checks a template, as annotated on the objects of a manifest
+func ParseTemplate(data string) (Template, error) {
+	var template Template
+	decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&template); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+	}
+	if err := template.Check(); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// Check returns ErrInvalidTemplate if a key of the template can't be generated,
+// or its name or the name of its public half is already taken
+func (t Template) Check() error {
+	if len(t) == 0 {
+		return fmt.Errorf("%w: it has no keys", ErrInvalidTemplate)
+	}
+
+	for _, name := range t.keys() {
+		key := t[name]
+		invalid := func(format string, args ...any) error {
+			return fmt.Errorf("%w: key %s: %s", ErrInvalidTemplate, name, fmt.Sprintf(format, args...))
+		}
+
+		if !secretKey.MatchString(name) || !secretKey.MatchString(name+PublicSuffix) {
+			return invalid("keys are made of letters, digits, '-', '_' and '.'")
+		}
+		if key.hasPublic() {
+			if _, ok := t[name+PublicSuffix]; ok {
+				return invalid("its public half would replace key %s", name+PublicSuffix)
+			}
+		}
+
+		if key.Length != 0 && key.Type != KeyToken && key.Type != KeyPassword {
+			return invalid("only tokens and passwords have a length")
+		}
+		if key.Length < 0 || key.Length > maxLength {
+			return invalid("the length must be between 1 and %d", maxLength)
+		}
+		if key.Alphabet != "" && key.Type != KeyPassword {
+			return invalid("only passwords have an alphabet")
+		}
+		if len(key.Hosts) > 0 && key.Type != KeyTLS {
+			return invalid("only tls keys have hosts")
+		}
+
+		switch key.Type {
+		case KeySeed, KeyToken, KeyEd25519, KeySecp256k1:
+		case KeyPassword:
+			alphabet, err := key.alphabet()
+			if err != nil {
+				return invalid("%s", err)
+			}
+			if len(alphabet) < 2 {
+				return invalid("the alphabet needs at least two characters")
+			}
+		case KeyTLS:
+			if len(key.Hosts) == 0 {
+				return invalid("tls keys need the hosts of their certificate")
+			}
+		default:
+			return invalid("unknown type %q", key.Type)
+		}
+	}
+	return nil
+}
+
+// keys returns the names of the keys, sorted
+func (t Template) keys() []string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (k KeyTemplate) hasPublic() bool {
+	return k.Type == KeyEd25519 || k.Type == KeySecp256k1 || k.Type == KeyTLS
+}
+
+// alphabet returns the distinct characters of the alphabet
+func (k KeyTemplate) alphabet() ([]rune, error) {
+	alphabet := k.Alphabet
+	if alphabet == "" {
+		alphabet = DefaultAlphabet
+	}
+	if !utf8.ValidString(alphabet) {
+		return nil, errors.New("the alphabet is not valid UTF-8")
+	}
+
+	runes := []rune{}
+	seen := map[rune]bool{}
+	for _, r := range alphabet {
+		if !seen[r] {
+			seen[r] = true
+			runes = append(runes, r)
+		}
+	}
+	if len(runes) > maxAlphabet {
+		return nil, fmt.Errorf("the alphabet has more than %d characters", maxAlphabet)
+	}
+	return runes, nil
+}
+
+// Generate returns the data of a secret following the template, derived from secret.
+// The same secret always generates the same data.
+func (t Template) Generate(secret []byte) (map[string][]byte, error) {
+	if err := t.Check(); err != nil {
+		return nil, err
+	}
+
+	data := make(map[string][]byte, len(t))
+	for _, name := range t.keys() {
+		private, public, err := t[name].generate(secret, name)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate key %s: %w", name, err)
+		}
+		data[name] = private
+		if public != nil {
+			data[name+PublicSuffix] = public
+		}
+	}
+	return data, nil
+}
+
+// Public returns the public halves of the keys generated from secret, by the name they are stored under
+func (t Template) Public(secret []byte) (map[string]string, error) {
+	data, err := t.Generate(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	public := map[string]string{}
+	for name, key := range t {
+		if key.hasPublic() {
+			public[name+PublicSuffix] = string(data[name+PublicSuffix])
+		}
+	}
+	return public, nil
+}
+
+// generate derives the key from secret, each key of a template from a stream of its own
+func (k KeyTemplate) generate(secret []byte, name string) ([]byte, []byte, error) {
+	if k.Type == KeySeed {
+		return []byte(hex.EncodeToString(secret)), nil, nil
+	}
+	kdf := hkdf.New(sha256.New, secret, nil, []byte("kutee autosecret key\x00"+k.Type+"\x00"+name))
+
+	switch k.Type {
+	case KeyToken:
+		token := make([]byte, orDefault(k.Length, DefaultTokenLength))
+		if _, err := io.ReadFull(kdf, token); err != nil {
+			return nil, nil, err
+		}
+		return []byte(hex.EncodeToString(token)), nil, nil
+
+	case KeyPassword:
+		password, err := k.password(kdf)
+		return password, nil, err
+
+	case KeyEd25519:
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := io.ReadFull(kdf, seed); err != nil {
+			return nil, nil, err
+		}
+		public := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+		return []byte(hex.EncodeToString(seed)), []byte(hex.EncodeToString(public)), nil
+
+	case KeySecp256k1:
+		private, err := secp256k1Key(kdf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []byte(hex.EncodeToString(private.Serialize())), []byte(hex.EncodeToString(private.PubKey().SerializeUncompressed())), nil
+
+	case KeyTLS:
+		return k.tlsKey(kdf)
+	}
+	return nil, nil, fmt.Errorf("%w: unknown type %q", ErrInvalidTemplate, k.Type)
+}
+
+func orDefault(length int, defaultLength int) int {
+	if length == 0 {
+		return defaultLength
+	}
+	return length
+}
+
+// password draws the characters from the alphabet, rejecting the bytes that would favor some of them
+func (k KeyTemplate) password(kdf io.Reader) ([]byte, error) {
+	alphabet, err := k.alphabet()
+	if err != nil {
+		return nil, err
+	}
+	limit := 256 - 256%len(alphabet)
+
+	password := make([]rune, 0, orDefault(k.Length, DefaultPasswordLength))
+	b := make([]byte, 1)
+	for len(password) < cap(password) {
+		if _, err := io.ReadFull(kdf, b); err != nil {
+			return nil, err
+		}
+		if int(b[0]) < limit {
+			password = append(password, alphabet[int(b[0])%len(alphabet)])
+		}
+	}
+	return []byte(string(password)), nil
+}
+
+// secp256k1Key draws scalars until one is a valid private key
+func secp256k1Key(kdf io.Reader) (*secp256k1.PrivateKey, error) {
+	b := make([]byte, 32)
+	for {
+		if _, err := io.ReadFull(kdf, b); err != nil {
+			return nil, err
+		}
+		var scalar secp256k1.ModNScalar
+		if overflow := scalar.SetByteSlice(b); !overflow && !scalar.IsZero() {
+			return secp256k1.NewPrivateKey(&scalar), nil
+		}
+	}
+}
+
+// tlsNotBefore and tlsNotAfter bound the certificates, which have no expiry date
+var (
+	tlsNotBefore = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tlsNotAfter  = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+)
+
+func (k KeyTemplate) tlsKey(kdf io.Reader) ([]byte, []byte, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	serial := make([]byte, 16)
+	for _, b := range [][]byte{seed, serial} {
+		if _, err := io.ReadFull(kdf, b); err != nil {
+			return nil, nil, err
+		}
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+
+	cert := &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes(serial),
+		Subject:               pkix.Name{CommonName: k.Hosts[0]},
+		NotBefore:             tlsNotBefore,
+		NotAfter:              tlsNotAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range k.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			cert.IPAddresses = append(cert.IPAddresses, ip)
+		} else {
+			cert.DNSNames = append(cert.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(kdf, cert, cert, private.Public(), private)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -0,0 +1,97 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseTemplate(t *testing.T) {
+	template, err := ParseTemplate(`{"NODE_KEY": {"type": "ed25519"}, "DB_PASSWORD": {"type": "password", "length": 24, "alphabet": "abc"}}`)
+	require.NoError(t, err)
+	require.Equal(t, Template{
+		"NODE_KEY":    {Type: KeyEd25519},
+		"DB_PASSWORD": {Type: KeyPassword, Length: 24, Alphabet: "abc"},
+	}, template)
+
+	for _, invalid := range []string{
+		`{}`,
+		`{"KEY": {"type": "rsa"}}`,
+		`{"KEY": {"type": "token", "size": 16}}`,
+		`{"KEY": {"type": "ed25519", "length": 16}}`,
+		`{"KEY": {"type": "password", "alphabet": "a"}}`,
+		`{"KEY": {"type": "password", "length": 100000}}`,
+		`{"KEY": {"type": "tls"}}`,
+		`{"KEY": {"type": "ed25519"}, "KEY_PUBLIC": {"type": "token"}}`,
+		`{"KEY/1": {"type": "token"}}`,
+	} {
+		_, err := ParseTemplate(invalid)
+		require.ErrorIs(t, err, ErrInvalidTemplate, invalid)
+	}
+}
+
+func Test_Template_Generate(t *testing.T) {
+	template := Template{
+		"SEED":      {Type: KeySeed},
+		"TOKEN":     {Type: KeyToken, Length: 16},
+		"PASSWORD":  {Type: KeyPassword, Length: 40, Alphabet: "xyz"},
+		"NODE_KEY":  {Type: KeyEd25519},
+		"ETH_KEY":   {Type: KeySecp256k1},
+		"tls":       {Type: KeyTLS, Hosts: []string{"app.example", "10.0.0.1"}},
+		"PASSWORD2": {Type: KeyPassword},
+	}
+	secret := bytes.Repeat([]byte{7}, SecretSize)
+
+	data, err := template.Generate(secret)
+	require.NoError(t, err)
+	require.Len(t, data, 10)
+
+	require.Equal(t, hex.EncodeToString(secret), string(data["SEED"]))
+	require.Len(t, data["TOKEN"], 32)
+	require.Len(t, data["PASSWORD"], 40)
+	require.Empty(t, strings.Trim(string(data["PASSWORD"]), "xyz"))
+	require.Len(t, data["PASSWORD2"], DefaultPasswordLength)
+	require.NotEqual(t, data["PASSWORD"][:32], data["PASSWORD2"])
+
+	seed, err := hex.DecodeString(string(data["NODE_KEY"]))
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)), string(data["NODE_KEY_PUBLIC"]))
+	require.Len(t, data["ETH_KEY"], 64)
+	require.Len(t, data["ETH_KEY_PUBLIC"], 130)
+
+	block, _ := pem.Decode(data["tls_PUBLIC"])
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app.example"}, cert.DNSNames)
+	require.Equal(t, "10.0.0.1", cert.IPAddresses[0].String())
+	require.NoError(t, cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature))
+	block, _ = pem.Decode(data["tls"])
+	require.NotNil(t, block)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+	require.Equal(t, cert.PublicKey, key.(ed25519.PrivateKey).Public())
+
+	// The same secret generates the same keys, the certificate included
+	again, err := template.Generate(secret)
+	require.NoError(t, err)
+	require.Equal(t, data, again)
+
+	other, err := template.Generate(bytes.Repeat([]byte{8}, SecretSize))
+	require.NoError(t, err)
+	require.NotEqual(t, data["NODE_KEY"], other["NODE_KEY"])
+
+	public, err := template.Public(secret)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"NODE_KEY_PUBLIC": string(data["NODE_KEY_PUBLIC"]),
+		"ETH_KEY_PUBLIC":  string(data["ETH_KEY_PUBLIC"]),
+		"tls_PUBLIC":      string(data["tls_PUBLIC"]),
+	}, public)
+}
@@ -0,0 +1,2 @@
+// Package workloads persists the workloads submitted to the orchestrator.
+package workloads
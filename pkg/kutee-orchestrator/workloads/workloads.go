@@ -0,0 +1,86 @@
+package workloads
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"kutee/statefile"
+
+	"kutee-orchestrator/kube"
+)
+
+var ErrNotFound = errors.New("workload not found")
+
+const storeFileName = "workloads.json"
+
+type Workload struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Creator   string    `json:"creator"`
+
+	// Revision counts the manifests applied, the first one is 1
+	Revision int    `json:"revision"`
+	Manifest string `json:"manifest"`
+	SHA256   string `json:"sha256"`
+	// Objects are the objects of the manifest, as applied to the cluster
+	Objects []kube.ObjectRef `json:"objects"`
+}
+
+// Store keeps the workloads in a JSON file in the state directory
+type Store struct {
+	workloads *statefile.Map[Workload]
+}
+
+// Open loads the store from stateDir, creating the directory if needed
+func Open(stateDir string) (*Store, error) {
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	workloads, err := statefile.OpenMap[Workload](filepath.Join(stateDir, storeFileName))
+	if err != nil {
+		return nil, err
+	}
+	return &Store{workloads: workloads}, nil
+}
+
+func (s *Store) Get(id string) (Workload, error) {
+	w, ok := s.workloads.Get(id)
+	if !ok {
+		return Workload{}, ErrNotFound
+	}
+	return w, nil
+}
+
+// List returns all workloads, oldest first
+func (s *Store) List() []Workload {
+	return s.workloads.List(func(a, b Workload) bool { return a.CreatedAt.Before(b.CreatedAt) })
+}
+
+func (s *Store) Create(w Workload) error {
+	created, err := s.workloads.Create(w.ID, w)
+	if err == nil && !created {
+		return errors.New("workload already exists")
+	}
+	return err
+}
+
+// Update applies fn to the stored workload and persists the result
+func (s *Store) Update(id string, fn func(w *Workload)) error {
+	found, err := s.workloads.Update(id, fn)
+	if err == nil && !found {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *Store) Delete(id string) error {
+	found, err := s.workloads.Delete(id)
+	if err == nil && !found {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package workloads
+
+import (
+	"testing"
+	"time"
+
+	"kutee-orchestrator/kube"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Store_Persists(t *testing.T) {
+	stateDir := t.TempDir()
+
+	s, err := Open(stateDir)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, s.Create(Workload{ID: "b", CreatedAt: now.Add(time.Second), Revision: 1}))
+	require.NoError(t, s.Create(Workload{ID: "a", CreatedAt: now, Revision: 1, Objects: []kube.ObjectRef{{Kind: "Pod", Name: "app"}}}))
+	require.Error(t, s.Create(Workload{ID: "a"}))
+
+	require.NoError(t, s.Update("b", func(w *Workload) { w.Revision++ }))
+	require.ErrorIs(t, s.Update("missing", func(w *Workload) {}), ErrNotFound)
+
+	reopened, err := Open(stateDir)
+	require.NoError(t, err)
+
+	workloads := reopened.List()
+	require.Len(t, workloads, 2)
+	require.Equal(t, "a", workloads[0].ID)
+	require.Equal(t, []kube.ObjectRef{{Kind: "Pod", Name: "app"}}, workloads[0].Objects)
+	require.Equal(t, "b", workloads[1].ID)
+	require.Equal(t, 2, workloads[1].Revision)
+
+	require.NoError(t, reopened.Delete("a"))
+	require.ErrorIs(t, reopened.Delete("a"), ErrNotFound)
+	_, err = reopened.Get("a")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	reopened, err = Open(stateDir)
+	require.NoError(t, err)
+	require.Len(t, reopened.List(), 1)
+}
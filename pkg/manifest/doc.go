@@ -0,0 +1,2 @@
+// Package manifest inspects the Kubernetes manifests deployed through kutee.
+package manifest
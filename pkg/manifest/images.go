@@ -0,0 +1,57 @@
+package manifest
+
+import (
+	"sort"
+	"strings"
+)
+
+// Images returns the sorted, deduplicated images of every container in the manifest
+func (m *Manifest) Images() ([]string, error) {
+	containers, err := m.Containers()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	images := []string{}
+	for _, c := range containers {
+		if !seen[c.Image()] {
+			seen[c.Image()] = true
+			images = append(images, c.Image())
+		}
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// RewriteImages replaces the image of every container with the one returned by rewrite
+func (m *Manifest) RewriteImages(rewrite func(image string) (string, error)) error {
+	containers, err := m.Containers()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range containers {
+		image, err := rewrite(c.Image())
+		if err != nil {
+			return err
+		}
+		c.SetImage(image)
+	}
+	return nil
+}
+
+// Images returns the sorted, deduplicated images referenced by any container
+// of any workload in a (possibly multi-document) manifest
+func Images(data []byte) ([]string, error) {
+	m, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return m.Images()
+}
+
+// ArchiveName is the file name an image's tarball is stored under in a deployment bundle
+func ArchiveName(image string) string {
+	return strings.NewReplacer("/", "_", ":", "-", "@", "-").Replace(image) + ".tar"
+}
@@ -0,0 +1,231 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// podSpecPaths is where each workload kind keeps its pod spec
+var podSpecPaths = map[string][]string{
+	"Pod":                   {"spec"},
+	"PodTemplate":           {"template", "spec"},
+	"Deployment":            {"spec", "template", "spec"},
+	"StatefulSet":           {"spec", "template", "spec"},
+	"DaemonSet":             {"spec", "template", "spec"},
+	"ReplicaSet":            {"spec", "template", "spec"},
+	"ReplicationController": {"spec", "template", "spec"},
+	"Job":                   {"spec", "template", "spec"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// containerListKeys are the pod spec fields holding containers
+var containerListKeys = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// Manifest is a parsed, possibly multi-document, Kubernetes manifest
+type Manifest struct {
+	docs []*yaml.Node
+}
+
+// Container is a container of a workload in the manifest
+type Container struct {
+	Kind     string
+	Workload string
+	Name     string
+
+	image *yaml.Node
+}
+
+// Image returns the image the container runs
+func (c *Container) Image() string {
+	return c.image.Value
+}
+
+// SetImage replaces the container's image in the manifest
+func (c *Container) SetImage(image string) {
+	c.image.Value = image
+}
+
+// Parse decodes every document of a manifest and checks that all of its containers have an image
+func Parse(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for i := 0; ; i++ {
+		doc := &yaml.Node{}
+		err := decoder.Decode(doc)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse manifest document %d: %w", i, err)
+		}
+		m.docs = append(m.docs, doc)
+	}
+
+	// Make sure every container can be walked, so that callers only deal with valid manifests
+	if _, err := m.Containers(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Containers returns the containers of every workload in the manifest, in document order.
+// Kinds that are not known to hold pods are skipped, unless they contain containers
+// that would be missed.
+func (m *Manifest) Containers() ([]*Container, error) {
+	containers := []*Container{}
+	for i, doc := range m.docs {
+		found, err := documentContainers(doc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest document %d: %w", i, err)
+		}
+		containers = append(containers, found...)
+	}
+	return containers, nil
+}
+
+// Marshal encodes the manifest, including any changes made to its containers
+func (m *Manifest) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	for _, doc := range m.docs {
+		if err := encoder.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func documentContainers(doc *yaml.Node) ([]*Container, error) {
+	obj := resolve(doc)
+	if obj == nil || obj.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	kind := scalar(lookup(obj, "kind"))
+	workload := scalar(lookup(obj, "metadata", "name"))
+
+	if strings.HasSuffix(kind, "List") {
+		items := resolve(lookup(obj, "items"))
+		if items == nil {
+			return nil, nil
+		}
+		containers := []*Container{}
+		for _, item := range items.Content {
+			found, err := documentContainers(item)
+			if err != nil {
+				return nil, err
+			}
+			containers = append(containers, found...)
+		}
+		return containers, nil
+	}
+
+	path, ok := podSpecPaths[kind]
+	if !ok {
+		if hasContainers(obj) {
+			return nil, fmt.Errorf("unsupported kind %q holds containers", kind)
+		}
+		return nil, nil
+	}
+
+	podSpec := resolve(lookup(obj, path...))
+	if podSpec == nil || podSpec.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s %s has no pod spec", kind, workload)
+	}
+
+	containers := []*Container{}
+	for _, key := range containerListKeys {
+		list := resolve(lookup(podSpec, key))
+		if list == nil {
+			continue
+		}
+		if list.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("%s %s: %s is not a list", kind, workload, key)
+		}
+		for _, c := range list.Content {
+			c = resolve(c)
+			name := scalar(lookup(c, "name"))
+			image := resolve(lookup(c, "image"))
+			if image == nil || image.Kind != yaml.ScalarNode || image.Value == "" {
+				return nil, fmt.Errorf("%s %s: container %s has no image", kind, workload, name)
+			}
+			containers = append(containers, &Container{Kind: kind, Workload: workload, Name: name, image: image})
+		}
+	}
+	return containers, nil
+}
+
+// hasContainers reports whether a container list appears anywhere under node
+func hasContainers(node *yaml.Node) bool {
+	node = resolve(node)
+	if node == nil {
+		return false
+	}
+	if node.Kind == yaml.MappingNode {
+		for _, key := range containerListKeys {
+			if list := resolve(lookup(node, key)); list != nil && list.Kind == yaml.SequenceNode {
+				return true
+			}
+		}
+	}
+	for _, child := range node.Content {
+		if hasContainers(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup follows a path of mapping keys, returning nil if any of them is missing
+func lookup(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		node = resolve(node)
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var value *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				value = node.Content[i+1]
+				break
+			}
+		}
+		node = value
+	}
+	return node
+}
+
+// resolve unwraps documents and aliases
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			if len(node.Content) == 0 {
+				return nil
+			}
+			node = node.Content[0]
+		case yaml.AliasNode:
+			node = node.Alias
+		default:
+			return node
+		}
+	}
+	return nil
+}
+
+func scalar(node *yaml.Node) string {
+	node = resolve(node)
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
@@ -0,0 +1,184 @@
+package manifest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testManifest = `# the frontend
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: migrate
+        image: "registry.example.com/team/migrate:1.2"
+      containers:
+      - name: web
+        image: docker.io/library/nginx:latest
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: backup
+            image: 'backup@sha256:abcd'
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+spec:
+  ports:
+  - port: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: apps/v1
+  kind: StatefulSet
+  metadata:
+    name: db
+  spec:
+    template:
+      spec:
+        containers:
+        - name: db
+          image: docker.io/library/nginx:latest
+`
+
+func Test_Images(t *testing.T) {
+	images, err := Images([]byte(testManifest))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"backup@sha256:abcd",
+		"docker.io/library/nginx:latest",
+		"registry.example.com/team/migrate:1.2",
+	}, images)
+
+	m, err := Parse([]byte(testManifest))
+	require.NoError(t, err)
+	containers, err := m.Containers()
+	require.NoError(t, err)
+	require.Len(t, containers, 4)
+	require.Equal(t, "Deployment", containers[0].Kind)
+	require.Equal(t, "web", containers[0].Workload)
+	require.Equal(t, "web", containers[0].Name)
+	require.Equal(t, "migrate", containers[1].Name)
+	require.Equal(t, "db", containers[3].Workload)
+}
+
+func Test_RewriteImages(t *testing.T) {
+	m, err := Parse([]byte(testManifest))
+	require.NoError(t, err)
+	require.NoError(t, m.RewriteImages(func(image string) (string, error) {
+		return ArchiveName(image), nil
+	}))
+
+	data, err := m.Marshal()
+	require.NoError(t, err)
+	require.Contains(t, string(data), "# the frontend")
+	require.Contains(t, string(data), "kind: Service")
+
+	images, err := Images(data)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"backup-sha256-abcd.tar",
+		"docker.io_library_nginx-latest.tar",
+		"registry.example.com_team_migrate-1.2.tar",
+	}, images)
+}
+
+func Test_Parse_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"missing image":    "kind: Pod\nspec:\n  containers:\n  - name: app\n",
+		"empty image":      "kind: Pod\nspec:\n  containers:\n  - name: app\n    image: \"\"\n",
+		"no pod spec":      "kind: Deployment\nmetadata:\n  name: app\n",
+		"unsupported kind": "kind: Workflow\nspec:\n  steps:\n  - containers:\n    - name: app\n      image: app\n",
+		"invalid yaml":     "kind: Pod\nspec: [\n",
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(data))
+			require.Error(t, err)
+		})
+	}
+}
+
+func Test_Objects(t *testing.T) {
+	m, err := Parse([]byte(testManifest))
+	require.NoError(t, err)
+
+	objects := m.Objects()
+	names := []string{}
+	for _, obj := range objects {
+		names = append(names, obj.Kind+"/"+obj.Name)
+	}
+	require.Equal(t, []string{"Deployment/web", "CronJob/backup", "Service/web", "StatefulSet/db"}, names)
+
+	web := objects[0]
+	web.SetNamespace("kutee")
+	web.SetLabel("tier", "frontend")
+	web.SetLabel("tier", "web")
+	require.Equal(t, "kutee", web.Namespace)
+
+	data, err := web.JSON()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"web","namespace":"kutee","labels":{"tier":"web"}}`, metadataJSON(t, data))
+
+	// Changes to the objects are changes to the manifest
+	out, err := m.Marshal()
+	require.NoError(t, err)
+	require.Contains(t, string(out), "namespace: kutee")
+}
+
+func metadataJSON(t *testing.T, data []byte) string {
+	t.Helper()
+	var obj struct {
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	require.NoError(t, json.Unmarshal(data, &obj))
+	return string(obj.Metadata)
+}
+
+func Test_Objects_PodSpec(t *testing.T) {
+	m, err := Parse([]byte(testManifest))
+	require.NoError(t, err)
+	objects := m.Objects()
+
+	spec, path, err := objects[1].PodSpec()
+	require.NoError(t, err)
+	require.Equal(t, "spec.jobTemplate.spec.template.spec", path)
+	require.JSONEq(t, `{"containers":[{"name":"backup","image":"backup@sha256:abcd"}]}`, string(spec))
+
+	// Services do not run pods
+	spec, _, err = objects[2].PodSpec()
+	require.NoError(t, err)
+	require.Nil(t, spec)
+}
+
+func Test_Objects_Annotations(t *testing.T) {
+	m, err := Parse([]byte("kind: Pod\nmetadata:\n  name: app\n  annotations:\n    team: web\nspec:\n  containers:\n  - name: app\n    image: app\n---\nkind: Service\nmetadata:\n  name: app\n"))
+	require.NoError(t, err)
+	objects := m.Objects()
+
+	annotations, err := objects[0].Annotations()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"team": "web"}, annotations)
+
+	annotations, err = objects[1].Annotations()
+	require.NoError(t, err)
+	require.Empty(t, annotations)
+}
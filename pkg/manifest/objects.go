@@ -0,0 +1,141 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Object is an object of the manifest, items of lists are objects of their own
+type Object struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+
+	node *yaml.Node
+}
+
+// Objects returns the objects of the manifest in document order, skipping empty documents
+func (m *Manifest) Objects() []*Object {
+	objects := []*Object{}
+	for _, doc := range m.docs {
+		objects = append(objects, documentObjects(doc)...)
+	}
+	return objects
+}
+
+func documentObjects(doc *yaml.Node) []*Object {
+	obj := resolve(doc)
+	if obj == nil || obj.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	kind := scalar(lookup(obj, "kind"))
+	if strings.HasSuffix(kind, "List") {
+		items := resolve(lookup(obj, "items"))
+		if items == nil {
+			return nil
+		}
+		objects := []*Object{}
+		for _, item := range items.Content {
+			objects = append(objects, documentObjects(item)...)
+		}
+		return objects
+	}
+
+	return []*Object{{
+		APIVersion: scalar(lookup(obj, "apiVersion")),
+		Kind:       kind,
+		Namespace:  scalar(lookup(obj, "metadata", "namespace")),
+		Name:       scalar(lookup(obj, "metadata", "name")),
+		node:       obj,
+	}}
+}
+
+// SetLabel sets a label in the metadata of the object, creating the metadata if needed
+func (o *Object) SetLabel(key string, value string) {
+	labels := mappingAt(o.node, "metadata", "labels")
+	if existing := lookup(labels, key); existing != nil {
+		existing.Kind, existing.Tag, existing.Value = yaml.ScalarNode, "!!str", value
+		return
+	}
+	labels.Content = append(labels.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value},
+	)
+}
+
+// Annotations returns the annotations in the metadata of the object
+func (o *Object) Annotations() (map[string]string, error) {
+	annotations := map[string]string{}
+	node := resolve(lookup(o.node, "metadata", "annotations"))
+	if node == nil {
+		return annotations, nil
+	}
+	if err := node.Decode(&annotations); err != nil {
+		return nil, fmt.Errorf("%s %s has invalid annotations: %w", o.Kind, o.Name, err)
+	}
+	return annotations, nil
+}
+
+// SetNamespace sets the namespace in the metadata of the object
+func (o *Object) SetNamespace(namespace string) {
+	setKey(mappingAt(o.node, "metadata"), "namespace", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: namespace})
+	o.Namespace = namespace
+}
+
+// JSON encodes the object as JSON, as the Kubernetes API expects it
+func (o *Object) JSON() ([]byte, error) {
+	var v any
+	if err := o.node.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// PodSpec returns the pod spec of the object as JSON, and where it is in the object, as in
+// spec.template.spec. The spec is nil for kinds that do not run pods.
+func (o *Object) PodSpec() ([]byte, string, error) {
+	path, ok := podSpecPaths[o.Kind]
+	if !ok {
+		return nil, "", nil
+	}
+
+	podSpec := resolve(lookup(o.node, path...))
+	if podSpec == nil || podSpec.Kind != yaml.MappingNode {
+		return nil, "", fmt.Errorf("%s %s has no pod spec", o.Kind, o.Name)
+	}
+
+	var v any
+	if err := podSpec.Decode(&v); err != nil {
+		return nil, "", err
+	}
+	data, err := json.Marshal(v)
+	return data, strings.Join(path, "."), err
+}
+
+// mappingAt returns the mapping at path under node, creating the missing ones
+func mappingAt(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		next := resolve(lookup(node, key))
+		if next == nil || next.Kind != yaml.MappingNode {
+			next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setKey(node, key, next)
+		}
+		node = next
+	}
+	return node
+}
+
+func setKey(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
@@ -0,0 +1,4 @@
+// Package ociarchive reassembles OCI image archives whose layers are stored separately,
+// as content-addressed blobs shared by all the images of a bundle. Archives written by
+// docker save, which always keep their layers, are read too.
+package ociarchive
@@ -0,0 +1,427 @@
+package ociarchive
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// MaxSize is the largest image the orchestrator accepts, and so the largest bundle the deployer builds
+const MaxSize = 1024 * 1024 * 500 // 500MiB
+
+const blobSuffix = ".blob"
+
+// ErrMissingBlobs is returned when an archive is assembled without all of its layers
+var ErrMissingBlobs = errors.New("missing layer blobs")
+
+// BlobName is the file name a layer is stored under, next to the image archives sharing it
+func BlobName(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + blobSuffix
+}
+
+// ParseBlobName returns the digest of a blob file, and whether name is a blob file at all
+func ParseBlobName(name string) (string, bool) {
+	algorithm, hexDigest, ok := strings.Cut(strings.TrimSuffix(name, blobSuffix), "-")
+	if !ok || !strings.HasSuffix(name, blobSuffix) || algorithm != "sha256" {
+		return "", false
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil || len(hexDigest) != sha256.Size*2 {
+		return "", false
+	}
+	return algorithm + ":" + hexDigest, true
+}
+
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type index struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type imageManifest struct {
+	Config descriptor   `json:"config"`
+	Layers []descriptor `json:"layers"`
+}
+
+// Annotations naming the images of an archive, the full name as containerd and the deployer write it,
+// or the tag as the OCI image spec does
+const (
+	imageNameAnnotation = "io.containerd.image.name"
+	refNameAnnotation   = "org.opencontainers.image.ref.name"
+)
+
+// Image is an image of an archive
+type Image struct {
+	// Name is the name the image is tagged with, empty if it's untagged
+	Name string `json:"name,omitempty"`
+	// Digest of the image manifest
+	Digest string `json:"digest"`
+	// ID is the digest of the image config, which images are pinned by
+	ID string `json:"id"`
+}
+
+// dockerManifest is an entry of the manifest.json of archives written by docker save
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// maxMetadataSize bounds the index, manifests and configs read into memory, layers are only streamed
+const maxMetadataSize = 4 * 1024 * 1024
+
+// archive is what an image archive holds, read without its layers
+type archive struct {
+	path string
+	// entries are the regular files of the archive
+	entries map[string]bool
+	images  []Image
+	// layers are the digests of the layers of every image, sorted. Archives from docker save
+	// reference their layers by path, and always contain them.
+	layers []string
+}
+
+// readArchive reads the images of an OCI image archive, or, without an index.json, of an archive
+// written by docker save. Only the metadata files are read into memory.
+func readArchive(archivePath string) (*archive, error) {
+	a := &archive{path: archivePath, entries: make(map[string]bool)}
+	metadata, err := a.read(func(name string) bool { return name == "index.json" || name == "manifest.json" })
+	if err != nil {
+		return nil, err
+	}
+
+	if data, ok := metadata["index.json"]; ok {
+		var idx index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, fmt.Errorf("invalid index.json: %w", err)
+		}
+		return a, a.readOCIImages(idx)
+	}
+	if data, ok := metadata["manifest.json"]; ok {
+		var manifests []dockerManifest
+		if err := json.Unmarshal(data, &manifests); err != nil {
+			return nil, fmt.Errorf("invalid manifest.json: %w", err)
+		}
+		return a, a.readDockerImages(manifests)
+	}
+	return nil, errors.New("neither index.json nor manifest.json is in the archive")
+}
+
+// read goes through the archive, recording its entries, and returns the content of the files wanted
+func (a *archive) read(wanted func(name string) bool) (map[string][]byte, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files := make(map[string][]byte)
+	seen := make(map[string]bool)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The loader could read either of the files of the same name, and not the one checked
+		name := path.Clean(hdr.Name)
+		if seen[name] {
+			return nil, fmt.Errorf("%s is in the archive more than once", hdr.Name)
+		}
+		seen[name] = true
+		a.entries[name] = true
+		if !wanted(name) {
+			continue
+		}
+		if hdr.Size > maxMetadataSize {
+			return nil, fmt.Errorf("%s is larger than %d bytes", hdr.Name, maxMetadataSize)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// readFiles reads the files at names, which must all be in the archive
+func (a *archive) readFiles(names []string) (map[string][]byte, error) {
+	for _, name := range names {
+		if !a.entries[name] {
+			return nil, fmt.Errorf("%s is not in the archive", name)
+		}
+	}
+	return a.read(func(name string) bool { return slices.Contains(names, name) })
+}
+
+// readOCIImages reads the manifests and configs of the images of the index, checking that they hold
+// what their digests claim, since images are allowed by them
+func (a *archive) readOCIImages(idx index) error {
+	manifestDigests := []string{}
+	for _, desc := range idx.Manifests {
+		manifestDigests = append(manifestDigests, desc.Digest)
+	}
+	manifests, err := a.readBlobs(manifestDigests)
+	if err != nil {
+		return err
+	}
+
+	parsed := make([]imageManifest, len(idx.Manifests))
+	configDigests := []string{}
+	for i, desc := range idx.Manifests {
+		if err := json.Unmarshal(manifests[desc.Digest], &parsed[i]); err != nil {
+			return fmt.Errorf("invalid manifest %s: %w", desc.Digest, err)
+		}
+		configDigests = append(configDigests, parsed[i].Config.Digest)
+	}
+	if _, err := a.readBlobs(configDigests); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i, desc := range idx.Manifests {
+		manifest := parsed[i]
+
+		for _, layer := range manifest.Layers {
+			if _, ok := ParseBlobName(BlobName(layer.Digest)); !ok {
+				return fmt.Errorf("unsupported layer digest %s", layer.Digest)
+			}
+			if !seen[layer.Digest] {
+				seen[layer.Digest] = true
+				a.layers = append(a.layers, layer.Digest)
+			}
+		}
+
+		name := desc.Annotations[imageNameAnnotation]
+		if name == "" {
+			name = desc.Annotations[refNameAnnotation]
+		}
+		a.images = append(a.images, Image{Name: name, Digest: desc.Digest, ID: manifest.Config.Digest})
+	}
+	sort.Strings(a.layers)
+	return nil
+}
+
+// readDockerImages reads the images of a docker save archive. They have no manifest digest,
+// and are identified by the digest of their config.
+func (a *archive) readDockerImages(manifests []dockerManifest) error {
+	configPaths := []string{}
+	for _, manifest := range manifests {
+		configPaths = append(configPaths, path.Clean(manifest.Config))
+		for _, layer := range manifest.Layers {
+			if !a.entries[path.Clean(layer)] {
+				return fmt.Errorf("layer %s is not in the archive", layer)
+			}
+		}
+	}
+	configs, err := a.readFiles(configPaths)
+	if err != nil {
+		return err
+	}
+
+	for _, manifest := range manifests {
+		id := fmt.Sprintf("sha256:%x", sha256.Sum256(configs[path.Clean(manifest.Config)]))
+		if len(manifest.RepoTags) == 0 {
+			a.images = append(a.images, Image{ID: id})
+		}
+		for _, tag := range manifest.RepoTags {
+			a.images = append(a.images, Image{Name: tag, ID: id})
+		}
+	}
+	return nil
+}
+
+// readBlobs reads the blobs of the digests, and checks that they hold what their digest claims
+func (a *archive) readBlobs(digests []string) (map[string][]byte, error) {
+	paths := []string{}
+	for _, digest := range digests {
+		if _, ok := ParseBlobName(BlobName(digest)); !ok {
+			return nil, fmt.Errorf("unsupported digest %s", digest)
+		}
+		paths = append(paths, blobPath(digest))
+	}
+	files, err := a.readFiles(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make(map[string][]byte, len(digests))
+	for _, digest := range digests {
+		data := files[blobPath(digest)]
+		if fmt.Sprintf("sha256:%x", sha256.Sum256(data)) != strings.ToLower(digest) {
+			return nil, fmt.Errorf("blob %s does not match its digest", digest)
+		}
+		blobs[digest] = data
+	}
+	return blobs, nil
+}
+
+func blobPath(digest string) string {
+	algorithm, hexDigest, _ := strings.Cut(digest, ":")
+	return path.Join("blobs", algorithm, hexDigest)
+}
+
+// Images returns the images in the archive at archivePath
+func Images(archivePath string) ([]Image, error) {
+	a, err := readArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return a.images, nil
+}
+
+// Layers returns the digests of the layers the images in the archive at archivePath consist of
+func Layers(archivePath string) ([]string, error) {
+	a, err := readArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return a.layers, nil
+}
+
+// MissingBlobs returns the layers of the archive that are neither in it nor in blobDir
+func MissingBlobs(archivePath string, blobDir string) ([]string, error) {
+	a, err := readArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return a.missingBlobs(blobDir)
+}
+
+func (a *archive) missingBlobs(blobDir string) ([]string, error) {
+	missing := []string{}
+	for _, layer := range a.layers {
+		if a.entries[blobPath(layer)] {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(blobDir, BlobName(layer))); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, layer)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// Assemble writes the archive at archivePath to w, with the layers it does not contain
+// taken from the blobs in blobDir. Blobs are verified against their digest as they are copied.
+func Assemble(w io.Writer, archivePath string, blobDir string) error {
+	a, err := readArchive(archivePath)
+	if err != nil {
+		return err
+	}
+
+	missing, err := a.missingBlobs(blobDir)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingBlobs, strings.Join(missing, ", "))
+	}
+
+	tw := tar.NewWriter(w)
+	if err := copyArchive(tw, archivePath); err != nil {
+		return err
+	}
+
+	for _, layer := range a.layers {
+		if a.entries[blobPath(layer)] {
+			continue
+		}
+		if err := copyBlob(tw, layer, filepath.Join(blobDir, BlobName(layer))); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// copyArchive streams the entries of the archive at archivePath to tw
+func copyArchive(tw *tar.Writer, archivePath string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func copyBlob(tw *tar.Writer, digest string, blobFile string) error {
+	f, err := os.Open(blobFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: blobPath(digest), Typeflag: tar.TypeReg, Mode: 0o644, Size: info.Size()}); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, h), f, info.Size()); err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("blob %s does not match its digest, got %s", BlobName(digest), actual)
+	}
+	return nil
+}
+
+// VerifyBlob checks that the file at blobFile holds the content with the given digest
+func VerifyBlob(blobFile string, digest string) error {
+	f, err := os.Open(blobFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return fmt.Errorf("blob %s does not match its digest, got %s", BlobName(digest), actual)
+	}
+	return nil
+}
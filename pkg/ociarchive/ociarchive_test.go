@@ -0,0 +1,137 @@
+package ociarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_BlobName(t *testing.T) {
+	digest := "sha256:" + "ab12000000000000000000000000000000000000000000000000000000000000"
+	name := BlobName(digest)
+	require.Equal(t, "sha256-ab12000000000000000000000000000000000000000000000000000000000000.blob", name)
+
+	parsed, ok := ParseBlobName(name)
+	require.True(t, ok)
+	require.Equal(t, digest, parsed)
+
+	for _, invalid := range []string{"app.tar", "sha256-ab12.blob", "sha512-" + digest[7:] + ".blob", "sha256-../../etc.blob", BlobName(digest) + ".tar"} {
+		_, ok := ParseBlobName(invalid)
+		require.False(t, ok, invalid)
+	}
+}
+
+type testEntry struct {
+	name    string
+	content string
+}
+
+func writeTestArchive(t *testing.T, entries ...testEntry) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0o644, Size: int64(len(entry.content))}))
+		_, err := tw.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	archivePath := filepath.Join(t.TempDir(), "image.tar")
+	require.NoError(t, os.WriteFile(archivePath, buf.Bytes(), 0o600))
+	return archivePath
+}
+
+func testDigest(content string) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+}
+
+func Test_OCIArchive(t *testing.T) {
+	config, layer, stored := `{"architecture": "amd64"}`, "layer", "stored layer"
+	manifest := fmt.Sprintf(`{"config": {"digest": %q}, "layers": [{"digest": %q}, {"digest": %q}]}`, testDigest(config), testDigest(layer), testDigest(stored))
+	index := fmt.Sprintf(`{"manifests": [{"digest": %q, "annotations": {"io.containerd.image.name": "docker.io/library/app:1"}}]}`, testDigest(manifest))
+
+	// The index comes last, as the blobs it references are only known once it is read
+	archivePath := writeTestArchive(t,
+		testEntry{blobPath(testDigest(manifest)), manifest},
+		testEntry{blobPath(testDigest(config)), config},
+		testEntry{blobPath(testDigest(layer)), layer},
+		testEntry{"index.json", index},
+	)
+
+	images, err := Images(archivePath)
+	require.NoError(t, err)
+	require.Equal(t, []Image{{Name: "docker.io/library/app:1", Digest: testDigest(manifest), ID: testDigest(config)}}, images)
+
+	blobDir := t.TempDir()
+	missing, err := MissingBlobs(archivePath, blobDir)
+	require.NoError(t, err)
+	require.Equal(t, []string{testDigest(stored)}, missing)
+	require.ErrorIs(t, Assemble(&bytes.Buffer{}, archivePath, blobDir), ErrMissingBlobs)
+
+	require.NoError(t, os.WriteFile(filepath.Join(blobDir, BlobName(testDigest(stored))), []byte(stored), 0o600))
+	assembledPath := filepath.Join(t.TempDir(), "assembled.tar")
+	f, err := os.Create(assembledPath)
+	require.NoError(t, err)
+	require.NoError(t, Assemble(f, archivePath, blobDir))
+	require.NoError(t, f.Close())
+
+	missing, err = MissingBlobs(assembledPath, t.TempDir())
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// Images are allowed by their digests, the manifest and config must hold what those claim
+	_, err = Images(writeTestArchive(t,
+		testEntry{blobPath(testDigest(manifest)), manifest},
+		testEntry{blobPath(testDigest(config)), `{"architecture": "arm64"}`},
+		testEntry{"index.json", index},
+	))
+	require.ErrorContains(t, err, "does not match its digest")
+	_, err = Images(writeTestArchive(t,
+		testEntry{blobPath(testDigest(manifest)), manifest + " "},
+		testEntry{blobPath(testDigest(config)), config},
+		testEntry{"index.json", index},
+	))
+	require.ErrorContains(t, err, "does not match its digest")
+
+	// Nor can an entry be shadowed by another of the same name
+	_, err = Images(writeTestArchive(t,
+		testEntry{blobPath(testDigest(manifest)), manifest},
+		testEntry{blobPath(testDigest(config)), config},
+		testEntry{blobPath(testDigest(config)), `{"architecture": "arm64"}`},
+		testEntry{"index.json", index},
+	))
+	require.ErrorContains(t, err, "more than once")
+}
+
+func Test_DockerArchive(t *testing.T) {
+	config := `{"architecture": "amd64"}`
+	manifest := `[{"Config": "abc.json", "RepoTags": ["app:1", "app:latest"], "Layers": ["1/layer.tar"]}]`
+
+	archivePath := writeTestArchive(t,
+		testEntry{"abc.json", config},
+		testEntry{"1/layer.tar", "layer"},
+		testEntry{"manifest.json", manifest},
+	)
+
+	images, err := Images(archivePath)
+	require.NoError(t, err)
+	require.Equal(t, []Image{{Name: "app:1", ID: testDigest(config)}, {Name: "app:latest", ID: testDigest(config)}}, images)
+
+	layers, err := Layers(archivePath)
+	require.NoError(t, err)
+	require.Empty(t, layers)
+
+	_, err = Images(writeTestArchive(t, testEntry{"abc.json", config}, testEntry{"manifest.json", manifest}))
+	require.ErrorContains(t, err, "1/layer.tar")
+
+	_, err = Images(writeTestArchive(t, testEntry{"abc.json", config}))
+	require.Error(t, err)
+}
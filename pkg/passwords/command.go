@@ -0,0 +1,70 @@
+package passwords
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+// UserCommand is the subcommand of the CLIs generating the entry of a user of the API, with a hashed
+// password read from the app's reader
+func UserCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "user",
+		Usage: "Generates the entry of a user of the API, with a hashed password",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "name",
+				Usage:    "name of the user, the password is read from stdin",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "hasher",
+				Value: "argon2id",
+				Usage: "how to hash the password, argon2id or bcrypt",
+			},
+			&cli.StringFlag{
+				Name:  "users",
+				Usage: "users file to add the user to, as the --auth flag of the server takes it, otherwise the entry is printed",
+			},
+		},
+		Action: runUser,
+	}
+}
+
+func runUser(cCtx *cli.Context) error {
+	hasher, found := Hashers[cCtx.String("hasher")]
+	if !found {
+		return errors.New("unknown hasher " + cCtx.String("hasher"))
+	}
+
+	password, err := io.ReadAll(cCtx.App.Reader)
+	if err != nil {
+		return err
+	}
+	password = bytes.TrimRight(password, "\r\n")
+	if len(password) == 0 {
+		return errors.New("empty password")
+	}
+
+	path := cCtx.String("users")
+	users, err := os.ReadFile(path)
+	if path == "" || errors.Is(err, os.ErrNotExist) {
+		users = nil
+	} else if err != nil {
+		return err
+	}
+
+	users, err = SetPassword(users, cCtx.String("name"), string(password), hasher)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		_, err = cCtx.App.Writer.Write(append(users, '\n'))
+		return err
+	}
+	return os.WriteFile(path, append(users, '\n'), 0o600)
+}
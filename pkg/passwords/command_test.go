@@ -0,0 +1,49 @@
+package passwords
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func runTestCLI(t *testing.T, password string, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	app := &cli.App{Commands: []*cli.Command{UserCommand()}, Reader: strings.NewReader(password), Writer: &out}
+	err := app.Run(append([]string{"cli", "user"}, args...))
+	return out.String(), err
+}
+
+func Test_UserCommand(t *testing.T) {
+	// Without a users file, the entry is printed
+	out, err := runTestCLI(t, "secret\n", "--name", "alice", "--hasher", "bcrypt")
+	require.NoError(t, err)
+	var printed map[string]string
+	require.NoError(t, json.Unmarshal([]byte(out), &printed))
+	ok, err := Verify(printed["alice"], "secret")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Users are added to the file
+	path := filepath.Join(t.TempDir(), "users.json")
+	_, err = runTestCLI(t, "secret", "--name", "alice", "--hasher", "bcrypt", "--users", path)
+	require.NoError(t, err)
+	_, err = runTestCLI(t, "other", "--name", "bob", "--hasher", "bcrypt", "--users", path)
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var users map[string]string
+	require.NoError(t, json.Unmarshal(data, &users))
+	require.Len(t, users, 2)
+
+	_, err = runTestCLI(t, "\n", "--name", "alice")
+	require.ErrorContains(t, err, "empty password")
+	_, err = runTestCLI(t, "secret", "--name", "alice", "--hasher", "md5")
+	require.ErrorContains(t, err, "unknown hasher")
+}
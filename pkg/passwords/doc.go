@@ -0,0 +1,5 @@
+// Package passwords hashes the passwords of the users of the APIs into PHC strings, with argon2id
+// or bcrypt, and verifies them in constant time. Legacy entries, the password followed by the
+// sha256 of nothing, are still verified so that they can be migrated. UserCommand adds users to the
+// users file from the CLIs.
+package passwords
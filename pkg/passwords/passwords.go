@@ -0,0 +1,217 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidHash = errors.New("invalid password hash")
+	ErrUnknownHash = errors.New("unknown password hash algorithm")
+)
+
+// Hasher hashes passwords into PHC strings, salted
+type Hasher interface {
+	Hash(password string) (string, error)
+}
+
+// Argon2id hashes passwords with argon2id, as $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+type Argon2id struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2id are the parameters OWASP recommends
+var DefaultArgon2id = Argon2id{Memory: 19 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// Bcrypt hashes passwords with bcrypt, as $2b$<cost>$<salt and hash>
+type Bcrypt struct {
+	Cost int
+}
+
+var DefaultBcrypt = Bcrypt{Cost: bcrypt.DefaultCost}
+
+// DefaultHasher hashes the passwords of new users
+var DefaultHasher Hasher = DefaultArgon2id
+
+// Hashers are the hashers by the name the CLIs take
+var Hashers = map[string]Hasher{
+	"argon2id": DefaultArgon2id,
+	"bcrypt":   DefaultBcrypt,
+}
+
+// b64 is the base64 of PHC strings, without padding
+var b64 = base64.RawStdEncoding
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.Memory, a.Iterations, a.Parallelism, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hash), err
+}
+
+// IsLegacy reports whether the hash is a legacy entry rather than a PHC string
+func IsLegacy(hash string) bool {
+	return !strings.HasPrefix(hash, "$")
+}
+
+// Verify reports whether the password matches the hash, comparing them in constant time
+func Verify(hash string, password string) (bool, error) {
+	switch {
+	case IsLegacy(hash):
+		return verifyLegacy(hash, password)
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrInvalidHash, err)
+		}
+		return true, nil
+	default:
+		return false, ErrUnknownHash
+	}
+}
+
+// Check returns an error if the hash can't be verified
+func Check(hash string) error {
+	_, err := Verify(hash, "")
+	return err
+}
+
+// legacySuffix is what the legacy hasher appended to passwords, sha256.New().Sum(password)
+var legacySuffix = sha256.New().Sum(nil)
+
+// verifyLegacy verifies the base64 of the password followed by legacySuffix
+func verifyLegacy(hash string, password string) (bool, error) {
+	decoded, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ErrInvalidHash, err)
+	}
+	expected := append([]byte(password), legacySuffix...)
+	return subtle.ConstantTimeCompare(decoded, expected) == 1, nil
+}
+
+func verifyArgon2id(hash string, password string) (bool, error) {
+	// $argon2id$v=19$m=...,t=...,p=...$salt$key splits into "", "argon2id", version, params, salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("%w: argon2id hashes have 5 fields", ErrInvalidHash)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("%w: unsupported argon2id version %s", ErrInvalidHash, parts[2])
+	}
+	var a Argon2id
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.Memory, &a.Iterations, &a.Parallelism); err != nil {
+		return false, fmt.Errorf("%w: argon2id parameters %s: %w", ErrInvalidHash, parts[3], err)
+	}
+	if a.Iterations == 0 || a.Parallelism == 0 {
+		return false, fmt.Errorf("%w: argon2id parameters %s", ErrInvalidHash, parts[3])
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("%w: argon2id salt: %w", ErrInvalidHash, err)
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, fmt.Errorf("%w: argon2id key", ErrInvalidHash)
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// Verifier authenticates users by their passwords
+type Verifier struct {
+	users map[string]string
+	// unknownHash is what the passwords of unknown users are checked against, so that they
+	// take as long to refuse as known users
+	unknownHash string
+}
+
+// NewVerifier verifies the passwords of users against their hashes. hasher is the one new users
+// are hashed with, DefaultHasher if nil.
+func NewVerifier(users map[string]string, hasher Hasher) (*Verifier, error) {
+	if hasher == nil {
+		hasher = DefaultHasher
+	}
+	for user, hash := range users {
+		if err := Check(hash); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user, err)
+		}
+	}
+
+	unknown := make([]byte, 16)
+	if _, err := rand.Read(unknown); err != nil {
+		return nil, err
+	}
+	unknownHash, err := hasher.Hash(string(unknown))
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{users: users, unknownHash: unknownHash}, nil
+}
+
+// Verify reports whether the password is the user's
+func (v *Verifier) Verify(user string, password string) bool {
+	hash, known := v.users[user]
+	if !known {
+		hash = v.unknownHash
+	}
+	ok, err := Verify(hash, password)
+	return known && ok && err == nil
+}
+
+// LegacyUsers returns the users whose passwords are legacy entries, sorted
+func LegacyUsers(users map[string]string) []string {
+	legacy := []string{}
+	for user, hash := range users {
+		if IsLegacy(hash) {
+			legacy = append(legacy, user)
+		}
+	}
+	sort.Strings(legacy)
+	return legacy
+}
+
+// SetPassword sets the user's password in users, the JSON the APIs take, and returns the updated JSON
+func SetPassword(users []byte, user string, password string, hasher Hasher) ([]byte, error) {
+	entries := map[string]string{}
+	if len(users) > 0 {
+		if err := json.Unmarshal(users, &entries); err != nil {
+			return nil, err
+		}
+	}
+
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	entries[user] = hash
+	return json.MarshalIndent(entries, "", "  ")
+}
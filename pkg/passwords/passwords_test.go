@@ -0,0 +1,106 @@
+package passwords
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testArgon2id keeps the tests fast
+var testArgon2id = Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func Test_Hash_Verify(t *testing.T) {
+	for name, hasher := range map[string]Hasher{"argon2id": testArgon2id, "bcrypt": Bcrypt{Cost: 4}} {
+		hash, err := hasher.Hash("secret")
+		require.NoError(t, err, name)
+		require.False(t, IsLegacy(hash), name)
+		require.NoError(t, Check(hash), name)
+
+		ok, err := Verify(hash, "secret")
+		require.NoError(t, err, name)
+		require.True(t, ok, name)
+		ok, err = Verify(hash, "wrong")
+		require.NoError(t, err, name)
+		require.False(t, ok, name)
+
+		// Hashes are salted
+		again, err := hasher.Hash("secret")
+		require.NoError(t, err, name)
+		require.NotEqual(t, hash, again, name)
+	}
+
+	hash, err := testArgon2id.Hash("secret")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), hash)
+}
+
+func Test_Verify_Legacy(t *testing.T) {
+	// test:test, as the legacy hasher stored it
+	legacy := "dGVzdOOwxEKY/BwUmvv0yJlvuSQnrkHkZJuTTKSVmRt4UrhV"
+	require.True(t, IsLegacy(legacy))
+
+	ok, err := Verify(legacy, "test")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = Verify(legacy, "other")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func Test_Verify_Invalid(t *testing.T) {
+	for _, hash := range []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5",
+		"$2b$04$short",
+		"not base64!",
+	} {
+		_, err := Verify(hash, "secret")
+		require.ErrorIs(t, err, ErrInvalidHash, hash)
+	}
+
+	_, err := Verify("$scrypt$ln=16,r=8,p=1$c2FsdA$a2V5", "secret")
+	require.ErrorIs(t, err, ErrUnknownHash)
+}
+
+func Test_Verifier(t *testing.T) {
+	hash, err := testArgon2id.Hash("secret")
+	require.NoError(t, err)
+	users := map[string]string{"alice": hash, "test": "dGVzdOOwxEKY/BwUmvv0yJlvuSQnrkHkZJuTTKSVmRt4UrhV"}
+
+	v, err := NewVerifier(users, testArgon2id)
+	require.NoError(t, err)
+	require.True(t, v.Verify("alice", "secret"))
+	require.False(t, v.Verify("alice", "test"))
+	require.True(t, v.Verify("test", "test"))
+	require.False(t, v.Verify("bob", "secret"))
+	require.False(t, v.Verify("bob", ""))
+
+	require.Equal(t, []string{"test"}, LegacyUsers(users))
+
+	_, err = NewVerifier(map[string]string{"bob": "$argon2id$broken"}, testArgon2id)
+	require.ErrorIs(t, err, ErrInvalidHash)
+}
+
+func Test_SetPassword(t *testing.T) {
+	users, err := SetPassword(nil, "alice", "secret", testArgon2id)
+	require.NoError(t, err)
+	users, err = SetPassword(users, "bob", "other", testArgon2id)
+	require.NoError(t, err)
+
+	verifier, err := NewVerifier(mustParse(t, users), testArgon2id)
+	require.NoError(t, err)
+	require.True(t, verifier.Verify("alice", "secret"))
+	require.True(t, verifier.Verify("bob", "other"))
+
+	_, err = SetPassword([]byte("not json"), "alice", "secret", testArgon2id)
+	require.Error(t, err)
+}
+
+func mustParse(t *testing.T, users []byte) map[string]string {
+	entries := map[string]string{}
+	require.NoError(t, json.Unmarshal(users, &entries))
+	return entries
+}
@@ -0,0 +1,3 @@
+// Package statefile keeps the state of the services in files that are replaced atomically,
+// so that a crash never leaves a partial file behind.
+package statefile
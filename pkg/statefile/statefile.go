@@ -0,0 +1,114 @@
+package statefile
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Write writes data next to path and renames it over path, creating the directory if needed
+func Write(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Map is a JSON file backed map of items by id.
+// Every modification is persisted before it returns.
+type Map[T any] struct {
+	path string
+
+	mu    sync.RWMutex
+	items map[string]T
+}
+
+// OpenMap loads the map from the file at path, which is created on the first modification
+func OpenMap[T any](path string) (*Map[T], error) {
+	m := &Map[T]{
+		path:  path,
+		items: make(map[string]T),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &m.items); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Map[T]) Get(id string) (T, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	item, ok := m.items[id]
+	return item, ok
+}
+
+// List returns all items, sorted by less
+func (m *Map[T]) List(less func(a, b T) bool) []T {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	items := make([]T, 0, len(m.items))
+	for _, item := range m.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return less(items[i], items[j]) })
+	return items
+}
+
+// Create adds the item, it returns false if there already is one with the id
+func (m *Map[T]) Create(id string, item T) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.items[id]; exists {
+		return false, nil
+	}
+	m.items[id] = item
+	return true, m.persist()
+}
+
+// Update applies fn to the stored item, it returns false if there is none with the id
+func (m *Map[T]) Update(id string, fn func(item *T)) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[id]
+	if !ok {
+		return false, nil
+	}
+	fn(&item)
+	m.items[id] = item
+	return true, m.persist()
+}
+
+// Delete removes the item, it returns false if there is none with the id
+func (m *Map[T]) Delete(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[id]; !ok {
+		return false, nil
+	}
+	delete(m.items, id)
+	return true, m.persist()
+}
+
+// persist replaces the file, must be called with the lock held
+func (m *Map[T]) persist() error {
+	data, err := json.MarshalIndent(m.items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return Write(m.path, data)
+}
@@ -0,0 +1,53 @@
+package statefile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "file.json")
+	require.NoError(t, Write(path, []byte("first")))
+	require.NoError(t, Write(path, []byte("second")))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(data))
+	require.NoFileExists(t, path+".tmp")
+}
+
+func Test_Map(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "items.json")
+	m, err := OpenMap[int](path)
+	require.NoError(t, err)
+
+	created, err := m.Create("b", 2)
+	require.NoError(t, err)
+	require.True(t, created)
+	created, err = m.Create("b", 3)
+	require.NoError(t, err)
+	require.False(t, created)
+
+	found, err := m.Update("b", func(item *int) { *item *= 10 })
+	require.NoError(t, err)
+	require.True(t, found)
+	found, err = m.Update("missing", func(item *int) {})
+	require.NoError(t, err)
+	require.False(t, found)
+
+	_, err = m.Create("a", 1)
+	require.NoError(t, err)
+
+	reopened, err := OpenMap[int](path)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 20}, reopened.List(func(a, b int) bool { return a < b }))
+
+	found, err = reopened.Delete("a")
+	require.NoError(t, err)
+	require.True(t, found)
+	_, ok := reopened.Get("a")
+	require.False(t, ok)
+}
@@ -0,0 +1,237 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DefaultChunkSize is the size of the chunks the client sends
+const DefaultChunkSize = 8 * 1024 * 1024 // 8MiB
+
+// Client uploads files in chunks, and resumes interrupted uploads.
+// The progress of an upload is kept in a state file next to the uploaded file.
+type Client struct {
+	HTTPClient *http.Client
+	// URL of the uploads endpoint, such as http://localhost:8087/api/uploads
+	URL string
+	// Authorize adds credentials to every request
+	Authorize func(*http.Request)
+	ChunkSize int64
+	Retries   int
+	Log       *slog.Logger
+}
+
+// state is what the client remembers about an upload in progress
+type state struct {
+	URL    string `json:"url"`
+	ID     string `json:"id"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// StatePath is where the progress of uploading path is kept
+func StatePath(path string) string {
+	return path + ".upload"
+}
+
+// Upload sends the file at path, resuming a previous upload of the same file if there was one.
+// It returns the session of the complete upload and the file's sha256, to finalize it with.
+func (c *Client) Upload(path string) (*Session, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	session, err := c.resume(path, info.Size(), digest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if session == nil {
+		session, err = c.create(info.Name(), info.Size())
+		if err != nil {
+			return nil, "", err
+		}
+		st := state{URL: c.URL, ID: session.ID, Size: info.Size(), SHA256: digest}
+		data, err := json.Marshal(st)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := os.WriteFile(StatePath(path), data, 0o600); err != nil {
+			return nil, "", err
+		}
+	}
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	for _, missing := range session.Missing() {
+		for offset := missing.Start; offset < missing.End; {
+			length := min(chunkSize, missing.End-offset)
+			session, err = c.sendChunk(f, session.ID, offset, length, info.Size())
+			if err != nil {
+				return nil, "", err
+			}
+			offset += length
+		}
+	}
+
+	if !session.Complete() {
+		return nil, "", fmt.Errorf("%w, missing %v", ErrIncomplete, session.Missing())
+	}
+	return session, digest, nil
+}
+
+// Finalize completes an upload, and returns the response of the server with its body.
+// The state of the upload is forgotten once it has been finalized.
+func (c *Client) Finalize(path string, session *Session, digest string) (*http.Response, []byte, error) {
+	body, err := json.Marshal(FinalizeRequest{SHA256: digest})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, rb, err := c.do(http.MethodPost, c.URL+"/"+session.ID+"/finalize", nil, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		_ = os.Remove(StatePath(path))
+	}
+	return res, rb, nil
+}
+
+// resume returns the session of a previous upload of the same file, or nil if there's none to resume
+func (c *Client) resume(path string, size int64, digest string) (*Session, error) {
+	data, err := os.ReadFile(StatePath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil || st.URL != c.URL || st.Size != size || st.SHA256 != digest {
+		return nil, nil // the file or the server changed, start over
+	}
+
+	res, rb, err := c.do(http.MethodGet, c.URL+"/"+st.ID, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil // expired
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not query upload %s: %s: %s", st.ID, res.Status, rb)
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal(rb, session); err != nil {
+		return nil, err
+	}
+	c.log().Info("resuming upload", "id", session.ID, "received", session.Received)
+	return session, nil
+}
+
+func (c *Client) create(filename string, size int64) (*Session, error) {
+	body, err := json.Marshal(CreateRequest{Filename: filename, Size: size})
+	if err != nil {
+		return nil, err
+	}
+
+	res, rb, err := c.do(http.MethodPost, c.URL, nil, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("could not create upload: %s: %s", res.Status, rb)
+	}
+
+	session := &Session{}
+	return session, json.Unmarshal(rb, session)
+}
+
+// sendChunk sends a chunk, retrying with backoff if it's interrupted
+func (c *Client) sendChunk(f *os.File, id string, offset int64, length int64, size int64) (*Session, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		header := http.Header{"Content-Range": []string{ContentRange(offset, length, size)}}
+		res, rb, err := c.do(http.MethodPut, c.URL+"/"+id, header, io.NewSectionReader(f, offset, length))
+		if err == nil && res.StatusCode == http.StatusOK {
+			session := &Session{}
+			return session, json.Unmarshal(rb, session)
+		}
+		if err == nil && res.StatusCode < http.StatusInternalServerError {
+			return nil, fmt.Errorf("chunk at %d rejected: %s: %s", offset, res.Status, rb)
+		}
+
+		if attempt >= c.Retries {
+			if err == nil {
+				err = fmt.Errorf("chunk at %d failed: %s: %s", offset, res.Status, rb)
+			}
+			return nil, err
+		}
+		c.log().Warn("chunk failed, retrying", "offset", offset, "err", err, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (c *Client) do(method string, url string, header http.Header, body io.Reader) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil && req.Header.Get("Content-Range") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Authorize != nil {
+		c.Authorize(req)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	rb, err := io.ReadAll(res.Body)
+	return res, rb, err
+}
+
+func (c *Client) log() *slog.Logger {
+	if c.Log == nil {
+		return slog.Default()
+	}
+	return c.Log
+}
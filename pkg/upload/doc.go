@@ -0,0 +1,3 @@
+// Package upload implements resumable uploads: a client creates an upload, sends it in chunks
+// at their offsets, queries which ranges were received to resume, and finalizes it with its sha256.
+package upload
@@ -0,0 +1,138 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"kutee/auth"
+)
+
+// MaxChunkSize is the largest chunk accepted in one request
+const MaxChunkSize = 64 * 1024 * 1024 // 64MiB
+
+type CreateRequest struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+type FinalizeRequest struct {
+	SHA256 string `json:"sha256"`
+}
+
+// HandleCreate starts an upload described by a CreateRequest for the authenticated user,
+// and responds with its session. The other handlers only find the uploads of that user.
+func (s *Store) HandleCreate(w http.ResponseWriter, r *http.Request) {
+	var req CreateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.Create(auth.User(r), req.Filename, req.Size)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeSession(w, http.StatusCreated, session)
+}
+
+// HandleStatus responds with the session of the upload, listing the ranges received so far
+func (s *Store) HandleStatus(w http.ResponseWriter, r *http.Request, id string) {
+	session, err := s.Get(auth.User(r), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeSession(w, http.StatusOK, session)
+}
+
+// HandleChunk writes the request body at the offset given by its Content-Range header,
+// `bytes <first>-<last>/<size>`, and responds with the updated session
+func (s *Store) HandleChunk(w http.ResponseWriter, r *http.Request, id string) {
+	offset, length, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if length > MaxChunkSize {
+		http.Error(w, fmt.Sprintf("chunks are limited to %d bytes", MaxChunkSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	session, err := s.WriteChunk(auth.User(r), id, offset, http.MaxBytesReader(w, r.Body, length), length)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeSession(w, http.StatusOK, session)
+}
+
+// ParseFinalize decodes a FinalizeRequest and checks the upload against it. It responds with an error
+// and returns false if the upload can't be finalized, the caller takes over the data at path otherwise.
+func (s *Store) ParseFinalize(w http.ResponseWriter, r *http.Request, id string) (session *Session, path string, ok bool) {
+	var req FinalizeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	session, path, err := s.Finalize(auth.User(r), id, strings.ToLower(req.SHA256))
+	if err != nil {
+		writeError(w, err)
+		return nil, "", false
+	}
+	return session, path, true
+}
+
+func parseContentRange(header string) (offset int64, length int64, err error) {
+	var first, last, size int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &first, &last, &size); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q, expected bytes <first>-<last>/<size>", header)
+	}
+	if first < 0 || last < first || last >= size {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return first, last - first + 1, nil
+}
+
+// ContentRange formats the Content-Range header of a chunk
+func ContentRange(offset int64, length int64, size int64) string {
+	return "bytes " + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidChunk):
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+	case errors.Is(err, ErrIncomplete):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrFinalized):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrDigestMismatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, ErrQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		http.Error(w, "chunk is shorter than its Content-Range", http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeSession(w http.ResponseWriter, status int, session *Session) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(session)
+}
@@ -0,0 +1,408 @@
+package upload
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"kutee/statefile"
+)
+
+var (
+	ErrNotFound       = errors.New("upload not found")
+	ErrInvalidChunk   = errors.New("chunk is outside of the upload")
+	ErrIncomplete     = errors.New("upload is incomplete")
+	ErrDigestMismatch = errors.New("upload does not match its sha256")
+	ErrTooLarge       = errors.New("upload is too large")
+	ErrQuotaExceeded  = errors.New("too many uploads in progress")
+	ErrFinalized      = errors.New("upload is finalized")
+)
+
+// SessionTTL is how long an untouched upload is kept before it's removed
+const SessionTTL = 24 * time.Hour
+
+// MaxSessionsPerOwner is how many uploads a user can have in progress at once
+const MaxSessionsPerOwner = 16
+
+// Range is a range of bytes received, End is exclusive
+type Range struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type Session struct {
+	ID string `json:"id"`
+	// Owner is the user who created the upload, the only one who can see and continue it
+	Owner    string  `json:"owner"`
+	Filename string  `json:"filename"`
+	Size     int64   `json:"size"`
+	Received []Range `json:"received"`
+	// SHA256 is set once the upload is finalized
+	SHA256    string    `json:"sha256,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Complete reports whether every byte of the upload was received
+func (s *Session) Complete() bool {
+	return s.Size == 0 || (len(s.Received) == 1 && s.Received[0] == Range{0, s.Size})
+}
+
+// Missing returns the ranges that were not received yet
+func (s *Session) Missing() []Range {
+	missing := []Range{}
+	var offset int64
+	for _, r := range s.Received {
+		if r.Start > offset {
+			missing = append(missing, Range{offset, r.Start})
+		}
+		offset = r.End
+	}
+	if offset < s.Size {
+		missing = append(missing, Range{offset, s.Size})
+	}
+	return missing
+}
+
+func (s *Session) addRange(added Range) {
+	ranges := append(s.Received, added)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	merged := []Range{}
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			merged[n-1].End = max(merged[n-1].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	s.Received = merged
+}
+
+// Store stages resumable uploads on disk. Every upload is a data file, written to at the
+// offsets of the chunks received, and the session describing which ranges were received.
+// Uploads belong to the user who created them, whose uploads in progress are limited to
+// MaxSessionsPerOwner and quota bytes in total.
+type Store struct {
+	dir     string
+	maxSize int64
+	quota   int64
+
+	mu sync.Mutex
+	// writing counts the chunks being written to each upload, and finalized has the uploads being
+	// or having been finalized, which take no more chunks
+	writing   map[string]int
+	finalized map[string]bool
+	written   *sync.Cond
+}
+
+func NewStore(dir string, maxSize int64, quota int64) *Store {
+	s := &Store{dir: dir, maxSize: maxSize, quota: quota, writing: make(map[string]int), finalized: make(map[string]bool)}
+	s.written = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *Store) dataPath(id string) string    { return filepath.Join(s.dir, id+".data") }
+func (s *Store) sessionPath(id string) string { return filepath.Join(s.dir, id+".json") }
+
+// Create starts a new upload of size bytes for owner
+func (s *Store) Create(owner string, filename string, size int64) (*Session, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%w: negative size", ErrInvalidChunk)
+	}
+	if size > s.maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, size, s.maxSize)
+	}
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, err
+	}
+	s.removeExpired()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkQuota(owner, size); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := &Session{
+		ID:        hex.EncodeToString(id),
+		Owner:     owner,
+		Filename:  filepath.Base(filename),
+		Size:      size,
+		Received:  []Range{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	f, err := os.OpenFile(s.dataPath(session.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := s.save(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// checkQuota returns ErrQuotaExceeded if owner can't start another upload of size bytes, s.mu must be held
+func (s *Store) checkQuota(owner string, size int64) error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	sessions, total := 0, size
+	for _, path := range paths {
+		session, err := s.load(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil || session.Owner != owner {
+			continue
+		}
+		sessions++
+		total += session.Size
+	}
+	if sessions >= MaxSessionsPerOwner {
+		return fmt.Errorf("%w: %d uploads, the limit is %d", ErrQuotaExceeded, sessions, MaxSessionsPerOwner)
+	}
+	if total > s.quota {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrQuotaExceeded, total, s.quota)
+	}
+	return nil
+}
+
+// Get returns the session of an upload of owner, uploads of other users are not found
+func (s *Store) Get(owner string, id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadOwned(owner, id)
+}
+
+// WriteChunk writes the chunk read from r at offset. The bytes that were written are recorded as
+// received even if reading the chunk fails, so that an interrupted chunk only needs to be resumed.
+// Uploads take no more chunks once they are being finalized.
+func (s *Store) WriteChunk(owner string, id string, offset int64, r io.Reader, length int64) (*Session, error) {
+	session, err := s.startWriting(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	n, copyErr := s.write(session, offset, r, length)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writing[id]--; s.writing[id] == 0 {
+		delete(s.writing, id)
+		s.written.Broadcast()
+	}
+
+	// Reload, other chunks may have been received in the meantime
+	session, err = s.loadOwned(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		session.addRange(Range{offset, offset + n})
+		session.UpdatedAt = time.Now().UTC()
+		if err := s.save(session); err != nil {
+			return nil, err
+		}
+	}
+	return session, copyErr
+}
+
+// startWriting returns the session of an upload that takes chunks, counting one more chunk being written to it
+func (s *Store) startWriting(owner string, id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, err := s.loadOwned(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if s.finalized[id] {
+		return nil, ErrFinalized
+	}
+	s.writing[id]++
+	return session, nil
+}
+
+func (s *Store) write(session *Session, offset int64, r io.Reader, length int64) (int64, error) {
+	if offset < 0 || length < 0 || offset+length > session.Size {
+		return 0, fmt.Errorf("%w: %d bytes at %d, the upload is %d bytes", ErrInvalidChunk, length, offset, session.Size)
+	}
+
+	f, err := os.OpenFile(s.dataPath(session.ID), os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.CopyN(io.NewOffsetWriter(f, offset), r, length)
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// Finalize checks that the upload is complete and matches the sha256 the client computed.
+// It returns the path of the uploaded data, which the caller moves to its destination before calling Remove.
+// The chunks being written are waited for, and no more are taken, so that the data is the one checked.
+func (s *Store) Finalize(owner string, id string, sha256Hex string) (*Session, string, error) {
+	session, err := s.startFinalizing(owner, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := s.checkDigest(session, sha256Hex); err != nil {
+		s.mu.Lock()
+		delete(s.finalized, id)
+		s.mu.Unlock()
+		return session, "", err
+	}
+	session.SHA256 = sha256Hex
+
+	return session, s.dataPath(id), nil
+}
+
+// startFinalizing marks the upload as finalized, and returns its session once no chunk is being written to it
+func (s *Store) startFinalizing(owner string, id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.loadOwned(owner, id); err != nil {
+		return nil, err
+	}
+	if s.finalized[id] {
+		return nil, ErrFinalized
+	}
+	s.finalized[id] = true
+	for s.writing[id] > 0 {
+		s.written.Wait()
+	}
+
+	// Reload, with the chunks written in the meantime
+	session, err := s.loadOwned(owner, id)
+	if err != nil {
+		delete(s.finalized, id)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *Store) checkDigest(session *Session, sha256Hex string) error {
+	if !session.Complete() {
+		return ErrIncomplete
+	}
+
+	f, err := os.Open(s.dataPath(session.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != sha256Hex {
+		return fmt.Errorf("%w: got %s", ErrDigestMismatch, actual)
+	}
+	return nil
+}
+
+// Remove deletes the upload and whatever is left of its data
+func (s *Store) Remove(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.dataPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(s.sessionPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	delete(s.finalized, id)
+	return nil
+}
+
+func (s *Store) removeExpired() {
+	sessions, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	for _, path := range sessions {
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > SessionTTL {
+			_ = s.Remove(filepath.Base(path[:len(path)-len(".json")]))
+		}
+	}
+}
+
+func (s *Store) load(id string) (*Session, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(s.sessionPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// loadOwned loads the session, which must belong to owner, s.mu must be held
+func (s *Store) loadOwned(owner string, id string) (*Session, error) {
+	session, err := s.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if session.Owner != owner {
+		return nil, ErrNotFound
+	}
+	return session, nil
+}
+
+// save writes the session atomically, s.mu must be held
+func (s *Store) save(session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	return statefile.Write(s.sessionPath(session.ID), data)
+}
+
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,243 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Store_Chunks(t *testing.T) {
+	store := NewStore(t.TempDir(), 1024, 4096)
+	content := []byte("0123456789")
+	digest := sha256.Sum256(content)
+
+	_, err := store.Create("user", "big.tar", 2048)
+	require.ErrorIs(t, err, ErrTooLarge)
+
+	session, err := store.Create("user", "../file.tar", int64(len(content)))
+	require.NoError(t, err)
+	require.Equal(t, "file.tar", session.Filename)
+	require.Equal(t, []Range{{0, 10}}, session.Missing())
+
+	// Chunks arrive in any order
+	session, err = store.WriteChunk("user", session.ID, 6, bytes.NewReader(content[6:]), 4)
+	require.NoError(t, err)
+	require.Equal(t, []Range{{0, 6}}, session.Missing())
+
+	_, err = store.WriteChunk("user", session.ID, 8, bytes.NewReader(content[8:]), 4)
+	require.ErrorIs(t, err, ErrInvalidChunk)
+
+	// An interrupted chunk keeps what was received
+	session, err = store.WriteChunk("user", session.ID, 0, bytes.NewReader(content[:2]), 4)
+	require.Error(t, err)
+	require.Equal(t, []Range{{0, 2}, {6, 10}}, session.Received)
+
+	_, _, err = store.Finalize("user", session.ID, hex.EncodeToString(digest[:]))
+	require.ErrorIs(t, err, ErrIncomplete)
+
+	session, err = store.WriteChunk("user", session.ID, 2, bytes.NewReader(content[2:6]), 4)
+	require.NoError(t, err)
+	require.True(t, session.Complete())
+
+	_, _, err = store.Finalize("user", session.ID, strings.Repeat("0", 64))
+	require.ErrorIs(t, err, ErrDigestMismatch)
+
+	session, path, err := store.Finalize("user", session.ID, hex.EncodeToString(digest[:]))
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(digest[:]), session.SHA256)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+
+	require.NoError(t, store.Remove(session.ID))
+	_, err = store.Get("user", session.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = store.Get("user", "../../etc/passwd")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func Test_Store_Owners(t *testing.T) {
+	store := NewStore(t.TempDir(), 1024, 2048)
+
+	session, err := store.Create("alice", "file.tar", 10)
+	require.NoError(t, err)
+
+	// The uploads of other users are not found
+	_, err = store.Get("bob", session.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = store.WriteChunk("bob", session.ID, 0, strings.NewReader("0123456789"), 10)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, _, err = store.Finalize("bob", session.ID, strings.Repeat("0", 64))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Users have their own quota of bytes and uploads in progress
+	_, err = store.Create("alice", "big.tar", 1024)
+	require.NoError(t, err)
+	_, err = store.Create("alice", "big.tar", 1024)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = store.Create("bob", "big.tar", 1024)
+	require.NoError(t, err)
+
+	for i := 0; i < MaxSessionsPerOwner; i++ {
+		_, err = store.Create("carol", "small.tar", 1)
+		require.NoError(t, err)
+	}
+	_, err = store.Create("carol", "small.tar", 1)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+// blockingReader reads content once release is closed
+type blockingReader struct {
+	release chan struct{}
+	content io.Reader
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.release
+	return r.content.Read(p)
+}
+
+func Test_Store_Finalizing(t *testing.T) {
+	store := NewStore(t.TempDir(), 1024, 4096)
+	content := []byte("0123456789")
+	digest := sha256.Sum256(content)
+
+	session, err := store.Create("user", "file.tar", int64(len(content)))
+	require.NoError(t, err)
+	_, err = store.WriteChunk("user", session.ID, 0, bytes.NewReader(content), 10)
+	require.NoError(t, err)
+
+	// An overlapping chunk being written is waited for, the data checked is the data returned
+	chunk := &blockingReader{release: make(chan struct{}), content: strings.NewReader("xxxxx")}
+	written := make(chan error)
+	go func() {
+		_, err := store.WriteChunk("user", session.ID, 0, chunk, 5)
+		written <- err
+	}()
+	require.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.writing[session.ID] == 1
+	}, time.Second, time.Millisecond)
+
+	finalized := make(chan error)
+	go func() {
+		_, _, err := store.Finalize("user", session.ID, hex.EncodeToString(digest[:]))
+		finalized <- err
+	}()
+	select {
+	case <-finalized:
+		t.Fatal("the upload was finalized while a chunk was being written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(chunk.release)
+	require.NoError(t, <-written)
+	require.ErrorIs(t, <-finalized, ErrDigestMismatch)
+
+	// Once finalized, uploads take no more chunks
+	_, err = store.WriteChunk("user", session.ID, 0, bytes.NewReader(content), 10)
+	require.NoError(t, err)
+	_, path, err := store.Finalize("user", session.ID, hex.EncodeToString(digest[:]))
+	require.NoError(t, err)
+	_, err = store.WriteChunk("user", session.ID, 0, strings.NewReader("xxxxx"), 5)
+	require.ErrorIs(t, err, ErrFinalized)
+	_, _, err = store.Finalize("user", session.ID, hex.EncodeToString(digest[:]))
+	require.ErrorIs(t, err, ErrFinalized)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+}
+
+func Test_ParseContentRange(t *testing.T) {
+	offset, length, err := parseContentRange(ContentRange(5, 10, 100))
+	require.NoError(t, err)
+	require.Equal(t, int64(5), offset)
+	require.Equal(t, int64(10), length)
+
+	for _, header := range []string{"", "bytes 10-5/100", "bytes 0-100/100", "bytes -1-5/100", "items 0-1/2"} {
+		_, _, err := parseContentRange(header)
+		require.Error(t, err, header)
+	}
+}
+
+// testServer serves a store the way the deployer and orchestrator do, failing the chunks
+// at the offsets in failAt once each
+func testServer(t *testing.T, store *Store, failAt map[int64]bool) *httptest.Server {
+	t.Helper()
+
+	mux := chi.NewRouter()
+	mux.Post("/api/uploads", store.HandleCreate)
+	mux.Get("/api/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		store.HandleStatus(w, r, chi.URLParam(r, "id"))
+	})
+	mux.Put("/api/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		offset, _, _ := parseContentRange(r.Header.Get("Content-Range"))
+		if failAt[offset] {
+			delete(failAt, offset)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		store.HandleChunk(w, r, chi.URLParam(r, "id"))
+	})
+	mux.Post("/api/uploads/{id}/finalize", func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := store.ParseFinalize(w, r, chi.URLParam(r, "id")); ok {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_Client_Resume(t *testing.T) {
+	store := NewStore(t.TempDir(), 1024, 4096)
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	path := filepath.Join(t.TempDir(), "bundle.tar")
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+
+	// The third chunk fails, and the client gives up without retries
+	srv := testServer(t, store, map[int64]bool{60: true})
+	client := &Client{URL: srv.URL + "/api/uploads", ChunkSize: 30}
+
+	_, _, err := client.Upload(path)
+	require.Error(t, err)
+	require.FileExists(t, StatePath(path))
+
+	// Resuming only sends what is missing
+	var chunks atomic.Int32
+	client.HTTPClient = &http.Client{Transport: countingTransport{&chunks}}
+	session, digest, err := client.Upload(path)
+	require.NoError(t, err)
+	require.True(t, session.Complete())
+	require.Equal(t, int32(2), chunks.Load())
+
+	res, _, err := client.Finalize(path, session, digest)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoFileExists(t, StatePath(path))
+}
+
+type countingTransport struct {
+	chunks *atomic.Int32
+}
+
+func (c countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut {
+		c.chunks.Add(1)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}